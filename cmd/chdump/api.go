@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// apiServer serves the HTTP API starting, monitoring and canceling the jobs of the daemon
+type apiServer struct {
+	jobs   *jobManager
+	token  string
+	server *http.Server
+}
+
+// serveAPI serves the HTTP API of the jobs on the address in the background. It requires a token unless insecure is
+// set.
+func serveAPI(jobs *jobManager, address, token string, insecure bool) (*apiServer, error) {
+	if token == "" && !insecure {
+		return nil, fmt.Errorf("the API requires a token, set -apiToken or CH_API_TOKEN, or -insecure to serve it without one")
+	}
+	s := &apiServer{jobs: jobs, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", s.startJob)
+	mux.HandleFunc("GET /jobs", s.listJobs)
+	mux.HandleFunc("GET /jobs/{id}", s.getJob)
+	mux.HandleFunc("POST /jobs/{id}/cancel", s.cancelJob)
+	s.server = &http.Server{Handler: s.authenticate(mux), ReadHeaderTimeout: 10 * time.Second}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serve the API: %w", err)
+	}
+	if token == "" {
+		log.Printf("Warning: the API on %s requires no token since -insecure is set", listener.Addr())
+	}
+	log.Printf("Serving the API on %s, jobs run in %s", listener.Addr(), jobs.jobsDir)
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Warning: the API stopped: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// shutdown stops serving the API
+func (s *apiServer) shutdown(ctx context.Context) {
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Printf("Warning: failed to stop the API: %v", err)
+	}
+}
+
+// authenticate requires the bearer token, when one is set, on every request
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r.Header.Get("Authorization"), s.token) {
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startJob starts the job of the request and responds with it
+func (s *apiServer) startJob(w http.ResponseWriter, r *http.Request) {
+	var request jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid job: %v", err))
+		return
+	}
+	j, err := s.jobs.start(request)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// listJobs responds with the jobs in the order they started, without their progress
+func (s *apiServer) listJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.jobs.list())
+}
+
+// getJob responds with the job and its progress
+func (s *apiServer) getJob(w http.ResponseWriter, r *http.Request) {
+	j, err := s.jobs.get(r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+// cancelJob interrupts a running job
+func (s *apiServer) cancelJob(w http.ResponseWriter, r *http.Request) {
+	j, err := s.jobs.cancel(r.PathValue("id"))
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// validToken reports whether the authorization header carries the bearer token, when one is required
+func validToken(authorization, token string) bool {
+	return token == "" || subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+token)) == 1
+}
+
+// writeJSON responds with the value as JSON
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Warning: failed to write the API response: %v", err)
+	}
+}
+
+// writeJobError responds with the error of a job operation and the status matching it
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidJob):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errJobNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errJobNotRunning):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// writeError responds with the error message as JSON
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidToken(t *testing.T) {
+	tests := []struct {
+		authorization string
+		token         string
+		want          bool
+	}{
+		{"", "", true},
+		{"Bearer anything", "", true},
+		{"Bearer s3cret", "s3cret", true},
+		{"", "s3cret", false},
+		{"Bearer wrong", "s3cret", false},
+		{"s3cret", "s3cret", false},
+		{"bearer s3cret", "s3cret", false},
+		{"Bearer s3cret ", "s3cret", false},
+		{"Bearer s3", "s3cret", false},
+	}
+	for _, test := range tests {
+		if got := validToken(test.authorization, test.token); got != test.want {
+			t.Errorf("validToken(%q, %q) = %v, want %v", test.authorization, test.token, got, test.want)
+		}
+	}
+}
+
+func TestServeAPIWithoutToken(t *testing.T) {
+	jobs, err := newJobManager(context.Background(), "chdump.yaml", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serveAPI(jobs, "127.0.0.1:0", "", false); err == nil {
+		t.Error("serveAPI() without a token succeeded, want an error")
+	}
+}
+
+func TestStartJobRejectsSettings(t *testing.T) {
+	jobs, err := newJobManager(context.Background(), "chdump.yaml", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		request jobRequest
+	}{
+		{"unknown command", jobRequest{Command: "daemon"}},
+		{"password", jobRequest{Command: "export", Settings: map[string]any{"password": "x"}}},
+		{"host", jobRequest{Command: "export", Settings: map[string]any{"host": "attacker.example.com"}}},
+		{"executable", jobRequest{Command: "export", Settings: map[string]any{"clickhouseClientPath": "/tmp/evil"}}},
+		{"ssh key", jobRequest{Command: "import", Settings: map[string]any{"sshKey": "/root/.ssh/id_rsa"}}},
+		{"log file", jobRequest{Command: "export", Settings: map[string]any{"logFile": "/etc/passwd"}}},
+		{"notification URL", jobRequest{Command: "export", Settings: map[string]any{"notifyURL": "https://attacker.example.com"}}},
+		{"config file", jobRequest{Command: "export", Settings: map[string]any{"config": "/tmp/other.yaml"}}},
+		{"status file", jobRequest{Command: "export", Settings: map[string]any{"statusFile": "/tmp/status.json"}}},
+		{"absolute dump directory", jobRequest{Command: "export", Settings: map[string]any{"dumpDir": "/etc"}}},
+		{"relative dump directory", jobRequest{Command: "import", Settings: map[string]any{"dumpDir": "../../backups"}}},
+		{"dump path", jobRequest{Command: "import", Settings: map[string]any{"dumpDir": "..", "from": "../../etc"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := jobs.start(test.request); !errors.Is(err, errInvalidJob) {
+				t.Errorf("start() error = %v, want an invalid job", err)
+			}
+		})
+	}
+}
+
+func TestConfineJobPath(t *testing.T) {
+	root := t.TempDir()
+	jobs, err := newJobManager(context.Background(), "chdump.yaml", filepath.Join(root, "jobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(jobs.jobsDir, "b")
+	if err := os.MkdirAll(filepath.Join(jobs.jobsDir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(jobs.jobsDir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "job directory", path: dir, want: dir},
+		{name: "directory of another job", path: "../a", want: filepath.Join(jobs.jobsDir, "a")},
+		{name: "new directory", path: "dump/sales", want: filepath.Join(dir, "dump", "sales")},
+		{name: "jobs directory", path: "..", want: jobs.jobsDir},
+		{name: "parent of the jobs directory", path: "../..", wantErr: true},
+		{name: "absolute path", path: "/etc", wantErr: true},
+		{name: "symbolic link", path: "../escape/dump", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := jobs.confine(dir, test.path)
+			if test.wantErr {
+				if !errors.Is(err, errInvalidJob) {
+					t.Errorf("confine() = %q, %v, want an invalid job", got, err)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("confine() = %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
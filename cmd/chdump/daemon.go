@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"clickhouse-import-export/pkg/chdump"
+	"github.com/robfig/cron/v3"
+)
+
+// secretSettings are the settings passed to the chdump processes through their environment rather than their command
+// line, which any user of the host can read
+var secretSettings = []string{"password", "sourcePassword", "smtpPassword", "vaultToken", "vaultSecretId"}
+
+// stopTimeout is how long a run is given to stop after it is interrupted before it is killed
+const stopTimeout = time.Minute
+
+// schedule is an export the daemon runs on a cron schedule
+type schedule struct {
+	Name      string
+	Cron      string
+	Profile   string
+	DumpDir   string
+	Retention chdump.RetentionPolicy
+	Settings  map[string]string
+}
+
+// runDaemon runs the exports of the schedules section of the config file on their cron schedules, and serves the
+// APIs starting and monitoring jobs when they are enabled, until the context is canceled. It then waits for the running
+// exports and jobs, which are interrupted with it.
+func runDaemon(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configFile := flags.String("config", "", "YAML config file with the schedules section and the settings of the exports")
+	apiAddr := flags.String("apiAddr", "", "Serve the API starting, monitoring and canceling jobs on this address, e.g. :8080")
+	grpcAddr := flags.String("grpcAddr", "", "Serve the gRPC API starting, monitoring and canceling jobs on this address, e.g. :9091")
+	apiToken := flags.String("apiToken", os.Getenv("CH_API_TOKEN"), "Bearer token required by the APIs")
+	insecure := flags.Bool("insecure", false, "Serve the APIs without a token when no -apiToken is given")
+	keepLast := flags.Int("keepLast", 0, "Number of the latest successful runs of a schedule to keep, unless the schedule sets keepLast")
+	keepDays := flags.Int("keepDays", 0, "Number of days to keep the runs of a schedule, unless the schedule sets keepDays")
+	jobsDir := flags.String("jobsDir", "jobs", "Directory of the directories of the jobs started through the APIs")
+	flags.Parse(args)
+	if *configFile == "" {
+		return fmt.Errorf("the daemon requires -config")
+	}
+	// The exports run in the directories of their runs, so they need the absolute path of the config file
+	path, err := filepath.Abs(*configFile)
+	if err != nil {
+		return err
+	}
+	schedules, err := loadSchedules(path, chdump.RetentionPolicy{KeepLast: *keepLast, KeepDays: *keepDays})
+	if err != nil {
+		return err
+	}
+	if len(schedules) == 0 && *apiAddr == "" && *grpcAddr == "" {
+		return fmt.Errorf("config file %s has no schedules section and neither -apiAddr nor -grpcAddr is given", path)
+	}
+	jobs, err := newJobManager(ctx, path, *jobsDir)
+	if err != nil {
+		return err
+	}
+	var api *apiServer
+	if *apiAddr != "" {
+		if api, err = serveAPI(jobs, *apiAddr, *apiToken, *insecure); err != nil {
+			return err
+		}
+	}
+	var grpcAPI *grpcServer
+	if *grpcAddr != "" {
+		if grpcAPI, err = serveGRPC(jobs, *grpcAddr, *apiToken, *insecure); err != nil {
+			return err
+		}
+	}
+
+	scheduler := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	ids := make(map[string]cron.EntryID)
+	for _, s := range schedules {
+		id, err := scheduler.AddFunc(s.Cron, func() { runSchedule(ctx, path, s) })
+		if err != nil {
+			return fmt.Errorf("invalid cron expression %q of schedule %s: %w", s.Cron, s.Name, err)
+		}
+		ids[s.Name] = id
+	}
+	scheduler.Start()
+	for _, s := range schedules {
+		log.Printf("Schedule %s (%s) exports into %s, next run at %s", s.Name, s.Cron, s.DumpDir,
+			scheduler.Entry(ids[s.Name]).Next.Format(time.RFC3339))
+	}
+
+	<-ctx.Done()
+	log.Printf("Stopping the daemon, waiting for the running exports")
+	<-scheduler.Stop().Done()
+	jobs.wait()
+	if api != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		api.shutdown(shutdownCtx)
+	}
+	if grpcAPI != nil {
+		grpcAPI.shutdown()
+	}
+	return nil
+}
+
+// loadSchedules reads the schedules section of the config file:
+//
+//	schedules:
+//	  nightly:
+//	    cron: "0 2 * * *"
+//	    profile: prod
+//	    dumpDir: /backups/nightly
+//	    keepLast: 7
+//	    keepDays: 30
+//	    settings:
+//	      dbname: analytics
+//
+// The retention of the schedules defaults to the given one.
+func loadSchedules(path string, retention chdump.RetentionPolicy) ([]schedule, error) {
+	config := readConfigFile(path)
+	if config["schedules"] == nil {
+		return nil, nil
+	}
+	sections, ok := config["schedules"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid schedules section in config file %s, expected a mapping", path)
+	}
+
+	var schedules []schedule
+	for name, section := range sections {
+		settings, ok := section.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule %s in config file %s, expected a mapping", name, path)
+		}
+		s := schedule{Name: name, DumpDir: filepath.Join("schedules", name), Retention: retention, Settings: make(map[string]string)}
+		for key, value := range settings {
+			switch key {
+			case "cron":
+				s.Cron = configValue(value)
+			case "profile":
+				s.Profile = configValue(value)
+			case "dumpDir":
+				s.DumpDir = configValue(value)
+			case "keepLast":
+				keepLast, ok := value.(int)
+				if !ok || keepLast < 0 {
+					return nil, fmt.Errorf("invalid %s of schedule %s, expected a number of runs to keep", key, name)
+				}
+				s.Retention.KeepLast = keepLast
+			case "keepDays":
+				keepDays, ok := value.(int)
+				if !ok || keepDays < 0 {
+					return nil, fmt.Errorf("invalid keepDays of schedule %s, expected a number of days", name)
+				}
+				s.Retention.KeepDays = keepDays
+			case "settings":
+				overrides, ok := value.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("invalid settings of schedule %s, expected a mapping", name)
+				}
+				for setting, override := range overrides {
+					if slices.Contains(configFileFlags, setting) || setting == "dumpDir" {
+						return nil, fmt.Errorf("setting %q cannot be overridden by schedule %s", setting, name)
+					}
+					s.Settings[setting] = configValue(override)
+				}
+			default:
+				return nil, fmt.Errorf("unknown key %q of schedule %s in config file %s", key, name, path)
+			}
+		}
+		if s.Cron == "" {
+			return nil, fmt.Errorf("schedule %s has no cron expression", name)
+		}
+		dumpDir, err := filepath.Abs(s.DumpDir)
+		if err != nil {
+			return nil, err
+		}
+		s.DumpDir = dumpDir
+		schedules = append(schedules, s)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Name < schedules[j].Name })
+	return schedules, nil
+}
+
+// runSchedule runs the export of the schedule in a new timestamped directory of its dump directory, and applies
+// the retention of the schedule once it succeeds. The export runs as a separate chdump process, so that it has
+// the settings, progress, metrics and notifications of a run of its own.
+func runSchedule(ctx context.Context, configFile string, s schedule) {
+	runDir := filepath.Join(s.DumpDir, time.Now().UTC().Format(chdump.TimestampFormat))
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		log.Printf("Scheduled export %s failed: %v", s.Name, err)
+		return
+	}
+	// The dump, state, report and manifest files of the run are written to the directory of the run
+	settings := maps.Clone(s.Settings)
+	settings["dumpDir"] = "."
+	cmd, err := runCommand(ctx, runDir, configFile, "export", s.Profile, settings)
+	if err != nil {
+		log.Printf("Scheduled export %s failed: %v", s.Name, err)
+		return
+	}
+
+	log.Printf("Starting scheduled export %s into %s", s.Name, runDir)
+	if err := cmd.Run(); err != nil {
+		log.Printf("Scheduled export %s failed: %v", s.Name, err)
+		if err := os.Rename(runDir, runDir+chdump.FailedSuffix); err != nil {
+			log.Printf("Failed to mark the run %s as failed: %v", runDir, err)
+		}
+		return
+	}
+	log.Printf("Scheduled export %s finished", s.Name)
+
+	if s.Retention.Enabled() {
+		if err := chdump.PruneDumps(s.DumpDir, s.Retention); err != nil {
+			log.Printf("Failed to apply the retention of schedule %s: %v", s.Name, err)
+		}
+	}
+}
+
+// runCommand returns the chdump process running the command with the config file, its profile and the settings
+// overriding it in the directory. The secret settings are passed as the CH_* environment variables of their flags. The
+// process is interrupted when the context is canceled, so that it stops like on
+// Ctrl+C, and killed when it does not stop in time.
+func runCommand(ctx context.Context, dir, configFile, command, profile string, settings map[string]string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{command, "-config=" + configFile}
+	if profile != "" {
+		args = append(args, "-profile="+profile)
+	}
+	env := os.Environ()
+	for _, name := range sortedKeys(settings) {
+		if slices.Contains(secretSettings, name) {
+			env = append(env, envName(name)+"="+settings[name])
+			continue
+		}
+		args = append(args, "-"+name+"="+settings[name])
+	}
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Env = env
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = stopTimeout
+	return cmd, nil
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
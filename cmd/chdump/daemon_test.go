@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"clickhouse-import-export/pkg/chdump"
+)
+
+func TestLoadSchedules(t *testing.T) {
+	abs := func(path string) string {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	defaults := chdump.RetentionPolicy{KeepLast: 3}
+
+	tests := []struct {
+		name    string
+		config  string
+		want    []schedule
+		wantErr bool
+	}{
+		{
+			name:   "no schedules section",
+			config: "host: localhost\n",
+		},
+		{
+			name: "schedules with defaults and overrides",
+			config: `
+schedules:
+  nightly:
+    cron: "0 2 * * *"
+    profile: prod
+    dumpDir: /backups/nightly
+    keepLast: 7
+    keepDays: 30
+    settings:
+      dbname: analytics
+      excludeTables: [tmp_*, scratch_*]
+  hourly:
+    cron: "@hourly"
+`,
+			want: []schedule{
+				{Name: "hourly", Cron: "@hourly", DumpDir: abs(filepath.Join("schedules", "hourly")), Retention: defaults, Settings: map[string]string{}},
+				{Name: "nightly", Cron: "0 2 * * *", Profile: "prod", DumpDir: "/backups/nightly", Retention: chdump.RetentionPolicy{KeepLast: 7, KeepDays: 30},
+					Settings: map[string]string{"dbname": "analytics", "excludeTables": "tmp_*,scratch_*"}},
+			},
+		},
+		{
+			name:    "schedules not a mapping",
+			config:  "schedules: [nightly]\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing cron expression",
+			config:  "schedules:\n  nightly:\n    profile: prod\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			config:  "schedules:\n  nightly:\n    cron: \"@daily\"\n    when: never\n",
+			wantErr: true,
+		},
+		{
+			name:    "config file flag in the settings",
+			config:  "schedules:\n  nightly:\n    cron: \"@daily\"\n    settings:\n      profile: prod\n",
+			wantErr: true,
+		},
+		{
+			name:    "dumpDir in the settings",
+			config:  "schedules:\n  nightly:\n    cron: \"@daily\"\n    settings:\n      dumpDir: /tmp\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "chdump.yaml")
+			if err := os.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadSchedules(path, defaults)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("loadSchedules() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadSchedules() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("loadSchedules() =\n%+v\nwant\n%+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunCommandKeepsSecretsOffTheCommandLine(t *testing.T) {
+	settings := map[string]string{"dbname": "analytics", "password": "secret", "vaultToken": "token"}
+	cmd, err := runCommand(context.Background(), t.TempDir(), "/etc/chdump.yaml", "export", "prod", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantArgs := []string{"export", "-config=/etc/chdump.yaml", "-profile=prod", "-dbname=analytics"}
+	if !slices.Equal(cmd.Args[1:], wantArgs) {
+		t.Errorf("runCommand() args = %v, want %v", cmd.Args[1:], wantArgs)
+	}
+	for _, variable := range []string{"CH_PASSWORD=secret", "CH_VAULT_TOKEN=token"} {
+		if !slices.Contains(cmd.Env, variable) {
+			t.Errorf("runCommand() environment lacks %s", variable)
+		}
+	}
+}
+
+func TestLoadScheduleRetention(t *testing.T) {
+	defaults := chdump.RetentionPolicy{KeepLast: 3}
+	tests := []struct {
+		name    string
+		config  string
+		want    chdump.RetentionPolicy
+		wantErr bool
+	}{
+		{name: "default retention", config: "schedules:\n  nightly:\n    cron: \"@daily\"\n", want: defaults},
+		{name: "overridden retention", config: "schedules:\n  nightly:\n    cron: \"@daily\"\n    keepLast: 7\n    keepDays: 30\n",
+			want: chdump.RetentionPolicy{KeepLast: 7, KeepDays: 30}},
+		{name: "former retention key", config: "schedules:\n  nightly:\n    cron: \"@daily\"\n    retention: 5\n", wantErr: true},
+		{name: "negative keepLast", config: "schedules:\n  nightly:\n    cron: \"@daily\"\n    keepLast: -1\n", wantErr: true},
+		{name: "keepDays not a number", config: "schedules:\n  nightly:\n    cron: \"@daily\"\n    keepDays: month\n", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "chdump.yaml")
+			if err := os.WriteFile(path, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			schedules, err := loadSchedules(path, defaults)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("loadSchedules() = %+v, want an error", schedules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadSchedules() error = %v", err)
+			}
+			if len(schedules) != 1 || schedules[0].Retention != test.want {
+				t.Errorf("loadSchedules() = %+v, want the retention %+v", schedules, test.want)
+			}
+		})
+	}
+}
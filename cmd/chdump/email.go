@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// emailSettings configure the email notification of the run
+type emailSettings struct {
+	Address  string // host:port of the SMTP server
+	User     string
+	Password string
+	From     string
+	To       []string
+}
+
+// notifyEmail sends the summary of the run by email, with the summary report attached as JSON. The connection is
+// upgraded with STARTTLS when the server supports it, and the credentials are only sent over it or to localhost.
+func notifyEmail(settings emailSettings, summary runSummary) error {
+	report, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fmt.Fprintf(&body, "From: %s\r\n", settings.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(settings.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("chdump %s %s", summary.Command, summary.Status)))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&body, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	text, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(text, summaryText(summary))
+
+	attachment, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/json"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", "chdump-"+summary.Command+"-report.json")},
+	})
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(report)
+	for len(encoded) > 76 {
+		fmt.Fprintf(attachment, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(attachment, "%s\r\n", encoded)
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if settings.User != "" {
+		host, _, err := net.SplitHostPort(settings.Address)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %w", settings.Address, err)
+		}
+		auth = smtp.PlainAuth("", settings.User, settings.Password, host)
+	}
+	return smtp.SendMail(settings.Address, auth, settings.From, settings.To, body.Bytes())
+}
@@ -0,0 +1,1020 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"clickhouse-import-export/pkg/chdump"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFromFlags loads the configuration of the command from the given command-line arguments, with the
+// monitor of its progress
+func loadConfigFromFlags(command string, args []string) (chdump.Options, *monitor) {
+	configFile := flag.String("config", "", "YAML config file with settings named like the flags, overridden by the flags given on the command line")
+	profile := flag.String("profile", "", "Named profile of the config file whose settings override its top-level ones")
+	sourceProfile := flag.String("sourceProfile", "", "Named profile of the config file whose connection settings are used for the source database")
+	host := flag.String("host", "", "ClickHouse host, or a comma-separated list of replicas")
+	hostStrategy := flag.String("hostStrategy", "roundRobin", "How to spread connections over multiple hosts: roundRobin or failover")
+	cluster := flag.String("cluster", "", "Export every shard of this cluster from system.clusters into <dumpDir>/shard_<num>")
+	parallelShards := flag.Int("parallelShards", 1, "Number of shards exported in parallel with -cluster")
+	port := flag.String("port", "", "ClickHouse port")
+	user := flag.String("user", "", "ClickHouse user")
+	password := flag.String("password", "", "ClickHouse password (prefer -passwordFile, CLICKHOUSE_PASSWORD or -askPassword)")
+	passwordFile := flag.String("passwordFile", "", "File containing the ClickHouse password")
+	askPassword := flag.Bool("askPassword", false, "Prompt for the ClickHouse password without echoing it")
+	dbName := flag.String("dbname", "", "ClickHouse database name, or a comma-separated list of databases")
+	readTimeout := flag.Int("readTimeout", 30, "Read timeout in seconds")
+	writeTimeout := flag.Int("writeTimeout", 30, "Write timeout in seconds")
+	chunkSize := flag.Int("chunkSize", 10000, "Number of rows to fetch per batch")
+	dataFormat := flag.String("format", "TSV", "Format of the data files: TSV, or TSVWithNamesAndTypes to store the names and types of the columns and check them on import")
+	clickHouseClientPath := flag.String("clickhouseClientPath", "clickhouse", "Path to the ClickHouse client executable")
+	incrementalColumns := flag.String("incrementalColumns", "", "Comma-separated table:column pairs used for incremental export (e.g. events:updated_at)")
+	tenantColumns := flag.String("tenantColumns", "", "Comma-separated table:column pairs splitting the exported data of the tables into per-tenant dumps by the tenant in the column (e.g. orders:customer_id)")
+	watermarkFile := flag.String("watermarkFile", "./data/watermarks.json", "Path to the file storing incremental export high-water marks")
+	watch := flag.Bool("watch", false, "Keep the export running and export the data that arrived since the previous cycle every -interval until interrupted")
+	watchInterval := flag.Duration("interval", 5*time.Minute, "Interval between the cycles of the export with -watch")
+	stateFile := flag.String("stateFile", "state.json", "Path to the checkpoint state file")
+	resume := flag.Bool("resume", false, "Resume a previous run from the checkpoint state file")
+	parallelTables := flag.Int("parallelTables", 1, "Number of tables exported or imported in parallel, the largest first")
+	failFast := flag.Bool("failFast", false, "Stop at the first table that fails")
+	strict := flag.Bool("strict", false, "Treat warnings, such as row count mismatches or tables without a data file, as table failures")
+	reportFile := flag.String("reportFile", "report.json", "Path to the end-of-run summary report")
+	manifestFile := flag.String("manifestFile", "manifest.json", "Path to the dump manifest")
+	estimate := flag.Bool("estimate", false, "Print the predicted dump size and duration without exporting anything")
+	estimateThroughput := flag.Float64("estimateThroughput", 50, "Expected export throughput in MB/s used to predict the duration")
+	skipManifestCheck := flag.Bool("skipManifestCheck", false, "Import without validating the dump against its manifest")
+	verifyRowCounts := flag.Bool("verifyRowCounts", true, "Verify that the number of rows inserted into each table matches its data file")
+	verifyTarget := flag.Bool("verifyTarget", false, "Make the verify subcommand also compare the row counts and checksums of the target server with the manifest")
+	dryRun := flag.Bool("dryRun", false, "Print the statements and files that would be imported and detected mismatches without executing anything")
+	sourceHost := flag.String("sourceHost", "", "Source ClickHouse host copied by the copy, migrate and sync subcommands and compared by the diff subcommand; the dump is used when empty")
+	sourcePort := flag.String("sourcePort", "", "Source ClickHouse port (defaults to -port)")
+	sourceUser := flag.String("sourceUser", "", "Source ClickHouse user (defaults to -user)")
+	sourcePassword := flag.String("sourcePassword", "", "Source ClickHouse password (defaults to -password)")
+	sourceDBName := flag.String("sourceDBName", "", "Source ClickHouse database name (defaults to -dbname)")
+	syncInterval := flag.Duration("syncInterval", 0, "Interval between the passes of the sync subcommand, which keeps running until interrupted; 0 runs a single pass")
+	allDatabases := flag.Bool("allDatabases", false, "Export all user databases, or import every database found in the dump directory")
+	dumpDir := flag.String("dumpDir", "dump", "Root directory of the per-database layout used with several databases")
+	timestamped := flag.Bool("timestamped", false, "Lay out every database as <dumpDir>/<db>/<timestamp>/{schema,data} with a latest link to the last complete dump")
+	from := flag.String("from", "", "Timestamped dump to read: latest, its timestamp, e.g. 20240501T020000Z, or a prefix of it such as a date; implies -timestamped")
+	keepLast := flag.Int("keepLast", 0, "Number of the latest complete timestamped dumps of a database kept after a successful export, 0 to keep them all")
+	keepDays := flag.Int("keepDays", 0, "Number of days the timestamped dumps of a database are kept after a successful export, 0 to keep them regardless of age")
+	renameDatabases := flag.String("renameDB", "", "Comma-separated old=new database renames applied on import")
+	renameTables := flag.String("renameTable", "", "Comma-separated old=new table renames applied on import")
+	tablePrefix := flag.String("tablePrefix", "", "Prefix added to the name of every restored table")
+	tableSuffix := flag.String("tableSuffix", "", "Suffix added to the name of every restored table")
+	onCluster := flag.String("onCluster", "", "Cluster on which the schema is created with ON CLUSTER")
+	shardCluster := flag.String("shardCluster", "", "Cluster whose shards the import spreads the data of the tables over, inserting it through their Distributed tables or temporary ones")
+	asyncDistributed := flag.Bool("asyncDistributed", false, "Let the inserts through Distributed tables return before the rows are written to the shards, instead of inserting with insert_distributed_sync")
+	dereplicate := flag.Bool("dereplicate", false, "Convert Replicated engines to MergeTree and Distributed engines to Merge over the local table")
+	replicatedPaths := flag.String("replicatedPaths", "keep", "How to rewrite the ZooKeeper path and replica name of Replicated engines: keep, macros or strip")
+	tableUUIDs := flag.String("tableUUIDs", "keep", "How to rewrite the UUIDs of the tables and inner tables of materialized views: keep, strip or regenerate")
+	replicaPathTemplate := flag.String("replicaPathTemplate", "/clickhouse/tables/{uuid}/{shard}", "ZooKeeper path used by -replicatedPaths=macros")
+	replicaNameTemplate := flag.String("replicaNameTemplate", "{replica}", "Replica name used by -replicatedPaths=macros")
+	storagePolicyMap := flag.String("storagePolicyMap", "", "Comma-separated old=new storage policy renames applied on import")
+	stripStoragePolicy := flag.Bool("stripStoragePolicy", false, "Remove the storage_policy setting from CREATE statements")
+	diskMap := flag.String("diskMap", "", "Comma-separated old=new disk renames applied to TTL TO DISK clauses")
+	volumeMap := flag.String("volumeMap", "", "Comma-separated old=new volume renames applied to TTL TO VOLUME clauses")
+	stripTTLMoves := flag.Bool("stripTTLMoves", false, "Remove TTL TO DISK and TO VOLUME moves from CREATE statements")
+	keepPopulate := flag.Bool("keepPopulate", false, "Keep the POPULATE keyword of materialized views instead of restoring their data from the dump only")
+	atomicRestore := flag.Bool("atomicRestore", false, "Load each table into a <table>__restore staging table and swap it in with EXCHANGE TABLES once its row count is verified")
+	allowErrors := flag.Int("allowErrors", 0, "Number of broken rows of a data file the import skips instead of failing (input_format_allow_errors_num)")
+	allowErrorsRatio := flag.Float64("allowErrorsRatio", 0, "Fraction of broken rows of a data file the import skips instead of failing, e.g. 0.001 (input_format_allow_errors_ratio)")
+	skipBrokenRows := flag.Bool("skipBrokenRows", false, "Skip every broken row of the data files instead of failing the import")
+	rejectedDir := flag.String("rejectedDir", "rejected", "Directory of the <table>.tsv files listing the broken rows skipped by the import")
+	maxBytesPerSec := flag.Int64("maxBytesPerSec", 0, "Maximum bytes of data per second exported or imported by the run (default: unlimited)")
+	maxRowsPerSec := flag.Int("maxRowsPerSec", 0, "Maximum rows per second exported or imported by the run (default: unlimited)")
+	diskSpaceCheck := flag.String("diskSpaceCheck", "fail", "What the export does when the free space of the dump directory is smaller than the predicted dump: fail, warn or off")
+	maxFileSize := flag.String("maxFileSize", "", "Maximum size of a data file, e.g. 5G, beyond which the data of a table is split into numbered parts (default: unlimited)")
+	maxRowsPerFile := flag.Int("maxRowsPerFile", 0, "Maximum rows of a data file, beyond which the data of a table is split into numbered parts (default: unlimited)")
+	freeze := flag.Bool("freeze", false, "Freeze the MergeTree tables at the start of the export and export them from the snapshot, so that they are consistent with each other")
+	final := flag.String("final", "", "Comma-separated globs or /regex/ patterns of the ReplacingMergeTree, CollapsingMergeTree and other merging tables whose data is exported with SELECT ... FINAL")
+	since := flag.String("since", "", "Export only the rows dated on or after this date, e.g. 2024-01-01, or this number of days before today, e.g. 90d, by the date column or the date of the partition key of each table")
+	until := flag.String("until", "", "Export only the rows dated before this date, e.g. 2024-07-01, or this number of days before today, e.g. 7d")
+	dateColumns := flag.String("dateColumns", "", "Comma-separated table:column pairs of the date columns -since and -until apply to, instead of the partition keys of the tables (e.g. events:event_time)")
+	partitions := flag.String("partitions", "", "Comma-separated partition IDs, optionally prefixed with table: to apply to that table only (e.g. 202401,events:202402), whose data the export dumps into files of their own and the import restores, replacing them")
+	orderByPK := flag.Bool("orderByPK", false, "Sort the exported data of each table by its ORDER BY key, so that the data files of unchanged tables are identical between runs")
+	selectSettings := settingsFlag{}
+	flag.Var(selectSettings, "selectSetting", "Setting of the SELECT of the exported data as key=value, e.g. max_threads=4 (repeatable)")
+	insertSettings := settingsFlag{}
+	flag.Var(insertSettings, "insertSetting", "Setting of the INSERT of the data files as key=value, e.g. max_insert_block_size=1048576 (repeatable)")
+	skipDataEngines := flag.String("skipDataEngines", "Kafka,RabbitMQ,NATS,Null,Distributed,Dictionary,Merge,URL,Buffer,Memory",
+		"Comma-separated table engines whose tables are exported and restored without data")
+	includeAccess := flag.Bool("includeAccess", false, "Also export or restore users, roles, grants, quotas, row policies and settings profiles in the access directory")
+	distributedData := flag.Bool("distributedData", false, "Export the data of Distributed tables through them, once per local table, instead of the data of their local tables")
+	includeTables := flag.String("tables", "", "Comma-separated table globs or /regex/ patterns to include (default: all tables)")
+	excludeTables := flag.String("excludeTables", "", "Comma-separated table globs or /regex/ patterns to exclude")
+	tableSelectsFile := flag.String("tableSelects", "", "File mapping tables to the SELECT expression lists their data is exported with, one \"table: expressions\" per line")
+	tableFiltersFile := flag.String("tableFilters", "", "File mapping tables to WHERE expressions, one \"table: expression\" per line")
+	maskFile := flag.String("maskFile", "", "File of masking rules applied to the exported columns, one \"table.column: rule\" per line with null, hash[:salt], constant:value, regex:/pattern/replacement/ or fake:kind[:salt]")
+	columnMapFile := flag.String("columnMapFile", "", "File mapping the columns of the dump to the columns of the target tables, one \"table.column: target\" per line, with - to skip the column")
+	allowSchemaDrift := flag.Bool("allowSchemaDrift", false, "Insert the data of tables whose columns differ from the dump by column name, skipping the columns missing from the target and filling the others with their defaults")
+	force := flag.Bool("force", false, "Load the data of tables whose columns do not match the dump instead of refusing to")
+	deduplicate := flag.String("deduplicate", "", "Comma-separated globs or /regex/ patterns of the tables deduplicated with OPTIMIZE TABLE ... FINAL DEDUPLICATE after the import")
+	materializeIndexes := flag.Bool("materializeIndexes", false, "Materialize the data skipping indexes and projections of the restored tables with ALTER TABLE ... MATERIALIZE INDEX/PROJECTION")
+	apply := flag.Bool("apply", false, "Apply the statements printed by the schema command to the target server")
+	sample := flag.Float64("sample", 0, "Fraction of rows to export from each table as a deterministic sample, e.g. 0.01 (default: all rows)")
+	tablesFile := flag.String("tablesFile", "", "File listing the tables to include, one per line with optional key=value options")
+	retryAttempts := flag.Int("retryAttempts", 3, "Maximum number of attempts for operations failing with transient errors")
+	retryBackoff := flag.Int("retryBackoff", 1, "Initial retry backoff in seconds, doubled after each attempt")
+	retryMaxBackoff := flag.Int("retryMaxBackoff", 30, "Maximum retry backoff in seconds")
+	vaultAddr := flag.String("vaultAddr", os.Getenv("VAULT_ADDR"), "Address of the HashiCorp Vault server")
+	vaultPath := flag.String("vaultPath", "", "Vault KV path of the secret holding the ClickHouse credentials, e.g. secret/clickhouse/prod")
+	vaultKVVersion := flag.Int("vaultKVVersion", 2, "Version of the Vault KV secrets engine mounted at the path")
+	vaultToken := flag.String("vaultToken", os.Getenv("VAULT_TOKEN"), "Vault token")
+	vaultRoleID := flag.String("vaultRoleId", os.Getenv("VAULT_ROLE_ID"), "Vault AppRole role ID, used when no token is given")
+	vaultSecretID := flag.String("vaultSecretId", os.Getenv("VAULT_SECRET_ID"), "Vault AppRole secret ID")
+	secure := flag.Bool("secure", false, "Connect to ClickHouse over TLS")
+	tlsCA := flag.String("tlsCA", "", "CA certificate file used to verify the ClickHouse server")
+	tlsCert := flag.String("tlsCert", "", "Client certificate file for mutual TLS")
+	tlsKey := flag.String("tlsKey", "", "Client private key file for mutual TLS")
+	tlsSkipVerify := flag.Bool("tlsSkipVerify", false, "Do not verify the ClickHouse server certificate")
+	sshDestination := flag.String("ssh", "", "Reach ClickHouse through an SSH tunnel to this jump host, as user@host[:port]")
+	sshKey := flag.String("sshKey", "", "Private key file for the SSH jump host (default: the SSH agent and ~/.ssh/id_*)")
+	sshKnownHosts := flag.String("sshKnownHosts", "", "Known hosts file used to verify the SSH jump host (default: ~/.ssh/known_hosts)")
+	awsRegion := flag.String("awsRegion", "", "AWS region of the secret, parameters or KMS key (default: the ambient AWS configuration)")
+	awsSecretID := flag.String("awsSecretId", "", "AWS Secrets Manager secret holding the ClickHouse credentials as JSON")
+	awsParameterPath := flag.String("awsParameterPath", "", "SSM Parameter Store path holding the ClickHouse credentials, e.g. /clickhouse/prod")
+	encrypt := flag.String("encrypt", "", "Encrypt the dump files with AES-256-GCM using this key file, kms:<key ID, ARN or alias> for an AWS KMS data key, or gpg:<recipient>,... for a data key encrypted to GPG recipients; the import needs the same setting")
+	gpgPath := flag.String("gpgPath", "gpg", "Path to the gpg executable")
+	signKey := flag.String("signKey", "", "GPG key signing the manifest of the export")
+	trustedSigners := flag.String("trustedSigners", "", "Comma-separated fingerprints or key IDs of the GPG keys one of which must have signed the manifest of the imported dump")
+	logFile := flag.String("logFile", "", "Write the log to this file, rotated by size, instead of standard error")
+	logMaxSize := flag.Int("logMaxSize", 100, "Size in megabytes after which the log file is rotated")
+	logMaxBackups := flag.Int("logMaxBackups", 5, "Number of rotated log files to keep, 0 to keep them all")
+	logMaxAge := flag.Int("logMaxAge", 0, "Number of days to keep rotated log files, 0 to keep them regardless of age")
+	metricsAddr := flag.String("metricsAddr", "", "Serve Prometheus metrics of the run on /metrics of this address, e.g. :9090")
+	pushgatewayURL := flag.String("pushgatewayURL", "", "Push the metrics of the run to this Prometheus Pushgateway when it ends")
+	pushgatewayJob := flag.String("pushgatewayJob", "chdump", "Job name of the metrics pushed to the Pushgateway")
+	statsdAddr := flag.String("statsdAddr", "", "Send the timing and throughput of every table to the StatsD server at this host:port over UDP")
+	statsdPrefix := flag.String("statsdPrefix", "chdump.", "Prefix of the StatsD metric names")
+	statsdFormat := flag.String("statsdFormat", "statsd", "StatsD dialect: statsd, with the database and table in the metric names, or dogstatsd, with them as tags")
+	notifyURL := flag.String("notifyURL", "", "Post a summary of the run to this Slack incoming webhook or generic webhook when it finishes")
+	smtpAddr := flag.String("smtpAddr", "", "Email a summary of the run with the report attached through the SMTP server at this host:port when it finishes")
+	smtpUser := flag.String("smtpUser", "", "SMTP user, when the server requires authentication")
+	smtpPassword := flag.String("smtpPassword", "", "SMTP password")
+	smtpFrom := flag.String("smtpFrom", "", "Sender address of the notification email")
+	smtpTo := flag.String("smtpTo", "", "Comma-separated recipient addresses of the notification email")
+	statusFile := flag.String("statusFile", "", "Keep the status of the run, with the progress of its tables, as JSON in this file while it runs")
+	progress := flag.Bool("progress", true, "Show progress bars when standard error is a terminal")
+	progressInterval := flag.Duration("progressInterval", 10*time.Second, "Interval between the progress log lines of a table when no progress bars are shown")
+	flag.CommandLine.Parse(args)
+
+	// Environment variables apply to the flags not given on the command line, and the settings of the config file
+	// to the flags given neither on the command line nor in the environment
+	applyEnvironment()
+	var tableOptions map[string]map[string]string
+	var hooks chdump.Hooks
+	var queries map[string]string
+	if *configFile != "" && *sourceProfile != "" {
+		applySourceProfile(*configFile, *sourceProfile)
+	}
+	if *configFile != "" {
+		tableOptions, hooks, queries = applyConfigFile(*configFile, *profile)
+	}
+
+	if *logFile != "" {
+		setupLogFile(*logFile, *logMaxSize, *logMaxBackups, *logMaxAge)
+	}
+
+	config := chdump.Options{
+		Host:                 *host,
+		Port:                 *port,
+		HostStrategy:         *hostStrategy,
+		Cluster:              *cluster,
+		ParallelShards:       *parallelShards,
+		User:                 *user,
+		Password:             resolvePassword(*password, *passwordFile, *askPassword),
+		DBName:               *dbName,
+		ReadTimeout:          *readTimeout,
+		WriteTimeout:         *writeTimeout,
+		ChunkSize:            *chunkSize,
+		ClickHouseClientPath: *clickHouseClientPath,
+		IncrementalColumns:   parseTableColumns(*incrementalColumns),
+		TenantColumns:        parseTableColumns(*tenantColumns),
+		WatermarkFile:        *watermarkFile,
+		Watch:                *watch,
+		WatchInterval:        *watchInterval,
+		StateFile:            *stateFile,
+		Resume:               *resume,
+		FailFast:             *failFast,
+		ParallelTables:       *parallelTables,
+		Strict:               *strict,
+		ReportFile:           *reportFile,
+		ManifestFile:         *manifestFile,
+		Estimate:             *estimate,
+		EstimateThroughput:   *estimateThroughput,
+		SkipManifestCheck:    *skipManifestCheck,
+		VerifyRowCounts:      *verifyRowCounts,
+		VerifyTarget:         *verifyTarget,
+		DryRun:               *dryRun,
+		Databases:            parseList(*dbName),
+		AllDatabases:         *allDatabases,
+		DumpDir:              *dumpDir,
+		Timestamped:          *timestamped,
+		From:                 *from,
+		RenameDatabases:      parseMapping(*renameDatabases),
+		RenameTables:         parseMapping(*renameTables),
+		TablePrefix:          *tablePrefix,
+		TableSuffix:          *tableSuffix,
+		OnCluster:            *onCluster,
+		Dereplicate:          *dereplicate,
+		ShardCluster:         *shardCluster,
+		ShardingKeys:         make(map[string]string),
+		AsyncDistributed:     *asyncDistributed,
+		ReplicatedPaths:      *replicatedPaths,
+		TableUUIDs:           *tableUUIDs,
+		ReplicaPathTemplate:  *replicaPathTemplate,
+		ReplicaNameTemplate:  *replicaNameTemplate,
+		StoragePolicyMap:     parseMapping(*storagePolicyMap),
+		StripStoragePolicy:   *stripStoragePolicy,
+		DiskMap:              parseMapping(*diskMap),
+		VolumeMap:            parseMapping(*volumeMap),
+		StripTTLMoves:        *stripTTLMoves,
+		KeepPopulate:         *keepPopulate,
+		AtomicRestore:        *atomicRestore,
+		AllowErrors:          *allowErrors,
+		AllowErrorsRatio:     *allowErrorsRatio,
+		SkipBrokenRows:       *skipBrokenRows,
+		RejectedDir:          *rejectedDir,
+		InsertSettings:       insertSettings,
+		ColumnMaps:           loadColumnMapFile(*columnMapFile),
+		AllowSchemaDrift:     *allowSchemaDrift,
+		Force:                *force,
+		Apply:                *apply,
+		MaterializeIndexes:   *materializeIndexes,
+		DeduplicateTables:    parseTablePatterns(*deduplicate),
+		IncludeAccess:        *includeAccess,
+		// An empty list skips no engines, while nil would select the default ones
+		SkipDataEngines: append([]string{}, parseList(*skipDataEngines)...),
+		IncludeTables:   parseTablePatterns(*includeTables),
+		ExcludeTables:   parseTablePatterns(*excludeTables),
+		TablesFile:      *tablesFile,
+		TableFilters:    loadTableExpressions(*tableFiltersFile, "table filter"),
+		TableSelects:    loadTableExpressions(*tableSelectsFile, "table select"),
+		ColumnMasks:     loadMaskFile(*maskFile),
+		Sample:          *sample,
+		SampleOverrides: make(map[string]float64),
+		SampleKeys:      make(map[string]string),
+		DistributedData: *distributedData,
+		SelectSettings:  selectSettings,
+		DiskSpaceCheck:  *diskSpaceCheck,
+		MaxFileSize:     parseByteSize(*maxFileSize),
+		MaxRowsPerFile:  *maxRowsPerFile,
+		Freeze:          *freeze,
+		OrderByPK:       *orderByPK,
+		FinalTables:     parseTablePatterns(*final),
+		Partitions:      parsePartitions(*partitions),
+		Since:           *since,
+		Until:           *until,
+		DateColumns:     parseTableColumns(*dateColumns),
+		SourceHost:      *sourceHost,
+		SourcePort:      *sourcePort,
+		SourceUser:      *sourceUser,
+		SourcePassword:  *sourcePassword,
+		SourceDBName:    *sourceDBName,
+		SyncInterval:    *syncInterval,
+		Vault: chdump.VaultConfig{
+			Address:   *vaultAddr,
+			Path:      *vaultPath,
+			KVVersion: *vaultKVVersion,
+			Token:     *vaultToken,
+			RoleID:    *vaultRoleID,
+			SecretID:  *vaultSecretID,
+		},
+		TLS: chdump.TLSConfig{
+			Secure:     *secure,
+			CAFile:     *tlsCA,
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+			SkipVerify: *tlsSkipVerify,
+		},
+		SSH: chdump.SSHConfig{
+			Destination:    *sshDestination,
+			KeyFile:        *sshKey,
+			KnownHostsFile: *sshKnownHosts,
+		},
+		AWS: chdump.AWSConfig{
+			Region:        *awsRegion,
+			SecretID:      *awsSecretID,
+			ParameterPath: *awsParameterPath,
+		},
+		Encryption: encryptionConfig(*encrypt),
+		Hooks:      hooks,
+		Queries:    queries,
+		GPG: chdump.GPGConfig{
+			Path:           *gpgPath,
+			SignKey:        *signKey,
+			TrustedSigners: parseList(*trustedSigners),
+		},
+		RateLimit: chdump.RateLimit{
+			MaxBytesPerSec: *maxBytesPerSec,
+			MaxRowsPerSec:  *maxRowsPerSec,
+		},
+		Retention: chdump.RetentionPolicy{
+			KeepLast: *keepLast,
+			KeepDays: *keepDays,
+		},
+		Retry: chdump.RetryPolicy{
+			MaxAttempts:    *retryAttempts,
+			InitialBackoff: time.Duration(*retryBackoff) * time.Second,
+			MaxBackoff:     time.Duration(*retryMaxBackoff) * time.Second,
+		},
+	}
+
+	// The catalog lists the dumps of every database unless some are given
+	if len(config.Databases) == 0 && !config.AllDatabases && command != "catalog" {
+		log.Fatalf("Either -dbname or -allDatabases is required")
+	}
+	if command == "export-query" && len(config.Queries) == 0 {
+		log.Fatalf("export-query requires a queries section in the -config file")
+	}
+	if config.Retention.Enabled() && !config.Timestamped {
+		log.Fatalf("-keepLast and -keepDays require -timestamped")
+	}
+	format, err := chdump.ParseFormat(*dataFormat)
+	if err != nil {
+		log.Fatalf("Invalid -format: %v", err)
+	}
+	config.Format = format
+	// A list of databases is exported over a connection to the default database
+	if len(config.Databases) > 1 || config.AllDatabases {
+		config.DBName = ""
+	}
+	for table, options := range tableOptions {
+		applyTableOptions(&config, table, options, *configFile)
+	}
+	if config.TablesFile != "" {
+		applyTablesFile(&config)
+	}
+	// The progress is shown, and passed on to the metrics when they are served, pushed or sent
+	runMonitor := newMonitor(command, newProgressDisplay(*progress, *progressInterval, config.Cluster != ""))
+	runMonitor.notifyURL = *notifyURL
+	runMonitor.statusFile = *statusFile
+	if *smtpAddr != "" {
+		if *smtpFrom == "" || *smtpTo == "" {
+			log.Fatalf("-smtpAddr requires -smtpFrom and -smtpTo")
+		}
+		runMonitor.email = &emailSettings{Address: *smtpAddr, User: *smtpUser, Password: *smtpPassword, From: *smtpFrom, To: parseList(*smtpTo)}
+	}
+	if *metricsAddr != "" || *pushgatewayURL != "" {
+		runMonitor.metrics = newMetrics()
+		runMonitor.metrics.pushURL, runMonitor.metrics.pushJob = *pushgatewayURL, *pushgatewayJob
+		if *metricsAddr != "" {
+			if err := serveMetrics(runMonitor.metrics, *metricsAddr); err != nil {
+				log.Fatalf("Failed to serve metrics: %v", err)
+			}
+		}
+	}
+	if *statsdAddr != "" {
+		if *statsdFormat != "statsd" && *statsdFormat != "dogstatsd" {
+			log.Fatalf("Invalid StatsD format %q, expected statsd or dogstatsd", *statsdFormat)
+		}
+		statsd, err := newStatsdClient(*statsdAddr, *statsdPrefix, *statsdFormat == "dogstatsd")
+		if err != nil {
+			log.Fatalf("Failed to set up StatsD: %v", err)
+		}
+		runMonitor.statsd = statsd
+	}
+	config.OnProgress = runMonitor.report
+	return config, runMonitor
+}
+
+// loadTableExpressions reads per-table expressions, such as the WHERE expressions of -tableFilters, from a file with
+// one "table: expression" per line. Blank lines and lines starting with # are ignored.
+func loadTableExpressions(path, kind string) map[string]string {
+	filters := make(map[string]string)
+	if path == "" {
+		return filters
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s file: %v", kind, err)
+	}
+	for lineNumber, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		table, expression, found := strings.Cut(line, ":")
+		table, expression = strings.TrimSpace(table), strings.TrimSpace(expression)
+		if !found || table == "" || expression == "" {
+			log.Fatalf("%s:%d: invalid %s %q, expected \"table: expression\"", path, lineNumber+1, kind, line)
+		}
+		filters[table] = expression
+	}
+	return filters
+}
+
+// loadMaskFile reads the masking rules of the columns from a file with one "table.column: rule" per line. Blank
+// lines and lines starting with # are ignored.
+func loadMaskFile(path string) map[string]chdump.MaskRules {
+	masks := make(map[string]chdump.MaskRules)
+	if path == "" {
+		return masks
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read mask file: %v", err)
+	}
+	for lineNumber, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rule, found := strings.Cut(line, ":")
+		table, column, qualified := strings.Cut(strings.TrimSpace(name), ".")
+		rule = strings.TrimSpace(rule)
+		if !found || !qualified || table == "" || column == "" || rule == "" {
+			log.Fatalf("%s:%d: invalid masking rule %q, expected \"table.column: rule\"", path, lineNumber+1, line)
+		}
+		if masks[table] == nil {
+			masks[table] = make(chdump.MaskRules)
+		}
+		masks[table][column] = rule
+	}
+	return masks
+}
+
+// loadColumnMapFile reads the column maps of the tables from a file with one "table.column: target" per line, where
+// a target of - skips the column. Blank lines and lines starting with # are ignored.
+func loadColumnMapFile(path string) map[string]chdump.ColumnMap {
+	columnMaps := make(map[string]chdump.ColumnMap)
+	if path == "" {
+		return columnMaps
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read column map file: %v", err)
+	}
+	for lineNumber, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, target, found := strings.Cut(line, ":")
+		table, column, qualified := strings.Cut(strings.TrimSpace(name), ".")
+		target = strings.TrimSpace(target)
+		if !found || !qualified || table == "" || column == "" || target == "" {
+			log.Fatalf("%s:%d: invalid column mapping %q, expected \"table.column: target\"", path, lineNumber+1, line)
+		}
+		if target == "-" {
+			target = ""
+		}
+		if columnMaps[table] == nil {
+			columnMaps[table] = make(chdump.ColumnMap)
+		}
+		columnMaps[table][column] = target
+	}
+	return columnMaps
+}
+
+// TableEntry is a table listed in a tables file together with its per-table options
+type TableEntry struct {
+	Name    string
+	Options map[string]string
+}
+
+// loadTablesFile reads a tables file containing one table per line, optionally followed by
+// space-separated key=value options. Blank lines and lines starting with # are ignored.
+func loadTablesFile(path string) ([]TableEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []TableEntry
+	for lineNumber, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		entry := TableEntry{Name: fields[0], Options: make(map[string]string)}
+		for _, option := range fields[1:] {
+			key, value, found := strings.Cut(option, "=")
+			if !found || key == "" {
+				return nil, fmt.Errorf("%s:%d: invalid option %q, expected key=value", path, lineNumber+1, option)
+			}
+			entry.Options[key] = value
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// applyTablesFile adds the tables listed in the tables file to the included tables and applies their options
+func applyTablesFile(config *chdump.Options) {
+	entries, err := loadTablesFile(config.TablesFile)
+	if err != nil {
+		log.Fatalf("Failed to load tables file: %v", err)
+	}
+	for _, entry := range entries {
+		config.IncludeTables = append(config.IncludeTables, chdump.GlobPattern(entry.Name))
+		applyTableOptions(config, entry.Name, entry.Options, config.TablesFile)
+	}
+}
+
+// applyTableOptions applies the options given for a table in the tables file or the config file
+func applyTableOptions(config *chdump.Options, table string, options map[string]string, source string) {
+	for key, value := range options {
+		switch key {
+		case "incremental":
+			config.IncrementalColumns[table] = value
+		case "tenant":
+			config.TenantColumns[table] = value
+		case "sample":
+			fraction, err := strconv.ParseFloat(value, 64)
+			if err != nil || fraction < 0 || fraction > 1 {
+				log.Fatalf("Invalid sample fraction %q for table %s in %s", value, table, source)
+			}
+			config.SampleOverrides[table] = fraction
+		case "sampleKey":
+			config.SampleKeys[table] = value
+		case "filter":
+			config.TableFilters[table] = value
+		case "select":
+			config.TableSelects[table] = value
+		case "final":
+			if final, err := strconv.ParseBool(value); err != nil {
+				log.Fatalf("Invalid final flag %q for table %s in %s", value, table, source)
+			} else if final {
+				config.FinalTables = append(config.FinalTables, chdump.GlobPattern(table))
+			}
+		case "dateColumn":
+			config.DateColumns[table] = value
+		case "partitions":
+			config.Partitions[table] = parseList(value)
+		case "rename":
+			config.RenameTables[table] = value
+		case "shardingKey":
+			config.ShardingKeys[table] = value
+		default:
+			log.Printf("Warning: ignoring unsupported option %s for table %s in %s", key, table, source)
+		}
+	}
+}
+
+// applyEnvironment sets the flags that were not given on the command line from the CH_* environment variables
+// named after them
+func applyEnvironment() {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] {
+			return
+		}
+		if err := flag.Set(f.Name, value); err != nil {
+			log.Fatalf("Invalid value for environment variable %s: %v", envName(f.Name), err)
+		}
+	})
+}
+
+// envName returns the environment variable of a flag: its name in upper snake case prefixed with CH_, e.g.
+// CH_CHUNK_SIZE for -chunkSize and CH_STRIP_TTL_MOVES for -stripTTLMoves
+func envName(flagName string) string {
+	var name strings.Builder
+	name.WriteString("CH_")
+	for i, r := range flagName {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := rune(flagName[i-1])
+			nextIsLower := i+1 < len(flagName) && unicode.IsLower(rune(flagName[i+1]))
+			if !unicode.IsUpper(previous) || nextIsLower {
+				name.WriteByte('_')
+			}
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// readConfigFile parses a YAML config file
+func readConfigFile(path string) map[string]any {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read config file: %v", err)
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(content, &settings); err != nil {
+		log.Fatalf("Failed to parse config file %s: %v", path, err)
+	}
+	return settings
+}
+
+// configProfile returns the settings of a named profile of the profiles section of the config file
+func configProfile(settings map[string]any, path, name string) map[string]any {
+	profiles, _ := settings["profiles"].(map[string]any)
+	profile, ok := profiles[name].(map[string]any)
+	if !ok {
+		log.Fatalf("Profile %q not found in config file %s", name, path)
+	}
+	return profile
+}
+
+// applyConfigFile sets the flags that were not given on the command line or in the environment from the settings of
+// a YAML config file, named like the flags, and returns the per-table options of its tableOptions section, the
+// hooks of its hooks section and the named queries of its queries section. The connection settings of its source
+// section apply to the source database, and the settings of its target section and then of the selected profile
+// override the top-level ones. Lists are joined with commas and maps are written as comma-separated key=value pairs.
+func applyConfigFile(path, profile string) (map[string]map[string]string, chdump.Hooks, map[string]string) {
+	settings := readConfigFile(path)
+	if source, ok := settings["source"]; ok {
+		applySourceSettings(configSection(source, "source", path), "source section of config file "+path)
+		delete(settings, "source")
+	}
+	if target, ok := settings["target"]; ok {
+		for name, value := range configSection(target, "target", path) {
+			settings[name] = value
+		}
+		delete(settings, "target")
+	}
+	if profile != "" {
+		for name, value := range configProfile(settings, path, profile) {
+			settings[name] = value
+		}
+	}
+	delete(settings, "profiles")
+	// The schedules are read by the daemon, which runs the exports with this file
+	delete(settings, "schedules")
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	tableOptions := make(map[string]map[string]string)
+	var hooks chdump.Hooks
+	var queries map[string]string
+	for name, value := range settings {
+		if name == "hooks" {
+			hooks = parseHooks(value, path)
+			continue
+		}
+		if name == "queries" {
+			queries = parseQueries(value, path)
+			continue
+		}
+		if name == "tableOptions" {
+			tables, ok := value.(map[string]any)
+			if !ok {
+				log.Fatalf("Invalid tableOptions in config file %s, expected a mapping of tables to options", path)
+			}
+			for table, options := range tables {
+				optionMap, ok := options.(map[string]any)
+				if !ok {
+					log.Fatalf("Invalid options for table %s in config file %s, expected a mapping", table, path)
+				}
+				tableOptions[table] = make(map[string]string)
+				for key, option := range optionMap {
+					tableOptions[table][key] = configValue(option)
+				}
+			}
+			continue
+		}
+		if slices.Contains(configFileFlags, name) || flag.Lookup(name) == nil {
+			log.Fatalf("Unknown setting %q in config file %s", name, path)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, configValue(value)); err != nil {
+			log.Fatalf("Invalid value for setting %s in config file %s: %v", name, path, err)
+		}
+	}
+	return tableOptions, hooks, queries
+}
+
+// parseQueries parses the queries section of a config file, which maps the names of the tables the export-query
+// command dumps to the SELECT queries producing their data
+func parseQueries(value any, path string) map[string]string {
+	entries, ok := value.(map[string]any)
+	if !ok {
+		log.Fatalf("Invalid queries in config file %s, expected a mapping of names to queries", path)
+	}
+	queries := make(map[string]string)
+	for name, query := range entries {
+		text, ok := query.(string)
+		if !ok || strings.TrimSpace(text) == "" {
+			log.Fatalf("Invalid query %s in config file %s, expected a SELECT query", name, path)
+		}
+		queries[name] = strings.TrimRight(strings.TrimSpace(text), ";")
+	}
+	return queries
+}
+
+// parseHooks parses the hooks section of a config file, which maps the stages preExport, postExport, preImport and
+// postImport to lists of hooks. A hook is a shell command, or a mapping with either sql or shell, and optionally
+// onError set to warn rather than fatal and onSuccess to run a post hook only when the run succeeded.
+func parseHooks(value any, path string) chdump.Hooks {
+	var hooks chdump.Hooks
+	stages, ok := value.(map[string]any)
+	if !ok {
+		log.Fatalf("Invalid hooks in config file %s, expected a mapping of stages to lists of hooks", path)
+	}
+	for stage, list := range stages {
+		var target *[]chdump.Hook
+		switch stage {
+		case "preExport":
+			target = &hooks.PreExport
+		case "postExport":
+			target = &hooks.PostExport
+		case "preImport":
+			target = &hooks.PreImport
+		case "postImport":
+			target = &hooks.PostImport
+		default:
+			log.Fatalf("Invalid hook stage %q in config file %s, expected preExport, postExport, preImport or postImport", stage, path)
+		}
+		entries, ok := list.([]any)
+		if !ok {
+			log.Fatalf("Invalid %s hooks in config file %s, expected a list", stage, path)
+		}
+		for _, entry := range entries {
+			*target = append(*target, parseHook(entry, stage, path))
+		}
+	}
+	return hooks
+}
+
+// parseHook parses a hook of the config file
+func parseHook(entry any, stage, path string) chdump.Hook {
+	if command, ok := entry.(string); ok {
+		return chdump.Hook{Command: command}
+	}
+	settings, ok := entry.(map[string]any)
+	if !ok {
+		log.Fatalf("Invalid %s hook in config file %s, expected a shell command or a mapping", stage, path)
+	}
+	var hook chdump.Hook
+	for key, value := range settings {
+		switch key {
+		case "sql":
+			hook.SQL = configValue(value)
+		case "shell":
+			hook.Command = configValue(value)
+		case "onError":
+			switch configValue(value) {
+			case "warn":
+				hook.Warn = true
+			case "fatal":
+			default:
+				log.Fatalf("Invalid onError %q of a %s hook in config file %s, expected fatal or warn", configValue(value), stage, path)
+			}
+		case "onSuccess":
+			hook.OnSuccess = configValue(value) == "true"
+		default:
+			log.Fatalf("Invalid setting %q of a %s hook in config file %s", key, stage, path)
+		}
+	}
+	if (hook.SQL == "") == (hook.Command == "") {
+		log.Fatalf("Invalid %s hook in config file %s, expected either sql or shell", stage, path)
+	}
+	return hook
+}
+
+// configFileFlags are the flags selecting the config file and its profiles, which cannot be set in the file itself
+var configFileFlags = []string{"config", "profile", "sourceProfile"}
+
+// configValue formats a value of the config file as a flag value
+func configValue(value any) string {
+	switch value := value.(type) {
+	case []any:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = configValue(item)
+		}
+		return strings.Join(items, ",")
+	case map[string]any:
+		var pairs []string
+		for key, item := range value {
+			pairs = append(pairs, key+"="+configValue(item))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// parseList parses a comma-separated list, ignoring empty items
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// byteSizeUnits are the suffixes of byte sizes, in powers of 1024
+var byteSizeUnits = map[string]int64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+// parseByteSize parses a byte size with an optional K, M, G or T suffix, e.g. 5G, returning 0 for an empty value
+func parseByteSize(value string) int64 {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	if number == "" {
+		return 0
+	}
+	unit := number[len(number)-1:]
+	if byteSizeUnits[unit] > 0 {
+		number = number[:len(number)-1]
+	} else {
+		unit = ""
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		log.Fatalf("Invalid byte size %q, expected a number with an optional K, M, G or T suffix", value)
+	}
+	return int64(size * float64(byteSizeUnits[unit]))
+}
+
+// settingsFlag is a repeatable flag collecting key=value settings, several of which may also be given
+// comma-separated, as the environment variables and config file do
+type settingsFlag map[string]string
+
+// String returns the settings of the flag sorted by name
+func (f settingsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, value := range f {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds the key=value settings of the value to the flag
+func (f settingsFlag) Set(value string) error {
+	for _, pair := range parseList(value) {
+		name, settingValue, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("invalid setting %q, expected key=value", pair)
+		}
+		f[strings.TrimSpace(name)] = strings.TrimSpace(settingValue)
+	}
+	return nil
+}
+
+// parsePartitions parses a comma-separated list of partition IDs, each applying to every table or, prefixed with a
+// table and a colon, to that table only
+func parsePartitions(value string) map[string][]string {
+	partitions := make(map[string][]string)
+	for _, item := range parseList(value) {
+		table, partition, found := strings.Cut(item, ":")
+		if !found {
+			table, partition = "", item
+		}
+		if partition == "" {
+			log.Fatalf("Invalid partition %q", item)
+		}
+		partitions[table] = append(partitions[table], partition)
+	}
+	return partitions
+}
+
+// parseTableColumns parses a comma-separated list of table:column pairs into a map
+func parseTableColumns(value string) map[string]string {
+	columns := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		table, column, found := strings.Cut(pair, ":")
+		if !found || table == "" || column == "" {
+			log.Fatalf("Invalid table:column pair %q", pair)
+		}
+		columns[table] = column
+	}
+	return columns
+}
+
+// sourceProfileFlags maps the connection settings of a profile to the flags of the source database
+var sourceProfileFlags = map[string]string{
+	"host":     "sourceHost",
+	"port":     "sourcePort",
+	"user":     "sourceUser",
+	"password": "sourcePassword",
+	"dbname":   "sourceDBName",
+}
+
+// applySourceProfile sets the source database flags that were not given on the command line or in the environment
+// from the connection settings of a profile of the config file, so that two profiles can be compared
+func applySourceProfile(path, profile string) {
+	settings := make(map[string]any)
+	for name, value := range configProfile(readConfigFile(path), path, profile) {
+		if _, ok := sourceProfileFlags[name]; ok {
+			settings[name] = value
+		}
+	}
+	applySourceSettings(settings, "profile "+profile)
+}
+
+// applySourceSettings sets the source database flags that were not given on the command line, in the environment or
+// by the source profile from connection settings, named like the target ones
+func applySourceSettings(settings map[string]any, origin string) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range settings {
+		sourceFlag, ok := sourceProfileFlags[name]
+		if !ok {
+			log.Fatalf("Unknown setting %q in %s, expected host, port, user, password or dbname", name, origin)
+		}
+		if explicit[sourceFlag] {
+			continue
+		}
+		if err := flag.Set(sourceFlag, configValue(value)); err != nil {
+			log.Fatalf("Invalid value for setting %s of %s: %v", name, origin, err)
+		}
+	}
+}
+
+// configSection returns the settings of a section of the config file, which must be a mapping
+func configSection(value any, name, path string) map[string]any {
+	section, ok := value.(map[string]any)
+	if !ok {
+		log.Fatalf("Invalid %s section in config file %s, expected a mapping of settings", name, path)
+	}
+	return section
+}
+
+// parseTablePatterns parses a comma-separated list of table globs and /regex/ patterns
+func parseTablePatterns(value string) []chdump.TablePattern {
+	patterns, err := chdump.ParseTablePatterns(value)
+	if err != nil {
+		log.Fatalf("Invalid table pattern: %v", err)
+	}
+	return patterns
+}
+
+// parseMapping parses a comma-separated list of old=new pairs into a map
+func parseMapping(value string) map[string]string {
+	mapping := make(map[string]string)
+	for _, pair := range parseList(value) {
+		oldName, newName, found := strings.Cut(pair, "=")
+		if !found || oldName == "" || newName == "" {
+			log.Fatalf("Invalid rename %q, expected old=new", pair)
+		}
+		mapping[oldName] = newName
+	}
+	return mapping
+}
+
+// resolvePassword returns the password given with -password, read from -passwordFile, taken from the
+// CLICKHOUSE_PASSWORD environment variable or, with -askPassword, prompted for without echo, in that order
+func resolvePassword(password, passwordFile string, askPassword bool) string {
+	if password != "" {
+		return password
+	}
+	if passwordFile != "" {
+		content, err := os.ReadFile(passwordFile)
+		if err != nil {
+			log.Fatalf("Failed to read password file: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n")
+	}
+	if password, ok := os.LookupEnv("CLICKHOUSE_PASSWORD"); ok {
+		return password
+	}
+	if askPassword {
+		fmt.Fprint(os.Stderr, "ClickHouse password: ")
+		content, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		return string(content)
+	}
+	return ""
+}
+
+// encryptionConfig returns the encryption settings of the -encrypt flag: a key file, a KMS key after kms:, or GPG
+// recipients after gpg:
+func encryptionConfig(value string) chdump.EncryptionConfig {
+	if keyID, ok := strings.CutPrefix(value, "kms:"); ok {
+		return chdump.EncryptionConfig{KMSKeyID: keyID}
+	}
+	if recipients, ok := strings.CutPrefix(value, "gpg:"); ok {
+		if len(parseList(recipients)) == 0 {
+			log.Fatalf("-encrypt=gpg: requires at least one recipient")
+		}
+		return chdump.EncryptionConfig{GPGRecipients: parseList(recipients)}
+	}
+	return chdump.EncryptionConfig{KeyFile: value}
+}
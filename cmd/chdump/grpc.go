@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"clickhouse-import-export/pkg/chdumppb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// watchInterval is the interval at which WatchJob checks the progress of the job
+const watchInterval = time.Second
+
+// jobStates are the states of the jobs in the gRPC API
+var jobStates = map[string]chdumppb.JobState{
+	"running":   chdumppb.JobState_JOB_STATE_RUNNING,
+	"succeeded": chdumppb.JobState_JOB_STATE_SUCCEEDED,
+	"failed":    chdumppb.JobState_JOB_STATE_FAILED,
+	"canceled":  chdumppb.JobState_JOB_STATE_CANCELED,
+}
+
+// grpcServer serves the gRPC API starting, monitoring and canceling the jobs of the daemon
+type grpcServer struct {
+	chdumppb.UnimplementedJobServiceServer
+	jobs   *jobManager
+	token  string
+	server *grpc.Server
+}
+
+// serveGRPC serves the gRPC API of the jobs on the address in the background. It requires a token unless insecure is
+// set.
+func serveGRPC(jobs *jobManager, address, token string, insecure bool) (*grpcServer, error) {
+	if token == "" && !insecure {
+		return nil, fmt.Errorf("the gRPC API requires a token, set -apiToken or CH_API_TOKEN, or -insecure to serve it without one")
+	}
+	s := &grpcServer{jobs: jobs, token: token}
+	s.server = grpc.NewServer(grpc.UnaryInterceptor(s.authenticateUnary), grpc.StreamInterceptor(s.authenticateStream))
+	chdumppb.RegisterJobServiceServer(s.server, s)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serve the gRPC API: %w", err)
+	}
+	if token == "" {
+		log.Printf("Warning: the gRPC API on %s requires no token since -insecure is set", listener.Addr())
+	}
+	log.Printf("Serving the gRPC API on %s, jobs run in %s", listener.Addr(), jobs.jobsDir)
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			log.Printf("Warning: the gRPC API stopped: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// shutdown stops serving the gRPC API once the calls in progress are over
+func (s *grpcServer) shutdown() {
+	s.server.GracefulStop()
+}
+
+// StartJob starts a job and returns it. Like through the HTTP API, only the settings of jobSettings can be overridden.
+func (s *grpcServer) StartJob(ctx context.Context, request *chdumppb.StartJobRequest) (*chdumppb.Job, error) {
+	settings := make(map[string]any, len(request.GetSettings()))
+	for name, value := range request.GetSettings() {
+		settings[name] = value
+	}
+	j, err := s.jobs.start(jobRequest{Command: request.GetCommand(), Profile: request.GetProfile(), Settings: settings})
+	if err != nil {
+		return nil, jobStatus(err)
+	}
+	return jobMessage(j), nil
+}
+
+// GetJob returns a job with its progress
+func (s *grpcServer) GetJob(ctx context.Context, request *chdumppb.GetJobRequest) (*chdumppb.Job, error) {
+	j, err := s.jobs.get(request.GetId())
+	if err != nil {
+		return nil, jobStatus(err)
+	}
+	return jobMessage(j), nil
+}
+
+// ListJobs returns the jobs in the order they started
+func (s *grpcServer) ListJobs(ctx context.Context, request *chdumppb.ListJobsRequest) (*chdumppb.ListJobsResponse, error) {
+	response := &chdumppb.ListJobsResponse{}
+	for _, j := range s.jobs.list() {
+		response.Jobs = append(response.Jobs, jobMessage(j))
+	}
+	return response, nil
+}
+
+// CancelJob interrupts a running job
+func (s *grpcServer) CancelJob(ctx context.Context, request *chdumppb.CancelJobRequest) (*chdumppb.Job, error) {
+	j, err := s.jobs.cancel(request.GetId())
+	if err != nil {
+		return nil, jobStatus(err)
+	}
+	return jobMessage(j), nil
+}
+
+// WatchJob streams the job whenever its state or progress changes, until it is over
+func (s *grpcServer) WatchJob(request *chdumppb.WatchJobRequest, stream chdumppb.JobService_WatchJobServer) error {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	var last *chdumppb.Job
+	for {
+		j, err := s.jobs.get(request.GetId())
+		if err != nil {
+			return jobStatus(err)
+		}
+		message := jobMessage(j)
+		if !proto.Equal(message, last) {
+			if err := stream.Send(message); err != nil {
+				return err
+			}
+			last = message
+		}
+		if j.State != "running" {
+			return nil
+		}
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-j.done:
+		case <-ticker.C:
+		}
+	}
+}
+
+// authenticateUnary requires the bearer token, when one is set, on every call
+func (s *grpcServer) authenticateUnary(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+// authenticateStream requires the bearer token, when one is set, on every stream
+func (s *grpcServer) authenticateStream(server any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authenticate(stream.Context()); err != nil {
+		return err
+	}
+	return handler(server, stream)
+}
+
+// authenticate checks the bearer token of the authorization metadata of the call
+func (s *grpcServer) authenticate(ctx context.Context) error {
+	var authorization string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	if !validToken(authorization, s.token) {
+		return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+	}
+	return nil
+}
+
+// jobStatus returns the gRPC status of the error of a job operation
+func jobStatus(err error) error {
+	switch {
+	case errors.Is(err, errInvalidJob):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errJobNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errJobNotRunning):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// jobMessage converts the job to its message of the gRPC API, without the settings of the job
+func jobMessage(j job) *chdumppb.Job {
+	message := &chdumppb.Job{
+		Id:        j.ID,
+		Command:   j.Command,
+		Profile:   j.Profile,
+		Dir:       j.Dir,
+		State:     jobStates[j.State],
+		Error:     j.Error,
+		StartedAt: timestamppb.New(j.StartedAt),
+	}
+	if j.FinishedAt != nil {
+		message.FinishedAt = timestamppb.New(*j.FinishedAt)
+	}
+	if j.Progress != nil {
+		message.Progress = &chdumppb.Progress{
+			Status:          j.Progress.Status,
+			Error:           j.Progress.Error,
+			DurationSeconds: j.Progress.DurationSeconds,
+			Tables:          tableMessages(j.Progress.Tables),
+			Running:         tableMessages(j.Progress.Running),
+		}
+	}
+	return message
+}
+
+// tableMessages converts the summaries of the tables to their messages of the gRPC API
+func tableMessages(tables []tableSummary) []*chdumppb.Table {
+	messages := make([]*chdumppb.Table, 0, len(tables))
+	for _, table := range tables {
+		messages = append(messages, &chdumppb.Table{
+			Operation:       table.Operation,
+			Host:            table.Host,
+			Database:        table.Database,
+			Table:           table.Table,
+			Status:          table.Status,
+			Rows:            int64(table.Rows),
+			Bytes:           table.Bytes,
+			DurationSeconds: table.DurationSeconds,
+			Error:           table.Error,
+		})
+	}
+	return messages
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestServeGRPCWithoutToken(t *testing.T) {
+	jobs, err := newJobManager(context.Background(), "chdump.yaml", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serveGRPC(jobs, "127.0.0.1:0", "", false); err == nil {
+		t.Error("serveGRPC() without a token succeeded, want an error")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-import-export/pkg/chdump"
+)
+
+// jobCommands are the commands the APIs can start
+var jobCommands = []string{"export", "import", "copy", "migrate"}
+
+// jobSettings are the settings a job can override: the selection of what is exported or imported, and the tuning of
+// the run. The servers, credentials, files and executables a job uses come from the config file of the daemon only,
+// so that a client of the APIs can neither send the credentials to another host nor run another program.
+var jobSettings = []string{
+	"dbname", "allDatabases", "dumpDir", "timestamped", "from", "sourceDBName",
+	"tables", "excludeTables", "partitions", "since", "until", "sample",
+	"renameDB", "renameTable", "tablePrefix", "tableSuffix",
+	"format", "chunkSize", "maxFileSize", "maxRowsPerFile", "parallelTables", "parallelShards",
+	"freeze", "final", "orderByPK", "includeAccess", "resume", "failFast", "strict", "dryRun", "estimate",
+	"verifyRowCounts", "skipManifestCheck", "atomicRestore", "force", "deduplicate",
+	"allowErrors", "allowErrorsRatio", "skipBrokenRows", "maxBytesPerSec", "maxRowsPerSec",
+	"retryAttempts", "retryBackoff", "retryMaxBackoff",
+}
+
+// jobStatusFile is the status file of a job in its directory, written by the chdump process running it
+const jobStatusFile = "status.json"
+
+var (
+	errInvalidJob    = errors.New("invalid job")
+	errJobNotFound   = errors.New("no such job")
+	errJobNotRunning = errors.New("job is not running")
+)
+
+// job is a run of a command started through the APIs
+type job struct {
+	ID         string     `json:"id"`
+	Command    string     `json:"command"`
+	Profile    string     `json:"profile,omitempty"`
+	Dir        string     `json:"dir"`
+	State      string     `json:"state"` // running, succeeded, failed or canceled
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Progress is the status file of the job, with the tables that are finished and those in progress
+	Progress *runSummary `json:"progress,omitempty"`
+	// Settings are the settings the job overrides, which the API does not return since they may be sensitive
+	Settings map[string]string `json:"-"`
+
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the job is over
+}
+
+// jobRequest is a request starting a job
+type jobRequest struct {
+	Command  string         `json:"command"`
+	Profile  string         `json:"profile"`
+	Settings map[string]any `json:"settings"`
+}
+
+// jobManager runs the jobs started through the APIs of the daemon. Every job is a chdump process running with the
+// config file of the daemon in a directory of its own, like the scheduled exports. The jobs are kept in memory, so
+// only their directories remain after the daemon restarts.
+type jobManager struct {
+	ctx        context.Context
+	configFile string
+	jobsDir    string
+
+	mu   sync.Mutex
+	jobs map[string]*job
+	wg   sync.WaitGroup
+}
+
+// newJobManager returns a manager running the jobs in the jobs directory. The jobs are interrupted when the context
+// is canceled.
+func newJobManager(ctx context.Context, configFile, jobsDir string) (*jobManager, error) {
+	jobsDir, err := filepath.Abs(jobsDir)
+	if err != nil {
+		return nil, err
+	}
+	return &jobManager{ctx: ctx, configFile: configFile, jobsDir: jobsDir, jobs: make(map[string]*job)}, nil
+}
+
+// start starts the job of the request in a new directory and returns it. Only the settings of jobSettings can be
+// overridden, and they are not returned with the job.
+func (m *jobManager) start(request jobRequest) (job, error) {
+	if !slices.Contains(jobCommands, request.Command) {
+		return job{}, fmt.Errorf("%w: invalid command %q, expected one of %v", errInvalidJob, request.Command, jobCommands)
+	}
+	id, err := newJobID()
+	if err != nil {
+		return job{}, err
+	}
+	dir := filepath.Join(m.jobsDir, id)
+	// The dump is written to, or read from, the directory of the job unless the settings point to another one
+	settings := map[string]string{"dumpDir": dir}
+	for name, value := range request.Settings {
+		if !slices.Contains(jobSettings, name) {
+			return job{}, fmt.Errorf("%w: setting %q cannot be overridden by a job", errInvalidJob, name)
+		}
+		settings[name] = configValue(value)
+	}
+	if settings["dumpDir"], err = m.confine(dir, settings["dumpDir"]); err != nil {
+		return job{}, err
+	}
+	// from names a dump inside the dump directory
+	if from, ok := settings["from"]; ok && (from != filepath.Base(from) || from == "." || from == "..") {
+		return job{}, fmt.Errorf("%w: invalid dump %q", errInvalidJob, from)
+	}
+
+	j := &job{ID: id, Command: request.Command, Profile: request.Profile, Settings: settings,
+		Dir: dir, State: "running", StartedAt: time.Now().UTC(), done: make(chan struct{})}
+	if err := os.MkdirAll(j.Dir, 0755); err != nil {
+		return job{}, err
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	args := maps.Clone(settings)
+	args["statusFile"] = jobStatusFile
+	cmd, err := runCommand(ctx, j.Dir, m.configFile, j.Command, j.Profile, args)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		cancel()
+		return job{}, fmt.Errorf("failed to start the job: %w", err)
+	}
+	j.cancel = cancel
+
+	m.mu.Lock()
+	m.jobs[id] = j
+	m.mu.Unlock()
+	log.Printf("Started job %s: %s in %s", id, j.Command, j.Dir)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		err := cmd.Wait()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		finishedAt := time.Now().UTC()
+		j.FinishedAt = &finishedAt
+		switch {
+		case err == nil:
+			j.State = "succeeded"
+		case ctx.Err() != nil:
+			j.State, j.Error = "canceled", err.Error()
+		default:
+			j.State, j.Error = "failed", err.Error()
+		}
+		close(j.done)
+		log.Printf("Job %s %s", id, j.State)
+	}()
+	return m.snapshot(j), nil
+}
+
+// confine resolves the path of a job setting, relative to the directory of the job, and checks that it stays in the
+// jobs directory once cleaned and its symbolic links followed, so that a job neither writes nor reads the dumps and
+// files of the server outside of it, e.g. an import restoring the dump of an earlier export job
+func (m *jobManager) confine(dir, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	root, err := evalExistingSymlinks(m.jobsDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := evalExistingSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if relative, err := filepath.Rel(root, resolved); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s is outside of the jobs directory %s", errInvalidJob, path, m.jobsDir)
+	}
+	return path, nil
+}
+
+// evalExistingSymlinks follows the symbolic links of the longest existing part of the path, which may not exist yet
+func evalExistingSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return resolved, err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolvedParent, err := evalExistingSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedParent, filepath.Base(path)), nil
+}
+
+// get returns the job with its progress
+func (m *jobManager) get(id string) (job, error) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return job{}, fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+	return m.snapshot(j), nil
+}
+
+// list returns the jobs in the order they started, without their progress
+func (m *jobManager) list() []job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID < jobs[k].ID })
+	return jobs
+}
+
+// cancel interrupts a running job, which then stops like on Ctrl+C
+func (m *jobManager) cancel(id string) (job, error) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	running := ok && j.State == "running"
+	m.mu.Unlock()
+	if !ok {
+		return job{}, fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+	if !running {
+		return job{}, fmt.Errorf("%w: %s", errJobNotRunning, id)
+	}
+	log.Printf("Canceling job %s", id)
+	j.cancel()
+	return m.snapshot(j), nil
+}
+
+// wait waits for the running jobs, which are interrupted with the context of the manager
+func (m *jobManager) wait() {
+	m.wg.Wait()
+}
+
+// snapshot returns a copy of the job with the content of its status file, once the process has written it
+func (m *jobManager) snapshot(j *job) job {
+	m.mu.Lock()
+	snapshot := *j
+	m.mu.Unlock()
+	if content, err := os.ReadFile(filepath.Join(j.Dir, jobStatusFile)); err == nil {
+		var progress runSummary
+		if json.Unmarshal(content, &progress) == nil {
+			snapshot.Progress = &progress
+		}
+	}
+	return snapshot
+}
+
+// newJobID returns a new job ID, starting with the time so that the IDs sort in the order the jobs started
+func newJobID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format(chdump.TimestampFormat) + "-" + hex.EncodeToString(suffix), nil
+}
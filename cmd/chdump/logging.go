@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// setupLogFile writes the log to the file instead of standard error, rotating it once it grows past maxSize
+// megabytes and keeping at most maxBackups rotated files for at most maxAge days, where zero keeps them all
+func setupLogFile(path string, maxSize, maxBackups, maxAge int) {
+	log.SetOutput(&lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAge,
+		LocalTime:  true,
+	})
+}
@@ -0,0 +1,153 @@
+// Command chdump exports ClickHouse databases into schema and data files and imports them back.
+//
+// Usage:
+//
+//	chdump <command> [flags]
+//
+// The commands are export, export-query, import, copy, migrate, sync, verify, diff, schema, list, catalog and
+// daemon. Run "chdump <command> -h" for the flags.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"clickhouse-import-export/pkg/chdump"
+)
+
+// version is the version of the tool, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// commands are the subcommands with their descriptions, in the order they are listed in the usage
+var commands = []struct {
+	name        string
+	description string
+}{
+	{"export", "Export databases into schema and data files"},
+	{"export-query", "Export the results of the named queries of the config file as tables of the dump"},
+	{"import", "Import a dump into the target server"},
+	{"copy", "Export the databases of the source server and import them into the target server"},
+	{"migrate", "Copy the databases of the source server into the target server and verify them, with a single report"},
+	{"sync", "Copy the partitions of the source server that diverge from the target server, repeatedly with -syncInterval"},
+	{"verify", "Check the dump files against the manifest, and with -verifyTarget the target server against the dump"},
+	{"diff", "Compare the source server, or the dump, with the target server per partition"},
+	{"schema", "Print, or apply with -apply, the statements syncing the schema of the target server with the dump"},
+	{"list", "List the databases and tables the export selects"},
+	{"catalog", "List the timestamped dumps of the dump directory that import -from can restore"},
+	{"daemon", "Keep running and export on the cron schedules of the config file"},
+}
+
+func main() {
+	if len(os.Args) < 2 || !isCommand(os.Args[1]) {
+		printUsage()
+		os.Exit(2)
+	}
+	command := os.Args[1]
+	chdump.Version = version
+
+	if command == "daemon" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runDaemon(ctx, os.Args[2:]); err != nil {
+			log.Fatalf("Daemon failed: %v", err)
+		}
+		return
+	}
+
+	config, runMonitor := loadConfigFromFlags(command, os.Args[2:])
+	log.Println(config)
+	// Interrupting the command cancels the running queries and clickhouse-client processes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, command, config)
+	stop()
+	runMonitor.finish(err)
+	if err != nil {
+		log.Fatalf("Command %s failed: %v", command, err)
+	}
+}
+
+// run runs the command with the configuration until it finishes or the context is canceled
+func run(ctx context.Context, command string, config chdump.Options) error {
+	switch command {
+	case "catalog":
+		return printCatalog(config, os.Stdout)
+	case "export", "export-query", "list":
+		exporter, err := chdump.NewExporter(ctx, config)
+		if err != nil {
+			return err
+		}
+		defer exporter.Close()
+		switch command {
+		case "list":
+			return exporter.List(ctx, os.Stdout)
+		case "export-query":
+			return exporter.ExportQueries(ctx)
+		}
+		return exporter.Export(ctx)
+	default:
+		importer, err := chdump.NewImporter(ctx, config)
+		if err != nil {
+			return err
+		}
+		defer importer.Close()
+		switch command {
+		case "verify":
+			return importer.Verify(ctx)
+		case "diff":
+			return importer.Diff(ctx)
+		case "schema":
+			return importer.SyncSchema(ctx)
+		case "copy":
+			return importer.Copy(ctx)
+		case "migrate":
+			return importer.Migrate(ctx)
+		case "sync":
+			return importer.Sync(ctx)
+		default:
+			return importer.Import(ctx)
+		}
+	}
+}
+
+// printCatalog writes the timestamped dumps of the dump directory, with the outcome, tables, rows and size of each
+func printCatalog(config chdump.Options, w io.Writer) error {
+	dumps, err := chdump.ListDumps(config)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "DATABASE\tTIMESTAMP\tSTATUS\tTABLES\tROWS\tSIZE\n")
+	for _, dump := range dumps {
+		status := dump.Status
+		if dump.Latest {
+			status += " (latest)"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\t%s\n", dump.Database, dump.Timestamp, status, dump.Tables, dump.Rows, chdump.FormatBytes(dump.Bytes))
+	}
+	return writer.Flush()
+}
+
+// isCommand checks if the name is one of the commands
+func isCommand(name string) bool {
+	for _, command := range commands {
+		if command.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// printUsage prints the commands to standard error
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: chdump <command> [flags]\n\nCommands:\n")
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s%s\n", command.name, command.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun \"chdump <command> -h\" for the flags.\n")
+}
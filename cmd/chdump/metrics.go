@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"clickhouse-import-export/pkg/chdump"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metrics are the Prometheus metrics of the run, updated from its progress
+type metrics struct {
+	registry *prometheus.Registry
+	rows     *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+	tables   *prometheus.CounterVec
+	duration *prometheus.GaugeVec
+
+	// The metrics of the whole run, set when it ends
+	runSuccess  prometheus.Gauge
+	runDuration prometheus.Gauge
+	runTables   prometheus.Gauge
+	runBytes    prometheus.Gauge
+	runEnd      prometheus.Gauge
+
+	// pushURL is the Pushgateway the metrics are pushed to when the run ends under the job pushJob, if any
+	pushURL string
+	pushJob string
+
+	mu         sync.Mutex
+	seen       map[string]chdump.Progress // last progress of the tables in progress, to count what was added since
+	doneTables int
+	doneBytes  int64
+}
+
+// newMetrics returns the metrics registered with a registry of their own
+func newMetrics() *metrics {
+	labels := []string{"operation", "host", "database", "table"}
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		rows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chdump_rows_total",
+			Help: "Rows exported or imported.",
+		}, labels),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chdump_bytes_total",
+			Help: "Bytes of data exported or imported.",
+		}, labels),
+		tables: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chdump_tables_total",
+			Help: "Tables finished, by status: success, failed or skipped.",
+		}, []string{"operation", "host", "database", "status"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "chdump_table_duration_seconds",
+			Help: "Duration of the last run of the table.",
+		}, labels),
+		runSuccess:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "chdump_last_run_success", Help: "Whether the run succeeded (1) or failed (0)."}),
+		runDuration: prometheus.NewGauge(prometheus.GaugeOpts{Name: "chdump_last_run_duration_seconds", Help: "Duration of the run."}),
+		runTables:   prometheus.NewGauge(prometheus.GaugeOpts{Name: "chdump_last_run_tables", Help: "Tables processed by the run."}),
+		runBytes:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "chdump_last_run_bytes", Help: "Bytes of data exported or imported by the run."}),
+		runEnd:      prometheus.NewGauge(prometheus.GaugeOpts{Name: "chdump_last_run_timestamp_seconds", Help: "Time the run ended, as a Unix timestamp."}),
+		seen:        make(map[string]chdump.Progress),
+	}
+	m.registry.MustRegister(m.rows, m.bytes, m.tables, m.duration, m.runSuccess, m.runDuration, m.runTables, m.runBytes, m.runEnd)
+	return m
+}
+
+// serveMetrics serves the metrics on /metrics of the address until the process exits
+func serveMetrics(m *metrics, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	log.Printf("Serving metrics on http://%s/metrics", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// report updates the metrics with the progress reported by the export or import
+func (m *metrics) report(progress chdump.Progress) {
+	if progress.Table == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Rows and bytes are reported as totals of the table so far, of which only the increase is counted. A retried
+	// import starts over, so a decrease counts everything reported since.
+	key := progress.Operation + "/" + progress.Host + "/" + progress.DBName + "/" + progress.Table
+	last := m.seen[key]
+	if progress.Rows < last.Rows || progress.Bytes < last.Bytes {
+		last = chdump.Progress{}
+	}
+	labels := prometheus.Labels{"operation": progress.Operation, "host": progress.Host, "database": progress.DBName, "table": progress.Table}
+	m.rows.With(labels).Add(float64(progress.Rows - last.Rows))
+	m.bytes.With(labels).Add(float64(progress.Bytes - last.Bytes))
+	m.doneBytes += progress.Bytes - last.Bytes
+
+	if progress.Status == "" {
+		m.seen[key] = progress
+		return
+	}
+	delete(m.seen, key)
+	m.doneTables++
+	m.tables.With(prometheus.Labels{"operation": progress.Operation, "host": progress.Host, "database": progress.DBName, "status": progress.Status}).Inc()
+	if progress.Duration > 0 {
+		m.duration.With(labels).Set(progress.Duration.Seconds())
+	}
+}
+
+// finish sets the metrics of the run that ended after the duration with the error, and pushes them to the
+// Pushgateway, if any, grouped by the command
+func (m *metrics) finish(command string, duration time.Duration, runErr error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runSuccess.Set(0)
+	if runErr == nil {
+		m.runSuccess.Set(1)
+	}
+	m.runDuration.Set(duration.Seconds())
+	m.runTables.Set(float64(m.doneTables))
+	m.runBytes.Set(float64(m.doneBytes))
+	m.runEnd.SetToCurrentTime()
+
+	if m.pushURL == "" {
+		return nil
+	}
+	if err := push.New(m.pushURL, m.pushJob).Gatherer(m.registry).Grouping("command", command).Push(); err != nil {
+		return fmt.Errorf("failed to push metrics to %s: %w", m.pushURL, err)
+	}
+	log.Printf("Pushed metrics to %s", m.pushURL)
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"clickhouse-import-export/pkg/chdump"
+)
+
+// statusInterval is the minimum interval between two writes of the status file while tables are in progress
+const statusInterval = time.Second
+
+// monitor passes the progress of the run on to the progress display and the metrics, and collects the summary of
+// the run that is sent as a notification when it ends
+type monitor struct {
+	display   *progressDisplay
+	metrics   *metrics      // nil when the metrics are neither served nor pushed
+	statsd    *statsdClient // nil when no StatsD server is configured
+	notifyURL string
+	email     *emailSettings // nil when no email is sent
+
+	statusFile string // empty when no status file is kept
+
+	mu         sync.Mutex
+	summary    runSummary
+	running    map[string]tableSummary // tables in progress by host, database and table
+	lastStatus time.Time
+}
+
+// runSummary summarizes the outcome of a run
+type runSummary struct {
+	Command         string         `json:"command"`
+	Status          string         `json:"status"`
+	Error           string         `json:"error,omitempty"`
+	StartedAt       time.Time      `json:"started_at"`
+	FinishedAt      time.Time      `json:"finished_at"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Tables          []tableSummary `json:"tables"`
+	Running         []tableSummary `json:"running,omitempty"`
+}
+
+// tableSummary summarizes the outcome of a table
+type tableSummary struct {
+	Operation       string  `json:"operation"`
+	Host            string  `json:"host"`
+	Database        string  `json:"database"`
+	Table           string  `json:"table"`
+	Status          string  `json:"status"`
+	Rows            int     `json:"rows"`
+	Bytes           int64   `json:"bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// newMonitor returns a monitor of the command showing the progress on the display
+func newMonitor(command string, display *progressDisplay) *monitor {
+	return &monitor{
+		display: display,
+		summary: runSummary{Command: command, Status: "running", StartedAt: time.Now(), Tables: []tableSummary{}},
+		running: make(map[string]tableSummary),
+	}
+}
+
+// report passes the progress on and records the tables in progress and those that are finished
+func (m *monitor) report(progress chdump.Progress) {
+	m.display.report(progress)
+	if m.metrics != nil {
+		m.metrics.report(progress)
+	}
+	if m.statsd != nil {
+		m.statsd.report(progress)
+	}
+	if progress.Table == "" {
+		return
+	}
+
+	table := tableSummary{
+		Operation:       progress.Operation,
+		Host:            progress.Host,
+		Database:        progress.DBName,
+		Table:           progress.Table,
+		Status:          progress.Status,
+		Rows:            progress.Rows,
+		Bytes:           progress.Bytes,
+		DurationSeconds: progress.Duration.Seconds(),
+	}
+	if progress.Err != nil {
+		table.Error = progress.Err.Error()
+	}
+	key := progress.Host + "/" + progress.DBName + "/" + progress.Table
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if progress.Status == "" {
+		m.running[key] = table
+	} else {
+		delete(m.running, key)
+		m.summary.Tables = append(m.summary.Tables, table)
+	}
+	if m.statusFile != "" && (progress.Status != "" || time.Since(m.lastStatus) >= statusInterval) {
+		m.writeStatus()
+	}
+}
+
+// writeStatus replaces the status file with the summary of the run so far and the tables in progress. It is
+// replaced atomically, so that it can be read at any time while the run goes on.
+func (m *monitor) writeStatus() {
+	m.lastStatus = time.Now()
+	m.summary.Running = make([]tableSummary, 0, len(m.running))
+	for _, table := range m.running {
+		m.summary.Running = append(m.summary.Running, table)
+	}
+	sort.Slice(m.summary.Running, func(i, j int) bool {
+		a, b := m.summary.Running[i], m.summary.Running[j]
+		return a.Host+"/"+a.Database+"/"+a.Table < b.Host+"/"+b.Database+"/"+b.Table
+	})
+	content, err := json.MarshalIndent(m.summary, "", "  ")
+	m.summary.Running = nil
+	if err == nil {
+		err = os.WriteFile(m.statusFile+".tmp", content, 0644)
+	}
+	if err == nil {
+		err = os.Rename(m.statusFile+".tmp", m.statusFile)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to write the status file: %v", err)
+	}
+}
+
+// finish completes the summary with the outcome of the run, removes the progress bars, pushes the metrics and sends
+// the notifications. Failures to push or notify are logged, since the run itself is over.
+func (m *monitor) finish(runErr error) {
+	m.display.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.summary.FinishedAt = time.Now()
+	duration := m.summary.FinishedAt.Sub(m.summary.StartedAt)
+	m.summary.DurationSeconds = duration.Seconds()
+	m.summary.Status = "success"
+	if runErr != nil {
+		m.summary.Status = "failed"
+		m.summary.Error = runErr.Error()
+	}
+	if m.statusFile != "" {
+		clear(m.running)
+		m.writeStatus()
+	}
+
+	if m.metrics != nil {
+		if err := m.metrics.finish(m.summary.Command, duration, runErr); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if m.notifyURL != "" {
+		if err := notifyWebhook(m.notifyURL, m.summary); err != nil {
+			log.Printf("Warning: failed to send the notification: %v", err)
+		}
+	}
+	if m.email != nil {
+		if err := notifyEmail(*m.email, m.summary); err != nil {
+			log.Printf("Warning: failed to send the notification email: %v", err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"clickhouse-import-export/pkg/chdump"
+)
+
+// notifyClient is the HTTP client used to send notifications
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// maxNotifiedFailures is the number of failed tables listed in a Slack message
+const maxNotifiedFailures = 10
+
+// notifyWebhook posts the summary of the run to the webhook: a message to a Slack incoming webhook, or the summary
+// as JSON to any other URL
+func notifyWebhook(webhookURL string, summary runSummary) error {
+	var payload any = summary
+	if isSlackWebhook(webhookURL) {
+		payload = map[string]string{"text": summaryText(summary)}
+	}
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := notifyClient.Post(webhookURL, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("webhook responded with %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// isSlackWebhook reports whether the URL is a Slack incoming webhook
+func isSlackWebhook(webhookURL string) bool {
+	parsed, err := url.Parse(webhookURL)
+	return err == nil && parsed.Host == "hooks.slack.com"
+}
+
+// summaryText describes the summary of the run in a few lines: its outcome, the number of tables, rows and bytes,
+// and the tables that failed
+func summaryText(summary runSummary) string {
+	var rows int
+	var size int64
+	var failed []tableSummary
+	for _, table := range summary.Tables {
+		rows += table.Rows
+		size += table.Bytes
+		if table.Status == "failed" {
+			failed = append(failed, table)
+		}
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "chdump %s %s in %s: %d table(s), %d failed, %d rows, %s",
+		summary.Command, summary.Status, (time.Duration(summary.DurationSeconds * float64(time.Second))).Round(time.Second),
+		len(summary.Tables), len(failed), rows, chdump.FormatBytes(size))
+	if summary.Error != "" {
+		fmt.Fprintf(&text, "\nError: %s", summary.Error)
+	}
+	for i, table := range failed {
+		if i == maxNotifiedFailures {
+			fmt.Fprintf(&text, "\n… and %d more", len(failed)-maxNotifiedFailures)
+			break
+		}
+		fmt.Fprintf(&text, "\n• %s.%s: %s", table.Database, table.Table, table.Error)
+	}
+	return text.String()
+}
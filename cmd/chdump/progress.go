@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"clickhouse-import-export/pkg/chdump"
+	"golang.org/x/term"
+)
+
+// progressRedrawInterval is the minimum interval between two redraws of the progress bars
+const progressRedrawInterval = 100 * time.Millisecond
+
+// progressDisplay shows the progress of the tables and of the whole run as progress bars on the terminal, or logs
+// it periodically when standard error is not a terminal
+type progressDisplay struct {
+	mu       sync.Mutex
+	out      *os.File
+	log      io.Writer // output of the log before the bars were drawn
+	bars     bool
+	interval time.Duration
+	showHost bool
+	started  time.Time
+
+	tables      map[string]*tableProgress
+	active      []string // keys of the tables in progress, in the order they started
+	totalTables int
+	doneTables  int
+	doneRows    int
+	doneBytes   int64
+
+	drawn    int // number of lines of the progress bars on the terminal
+	lastDraw time.Time
+}
+
+// tableProgress is the progress of a table in progress
+type tableProgress struct {
+	label    string
+	started  time.Time
+	lastLog  time.Time
+	progress chdump.Progress
+}
+
+// newProgressDisplay returns a progress display drawing progress bars when they are enabled and standard error is
+// a terminal, and logging the progress every interval otherwise. The host is shown with the tables of a cluster.
+// While the bars are drawn, the log is written above them.
+func newProgressDisplay(bars bool, interval time.Duration, showHost bool) *progressDisplay {
+	display := &progressDisplay{
+		out:      os.Stderr,
+		bars:     bars && term.IsTerminal(int(os.Stderr.Fd())),
+		interval: interval,
+		showHost: showHost,
+		started:  time.Now(),
+		tables:   make(map[string]*tableProgress),
+		log:      log.Writer(),
+	}
+	// The log is only written above the bars when it goes to the terminal rather than to a log file
+	if display.bars && display.log == os.Stderr {
+		log.SetOutput(display)
+	}
+	return display
+}
+
+// Write writes a log line above the progress bars
+func (d *progressDisplay) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clear()
+	n, err := d.out.Write(p)
+	d.draw()
+	return n, err
+}
+
+// Close removes the progress bars and writes the log to standard error again
+func (d *progressDisplay) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.bars {
+		d.clear()
+		log.SetOutput(d.log)
+	}
+}
+
+// report records the progress reported by the export or import and shows it
+func (d *progressDisplay) report(progress chdump.Progress) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := progress.Host + "/" + progress.DBName + "/" + progress.Table
+	switch {
+	case progress.Table == "":
+		d.totalTables += progress.Tables
+		return
+	case progress.Status != "":
+		if index := slices.Index(d.active, key); index >= 0 {
+			d.active = append(d.active[:index], d.active[index+1:]...)
+		}
+		delete(d.tables, key)
+		d.doneTables++
+		d.doneRows += progress.Rows
+		d.doneBytes += progress.Bytes
+		if !d.bars {
+			log.Printf("Overall progress: %s", d.overall())
+		}
+	default:
+		table, ok := d.tables[key]
+		if !ok {
+			table = &tableProgress{label: d.label(progress), started: time.Now()}
+			d.tables[key] = table
+			d.active = append(d.active, key)
+		}
+		table.progress = progress
+		if !d.bars && time.Since(table.lastLog) >= d.interval {
+			table.lastLog = time.Now()
+			log.Printf("Progress of the %s of table %s: %s", progress.Operation, table.label, table.describe())
+		}
+	}
+
+	if d.bars {
+		// Remove the bars once every table is done, so that the summary printed next is not drawn over
+		if len(d.active) == 0 && d.doneTables >= d.totalTables {
+			d.clear()
+			return
+		}
+		if time.Since(d.lastDraw) >= progressRedrawInterval || progress.Status != "" {
+			d.clear()
+			d.draw()
+		}
+	}
+}
+
+// label returns the name of the table shown with its progress
+func (d *progressDisplay) label(progress chdump.Progress) string {
+	label := progress.Table
+	if progress.DBName != "" {
+		label = progress.DBName + "." + label
+	}
+	if d.showHost {
+		label = progress.Host + ":" + label
+	}
+	return label
+}
+
+// clear removes the progress bars from the terminal
+func (d *progressDisplay) clear() {
+	if d.drawn > 0 {
+		fmt.Fprintf(d.out, "\033[%dA\033[J", d.drawn)
+		d.drawn = 0
+	}
+}
+
+// draw draws a progress bar for each table in progress and one for the whole run
+func (d *progressDisplay) draw() {
+	if !d.bars || len(d.active) == 0 {
+		return
+	}
+	width, _, err := term.GetSize(int(d.out.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	var lines []string
+	for _, key := range d.active {
+		table := d.tables[key]
+		lines = append(lines, fmt.Sprintf("%-30s %s %s", truncate(table.label, 30), progressBar(table.fraction()), table.describe()))
+	}
+	lines = append(lines, fmt.Sprintf("%-30s %s %s", "Overall", progressBar(d.fraction()), d.overall()))
+	for _, line := range lines {
+		// A line wrapped by the terminal would take two lines, which clear does not account for
+		fmt.Fprintln(d.out, truncate(line, width-1))
+	}
+	d.drawn = len(lines)
+	d.lastDraw = time.Now()
+}
+
+// fraction returns the fraction of the tables of the run that is done, counting the progress of the tables in
+// progress
+func (d *progressDisplay) fraction() float64 {
+	if d.totalTables == 0 {
+		return 0
+	}
+	done := float64(d.doneTables)
+	for _, table := range d.tables {
+		done += table.fraction()
+	}
+	return min(done/float64(d.totalTables), 1)
+}
+
+// overall describes the progress of the whole run
+func (d *progressDisplay) overall() string {
+	rows, bytes := d.doneRows, d.doneBytes
+	for _, table := range d.tables {
+		rows += table.progress.Rows
+		bytes += table.progress.Bytes
+	}
+	// Verifying and comparing report the tables as they finish, without announcing how many there are
+	tables := fmt.Sprintf("%d tables", d.doneTables)
+	if d.totalTables >= d.doneTables {
+		tables = fmt.Sprintf("%d/%d tables", d.doneTables, d.totalTables)
+	}
+	elapsed := time.Since(d.started)
+	return fmt.Sprintf("%s, %d rows, %s, %s elapsed, ETA %s", tables, rows, chdump.FormatBytes(bytes),
+		elapsed.Round(time.Second), eta(elapsed, d.fraction()))
+}
+
+// fraction returns the fraction of the table that is done, by rows when the total number of rows is known and by
+// bytes otherwise
+func (t *tableProgress) fraction() float64 {
+	switch {
+	case t.progress.TotalRows > 0:
+		return min(float64(t.progress.Rows)/float64(t.progress.TotalRows), 1)
+	case t.progress.TotalBytes > 0:
+		return min(float64(t.progress.Bytes)/float64(t.progress.TotalBytes), 1)
+	}
+	return 0
+}
+
+// describe describes the progress of the table with its rows, bytes, rate and estimated time left
+func (t *tableProgress) describe() string {
+	elapsed := time.Since(t.started)
+	rate := float64(t.progress.Rows) / max(elapsed.Seconds(), 0.001)
+	rows := fmt.Sprintf("%d rows", t.progress.Rows)
+	if t.progress.TotalRows > 0 {
+		rows = fmt.Sprintf("%d/%d rows", t.progress.Rows, t.progress.TotalRows)
+	}
+	return fmt.Sprintf("%5.1f%% %s, %s, %.0f rows/s, ETA %s", t.fraction()*100, rows,
+		chdump.FormatBytes(t.progress.Bytes), rate, eta(elapsed, t.fraction()))
+}
+
+// eta estimates the time left from the elapsed time and the fraction done
+func eta(elapsed time.Duration, fraction float64) string {
+	if fraction <= 0 {
+		return "?"
+	}
+	return time.Duration(float64(elapsed) * (1 - fraction) / fraction).Round(time.Second).String()
+}
+
+// progressBarWidth is the number of cells of a progress bar
+const progressBarWidth = 20
+
+// progressBar draws a progress bar filled to the fraction
+func progressBar(fraction float64) string {
+	filled := int(fraction * progressBarWidth)
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled) + "]"
+}
+
+// truncate shortens the text to the width
+func truncate(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) <= width {
+		return text
+	}
+	return string(runes[:max(width, 0)])
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"clickhouse-import-export/pkg/chdump"
+)
+
+// statsdClient emits the timing and throughput of every finished table to a StatsD server over UDP. With DogStatsD
+// the operation, host, database, table and status are tags; plain StatsD has no tags, so the operation, database
+// and table are part of the metric names instead.
+type statsdClient struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	prefix string
+	dog    bool
+}
+
+// newStatsdClient returns a client sending to the StatsD server at the address, with the prefix added to the metric
+// names, in the DogStatsD format when dog is set
+func newStatsdClient(address, prefix string, dog bool) (*statsdClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD at %s: %w", address, err)
+	}
+	return &statsdClient{conn: conn, prefix: prefix, dog: dog}, nil
+}
+
+// report emits the metrics of a finished table
+func (c *statsdClient) report(progress chdump.Progress) {
+	if progress.Table == "" || progress.Status == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := c.prefix
+	var tags string
+	if c.dog {
+		tags = fmt.Sprintf("|#operation:%s,host:%s,database:%s,table:%s,status:%s", progress.Operation,
+			statsdTag(progress.Host), statsdTag(progress.DBName), statsdTag(progress.Table), progress.Status)
+	} else {
+		name += statsdName(progress.Operation) + "." + statsdName(progress.DBName) + "." + statsdName(progress.Table) + "."
+	}
+
+	c.send(name+"tables", "1|c", tags)
+	if !c.dog {
+		c.send(name+"tables_"+progress.Status, "1|c", tags)
+	}
+	if progress.Duration <= 0 {
+		return
+	}
+	c.send(name+"duration", fmt.Sprintf("%d|ms", progress.Duration.Milliseconds()), tags)
+	c.send(name+"rows", fmt.Sprintf("%d|c", progress.Rows), tags)
+	c.send(name+"bytes", fmt.Sprintf("%d|c", progress.Bytes), tags)
+	c.send(name+"rows_per_second", fmt.Sprintf("%.0f|g", float64(progress.Rows)/progress.Duration.Seconds()), tags)
+	c.send(name+"bytes_per_second", fmt.Sprintf("%.0f|g", float64(progress.Bytes)/progress.Duration.Seconds()), tags)
+}
+
+// send sends a metric, logging failures instead of failing the run since metrics are sent on a best-effort basis
+func (c *statsdClient) send(name, value, tags string) {
+	if _, err := fmt.Fprintf(c.conn, "%s:%s%s", name, value, tags); err != nil {
+		log.Printf("Warning: failed to send metric %s to StatsD: %v", name, err)
+	}
+}
+
+// statsdName replaces the characters with a meaning in StatsD metric names by underscores
+func statsdName(part string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(".:|@# ", r) {
+			return '_'
+		}
+		return r
+	}, part)
+}
+
+// statsdTag replaces the characters with a meaning in DogStatsD tags by underscores
+func statsdTag(value string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(",|#", r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
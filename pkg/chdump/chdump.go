@@ -0,0 +1,347 @@
+// Package chdump exports ClickHouse databases into schema and data files and imports them back. It is the library
+// behind the chdump command, so that other programs can embed the export and restore instead of running it.
+//
+// An Exporter writes the dump of the databases selected by its Options, and an Importer restores, verifies or
+// compares a dump:
+//
+//	exporter, err := chdump.NewExporter(ctx, chdump.Options{Host: "localhost", Port: "9000", Databases: []string{"sales"}})
+//	if err != nil {
+//		return err
+//	}
+//	defer exporter.Close()
+//	err = exporter.Export(ctx)
+package chdump
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+// Version is the version of the tool recorded in the manifests of the dumps
+var Version = "dev"
+
+// Progress describes the progress of a database or table on a host. It is reported when the data of a database
+// starts, with Table empty and the number of Tables whose data it processes, as the data of a table is exported,
+// with Rows of TotalRows, or imported, with Bytes of TotalBytes, and when a table is finished, with its Status,
+// Duration and the error it failed with.
+type Progress struct {
+	Operation  string
+	Host       string
+	DBName     string
+	Table      string
+	Tables     int
+	Rows       int
+	TotalRows  int
+	Bytes      int64
+	TotalBytes int64
+	Status     string
+	Duration   time.Duration
+	Err        error
+}
+
+// reportProgress passes the progress to the callback of the options, if any. Progress callbacks may be called
+// concurrently when the shards of a cluster are exported.
+func reportProgress(config Options, progress Progress) {
+	if config.OnProgress != nil {
+		progress.Host = config.Host
+		progress.DBName = cmp.Or(progress.DBName, config.DBName)
+		config.OnProgress(progress)
+	}
+}
+
+// Exporter exports databases into schema and data files
+type Exporter struct {
+	options Options
+}
+
+// NewExporter returns an exporter with the options, preparing their TLS settings, SSH tunnel and credentials, which
+// are fetched within the context. Close releases them.
+func NewExporter(ctx context.Context, options Options) (*Exporter, error) {
+	if err := prepare(ctx, &options); err != nil {
+		return nil, err
+	}
+	return &Exporter{options: options}, nil
+}
+
+// Export exports the databases, or every shard of the cluster when one is given, between the export hooks. With
+// Watch, it keeps exporting the data that arrived since the previous cycle until the context is canceled.
+func (e *Exporter) Export(ctx context.Context) error {
+	if e.options.Watch {
+		return watchExport(ctx, e.options, runExport)
+	}
+	return runExport(ctx, e.options)
+}
+
+// runExport runs an export of the options between the export hooks
+func runExport(ctx context.Context, options Options) error {
+	return withHooks(ctx, options, "export", options.Hooks.PreExport, options.Hooks.PostExport, func() error {
+		if options.Cluster != "" {
+			if err := exportCluster(ctx, options); err != nil {
+				return fmt.Errorf("error exporting cluster %s: %w", options.Cluster, err)
+			}
+			return nil
+		}
+		return exportServer(ctx, options, false)
+	})
+}
+
+// ExportQueries dumps the results of the named queries of the options into the dump of the database, between the
+// export hooks
+func (e *Exporter) ExportQueries(ctx context.Context) error {
+	return withHooks(ctx, e.options, "export", e.options.Hooks.PreExport, e.options.Hooks.PostExport, func() error {
+		return exportQueries(ctx, e.options)
+	})
+}
+
+// List writes the databases and tables the export selects, with their engines
+func (e *Exporter) List(ctx context.Context, w io.Writer) error {
+	return listTables(ctx, e.options, w)
+}
+
+// Close releases the TLS settings and SSH tunnel of the exporter
+func (e *Exporter) Close() error {
+	return release(e.options)
+}
+
+// Importer imports, verifies and compares dumps
+type Importer struct {
+	options Options
+}
+
+// NewImporter returns an importer with the options, preparing their TLS settings, SSH tunnel and credentials, which
+// are fetched within the context. Close releases them.
+func NewImporter(ctx context.Context, options Options) (*Importer, error) {
+	if err := prepare(ctx, &options); err != nil {
+		return nil, err
+	}
+	return &Importer{options: options}, nil
+}
+
+// Import imports the dump into the target server between the import hooks, or prints what it would do with DryRun
+func (i *Importer) Import(ctx context.Context) error {
+	if i.options.DryRun {
+		return importServer(ctx, "import", i.options, false)
+	}
+	return withHooks(ctx, i.options, "import", i.options.Hooks.PreImport, i.options.Hooks.PostImport, func() error {
+		return importServer(ctx, "import", i.options, false)
+	})
+}
+
+// Verify checks the dump files against the manifest, and with VerifyTarget the target server against the dump
+func (i *Importer) Verify(ctx context.Context) error {
+	return importServer(ctx, "verify", i.options, false)
+}
+
+// Diff compares the source server, or the dump when no source host is given, with the target server
+func (i *Importer) Diff(ctx context.Context) error {
+	return importServer(ctx, "diff", i.options, false)
+}
+
+// SyncSchema prints, or applies with Apply, the statements bringing the schema of the target server in line with the
+// dump, without dropping the existing tables
+func (i *Importer) SyncSchema(ctx context.Context) error {
+	return importServer(ctx, "schema", i.options, false)
+}
+
+// Copy exports the databases of the source server into the per-database layout of the dump directory and
+// imports them into the target server, the export hooks running on the source and the import hooks on the target
+func (i *Importer) Copy(ctx context.Context) error {
+	if i.options.SourceHost == "" {
+		return fmt.Errorf("copying requires a source host")
+	}
+	source := sourceConfig(i.options)
+	err := withHooks(ctx, source, "export", i.options.Hooks.PreExport, i.options.Hooks.PostExport, func() error {
+		return exportServer(ctx, source, true)
+	})
+	if err != nil {
+		return fmt.Errorf("export from %s failed: %w", i.options.SourceHost, err)
+	}
+	return withHooks(ctx, i.options, "import", i.options.Hooks.PreImport, i.options.Hooks.PostImport, func() error {
+		return importServer(ctx, "import", i.options, true)
+	})
+}
+
+// Migrate copies the databases of the source server into the target server like Copy, then verifies the imported
+// databases against the dump, and writes a single report of the steps into the dump directory
+func (i *Importer) Migrate(ctx context.Context) error {
+	if i.options.SourceHost == "" {
+		return fmt.Errorf("migrating requires a source host")
+	}
+	return migrate(ctx, i.options)
+}
+
+// Sync copies the partitions of the tables of the source server that diverge from those of the target server, once
+// or, with SyncInterval, repeatedly until the context is canceled
+func (i *Importer) Sync(ctx context.Context) error {
+	if i.options.SourceHost == "" {
+		return fmt.Errorf("syncing requires a source host")
+	}
+	return syncServer(ctx, i.options)
+}
+
+// Close releases the TLS settings and SSH tunnel of the importer
+func (i *Importer) Close() error {
+	return release(i.options)
+}
+
+// DefaultSkipDataEngines are the engines whose tables are exported and restored without data when the options
+// leave SkipDataEngines nil
+var DefaultSkipDataEngines = []string{"Kafka", "RabbitMQ", "NATS", "Null", "Distributed", "Dictionary", "Merge", "URL", "Buffer", "Memory"}
+
+// setDefaults fills the settings the options leave unset with the defaults of the chdump command
+func setDefaults(options *Options) {
+	options.HostStrategy = cmp.Or(options.HostStrategy, "roundRobin")
+	options.ReadTimeout = cmp.Or(options.ReadTimeout, 30)
+	options.WriteTimeout = cmp.Or(options.WriteTimeout, 30)
+	options.ChunkSize = cmp.Or(options.ChunkSize, 10000)
+	options.ClickHouseClientPath = cmp.Or(options.ClickHouseClientPath, "clickhouse")
+	options.WatermarkFile = cmp.Or(options.WatermarkFile, "./data/watermarks.json")
+	options.StateFile = cmp.Or(options.StateFile, "state.json")
+	options.ReportFile = cmp.Or(options.ReportFile, "report.json")
+	options.ManifestFile = cmp.Or(options.ManifestFile, "manifest.json")
+	options.RejectedDir = cmp.Or(options.RejectedDir, "rejected")
+	options.EstimateThroughput = cmp.Or(options.EstimateThroughput, 50)
+	options.DumpDir = cmp.Or(options.DumpDir, "dump")
+	options.ReplicatedPaths = cmp.Or(options.ReplicatedPaths, "keep")
+	options.TableUUIDs = cmp.Or(options.TableUUIDs, "keep")
+	options.DiskSpaceCheck = cmp.Or(options.DiskSpaceCheck, "fail")
+	options.ReplicaPathTemplate = cmp.Or(options.ReplicaPathTemplate, "/clickhouse/tables/{uuid}/{shard}")
+	options.ReplicaNameTemplate = cmp.Or(options.ReplicaNameTemplate, "{replica}")
+	options.Retry.MaxAttempts = cmp.Or(options.Retry.MaxAttempts, 3)
+	options.Retry.InitialBackoff = cmp.Or(options.Retry.InitialBackoff, time.Second)
+	options.Retry.MaxBackoff = cmp.Or(options.Retry.MaxBackoff, 30*time.Second)
+	options.Format = cmp.Or(options.Format, TSV)
+	options.GPG.Path = cmp.Or(options.GPG.Path, "gpg")
+	if options.SkipDataEngines == nil {
+		options.SkipDataEngines = DefaultSkipDataEngines
+	}
+}
+
+// prepare validates the options, sets up TLS and the SSH tunnel, and fetches the credentials from the secret store
+func prepare(ctx context.Context, options *Options) error {
+	setDefaults(options)
+	if !slices.Contains([]string{"roundRobin", "failover"}, options.HostStrategy) {
+		return fmt.Errorf("invalid host strategy %q, expected roundRobin or failover", options.HostStrategy)
+	}
+	if !slices.Contains([]string{"fail", "warn", "off"}, options.DiskSpaceCheck) {
+		return fmt.Errorf("invalid disk space check %q, expected fail, warn or off", options.DiskSpaceCheck)
+	}
+	if !slices.Contains([]string{"keep", "macros", "strip"}, options.ReplicatedPaths) {
+		return fmt.Errorf("invalid replicated paths mode %q, expected keep, macros or strip", options.ReplicatedPaths)
+	}
+	if !slices.Contains([]string{"keep", "strip", "regenerate"}, options.TableUUIDs) {
+		return fmt.Errorf("invalid table UUIDs mode %q, expected keep, strip or regenerate", options.TableUUIDs)
+	}
+	if options.From != "" {
+		if options.From != LatestLink && !dumpPrefixPattern.MatchString(options.From) {
+			return fmt.Errorf("invalid dump %q, expected latest or a timestamp such as 20240501T020000Z or a prefix of it", options.From)
+		}
+		options.Timestamped = true
+	}
+	if err := validateMasks(options.ColumnMasks); err != nil {
+		return err
+	}
+	for table := range options.TableSelects {
+		if _, ok := options.ColumnMasks[table]; ok {
+			// The masks replace columns of *, which a SELECT expression list does not select
+			return fmt.Errorf("table %s has both masking rules and a SELECT expression list, mask the columns in the expressions instead", table)
+		}
+	}
+	for table := range options.TenantColumns {
+		if _, ok := options.IncrementalColumns[table]; ok {
+			return fmt.Errorf("table %s cannot be both exported incrementally and split by tenant", table)
+		}
+	}
+	if options.Watch && options.WatchInterval <= 0 {
+		return fmt.Errorf("invalid watch interval %s, expected a positive duration", options.WatchInterval)
+	}
+	for _, bound := range []string{options.Since, options.Until} {
+		if _, err := dateBound(bound); bound != "" && err != nil {
+			return fmt.Errorf("invalid date range: %w", err)
+		}
+	}
+	if options.ShardCluster != "" && options.AtomicRestore {
+		// The staging tables are local to the node the import connects to
+		return errors.New("a shard-aware import cannot be an atomic restore")
+	}
+	if len(options.Partitions) > 0 && options.AtomicRestore {
+		// An atomic restore replaces whole tables
+		return errors.New("partitions cannot be selected for an atomic restore")
+	}
+	if options.Sample < 0 || options.Sample > 1 {
+		return fmt.Errorf("invalid sample fraction %v, expected a value between 0 and 1", options.Sample)
+	}
+	if options.AllowErrors < 0 {
+		return fmt.Errorf("invalid number of allowed errors %d", options.AllowErrors)
+	}
+	if options.AllowErrorsRatio < 0 || options.AllowErrorsRatio > 1 {
+		return fmt.Errorf("invalid allowed error ratio %v, expected a value between 0 and 1", options.AllowErrorsRatio)
+	}
+	if err := validateSettings("insert", options.InsertSettings); err != nil {
+		return err
+	}
+	if err := validateSettings("select", options.SelectSettings); err != nil {
+		return err
+	}
+	if options.RateLimit.MaxBytesPerSec < 0 || options.RateLimit.MaxRowsPerSec < 0 {
+		return errors.New("invalid rate limit, expected a positive value")
+	}
+	if len(options.ColumnMaps) > 0 && options.AtomicRestore {
+		// The staging tables are created with the schema of the dump, not that of the target tables
+		return errors.New("column maps cannot be used with an atomic restore")
+	}
+	if options.MaxFileSize < 0 || options.MaxRowsPerFile < 0 {
+		return errors.New("invalid data file limit, expected a positive value")
+	}
+	if options.MaxRowsPerFile > 0 && options.ChunkSize > options.MaxRowsPerFile {
+		// The parts are closed between batches
+		log.Printf("Reducing the chunk size from %d to the maximum rows per file %d", options.ChunkSize, options.MaxRowsPerFile)
+		options.ChunkSize = options.MaxRowsPerFile
+	}
+	if options.RateLimit.Enabled() && options.RateLimit.limiter == nil {
+		options.RateLimit.limiter = newRateLimiter(options.RateLimit)
+	}
+	if options.SkipBrokenRows {
+		// Every broken row is skipped
+		options.AllowErrorsRatio = 1
+	}
+	if len(options.GPG.TrustedSigners) > 0 && options.SkipManifestCheck {
+		return errors.New("trusted signers of the manifest require the manifest check")
+	}
+	if options.Encryption.Enabled() && options.Encryption.cipher == nil {
+		cipher, err := newFileCipher(*options)
+		if err != nil {
+			return fmt.Errorf("failed to set up encryption: %w", err)
+		}
+		options.Encryption.cipher = cipher
+		options.Format = encryptedFormat{Format: options.Format, cipher: cipher}
+	}
+	if err := setupTLS(&options.TLS); err != nil {
+		return fmt.Errorf("failed to set up TLS: %w", err)
+	}
+	if err := routeThroughTunnel(options); err != nil {
+		return fmt.Errorf("failed to set up SSH tunnel: %w", err)
+	}
+	if err := refreshCredentials(ctx, options); err != nil {
+		return fmt.Errorf("failed to fetch credentials: %w", err)
+	}
+	return nil
+}
+
+// release removes the clickhouse-client config file of the TLS settings and closes the SSH tunnel
+func release(options Options) error {
+	if options.TLS.ClientConfigFile != "" {
+		os.Remove(options.TLS.ClientConfigFile)
+	}
+	if options.SSH.tunnel != nil {
+		return options.SSH.tunnel.Close()
+	}
+	return nil
+}
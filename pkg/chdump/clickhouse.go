@@ -0,0 +1,146 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// getTableChecksum returns an order-independent checksum of the table rows matching the optional WHERE clause, with
+// the columns selected as the export does
+func getTableChecksum(ctx context.Context, db *sql.DB, from, columns, whereClause string) (string, error) {
+	var checksum string
+	query := fmt.Sprintf("SELECT toString(sum(cityHash64(*))) FROM %s%s", from, formatWhere(whereClause))
+	if columns != "*" {
+		query = fmt.Sprintf("SELECT toString(sum(cityHash64(*))) FROM (SELECT %s FROM %s%s)", columns, from, formatWhere(whereClause))
+	}
+	if err := db.QueryRowContext(ctx, query).Scan(&checksum); err != nil {
+		return "", err
+	}
+	return checksum, nil
+}
+
+// getTables fetches the list of tables in the specified database
+func getTables(ctx context.Context, db *sql.DB, dbName string) ([]string, error) {
+	query := fmt.Sprintf("SHOW TABLES FROM %s", quoteIdentifier(dbName))
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// materializedViewTargetPattern matches the TO clause of a CREATE MATERIALIZED VIEW statement, capturing the
+// target table
+var materializedViewTargetPattern = regexp.MustCompile("(?i)\\bTO\\s+((?:`[^`]+`|\\w+)(?:\\.(?:`[^`]+`|\\w+))?)")
+
+// materializedViewQueryPattern matches the start of the SELECT query of a CREATE MATERIALIZED VIEW statement
+var materializedViewQueryPattern = regexp.MustCompile(`(?i)\bAS\s+(SELECT|WITH|\()`)
+
+// skipsData checks if tables with the specified engine are exported and restored without data, because they are
+// views, stream from or to external systems or read the data of other tables
+func skipsData(config Options, engine string) bool {
+	return engine == "View" || slices.Contains(config.SkipDataEngines, engine)
+}
+
+// distributedEnginePattern matches the beginning of a Distributed engine clause
+var distributedEnginePattern = regexp.MustCompile(`(?i)\bENGINE\s*=\s*Distributed\(`)
+
+// distributedLocalTable returns the database and table a CREATE statement of a Distributed table reads from, with
+// an empty database when it is the current database
+func distributedLocalTable(createStmt string) (string, string) {
+	location := distributedEnginePattern.FindStringIndex(createStmt)
+	if location == nil {
+		return "", ""
+	}
+	args, _ := splitArguments(createStmt, location[1])
+	if len(args) < 3 {
+		return "", ""
+	}
+	dbName := strings.Trim(strings.TrimSpace(args[1]), "'`\"")
+	if strings.EqualFold(dbName, "currentDatabase()") {
+		dbName = ""
+	}
+	return dbName, strings.Trim(strings.TrimSpace(args[2]), "'`\"")
+}
+
+// distributedShardingKey returns the sharding key of a CREATE statement of a Distributed table, or an empty string
+// for a Distributed table without one, which has a single shard
+func distributedShardingKey(createStmt string) string {
+	location := distributedEnginePattern.FindStringIndex(createStmt)
+	if location == nil {
+		return ""
+	}
+	args, _ := splitArguments(createStmt, location[1])
+	if len(args) < 4 {
+		return ""
+	}
+	return strings.TrimSpace(args[3])
+}
+
+// splitArguments splits the arguments of a function call starting right after its opening parenthesis at the
+// top-level commas and returns them together with the position right after the closing parenthesis
+func splitArguments(statement string, start int) ([]string, int) {
+	var args []string
+	depth, quote, argStart := 0, byte(0), start
+	for i := start; i < len(statement); i++ {
+		c := statement[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == ')':
+			return append(args, statement[argStart:i]), i + 1
+		case c == ',' && depth == 0:
+			args = append(args, statement[argStart:i])
+			argStart = i + 1
+		}
+	}
+	return nil, len(statement)
+}
+
+// isInnerTable checks if the table is the implicit storage of a materialized view without a TO table
+func isInnerTable(table string) bool {
+	return strings.HasPrefix(table, ".inner.") || strings.HasPrefix(table, ".inner_id.")
+}
+
+// dictionarySchemaDir is the subdirectory of the schema directory holding dictionary definitions
+const dictionarySchemaDir = "dictionaries"
+
+// quoteIdentifier quotes a database, table, column or cluster name with backticks, escaping backslashes and backticks, so
+// that names with reserved words, dots or other special characters can be used in queries
+func quoteIdentifier(name string) string {
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(name) + "`"
+}
+
+// qualifiedName returns the quoted name of a table qualified with its database
+func qualifiedName(dbName, table string) string {
+	return quoteIdentifier(dbName) + "." + quoteIdentifier(table)
+}
+
+// quoteString quotes a value as a string literal, escaping backslashes and single quotes
+func quoteString(value string) string {
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(value) + "'"
+}
@@ -0,0 +1,143 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// namedCollectionsVersion is the first version of ClickHouse creating named collections with SQL statements
+const namedCollectionsVersion = "23.2"
+
+// hiddenSecret is the value system.named_collections shows for a value the user may not see
+const hiddenSecret = "[HIDDEN]"
+
+// exportNamedCollections dumps the named collections created with SQL statements, which dictionaries, table engines
+// and table functions may reference, as CREATE NAMED COLLECTION statements, one file per collection. Collections
+// whose values are hidden from the user are skipped with a warning, as they cannot be recreated.
+func exportNamedCollections(ctx context.Context, db *sql.DB, config Options, dir string) error {
+	if !versionAtLeast(config.serverVersion, namedCollectionsVersion) {
+		return nil
+	}
+	collections := make(map[string]string)
+	err := withRetry(ctx, config.Retry, "fetching named collections", func() error {
+		rows, err := db.QueryContext(ctx, "SELECT name, mapKeys(collection), mapValues(collection) FROM system.named_collections "+
+			"WHERE source = 'SQL' ORDER BY name SETTINGS format_display_secrets_in_show_and_select = 1")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		clear(collections)
+		for rows.Next() {
+			var name string
+			var keys, values []string
+			if err := rows.Scan(&name, &keys, &values); err != nil {
+				return err
+			}
+			statement, hidden := createNamedCollection(name, keys, values)
+			if hidden {
+				log.Printf("Warning: skipping named collection %s: its values are hidden, grant show_named_collections_secrets "+
+					"and enable display_secrets_in_show_and_select on the server to export it", name)
+				continue
+			}
+			collections[name] = statement
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+	if len(collections) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create named collections directory: %w", err)
+	}
+	for name, statement := range collections {
+		if err := writeDumpFile(config, filepath.Join(dir, name+".sql"), []byte(statement)); err != nil {
+			return err
+		}
+	}
+	log.Printf("Exported %d named collection(s) to %s", len(collections), dir)
+	return nil
+}
+
+// createNamedCollection returns the CREATE NAMED COLLECTION statement of a collection with its keys and values, and
+// whether one of the values is hidden
+func createNamedCollection(name string, keys, values []string) (string, bool) {
+	pairs := make([]string, len(keys))
+	hidden := false
+	for i, key := range keys {
+		hidden = hidden || values[i] == hiddenSecret
+		pairs[i] = quoteIdentifier(key) + " = " + quoteString(values[i])
+	}
+	return fmt.Sprintf("CREATE NAMED COLLECTION %s AS %s", quoteIdentifier(name), strings.Join(pairs, ", ")), hidden
+}
+
+// createNamedCollectionPattern matches the beginning of a CREATE NAMED COLLECTION statement
+var createNamedCollectionPattern = regexp.MustCompile(`(?i)^\s*CREATE\s+NAMED\s+COLLECTION\s+(?:IF\s+NOT\s+EXISTS\s+)?`)
+
+// importNamedCollections creates the dumped named collections. Collections that already exist are left unchanged.
+func importNamedCollections(ctx context.Context, config Options, dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read named collections directory: %w", err)
+	}
+
+	db, err := createDBConnection(ctx, config, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".sql" {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		content, err := readDumpFile(config, path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		statement := createNamedCollectionPattern.ReplaceAllString(string(content), "CREATE NAMED COLLECTION IF NOT EXISTS ")
+		statement = addClusterToCollection(config.OnCluster, statement)
+		if config.DryRun {
+			fmt.Printf("-- Would run %s:\n%s;\n", path, strings.TrimSpace(statement))
+			continue
+		}
+		err = withRetry(ctx, config.Retry, "creating named collection "+file.Name(), func() error {
+			_, err := db.ExecContext(ctx, statement)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create named collection from %s: %w", path, err)
+		}
+		log.Printf("Named collection imported from %s", path)
+	}
+	return nil
+}
+
+// namedCollectionHeadPattern matches the beginning of a CREATE NAMED COLLECTION statement up to the name of the
+// collection
+var namedCollectionHeadPattern = regexp.MustCompile("(?i)^\\s*CREATE\\s+NAMED\\s+COLLECTION\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?(?:`[^`]+`|\\w+)")
+
+// addClusterToCollection adds an ON CLUSTER clause after the name of the collection of a CREATE NAMED COLLECTION
+// statement when a cluster is configured
+func addClusterToCollection(cluster, statement string) string {
+	location := namedCollectionHeadPattern.FindStringIndex(statement)
+	if cluster == "" || location == nil {
+		return statement
+	}
+	return statement[:location[1]] + " ON CLUSTER " + quoteIdentifier(cluster) + statement[location[1]:]
+}
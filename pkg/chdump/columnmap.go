@@ -0,0 +1,236 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ColumnMap maps the columns of a table of the dump to the columns of the target table they are inserted into, so
+// that a dump of an older schema can be loaded into a table whose columns were renamed or reordered. A column mapped
+// to an empty name is skipped, and the columns the map does not list keep their names.
+type ColumnMap map[string]string
+
+// columnListPattern matches what may come between the name of the table created by a CREATE TABLE statement and
+// the opening parenthesis of its column list
+var columnListPattern = regexp.MustCompile(`(?is)^\s*(?:UUID\s+'[^']*'\s*)?(?:ON\s+CLUSTER\s+(?:` + "`[^`]+`" + `|\S+)\s*)?\(`)
+
+// columnModifierPattern matches the modifiers of the columns that are not in the data files
+var columnModifierPattern = regexp.MustCompile(`(?i)^\s*(?:MATERIALIZED|ALIAS|EPHEMERAL)\b`)
+
+// tableElementPattern matches the elements of a column list that are not columns
+var tableElementPattern = regexp.MustCompile(`(?i)^(?:INDEX|PROJECTION|CONSTRAINT)\s`)
+
+// columnDefinition is a column of a CREATE TABLE statement with its whole definition
+type columnDefinition struct {
+	Column
+	// definition is the definition of the column, e.g. `id` UInt64 CODEC(Delta, ZSTD)
+	definition string
+	// stored is set on the columns the data files hold, unlike the MATERIALIZED, ALIAS and EPHEMERAL ones
+	stored bool
+}
+
+// columnDefinitions returns the columns of a CREATE TABLE statement in order, leaving out the indexes, projections
+// and constraints. A Nested column is returned as the array columns of its fields, as ClickHouse stores it.
+func columnDefinitions(statement string) []columnDefinition {
+	var columns []columnDefinition
+	for _, element := range tableElements(statement) {
+		if tableElementPattern.MatchString(element) {
+			continue
+		}
+		name, rest := splitColumnName(element)
+		columnType, rest := splitColumnType(rest)
+		if columnType == "" {
+			continue
+		}
+		if fields, ok := strings.CutPrefix(columnType, "Nested("); ok {
+			for _, field := range splitTopLevel(strings.TrimSuffix(fields, ")")) {
+				fieldName, fieldType := splitColumnName(strings.TrimSpace(field))
+				column := Column{Name: name + "." + fieldName, Type: "Array(" + fieldType + ")"}
+				columns = append(columns, columnDefinition{Column: column, definition: quoteIdentifier(column.Name) + " " + column.Type, stored: true})
+			}
+			continue
+		}
+		columns = append(columns, columnDefinition{
+			Column:     Column{Name: name, Type: columnType},
+			definition: element,
+			stored:     !columnModifierPattern.MatchString(rest),
+		})
+	}
+	return columns
+}
+
+// tableElements returns the elements of the column list of a CREATE TABLE statement: its columns, indexes,
+// projections and constraints
+func tableElements(statement string) []string {
+	location := createObjectPattern.FindStringIndex(statement)
+	if location == nil {
+		return nil
+	}
+	list := columnListPattern.FindStringIndex(statement[location[1]:])
+	if list == nil {
+		return nil
+	}
+	arguments, _ := splitArguments(statement, location[1]+list[1])
+
+	var elements []string
+	for _, element := range arguments {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// schemaColumns returns the columns of a CREATE TABLE statement in order, with their types, as they are in the data
+// files
+func schemaColumns(statement string) []Column {
+	var columns []Column
+	for _, column := range columnDefinitions(statement) {
+		if column.stored {
+			columns = append(columns, column.Column)
+		}
+	}
+	return columns
+}
+
+// splitColumnName splits a column definition into the unquoted name of the column and the rest of the definition
+func splitColumnName(definition string) (string, string) {
+	if !strings.HasPrefix(definition, "`") {
+		name, rest, _ := strings.Cut(definition, " ")
+		return name, strings.TrimSpace(rest)
+	}
+	for i := 1; i < len(definition); i++ {
+		switch definition[i] {
+		case '\\':
+			i++
+		case '`':
+			name := strings.NewReplacer("\\`", "`", `\\`, `\`).Replace(definition[1:i])
+			return name, strings.TrimSpace(definition[i+1:])
+		}
+	}
+	return definition, ""
+}
+
+// splitColumnType splits the rest of a column definition into the type of the column, with its parameters, and the
+// rest of the definition
+func splitColumnType(definition string) (string, string) {
+	end := strings.IndexFunc(definition, func(r rune) bool { return r == '(' || r == ' ' })
+	if end < 0 {
+		return definition, ""
+	}
+	if definition[end] == '(' {
+		_, end = splitArguments(definition, end+1)
+	}
+	return definition[:end], definition[end:]
+}
+
+// mappedInserts returns the INSERT statements loading the data of the tables with a column map through the map,
+// keyed by target table and without the name of the table, which may be a staging table. The columns of the data
+// files are read with the input table function in the structure of the schema files of the dump.
+func mappedInserts(config Options, schemaFiles []SchemaFile) (map[string]string, error) {
+	inserts := make(map[string]string)
+	for table, columnMap := range config.ColumnMaps {
+		index := -1
+		for i, file := range schemaFiles {
+			if file.Table == table {
+				index = i
+			}
+		}
+		if index < 0 {
+			log.Printf("Warning: ignoring the column map of table %s: the table is not in the dump", table)
+			continue
+		}
+		columns := schemaColumns(schemaFiles[index].Content)
+		if len(columns) == 0 {
+			return nil, fmt.Errorf("failed to read the columns of table %s from %s", table, schemaFiles[index].Path)
+		}
+		for column := range columnMap {
+			if !slices.ContainsFunc(columns, func(c Column) bool { return c.Name == column }) {
+				return nil, fmt.Errorf("column %s of the column map of table %s is not in the dump", column, table)
+			}
+		}
+		inserts[targetTableName(config, table)] = mapColumns(table, columns, columnMap)
+	}
+	return inserts, nil
+}
+
+// mapColumns returns the INSERT statement, without the name of the table, loading data files with the columns of
+// a table of the dump through its column map
+func mapColumns(table string, columns []Column, columnMap ColumnMap) string {
+	var structure, targets, sources []string
+	for _, column := range columns {
+		structure = append(structure, quoteIdentifier(column.Name)+" "+column.Type)
+		target, ok := columnMap[column.Name]
+		if !ok {
+			target = column.Name
+		}
+		if target == "" {
+			log.Printf("Skipping column %s of table %s: it is not mapped to a column of the target", column.Name, table)
+			continue
+		}
+		targets = append(targets, quoteIdentifier(target))
+		sources = append(sources, quoteIdentifier(column.Name))
+	}
+	return fmt.Sprintf("(%s) SELECT %s FROM input(%s)", strings.Join(targets, ", "), strings.Join(sources, ", "),
+		quoteString(strings.Join(structure, ", ")))
+}
+
+// driftInserts adds the INSERT statements of the tables whose columns in the dump differ from those of the existing
+// target table to the mapped inserts: the columns of the dump missing from the target are skipped, the columns of the
+// target missing from the dump get their default values, and the columns in another order are inserted by name.
+// Tables with a column map, staged tables and tables whose columns match are left alone.
+func driftInserts(ctx context.Context, db *sql.DB, config Options, schemaFiles []SchemaFile, staged map[string]bool) (map[string]string, error) {
+	inserts := maps.Clone(config.mappedInserts)
+	if inserts == nil {
+		inserts = make(map[string]string)
+	}
+	for _, file := range schemaFiles {
+		if _, ok := config.ColumnMaps[file.Table]; ok || staged[file.Table] || !createTablePattern.MatchString(file.Content) {
+			continue
+		}
+		columns := schemaColumns(file.Content)
+		if len(columns) == 0 {
+			continue
+		}
+		table := targetTableName(config, file.Table)
+		targetColumns, err := insertableColumns(ctx, db, config, table)
+		if err != nil {
+			return nil, err
+		}
+		sameNames := func(a, b Column) bool { return a.Name == b.Name }
+		if len(targetColumns) == 0 || slices.EqualFunc(columns, targetColumns, sameNames) {
+			continue
+		}
+
+		columnMap := make(ColumnMap)
+		for _, column := range columns {
+			if !slices.ContainsFunc(targetColumns, func(c Column) bool { return sameNames(c, column) }) {
+				columnMap[column.Name] = ""
+			}
+		}
+		for _, column := range targetColumns {
+			if !slices.ContainsFunc(columns, func(c Column) bool { return sameNames(c, column) }) {
+				log.Printf("Column %s of table %s is not in the dump: it gets its default value", column.Name, table)
+			}
+		}
+		log.Printf("Columns of table %s differ from the dump: inserting its data by column name", table)
+		inserts[table] = mapColumns(file.Table, columns, columnMap)
+	}
+	return inserts, nil
+}
+
+// mappedInsert returns the INSERT statement of a table with a column map, if it has one, without the name of the
+// table
+func mappedInsert(config Options, table string) (string, bool) {
+	if config.AtomicRestore {
+		table = strings.TrimSuffix(table, stagingSuffix)
+	}
+	insert, ok := config.mappedInserts[table]
+	return insert, ok
+}
@@ -0,0 +1,665 @@
+package chdump
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// VaultConfig holds the settings for fetching the ClickHouse credentials from a HashiCorp Vault KV secret
+type VaultConfig struct {
+	Address   string
+	Path      string
+	KVVersion int
+	Token     string
+	RoleID    string
+	SecretID  string
+}
+
+// TLSConfig holds the settings for connecting to ClickHouse over TLS, optionally authenticating with a client
+// certificate
+type TLSConfig struct {
+	Secure     bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	SkipVerify bool
+
+	// ClientConfigFile is the generated clickhouse-client config file holding the certificate settings
+	ClientConfigFile string
+}
+
+// SSHConfig holds the settings of the SSH tunnel ClickHouse is reached through
+type SSHConfig struct {
+	Destination    string
+	KeyFile        string
+	KnownHostsFile string
+
+	tunnel *sshTunnel
+}
+
+// AWSConfig holds the settings for fetching the ClickHouse credentials from AWS Secrets Manager or SSM Parameter
+// Store with the ambient AWS credentials
+type AWSConfig struct {
+	Region        string
+	SecretID      string
+	ParameterPath string
+}
+
+// sshTimeout bounds connecting to the SSH jump host
+const sshTimeout = 30 * time.Second
+
+// sshTunnel forwards local connections to the ClickHouse server through an SSH jump host
+type sshTunnel struct {
+	client   *ssh.Client
+	listener net.Listener
+
+	mu     sync.Mutex
+	remote string
+}
+
+// routeThroughTunnel forwards the SSH tunnel, opening it on first use, to the ClickHouse host and port of the
+// config, and points the config at the local end of the tunnel instead
+func routeThroughTunnel(config *Options) error {
+	if config.SSH.Destination == "" {
+		return nil
+	}
+	addresses := hostAddresses(*config)
+	if len(addresses) != 1 {
+		return errors.New("the SSH tunnel supports a single host")
+	}
+	if config.SSH.tunnel == nil {
+		tunnel, err := openSSHTunnel(config.SSH)
+		if err != nil {
+			return fmt.Errorf("failed to open SSH tunnel through %s: %w", config.SSH.Destination, err)
+		}
+		config.SSH.tunnel = tunnel
+		log.Printf("Opened SSH tunnel through %s on %s", config.SSH.Destination, tunnel.listener.Addr())
+	}
+	config.SSH.tunnel.setRemote(addresses[0])
+	config.Host, config.Port, _ = net.SplitHostPort(config.SSH.tunnel.listener.Addr().String())
+	return nil
+}
+
+// openSSHTunnel connects to the SSH jump host, authenticating with the SSH agent and the private key, and starts
+// accepting local connections to forward
+func openSSHTunnel(settings SSHConfig) (*sshTunnel, error) {
+	user, address, found := strings.Cut(settings.Destination, "@")
+	if !found {
+		user, address = os.Getenv("USER"), settings.Destination
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	home, _ := os.UserHomeDir()
+	knownHostsFile := cmp.Or(settings.KnownHostsFile, filepath.Join(home, ".ssh", "known_hosts"))
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	keyFiles := []string{settings.KeyFile}
+	if settings.KeyFile == "" {
+		keyFiles = []string{
+			filepath.Join(home, ".ssh", "id_ed25519"),
+			filepath.Join(home, ".ssh", "id_ecdsa"),
+			filepath.Join(home, ".ssh", "id_rsa"),
+		}
+	}
+	for _, keyFile := range keyFiles {
+		key, err := os.ReadFile(keyFile)
+		if errors.Is(err, os.ErrNotExist) && settings.KeyFile == "" {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", keyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	tunnel := &sshTunnel{client: client, listener: listener}
+	go tunnel.serve()
+	return tunnel, nil
+}
+
+// setRemote sets the address the tunnel forwards new connections to
+func (t *sshTunnel) setRemote(remote string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remote = remote
+}
+
+// remoteAddr returns the address the tunnel forwards new connections to
+func (t *sshTunnel) remoteAddr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remote
+}
+
+// serve forwards every accepted local connection to the remote address until the listener is closed
+func (t *sshTunnel) serve() {
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.forward(local)
+	}
+}
+
+// forward copies data between a local connection and a new connection to the remote address from the jump host
+func (t *sshTunnel) forward(local net.Conn) {
+	defer local.Close()
+	remote, err := t.client.Dial("tcp", t.remoteAddr())
+	if err != nil {
+		log.Printf("SSH tunnel failed to connect to %s: %v", t.remoteAddr(), err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Close stops accepting connections and disconnects from the jump host
+func (t *sshTunnel) Close() error {
+	t.listener.Close()
+	return t.client.Close()
+}
+
+// tlsConfigName is the name the TLS configuration is registered under with the ClickHouse driver
+const tlsConfigName = "client"
+
+// setupTLS prepares the TLS settings of both the driver and clickhouse-client: it registers a TLS configuration
+// with the CA and client certificate with the driver, and writes them to a clickhouse-client config file. Giving
+// a certificate implies -secure.
+func setupTLS(settings *TLSConfig) error {
+	if settings.CAFile == "" && settings.CertFile == "" && settings.KeyFile == "" {
+		return nil
+	}
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return errors.New("-tlsCert and -tlsKey must be given together")
+	}
+	settings.Secure = true
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: settings.SkipVerify}
+	if settings.CAFile != "" {
+		caCert, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificates found in %s", settings.CAFile)
+		}
+	}
+	if settings.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if err := clickhouse.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+		return err
+	}
+
+	// clickhouse-client reads client certificates from the openSSL section of its config file only
+	var clientConfig bytes.Buffer
+	clientConfig.WriteString("<config><openSSL><client>")
+	for _, setting := range [][2]string{
+		{"caConfig", settings.CAFile},
+		{"certificateFile", settings.CertFile},
+		{"privateKeyFile", settings.KeyFile},
+	} {
+		element, value := setting[0], setting[1]
+		if value == "" {
+			continue
+		}
+		clientConfig.WriteString("<" + element + ">")
+		if err := xml.EscapeText(&clientConfig, []byte(value)); err != nil {
+			return err
+		}
+		clientConfig.WriteString("</" + element + ">")
+	}
+	if settings.SkipVerify {
+		clientConfig.WriteString("<verificationMode>none</verificationMode>")
+	}
+	clientConfig.WriteString("</client></openSSL></config>\n")
+
+	file, err := os.CreateTemp("", "clickhouse-client-*.xml")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(clientConfig.Bytes()); err != nil {
+		return err
+	}
+	settings.ClientConfigFile = file.Name()
+	return nil
+}
+
+// tlsParams adds the DSN parameters of the TLS settings to the parameters
+func tlsParams(settings TLSConfig, params url.Values) {
+	if settings.Secure {
+		params.Set("secure", "true")
+	}
+	if settings.SkipVerify {
+		params.Set("skip_verify", "true")
+	}
+	if settings.ClientConfigFile != "" {
+		params.Set("tls_config", tlsConfigName)
+	}
+}
+
+// hostDialTimeout bounds checking whether a host accepts connections before starting clickhouse-client on it
+const hostDialTimeout = 5 * time.Second
+
+// hostRotation counts the clickhouse-client processes started, to spread them over the hosts in turn
+var hostRotation atomic.Uint64
+
+// hostAddresses returns the host:port addresses of the comma-separated hosts of the config, using the port of
+// the config for hosts without one
+func hostAddresses(config Options) []string {
+	var addresses []string
+	for _, host := range strings.Split(config.Host, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, config.Port)
+		}
+		addresses = append(addresses, host)
+	}
+	return addresses
+}
+
+// dsnAddress returns the address of the first host for the DSN, and adds the parameters that make the driver fail
+// over to the other hosts to the parameters
+func dsnAddress(config Options, params url.Values) string {
+	addresses := hostAddresses(config)
+	if len(addresses) == 0 {
+		return net.JoinHostPort(config.Host, config.Port)
+	}
+	if len(addresses) == 1 {
+		return addresses[0]
+	}
+	strategy := "random"
+	if config.HostStrategy == "failover" {
+		strategy = "in_order"
+	}
+	params.Set("alt_hosts", strings.Join(addresses[1:], ","))
+	params.Set("connection_open_strategy", strategy)
+	return addresses[0]
+}
+
+// pickHost returns the host and port for a clickhouse-client process: the first host accepting connections,
+// starting from the next host in turn with the roundRobin strategy and from the first host with failover
+func pickHost(config Options) (string, string) {
+	addresses := hostAddresses(config)
+	if len(addresses) == 0 {
+		return config.Host, config.Port
+	}
+	start := 0
+	if config.HostStrategy == "roundRobin" {
+		start = int((hostRotation.Add(1) - 1) % uint64(len(addresses)))
+	}
+	if len(addresses) > 1 {
+		for i := range addresses {
+			address := addresses[(start+i)%len(addresses)]
+			conn, err := net.DialTimeout("tcp", address, hostDialTimeout)
+			if err == nil {
+				conn.Close()
+				start = (start + i) % len(addresses)
+				break
+			}
+			log.Printf("Host %s is unreachable, trying the next one: %v", address, err)
+		}
+	}
+	// When no host is reachable, clickhouse-client reports the error of the first one
+	host, port, _ := net.SplitHostPort(addresses[start])
+	return host, port
+}
+
+// settingNamePattern matches the name of a ClickHouse setting
+var settingNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateSettings checks the names of the settings of a query
+func validateSettings(kind string, settings map[string]string) error {
+	for name := range settings {
+		if !settingNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid %s setting %q", kind, name)
+		}
+	}
+	return nil
+}
+
+// settingsArgs returns the clickhouse-client arguments applying the settings to its query, sorted by name
+func settingsArgs(settings map[string]string) []string {
+	args := make([]string, 0, len(settings))
+	for name, value := range settings {
+		args = append(args, "--"+name+"="+value)
+	}
+	sort.Strings(args)
+	return args
+}
+
+// settingLiteralPattern matches the setting values used as they are in a SETTINGS clause: numbers, booleans and
+// quoted strings
+var settingLiteralPattern = regexp.MustCompile(`^(?:[-+]?[0-9][0-9._eE+-]*|true|false|'(?:[^'\\]|\\.)*')$`)
+
+// settingsClause returns the SETTINGS clause of a query applying the settings, sorted by name, or nothing when
+// there are none. Values other than numbers, booleans and quoted strings are quoted.
+func settingsClause(settings map[string]string) string {
+	if len(settings) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(settings))
+	for name, value := range settings {
+		if !settingLiteralPattern.MatchString(value) {
+			value = quoteString(value)
+		}
+		pairs = append(pairs, name+" = "+value)
+	}
+	sort.Strings(pairs)
+	return " SETTINGS " + strings.Join(pairs, ", ")
+}
+
+// clickHouseClientCommand returns a clickhouse-client command connecting with the configured credentials. The
+// password is passed through the environment rather than the command line, where it would be visible in ps output.
+func clickHouseClientCommand(ctx context.Context, config Options, args ...string) *exec.Cmd {
+	host, port := pickHost(config)
+	args = append([]string{"client", "--host", host, "--port", port, "--user", config.User}, args...)
+	if config.TLS.ClientConfigFile != "" {
+		args = append(args, "--config-file", config.TLS.ClientConfigFile)
+	}
+	if config.TLS.Secure {
+		args = append(args, "--secure")
+	}
+	cmd := exec.CommandContext(ctx, config.ClickHouseClientPath, args...)
+	cmd.Env = append(os.Environ(), "CLICKHOUSE_PASSWORD="+config.Password)
+	return cmd
+}
+
+// vaultClient is the HTTP client used to talk to Vault
+var vaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// refreshCredentials fetches the ClickHouse user and password, and the host and port when the secret has them,
+// from the configured Vault KV secret, AWS Secrets Manager secret or SSM parameter path. It does nothing when no
+// secret backend is configured.
+func refreshCredentials(ctx context.Context, config *Options) error {
+	var source string
+	var readSecret func() (map[string]string, error)
+	switch {
+	case config.Vault.Path != "":
+		source = "Vault secret " + config.Vault.Path
+		readSecret = func() (map[string]string, error) { return readVaultSecret(ctx, config.Vault) }
+	case config.AWS.SecretID != "":
+		source = "AWS secret " + config.AWS.SecretID
+		readSecret = func() (map[string]string, error) { return readAWSSecret(ctx, config.AWS) }
+	case config.AWS.ParameterPath != "":
+		source = "SSM parameters under " + config.AWS.ParameterPath
+		readSecret = func() (map[string]string, error) { return readAWSParameters(ctx, config.AWS) }
+	default:
+		return nil
+	}
+
+	var secret map[string]string
+	err := withRetry(ctx, config.Retry, "fetching credentials from "+source, func() (err error) {
+		secret, err = readSecret()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", source, err)
+	}
+
+	if user := cmp.Or(secret["user"], secret["username"]); user != "" {
+		config.User = user
+	}
+	if password, ok := secret["password"]; ok {
+		config.Password = password
+	}
+	if config.SSH.tunnel != nil {
+		// The host and port of the secret are relative to the jump host
+		config.Host, config.Port, _ = net.SplitHostPort(config.SSH.tunnel.remoteAddr())
+	}
+	if host, ok := secret["host"]; ok {
+		config.Host = host
+	}
+	if port, ok := secret["port"]; ok {
+		config.Port = port
+	}
+	if err := routeThroughTunnel(config); err != nil {
+		return err
+	}
+	log.Printf("Fetched ClickHouse credentials from %s", source)
+	return nil
+}
+
+// readVaultSecret reads the key/value pairs of a Vault KV secret, logging in with AppRole when no token is given
+func readVaultSecret(ctx context.Context, vault VaultConfig) (map[string]string, error) {
+	if vault.Address == "" {
+		return nil, errors.New("no Vault address given, set -vaultAddr or VAULT_ADDR")
+	}
+	token := vault.Token
+	if token == "" {
+		if vault.RoleID == "" {
+			return nil, errors.New("no Vault token or AppRole role ID given")
+		}
+		var login struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		body := map[string]string{"role_id": vault.RoleID, "secret_id": vault.SecretID}
+		if err := vaultRequest(ctx, vault, http.MethodPost, "auth/approle/login", "", body, &login); err != nil {
+			return nil, fmt.Errorf("AppRole login failed: %w", err)
+		}
+		token = login.Auth.ClientToken
+	}
+
+	// KV version 2 serves the secrets of a mount under <mount>/data/<path>, nested in a second data object
+	path := strings.Trim(vault.Path, "/")
+	if vault.KVVersion == 2 {
+		mount, rest, _ := strings.Cut(path, "/")
+		path = mount + "/data/" + rest
+	}
+	var response struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := vaultRequest(ctx, vault, http.MethodGet, path, token, nil, &response); err != nil {
+		return nil, err
+	}
+	data := response.Data
+	if vault.KVVersion == 2 {
+		data, _ = data["data"].(map[string]any)
+	}
+
+	secret := make(map[string]string)
+	for key, value := range data {
+		secret[key] = fmt.Sprint(value)
+	}
+	return secret, nil
+}
+
+// vaultRequest sends a request to the Vault HTTP API and decodes the JSON response into result
+func vaultRequest(ctx context.Context, vault VaultConfig, method, path, token string, body, result any) error {
+	var content io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(vault.Address, "/")+"/v1/"+path, content)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+
+	response, err := vaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return fmt.Errorf("Vault returned %s for %s: %s", response.Status, path, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// awsTimeout bounds the requests to the AWS APIs
+const awsTimeout = 30 * time.Second
+
+// readAWSSecret reads the key/value pairs of a Secrets Manager secret stored as a JSON object
+func readAWSSecret(ctx context.Context, settings AWSConfig) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsTimeout)
+	defer cancel()
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(settings.Region))
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := secretsmanager.NewFromConfig(awsConfig).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(settings.SecretID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]any
+	if err := json.Unmarshal([]byte(aws.ToString(output.SecretString)), &values); err != nil {
+		return nil, fmt.Errorf("secret is not a JSON object: %w", err)
+	}
+
+	secret := make(map[string]string)
+	for key, value := range values {
+		secret[key] = fmt.Sprint(value)
+	}
+	return secret, nil
+}
+
+// readAWSParameters reads the parameters under an SSM Parameter Store path, decrypting SecureString parameters,
+// keyed by the last element of their names
+func readAWSParameters(ctx context.Context, settings AWSConfig) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsTimeout)
+	defer cancel()
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(settings.Region))
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make(map[string]string)
+	paginator := ssm.NewGetParametersByPathPaginator(ssm.NewFromConfig(awsConfig), &ssm.GetParametersByPathInput{
+		Path:           aws.String(settings.ParameterPath),
+		WithDecryption: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, parameter := range page.Parameters {
+			secret[path.Base(aws.ToString(parameter.Name))] = aws.ToString(parameter.Value)
+		}
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("no parameters found under %s", settings.ParameterPath)
+	}
+	return secret, nil
+}
+
+// createDBConnection creates and tests a database connection. The parameters of the DSN are escaped, so that the
+// user, password and database may hold any character.
+func createDBConnection(ctx context.Context, config Options, dbName string) (*sql.DB, error) {
+	params := url.Values{}
+	params.Set("username", config.User)
+	params.Set("password", config.Password)
+	params.Set("database", dbName)
+	params.Set("read_timeout", strconv.Itoa(config.ReadTimeout))
+	params.Set("write_timeout", strconv.Itoa(config.WriteTimeout))
+	address := dsnAddress(config, params)
+	tlsParams(config.TLS, params)
+	dsn := "tcp://" + address + "?" + params.Encode()
+
+	db, err := sql.Open("clickhouse", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection to ClickHouse: %w", err)
+	}
+
+	if err := withRetry(ctx, config.Retry, "ping", func() error { return db.PingContext(ctx) }); err != nil {
+		return nil, fmt.Errorf("failed to connect to ClickHouse: %w", err)
+	}
+	log.Printf("Connection to ClickHouse %s successful.", dbName)
+	return db, nil
+}
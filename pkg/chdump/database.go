@@ -0,0 +1,74 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// databaseSchemaDir is the subdirectory of the schema directory holding the CREATE DATABASE statement of the database
+const databaseSchemaDir = "database"
+
+// databaseSchemaFile returns the path of the CREATE DATABASE statement of the dump in the schema directory
+func databaseSchemaFile(schemaDir string) string {
+	return filepath.Join(schemaDir, databaseSchemaDir, "create.sql")
+}
+
+// createDatabasePattern matches the beginning of a CREATE DATABASE statement up to its optional IF NOT EXISTS clause
+var createDatabasePattern = regexp.MustCompile(`(?is)^\s*CREATE\s+DATABASE\s+(?:IF\s+NOT\s+EXISTS\s+)?`)
+
+// replicatedDatabasePattern matches the Replicated engine of a database with its arguments
+var replicatedDatabasePattern = regexp.MustCompile(`(?i)\bENGINE\s*=\s*Replicated\s*\((?:[^()']|'(?:[^'\\]|\\.)*')*\)`)
+
+// dumpDatabaseSchema dumps the CREATE DATABASE statement of the database, with its engine, settings and comment
+func dumpDatabaseSchema(ctx context.Context, db *sql.DB, config Options, schemaDir string) error {
+	var createStmt string
+	query := "SHOW CREATE DATABASE " + quoteIdentifier(config.DBName)
+	if err := db.QueryRowContext(ctx, query).Scan(&createStmt); err != nil {
+		return err
+	}
+
+	path := databaseSchemaFile(schemaDir)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeDumpFile(config, path, []byte(createStmt))
+}
+
+// createDatabaseQuery returns the statement creating the database if it does not exist: the CREATE DATABASE
+// statement of the dump, renamed to the database and with a Replicated engine turned into Atomic when dereplicating,
+// or one with the default engine for dumps without it
+func createDatabaseQuery(config Options, schemaDir string) (string, error) {
+	path := databaseSchemaFile(schemaDir)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return addOnCluster(config.OnCluster, "CREATE DATABASE IF NOT EXISTS "+quoteIdentifier(config.DBName)), nil
+	}
+	content, err := readDumpFile(config, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read database schema file %s: %w", path, err)
+	}
+	statement := strings.TrimRight(strings.TrimSpace(string(content)), ";")
+	statement = createDatabasePattern.ReplaceAllLiteralString(statement, "CREATE DATABASE IF NOT EXISTS ")
+	statement = renameCreated(statement, quoteIdentifier(config.DBName))
+	statement = rewriteUUIDs(config, statement)
+	if config.Dereplicate {
+		statement = replicatedDatabasePattern.ReplaceAllLiteralString(statement, "ENGINE = Atomic")
+	}
+	return addOnCluster(config.OnCluster, statement), nil
+}
+
+// createDatabaseIfNotExists creates the database if it does not exist, on every host of the cluster when one is given
+func createDatabaseIfNotExists(ctx context.Context, db *sql.DB, config Options, schemaDir string) error {
+	query, err := createDatabaseQuery(config, schemaDir)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", config.DBName, err)
+	}
+	return nil
+}
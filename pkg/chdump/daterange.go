@@ -0,0 +1,72 @@
+package chdump
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// relativeDatePattern matches a date bound relative to the day of the export, a number of days such as 90d
+var relativeDatePattern = regexp.MustCompile(`^(\d+)d$`)
+
+// datePartitionKeyPattern matches a partition key on a date function of a column, such as toYYYYMM(event_date),
+// alone or first in a tuple, capturing the column
+var datePartitionKeyPattern = regexp.MustCompile("^\\(?\\s*(?:toYYYYMM|toYYYYMMDD|toDate|toDate32|toMonday|toYear|toStartOf\\w+)\\((\\w+|`[^`]+`)\\)")
+
+// dateBound returns the SQL expression of a date bound: a date such as 2024-01-01, or a number of days before the
+// day of the export such as 90d
+func dateBound(value string) (string, error) {
+	if match := relativeDatePattern.FindStringSubmatch(value); match != nil {
+		days, err := strconv.Atoi(match[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid number of days in %q: %w", value, err)
+		}
+		return fmt.Sprintf("today() - %d", days), nil
+	}
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		return "", fmt.Errorf("invalid date %q, expected a date such as 2024-01-01 or a number of days such as 90d", value)
+	}
+	return "toDate(" + quoteString(value) + ")", nil
+}
+
+// dateColumns returns the columns the date range of the export applies to: the configured date column of a table,
+// or the column of its partition key on a date function. The tables without either, which are exported whole, are
+// logged.
+func dateColumns(config Options, metadata map[string]TableMetadata, tables []string) map[string]string {
+	columns := make(map[string]string)
+	for _, table := range tables {
+		if column, ok := config.DateColumns[table]; ok {
+			columns[table] = quoteIdentifier(column)
+			continue
+		}
+		if match := datePartitionKeyPattern.FindStringSubmatch(metadata[table].PartitionKey); match != nil {
+			columns[table] = match[1]
+			continue
+		}
+		if hasData(config, metadata[table]) && metadata[table].Target == "" {
+			log.Printf("Table %s has neither a date column nor a partition key on a date: its data is exported without the date range", table)
+		}
+	}
+	return columns
+}
+
+// dateRangeCondition returns the condition selecting the rows of a table within the date range of the export, or an
+// empty string when no range is set or the table has no date column. The range includes its start and excludes its
+// end.
+func dateRangeCondition(config Options, table string) string {
+	column, ok := config.dateColumns[table]
+	if !ok {
+		return ""
+	}
+	var conditions []string
+	if since, err := dateBound(config.Since); config.Since != "" && err == nil {
+		conditions = append(conditions, column+" >= "+since)
+	}
+	if until, err := dateBound(config.Until); config.Until != "" && err == nil {
+		conditions = append(conditions, column+" < "+until)
+	}
+	return strings.Join(conditions, " AND ")
+}
@@ -0,0 +1,56 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// deduplicateTables runs OPTIMIZE TABLE ... FINAL DEDUPLICATE on the restored MergeTree tables matching the
+// deduplication patterns, merging all of their parts and removing the identical rows that the retried inserts of a
+// batch may have left. The tables that failed to import are skipped. It returns the tables it failed to deduplicate.
+func deduplicateTables(ctx context.Context, db *sql.DB, config Options, schemaFiles []SchemaFile, failedTables []string) ([]string, error) {
+	var failed []string
+	for _, file := range schemaFiles {
+		table := targetTableName(config, file.Table)
+		if !matchesAnyPattern(config.DeduplicateTables, file.Table) || slices.Contains(failedTables, table) {
+			continue
+		}
+		var engine string
+		err := withRetry(ctx, config.Retry, "fetching engine of table "+table, func() (err error) {
+			engine, err = getTableEngine(ctx, db, table, config.DBName)
+			return err
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch engine of table %s: %w", table, err)
+		}
+		if !strings.HasSuffix(engine, "MergeTree") {
+			log.Printf("Skipping deduplication of table %s: the %s engine does not support OPTIMIZE ... DEDUPLICATE", table, engine)
+			continue
+		}
+
+		start := time.Now()
+		query := "OPTIMIZE TABLE " + qualifiedName(config.DBName, table)
+		if config.OnCluster != "" {
+			query += " ON CLUSTER " + quoteIdentifier(config.OnCluster)
+		}
+		if err := execWithRetry(ctx, db, config, query+" FINAL DEDUPLICATE"); err != nil {
+			log.Printf("Failed to deduplicate table %s: %v", table, err)
+			if config.FailFast || ctx.Err() != nil {
+				return nil, fmt.Errorf("failed to deduplicate table %s: %w", table, err)
+			}
+			failed = append(failed, table)
+			continue
+		}
+		log.Printf("Deduplicated table %s in %s", table, time.Since(start).Round(time.Millisecond))
+	}
+	return failed, nil
+}
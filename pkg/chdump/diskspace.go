@@ -0,0 +1,69 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// checkDiskSpace compares the size of the dump of the databases, predicted from the uncompressed size of the active
+// parts of their selected tables, with the free space of the volume of the dump directory. A dump that does not fit
+// fails the export before it starts, or only logs a warning when the check warns.
+func checkDiskSpace(ctx context.Context, db *sql.DB, config Options, databases []string, dir string) error {
+	if config.DiskSpaceCheck == "off" {
+		return nil
+	}
+	var required int64
+	for _, dbName := range databases {
+		var tables []string
+		var sizes map[string]TableSize
+		err := withRetry(ctx, config.Retry, "fetching table sizes of "+dbName, func() (err error) {
+			if tables, err = getTables(ctx, db, dbName); err != nil {
+				return err
+			}
+			sizes, err = getTableSizes(ctx, db, dbName)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch the table sizes of database %s: %w", dbName, err)
+		}
+		for _, table := range filterTables(config, tables) {
+			required += sizes[table].UncompressedBytes
+		}
+	}
+
+	volume := existingParent(dir)
+	available, err := freeSpace(volume)
+	if err != nil {
+		log.Printf("Warning: skipping the disk space check: %v", err)
+		return nil
+	}
+	if required <= available {
+		log.Printf("Disk space check passed: the dump needs about %s, %s is free in %s", FormatBytes(required), FormatBytes(available), volume)
+		return nil
+	}
+	err = fmt.Errorf("not enough disk space: the dump needs about %s, only %s is free in %s", FormatBytes(required), FormatBytes(available), volume)
+	if config.DiskSpaceCheck == "warn" {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	return err
+}
+
+// existingParent returns the directory, or its closest parent that exists, whose volume holds the directory once
+// it is created
+func existingParent(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
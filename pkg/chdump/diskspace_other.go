@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package chdump
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeSpace returns the number of bytes available to the user on the volume of the path
+func freeSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("the free space of %s cannot be checked on %s", path, runtime.GOOS)
+}
@@ -0,0 +1,494 @@
+package chdump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// EncryptionConfig encrypts the data and schema files of the dump at rest with AES-256-GCM. The key is read from
+// a key file, or is a data key generated for every export and stored in the files encrypted by AWS KMS or to GPG
+// recipients, so that the import only needs access to the KMS key or to the secret key of a recipient.
+type EncryptionConfig struct {
+	// KeyFile holds the 256-bit key as 32 raw bytes, 64 hex digits or base64
+	KeyFile string
+	// KMSKeyID is the ID, ARN or alias of the KMS key, in the region of the AWS settings
+	KMSKeyID string
+	// GPGRecipients are the key IDs, fingerprints or user IDs of the GPG public keys the data key is encrypted to
+	GPGRecipients []string
+
+	cipher *fileCipher
+}
+
+// Enabled reports whether the dump files are encrypted
+func (e EncryptionConfig) Enabled() bool {
+	return e.KeyFile != "" || e.KMSKeyID != "" || len(e.GPGRecipients) > 0
+}
+
+// An encrypted file is a sequence of segments, one per batch of the export so that the data files can still be
+// appended to. A segment starts with a header:
+//
+//	magic "CHDE" | version | kind of key | length of the data key (2 bytes) | encrypted data key | salt (16 bytes)
+//
+// where the data key is empty with a key file, followed by chunks of at most encryptionChunkSize bytes of plaintext, each one sealed with the key derived from
+// the key and the salt of the segment, and prefixed with the length of its ciphertext (4 bytes) whose high bit
+// marks the last chunk of the segment. The nonce of a chunk is its number and the last-chunk flag, and the header
+// is authenticated with every chunk, so that chunks cannot be reordered, dropped or moved to another segment
+// without failing the decryption.
+const (
+	encryptionMagic     = "CHDE"
+	encryptionVersion   = 1
+	encryptionSaltSize  = 16
+	encryptionChunkSize = 64 * 1024
+	encryptionLastChunk = 1 << 31
+)
+
+// The kinds of keys of the encrypted files
+const (
+	keyFileKey byte = iota
+	kmsKey
+	gpgKey
+)
+
+// fileCipher encrypts and decrypts the dump files with the key of the encryption settings
+type fileCipher struct {
+	settings EncryptionConfig
+	region   string
+	gpg      GPGConfig
+	key      []byte // the key of the key file, nil with KMS and GPG
+
+	mu sync.Mutex
+	// dataKey and wrappedKey are the plaintext and encrypted data key of the export, generated on first use
+	dataKey, wrappedKey []byte
+	// unwrapped caches the data keys decrypted by KMS or GPG by their encrypted form
+	unwrapped map[string][]byte
+}
+
+// newFileCipher returns the cipher of the encryption settings of the options, reading the key file if there is one
+func newFileCipher(config Options) (*fileCipher, error) {
+	settings := config.Encryption
+	keys := 0
+	for _, set := range []bool{settings.KeyFile != "", settings.KMSKeyID != "", len(settings.GPGRecipients) > 0} {
+		if set {
+			keys++
+		}
+	}
+	if keys > 1 {
+		return nil, errors.New("set only one of a key file, a KMS key or GPG recipients")
+	}
+	c := &fileCipher{settings: settings, region: config.AWS.Region, gpg: config.GPG, unwrapped: make(map[string][]byte)}
+	if settings.KeyFile != "" {
+		content, err := os.ReadFile(settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if c.key, err = parseKey(content); err != nil {
+			return nil, fmt.Errorf("invalid key file %s: %w", settings.KeyFile, err)
+		}
+	}
+	return c, nil
+}
+
+// parseKey returns the 256-bit key of a key file, as raw bytes, hex digits or base64
+func parseKey(content []byte) ([]byte, error) {
+	if len(content) == 32 {
+		return content, nil
+	}
+	text := strings.TrimSpace(string(content))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("expected a 256-bit key as 32 raw bytes, 64 hex digits or base64")
+}
+
+// encryptionKey returns the kind of key encrypting the files of the export, the key and, with KMS and GPG, its
+// encrypted form stored in them
+func (c *fileCipher) encryptionKey() (byte, []byte, []byte, error) {
+	if c.key != nil {
+		return keyFileKey, c.key, nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.settings.GPGRecipients) > 0 {
+		if c.dataKey == nil {
+			dataKey := make([]byte, 32)
+			if _, err := rand.Read(dataKey); err != nil {
+				return 0, nil, nil, err
+			}
+			wrappedKey, err := gpgEncrypt(c.gpg, c.settings.GPGRecipients, dataKey)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			c.dataKey, c.wrappedKey = dataKey, wrappedKey
+		}
+		return gpgKey, c.dataKey, c.wrappedKey, nil
+	}
+	if c.dataKey == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+		defer cancel()
+		client, err := c.kmsClient(ctx)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		output, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+			KeyId:   aws.String(c.settings.KMSKeyID),
+			KeySpec: types.DataKeySpecAes256,
+		})
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("failed to generate a data key with KMS key %s: %w", c.settings.KMSKeyID, err)
+		}
+		c.dataKey, c.wrappedKey = output.Plaintext, output.CiphertextBlob
+	}
+	return kmsKey, c.dataKey, c.wrappedKey, nil
+}
+
+// decryptionKey returns the key that encrypted a segment, decrypting its data key with KMS or GPG
+func (c *fileCipher) decryptionKey(kind byte, wrappedKey []byte) ([]byte, error) {
+	switch {
+	case kind == keyFileKey && c.key == nil:
+		return nil, errors.New("the file is encrypted with a key file")
+	case kind == keyFileKey:
+		return c.key, nil
+	case kind == kmsKey && c.settings.KMSKeyID == "":
+		return nil, errors.New("the file is encrypted with a KMS key")
+	case kind == gpgKey && len(c.settings.GPGRecipients) == 0:
+		return nil, errors.New("the file is encrypted to GPG recipients")
+	case kind != kmsKey && kind != gpgKey:
+		return nil, fmt.Errorf("unsupported kind of key %d", kind)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.unwrapped[string(wrappedKey)]; ok {
+		return key, nil
+	}
+	if kind == gpgKey {
+		key, err := gpgDecrypt(c.gpg, wrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		c.unwrapped[string(wrappedKey)] = key
+		return key, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+	defer cancel()
+	client, err := c.kmsClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.Decrypt(ctx, &kms.DecryptInput{KeyId: aws.String(c.settings.KMSKeyID), CiphertextBlob: wrappedKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the data key with KMS key %s: %w", c.settings.KMSKeyID, err)
+	}
+	c.unwrapped[string(wrappedKey)] = output.Plaintext
+	return output.Plaintext, nil
+}
+
+// kmsClient returns a KMS client with the ambient AWS configuration
+func (c *fileCipher) kmsClient(ctx context.Context) (*kms.Client, error) {
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(c.region))
+	if err != nil {
+		return nil, err
+	}
+	return kms.NewFromConfig(awsConfig), nil
+}
+
+// segmentAEAD returns the AES-256-GCM cipher of a segment, keyed with the HMAC of its salt so that every segment has
+// a key of its own and the chunk numbers can serve as nonces
+func segmentAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk of a segment
+func chunkNonce(chunk uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:11], chunk)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts what is written to it as a segment of the underlying writer, which is complete once the
+// writer is closed
+type encryptWriter struct {
+	w      io.Writer
+	cipher *fileCipher
+	aead   cipher.AEAD
+	header []byte
+	buffer []byte
+	chunk  uint32
+}
+
+// encrypt returns a writer encrypting a new segment to the writer
+func (c *fileCipher) encrypt(w io.Writer) io.WriteCloser {
+	return &encryptWriter{w: w, cipher: c}
+}
+
+// start writes the header of the segment
+func (e *encryptWriter) start() error {
+	kind, key, wrappedKey, err := e.cipher.encryptionKey()
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	if e.aead, err = segmentAEAD(key, salt); err != nil {
+		return err
+	}
+	header := append([]byte(encryptionMagic), encryptionVersion, kind)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrappedKey)))
+	header = append(append(header, wrappedKey...), salt...)
+	e.header = header
+	_, err = e.w.Write(header)
+	return err
+}
+
+// Write encrypts the data, keeping the last chunk until the writer is closed since it is marked as the last one
+func (e *encryptWriter) Write(data []byte) (int, error) {
+	if e.aead == nil {
+		if err := e.start(); err != nil {
+			return 0, err
+		}
+	}
+	e.buffer = append(e.buffer, data...)
+	for len(e.buffer) > encryptionChunkSize {
+		if err := e.seal(e.buffer[:encryptionChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buffer = e.buffer[encryptionChunkSize:]
+	}
+	return len(data), nil
+}
+
+// Close writes the last chunk of the segment
+func (e *encryptWriter) Close() error {
+	if e.aead == nil {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	err := e.seal(e.buffer, true)
+	e.buffer = nil
+	return err
+}
+
+// seal encrypts and writes a chunk of the segment
+func (e *encryptWriter) seal(plaintext []byte, last bool) error {
+	if e.chunk == encryptionLastChunk {
+		return errors.New("too many chunks in an encrypted segment")
+	}
+	sealed := e.aead.Seal(make([]byte, 4, 4+len(plaintext)+e.aead.Overhead()), chunkNonce(e.chunk, last), plaintext, e.header)
+	length := uint32(len(sealed) - 4)
+	if last {
+		length |= encryptionLastChunk
+	}
+	binary.BigEndian.PutUint32(sealed, length)
+	e.chunk++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts the segments of the underlying reader one after the other
+type decryptReader struct {
+	r      *bufio.Reader
+	cipher *fileCipher
+	aead   cipher.AEAD // nil between segments
+	header []byte
+	chunk  uint32
+	buffer []byte
+}
+
+// decrypt returns a reader decrypting the segments of the reader
+func (c *fileCipher) decrypt(r io.Reader) io.Reader {
+	return &decryptReader{r: bufio.NewReader(r), cipher: c}
+}
+
+// Read returns the decrypted data of the chunks
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buffer) == 0 {
+		if d.aead == nil {
+			if err := d.start(); err != nil {
+				return 0, err
+			}
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buffer)
+	d.buffer = d.buffer[n:]
+	return n, nil
+}
+
+// start reads the header of the next segment, returning io.EOF at the end of the file
+func (d *decryptReader) start() error {
+	header := make([]byte, len(encryptionMagic)+4)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errors.New("truncated encrypted file")
+		}
+		return err
+	}
+	if !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return errors.New("the file is not encrypted, or is corrupted")
+	}
+	if version := header[len(encryptionMagic)]; version != encryptionVersion {
+		return fmt.Errorf("unsupported encryption version %d", version)
+	}
+	rest := make([]byte, int(binary.BigEndian.Uint16(header[len(encryptionMagic)+2:]))+encryptionSaltSize)
+	if _, err := io.ReadFull(d.r, rest); err != nil {
+		return errors.New("truncated encrypted file")
+	}
+	wrappedKey, salt := rest[:len(rest)-encryptionSaltSize], rest[len(rest)-encryptionSaltSize:]
+	key, err := d.cipher.decryptionKey(header[len(encryptionMagic)+1], wrappedKey)
+	if err != nil {
+		return err
+	}
+	if d.aead, err = segmentAEAD(key, salt); err != nil {
+		return err
+	}
+	d.header = append(header, rest...)
+	d.chunk = 0
+	return nil
+}
+
+// open reads and decrypts the next chunk of the segment
+func (d *decryptReader) open() error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(d.r, prefix[:]); err != nil {
+		return errors.New("truncated encrypted file")
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	last := length&encryptionLastChunk != 0
+	length &^= encryptionLastChunk
+	if length > encryptionChunkSize+uint32(d.aead.Overhead()) {
+		return errors.New("corrupted encrypted file")
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return errors.New("truncated encrypted file")
+	}
+	plaintext, err := d.aead.Open(sealed[:0], chunkNonce(d.chunk, last), sealed, d.header)
+	if err != nil {
+		return errors.New("wrong key, or the file is corrupted")
+	}
+	d.buffer = plaintext
+	d.chunk++
+	if last {
+		d.aead = nil
+	}
+	return nil
+}
+
+// encryptedFormat encrypts the data files of another format, after encoding them if the format does
+type encryptedFormat struct {
+	Format
+	cipher *fileCipher
+}
+
+// Encode encrypts the batch as a segment of the data file
+func (f encryptedFormat) Encode(w io.Writer) io.WriteCloser {
+	encrypted := f.cipher.encrypt(w)
+	encoder, ok := f.Format.(Encoder)
+	if !ok {
+		return encrypted
+	}
+	return &encodedWriter{WriteCloser: encoder.Encode(encrypted), encrypted: encrypted}
+}
+
+// Decode decrypts the data file, and decodes it if the format does
+func (f encryptedFormat) Decode(r io.Reader) (io.ReadCloser, error) {
+	decrypted := f.cipher.decrypt(r)
+	if decoder, ok := f.Format.(Decoder); ok {
+		return decoder.Decode(decrypted)
+	}
+	return io.NopCloser(decrypted), nil
+}
+
+// encodedWriter is the encoder of a format writing to an encrypted segment, which closes the segment together with
+// the encoder
+type encodedWriter struct {
+	io.WriteCloser
+	encrypted io.WriteCloser
+}
+
+// Close closes the encoder and the segment
+func (w *encodedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if closeErr := w.encrypted.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeDumpFile writes a schema file of the dump, encrypted if the options say so
+func writeDumpFile(config Options, path string, content []byte) error {
+	if config.Encryption.cipher == nil {
+		return os.WriteFile(path, content, 0644)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	encrypted := config.Encryption.cipher.encrypt(file)
+	if _, err := encrypted.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := encrypted.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readDumpFile reads a schema file of the dump, decrypting it if the options say so
+func readDumpFile(config Options, path string) ([]byte, error) {
+	if config.Encryption.cipher == nil {
+		content, err := os.ReadFile(path)
+		if err == nil && bytes.HasPrefix(content, []byte(encryptionMagic)) {
+			return nil, fmt.Errorf("%s is encrypted, set the encryption key", path)
+		}
+		return content, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(config.Encryption.cipher.decrypt(file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return content, nil
+}
@@ -0,0 +1,124 @@
+package chdump
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestChunkNonce(t *testing.T) {
+	tests := []struct {
+		chunk uint32
+		last  bool
+		want  []byte
+	}{
+		{0, false, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{0, true, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{1, false, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0}},
+		{0x01020304, true, []byte{0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 1}},
+		{encryptionLastChunk - 1, false, []byte{0, 0, 0, 0, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff, 0}},
+	}
+	for _, test := range tests {
+		if got := chunkNonce(test.chunk, test.last); !bytes.Equal(got, test.want) {
+			t.Errorf("chunkNonce(%d, %v) = %v, want %v", test.chunk, test.last, got, test.want)
+		}
+	}
+}
+
+// testCipher returns a cipher with a random key, like that of a key file
+func testCipher(t *testing.T) *fileCipher {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return &fileCipher{key: key, unwrapped: make(map[string][]byte)}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []int // the sizes of the segments appended to the file
+	}{
+		{"empty segment", []int{0}},
+		{"small segment", []int{100}},
+		{"exactly one chunk", []int{encryptionChunkSize}},
+		{"one byte over a chunk", []int{encryptionChunkSize + 1}},
+		{"several chunks", []int{3*encryptionChunkSize + 17}},
+		{"appended segments", []int{10, encryptionChunkSize * 2, 0, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := testCipher(t)
+			var file, plaintext bytes.Buffer
+			for _, size := range test.segments {
+				data := make([]byte, size)
+				if _, err := rand.Read(data); err != nil {
+					t.Fatal(err)
+				}
+				plaintext.Write(data)
+				w := c.encrypt(&file)
+				if _, err := w.Write(data); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("Close() error = %v", err)
+				}
+			}
+
+			got, err := io.ReadAll(c.decrypt(bytes.NewReader(file.Bytes())))
+			if err != nil {
+				t.Fatalf("decrypt error = %v", err)
+			}
+			if !bytes.Equal(got, plaintext.Bytes()) {
+				t.Errorf("decrypted %d bytes, want the %d bytes written", len(got), plaintext.Len())
+			}
+		})
+	}
+}
+
+func TestDecryptionFailures(t *testing.T) {
+	c := testCipher(t)
+	var file bytes.Buffer
+	w := c.encrypt(&file)
+	if _, err := w.Write(bytes.Repeat([]byte("row\n"), encryptionChunkSize/2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := file.Bytes()
+	// The first chunk starts after the header of the segment, which has no data key with a key file
+	firstChunk := len(encryptionMagic) + 4 + encryptionSaltSize
+
+	tests := []struct {
+		name   string
+		cipher *fileCipher
+		file   func() []byte
+	}{
+		{"wrong key", testCipher(t), func() []byte { return encrypted }},
+		{"truncated file", c, func() []byte { return encrypted[:len(encrypted)-10] }},
+		{"missing last chunk", c, func() []byte {
+			return encrypted[:firstChunk+4+encryptionChunkSize+16]
+		}},
+		{"modified chunk", c, func() []byte {
+			modified := bytes.Clone(encrypted)
+			modified[firstChunk+10] ^= 1
+			return modified
+		}},
+		{"modified header", c, func() []byte {
+			modified := bytes.Clone(encrypted)
+			modified[firstChunk-1] ^= 1
+			return modified
+		}},
+		{"not encrypted", c, func() []byte { return []byte("plain text data") }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := io.ReadAll(test.cipher.decrypt(bytes.NewReader(test.file()))); err == nil {
+				t.Error("decryption succeeded, want an error")
+			}
+		})
+	}
+}
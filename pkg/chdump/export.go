@@ -0,0 +1,1493 @@
+package chdump
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// exportServer exports the databases, user-defined functions and access entities of the server, laying out the
+// dump per database when more than one database is exported or multiDatabase is set
+func exportServer(ctx context.Context, config Options, multiDatabase bool) error {
+	// Create and test the database connection
+	db, err := createDBConnection(ctx, config, config.DBName)
+	if err != nil {
+		return fmt.Errorf("database connection failed: %w", err)
+	}
+	defer db.Close()
+	if config.serverVersion, err = checkServerVersion(ctx, db, config, exportFeatures); err != nil {
+		return err
+	}
+
+	databases, err := serverDatabases(ctx, db, config)
+	if err != nil {
+		return fmt.Errorf("failed to resolve databases: %w", err)
+	}
+
+	// Export each database, laying out the dump per database when more than one is exported
+	multiDatabase = multiDatabase || config.AllDatabases || config.Timestamped || len(databases) > 1
+	if config.Timestamped && config.timestamp == "" {
+		config.timestamp = time.Now().UTC().Format(TimestampFormat)
+	}
+	if !config.Estimate {
+		// With a single database, the schema and data directories are created in the working directory
+		dumpDir := "."
+		if multiDatabase {
+			dumpDir = config.DumpDir
+		}
+		if err := checkDiskSpace(ctx, db, config, databases, dumpDir); err != nil {
+			return err
+		}
+	}
+	var failedDatabases []string
+	for i, dbName := range databases {
+		// Fetch the credentials again so that a long run picks up rotated ones
+		if i > 0 {
+			if err := refreshCredentials(ctx, &config); err != nil {
+				return fmt.Errorf("failed to fetch credentials: %w", err)
+			}
+		}
+		dbDir, err := databaseDir(config, dbName, multiDatabase, true)
+		if err == nil {
+			dbConfig, schemaDir, dataDir := databaseConfig(config, dbName, dbDir)
+			err = exportDatabase(ctx, db, dbConfig, schemaDir, dataDir)
+			if config.Timestamped && !config.Estimate {
+				if finishErr := finishTimestampedDump(config, dbDir, err); finishErr != nil {
+					log.Printf("Warning: failed to finish the timestamped dump %s: %v", dbDir, finishErr)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Error exporting database %s: %v", dbName, err)
+			if config.FailFast || ctx.Err() != nil {
+				return fmt.Errorf("error processing tables: %w", err)
+			}
+			failedDatabases = append(failedDatabases, dbName)
+		}
+	}
+	if !config.Estimate {
+		if err := exportFunctions(ctx, db, config, serverDir(config, multiDatabase, "functions")); err != nil {
+			return fmt.Errorf("error exporting user-defined functions: %w", err)
+		}
+		if err := exportNamedCollections(ctx, db, config, serverDir(config, multiDatabase, "named_collections")); err != nil {
+			return fmt.Errorf("error exporting named collections: %w", err)
+		}
+	}
+	if config.IncludeAccess && !config.Estimate {
+		if err := exportAccess(ctx, db, config, serverDir(config, multiDatabase, "access")); err != nil {
+			return fmt.Errorf("error exporting access entities: %w", err)
+		}
+	}
+	if len(failedDatabases) > 0 {
+		return fmt.Errorf("error processing tables of %d database(s): %s", len(failedDatabases), strings.Join(failedDatabases, ", "))
+	}
+	return nil
+}
+
+// listTables writes the databases and tables the export selects, with their engines
+func listTables(ctx context.Context, config Options, w io.Writer) error {
+	db, err := createDBConnection(ctx, config, config.DBName)
+	if err != nil {
+		return fmt.Errorf("database connection failed: %w", err)
+	}
+	defer db.Close()
+	if config.serverVersion, err = checkServerVersion(ctx, db, config, exportFeatures); err != nil {
+		return err
+	}
+
+	databases, err := serverDatabases(ctx, db, config)
+	if err != nil {
+		return fmt.Errorf("failed to resolve databases: %w", err)
+	}
+
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "DATABASE\tTABLE\tENGINE\n")
+	for _, dbName := range databases {
+		var tables []string
+		var metadata map[string]TableMetadata
+		err := withRetry(ctx, config.Retry, "fetching tables of "+dbName, func() (err error) {
+			if tables, err = getTables(ctx, db, dbName); err != nil {
+				return err
+			}
+			metadata, err = getTableMetadata(ctx, db, dbName)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch tables of %s: %w", dbName, err)
+		}
+		for _, table := range filterTables(config, tables) {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", dbName, table, metadata[table].Engine)
+		}
+	}
+	return writer.Flush()
+}
+
+// Shard is a shard of a cluster with the native protocol addresses of its replicas
+type Shard struct {
+	Num      int
+	Replicas []string
+}
+
+// exportCluster exports every shard of the cluster into <dumpDir>/shard_<num>, connecting to the replicas of the
+// shard with failover, and exporting up to ParallelShards shards at a time
+func exportCluster(ctx context.Context, config Options) error {
+	if config.SSH.Destination != "" {
+		return errors.New("the SSH tunnel does not support cluster exports")
+	}
+	db, err := createDBConnection(ctx, config, config.DBName)
+	if err != nil {
+		return fmt.Errorf("database connection failed: %w", err)
+	}
+	var shards []Shard
+	err = withRetry(ctx, config.Retry, "fetching shards", func() (err error) {
+		shards, err = getClusterShards(ctx, db, config.Cluster)
+		return err
+	})
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("failed to fetch shards: %w", err)
+	}
+	if len(shards) == 0 {
+		return fmt.Errorf("cluster %s not found in system.clusters", config.Cluster)
+	}
+	log.Printf("Exporting %d shard(s) of cluster %s", len(shards), config.Cluster)
+
+	var (
+		wg           sync.WaitGroup
+		mu           sync.Mutex
+		failedShards []int
+		workers      = make(chan struct{}, max(config.ParallelShards, 1))
+	)
+	for _, shard := range shards {
+		shardConfig := config
+		shardConfig.Host = strings.Join(shard.Replicas, ",")
+		shardConfig.HostStrategy = "failover"
+		shardConfig.DumpDir = filepath.Join(config.DumpDir, fmt.Sprintf("shard_%d", shard.Num))
+
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			log.Printf("Exporting shard %d from %s to %s", shard.Num, shardConfig.Host, shardConfig.DumpDir)
+			if err := exportServer(ctx, shardConfig, true); err != nil {
+				log.Printf("Error exporting shard %d: %v", shard.Num, err)
+				mu.Lock()
+				failedShards = append(failedShards, shard.Num)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failedShards) > 0 {
+		sort.Ints(failedShards)
+		return fmt.Errorf("failed to export %d shard(s): %v", len(failedShards), failedShards)
+	}
+	return nil
+}
+
+// getClusterShards returns the shards of the cluster in shard order, with the replicas of each shard in
+// replica order
+func getClusterShards(ctx context.Context, db *sql.DB, cluster string) ([]Shard, error) {
+	rows, err := db.QueryContext(ctx, "SELECT shard_num, host_name, port FROM system.clusters WHERE cluster = ? ORDER BY shard_num, replica_num", cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shards []Shard
+	for rows.Next() {
+		var shardNum uint32
+		var hostName string
+		var port uint16
+		if err := rows.Scan(&shardNum, &hostName, &port); err != nil {
+			return nil, err
+		}
+		if len(shards) == 0 || shards[len(shards)-1].Num != int(shardNum) {
+			shards = append(shards, Shard{Num: int(shardNum)})
+		}
+		shard := &shards[len(shards)-1]
+		shard.Replicas = append(shard.Replicas, net.JoinHostPort(hostName, strconv.Itoa(int(port))))
+	}
+	return shards, rows.Err()
+}
+
+// exportFunctions dumps the CREATE FUNCTION statements of the SQL user-defined functions, one file per function
+func exportFunctions(ctx context.Context, db *sql.DB, config Options, dir string) error {
+	functions := make(map[string]string)
+	err := withRetry(ctx, config.Retry, "fetching user-defined functions", func() error {
+		rows, err := db.QueryContext(ctx, "SELECT name, create_query FROM system.functions WHERE origin = 'SQLUserDefined' ORDER BY name")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name, createStmt string
+			if err := rows.Scan(&name, &createStmt); err != nil {
+				return err
+			}
+			functions[name] = createStmt
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+	if len(functions) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create functions directory: %w", err)
+	}
+	for name, createStmt := range functions {
+		if err := writeDumpFile(config, filepath.Join(dir, name+".sql"), []byte(createStmt)); err != nil {
+			return err
+		}
+	}
+	log.Printf("Exported %d user-defined function(s) to %s", len(functions), dir)
+	return nil
+}
+
+// accessEntities lists the kinds of access entities in the order they are restored, with the query listing the
+// entities that are not defined in users.xml by name and, for row policies, the database and table they apply to
+var accessEntities = []struct {
+	File  string
+	Kind  string
+	Query string
+}{
+	{"roles", "ROLE", "SELECT name, '', '' FROM system.roles WHERE storage != 'users.xml' ORDER BY name"},
+	{"settings_profiles", "SETTINGS PROFILE", "SELECT name, '', '' FROM system.settings_profiles WHERE storage != 'users.xml' ORDER BY name"},
+	{"users", "USER", "SELECT name, '', '' FROM system.users WHERE storage != 'users.xml' ORDER BY name"},
+	{"row_policies", "ROW POLICY", "SELECT short_name, database, table FROM system.row_policies WHERE storage != 'users.xml' ORDER BY name"},
+	{"quotas", "QUOTA", "SELECT name, '', '' FROM system.quotas WHERE storage != 'users.xml' ORDER BY name"},
+}
+
+// exportAccess dumps the definitions of the access entities into one file per kind and the grants of the users
+// and roles into grants.sql, one statement per line
+func exportAccess(ctx context.Context, db *sql.DB, config Options, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create access directory: %w", err)
+	}
+
+	var grantees []string
+	for _, entity := range accessEntities {
+		var names, statements []string
+		err := withRetry(ctx, config.Retry, "exporting "+entity.File, func() (err error) {
+			if names, err = queryAccessNames(ctx, db, entity.Query); err != nil {
+				return err
+			}
+			statements = nil
+			for _, name := range names {
+				createStmts, err := queryStrings(ctx, db, fmt.Sprintf("SHOW CREATE %s %s", entity.Kind, name))
+				if err != nil {
+					return err
+				}
+				statements = append(statements, createStmts...)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", entity.File, err)
+		}
+		if err := writeStatements(config, filepath.Join(dir, entity.File+".sql"), statements); err != nil {
+			return err
+		}
+		log.Printf("Exported %d %s", len(statements), strings.ReplaceAll(entity.File, "_", " "))
+		if entity.Kind == "USER" || entity.Kind == "ROLE" {
+			grantees = append(grantees, names...)
+		}
+	}
+
+	var grants []string
+	for _, grantee := range grantees {
+		err := withRetry(ctx, config.Retry, "exporting grants of "+grantee, func() error {
+			granteeGrants, err := queryStrings(ctx, db, "SHOW GRANTS FOR "+grantee)
+			if err == nil {
+				grants = append(grants, granteeGrants...)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export grants of %s: %w", grantee, err)
+		}
+	}
+	log.Printf("Exported %d grants", len(grants))
+	return writeStatements(config, filepath.Join(dir, "grants.sql"), grants)
+}
+
+// queryAccessNames runs a query listing access entities and returns their quoted names
+func queryAccessNames(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name, database, table string
+		if err := rows.Scan(&name, &database, &table); err != nil {
+			return nil, err
+		}
+		name = quoteIdentifier(name)
+		if database != "" {
+			name += " ON " + qualifiedName(database, table)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// queryStrings runs a query returning a single string column and collects its values
+func queryStrings(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// writeStatements writes SQL statements to a file, one per line
+func writeStatements(config Options, path string, statements []string) error {
+	var content strings.Builder
+	for _, statement := range statements {
+		content.WriteString(strings.ReplaceAll(statement, "\n", " ") + ";\n")
+	}
+	return writeDumpFile(config, path, []byte(content.String()))
+}
+
+// exportDatabase estimates or exports the schema and data of a single database
+func exportDatabase(ctx context.Context, db *sql.DB, config Options, schemaDir, dataDir string) error {
+	if config.Estimate {
+		return estimateExport(ctx, db, config)
+	}
+
+	// Prepare directories for schema and data dumps
+	if err := createDirectories(schemaDir, dataDir); err != nil {
+		return err
+	}
+
+	// Keep the engine, settings and comment of the database
+	err := withRetry(ctx, config.Retry, "dumping schema of database "+config.DBName, func() error {
+		return dumpDatabaseSchema(ctx, db, config, schemaDir)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dump schema of database %s: %w", config.DBName, err)
+	}
+
+	// Fetch all tables and process each one
+	return processTables(ctx, db, config, schemaDir, dataDir)
+}
+
+// serverDatabases returns the databases to export, listing all user databases when requested
+func serverDatabases(ctx context.Context, db *sql.DB, config Options) ([]string, error) {
+	if !config.AllDatabases {
+		return config.Databases, nil
+	}
+
+	var databases []string
+	err := withRetry(ctx, config.Retry, "fetching databases", func() error {
+		rows, err := db.QueryContext(ctx, "SELECT name FROM system.databases WHERE name NOT IN ('system', 'INFORMATION_SCHEMA', 'information_schema') ORDER BY name")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		databases = nil
+		for rows.Next() {
+			var database string
+			if err := rows.Scan(&database); err != nil {
+				return err
+			}
+			databases = append(databases, database)
+		}
+		return rows.Err()
+	})
+	return databases, err
+}
+
+// createDirectories ensures the schema and data directories exist
+func createDirectories(schemaDir, dataDir string) error {
+	if err := os.MkdirAll(schemaDir, 0755); err != nil {
+		return fmt.Errorf("failed to create schema directory: %w", err)
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	return nil
+}
+
+// processTables fetches all tables and dumps their schema and data
+func processTables(ctx context.Context, db *sql.DB, config Options, schemaDir, dataDir string) (err error) {
+	report := &Report{Operation: "export", DBName: config.DBName, StartedAt: time.Now()}
+	defer func() {
+		if reportErr := writeReport(config, report, err); reportErr != nil {
+			log.Printf("Failed to write report: %v", reportErr)
+		}
+	}()
+
+	var tables []string
+	err = withRetry(ctx, config.Retry, "fetching tables", func() (err error) {
+		tables, err = getTables(ctx, db, config.DBName)
+		return err
+	})
+	tables = filterTables(config, tables)
+	if err != nil {
+		return fmt.Errorf("failed to fetch tables: %w", err)
+	}
+
+	var dictionaries []string
+	err = withRetry(ctx, config.Retry, "fetching dictionaries", func() (err error) {
+		dictionaries, err = getDictionaries(ctx, db, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch dictionaries: %w", err)
+	}
+	dictionaries = filterTables(config, dictionaries)
+	tables = slices.DeleteFunc(tables, func(table string) bool {
+		return slices.Contains(dictionaries, table)
+	})
+
+	var metadata map[string]TableMetadata
+	err = withRetry(ctx, config.Retry, "fetching table engines", func() (err error) {
+		metadata, err = getTableMetadata(ctx, db, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch table engines: %w", err)
+	}
+	if config.DistributedData {
+		assignDistributedData(config.DBName, metadata)
+	}
+	tables = slices.DeleteFunc(tables, func(table string) bool {
+		if !isInnerTable(table) {
+			return false
+		}
+		log.Printf("Skipping table %s: its data is exported with its materialized view", table)
+		return true
+	})
+	tables = slices.DeleteFunc(slices.Clone(tables), func(table string) bool {
+		base, ok := strings.CutSuffix(table, snapshotSuffix)
+		if !ok || !slices.Contains(tables, base) {
+			return false
+		}
+		log.Printf("Skipping table %s: it is the snapshot table of a frozen export", table)
+		return true
+	})
+
+	watermarks, err := loadWatermarkStore(config.WatermarkFile)
+	if err != nil {
+		return fmt.Errorf("failed to load watermarks: %w", err)
+	}
+
+	state, err := loadState(config, "export")
+	if err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+
+	var failedTables []string
+	for _, dictionary := range dictionaries {
+		tableReport := startTableReport(report, dictionary)
+		err := withRetry(ctx, config.Retry, "dumping schema of dictionary "+dictionary, func() error {
+			return dumpDictionarySchema(ctx, db, config, dictionary, schemaDir)
+		})
+		finishTableReport(config, report, tableReport, err)
+		if err != nil {
+			log.Printf("Error exporting dictionary %s: %v", dictionary, err)
+			if config.FailFast || ctx.Err() != nil {
+				return fmt.Errorf("failed to export dictionary %s: %w", dictionary, err)
+			}
+			failedTables = append(failedTables, dictionary)
+			continue
+		}
+		log.Printf("Schema exported for dictionary %s", dictionary)
+	}
+
+	reportProgress(config, Progress{Operation: "export", Tables: len(tables)})
+	var pending []string
+	for _, table := range tables {
+		if slices.Contains(state.CompletedTables, table) {
+			log.Printf("Skipping table %s: already exported in a previous run", table)
+			skipTableReport(config, report, table)
+			continue
+		}
+		pending = append(pending, table)
+	}
+	config.sortingKeys = sortingKeys(config, metadata, pending)
+	if config.Since != "" || config.Until != "" {
+		config.dateColumns = dateColumns(config, metadata, pending)
+	}
+	flushBuffers(ctx, db, config, metadata, tables)
+	if len(config.FinalTables) > 0 {
+		config.finalTables = finalTables(config, metadata, pending)
+	}
+	if config.Freeze {
+		snapshots, err := freezeTables(ctx, db, config, pending, metadata)
+		defer dropSnapshots(context.WithoutCancel(ctx), db, config, snapshots)
+		if err != nil {
+			return fmt.Errorf("failed to freeze tables: %w", err)
+		}
+		config.snapshots = snapshots
+	}
+	if config.ParallelTables > 1 {
+		if pending, err = scheduleExport(ctx, db, config, pending); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	err = runTables(pending, config.ParallelTables, func(table string) error {
+		tableReport := startTableReport(report, table)
+		err := processTable(ctx, db, config, table, schemaDir, dataDir, watermarks, metadata, state, tableReport)
+		finishTableReport(config, report, tableReport, err)
+		if err != nil {
+			log.Printf("Error exporting table %s: %v", table, err)
+			if config.FailFast || ctx.Err() != nil {
+				return fmt.Errorf("failed to export table %s: %w", table, err)
+			}
+			mu.Lock()
+			failedTables = append(failedTables, table)
+			mu.Unlock()
+			return nil
+		}
+		if err := markTableCompleted(config.StateFile, state, table); err != nil {
+			return fmt.Errorf("failed to save state: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	exportedDictionaries := slices.DeleteFunc(slices.Clone(dictionaries), func(dictionary string) bool {
+		return slices.Contains(failedTables, dictionary)
+	})
+	if err := writeManifest(ctx, db, config, schemaDir, dataDir, state.CompletedTables, exportedDictionaries, metadata); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if len(failedTables) > 0 {
+		return fmt.Errorf("%d of %d table(s) failed: %s", len(failedTables), len(tables)+len(dictionaries), strings.Join(failedTables, ", "))
+	}
+	return nil
+}
+
+// scheduleExport orders the tables exported in parallel largest first by the uncompressed size of their active
+// parts, and logs the predicted duration and critical path of the export
+func scheduleExport(ctx context.Context, db *sql.DB, config Options, tables []string) ([]string, error) {
+	var tableSizes map[string]TableSize
+	err := withRetry(ctx, config.Retry, "fetching table sizes", func() (err error) {
+		tableSizes, err = getTableSizes(ctx, db, config.DBName)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch table sizes: %w", err)
+	}
+	sizes := make(map[string]int64)
+	for table, size := range tableSizes {
+		sizes[table] = size.UncompressedBytes
+	}
+	tables = largestFirst(tables, sizes)
+	logSchedule(config, "export", tables, sizes)
+	return tables, nil
+}
+
+// writeManifest writes the manifest describing the exported files of the given tables. The checksum of a table is
+// only recorded when its data was read from a snapshot, which still holds the exported data: the live table may have
+// changed since.
+func writeManifest(ctx context.Context, db *sql.DB, config Options, schemaDir, dataDir string, tables, dictionaries []string, metadata map[string]TableMetadata) error {
+	manifest := Manifest{ToolVersion: Version, DBName: config.DBName, ServerVersion: config.serverVersion, CreatedAt: time.Now().UTC()}
+	if manifest.ServerVersion == "" {
+		var err error
+		if manifest.ServerVersion, err = serverVersion(ctx, db, config); err != nil {
+			return err
+		}
+	}
+
+	if len(config.snapshots) == 0 {
+		log.Printf("No table checksums are recorded in the manifest: they require -freeze")
+	}
+	shardingKeys := localShardingKeys(config.DBName, metadata)
+	for _, table := range tables {
+		manifestTable := ManifestTable{Name: table, PartitionKey: metadata[table].PartitionKey, SortingKey: metadata[table].SortingKey,
+			ShardingKey: cmp.Or(metadata[table].ShardingKey, shardingKeys[table])}
+
+		schemaFile, err := describeFile(filepath.Join(schemaDir, table+".sql"))
+		if err != nil {
+			return err
+		}
+		manifestTable.Files = append(manifestTable.Files, schemaFile)
+
+		files, err := dataFiles(config, dataDir, table)
+		if err != nil {
+			return err
+		}
+		if metadata[table].Engine == "MaterializedView" {
+			manifestTable.MaterializedView, manifestTable.Target = "inner", metadata[table].Target
+			if manifestTable.Target != "" {
+				manifestTable.MaterializedView = "to"
+			}
+		}
+		_, incremental := config.IncrementalColumns[table]
+		_, tenants := config.TenantColumns[table]
+		switch {
+		case manifestTable.MaterializedView == "to" || !hasData(config, metadata[table]):
+			// The data is exported with the TO table, or not at all
+		case tenants:
+			// The data is exported into the dumps of the tenants
+			files = nil
+		case incremental:
+			files = []string{deltaFilePath(config, dataDir, table)}
+			manifestTable.Incremental = true
+		case config.snapshots[table] == "":
+			if len(config.snapshots) > 0 {
+				log.Printf("No checksum recorded for table %s: its data was exported live", table)
+			}
+		default:
+			columns, err := selectColumns(ctx, db, config, table)
+			if err != nil {
+				return err
+			}
+			err = withRetry(ctx, config.Retry, "computing checksum of "+table, func() (err error) {
+				manifestTable.Checksum, err = getTableChecksum(ctx, db, sourceFrom(config, table), columns, tableWhereClause(config, table, ""))
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to compute checksum of table %s: %w", table, err)
+			}
+		}
+		if err := describeDataFiles(config, &manifestTable, files); err != nil {
+			return err
+		}
+
+		manifest.Tables = append(manifest.Tables, manifestTable)
+	}
+
+	for _, dictionary := range dictionaries {
+		schemaFile, err := describeFile(filepath.Join(schemaDir, dictionarySchemaDir, dictionary+".sql"))
+		if err != nil {
+			return err
+		}
+		manifest.Dictionaries = append(manifest.Dictionaries, ManifestTable{Name: dictionary, Files: []ManifestFile{schemaFile}})
+	}
+	if _, err := os.Stat(databaseSchemaFile(schemaDir)); err == nil {
+		databaseFile, err := describeFile(databaseSchemaFile(schemaDir))
+		if err != nil {
+			return err
+		}
+		manifest.Database = &databaseFile
+	}
+
+	return saveManifest(config, manifest)
+}
+
+// saveManifest writes the manifest to the manifest file, and signs it when a signing key is configured
+func saveManifest(config Options, manifest Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Printf("Writing manifest for %d table(s) to %s", len(manifest.Tables), config.ManifestFile)
+	if err := os.WriteFile(config.ManifestFile, content, 0644); err != nil {
+		return err
+	}
+	if config.GPG.SignKey != "" {
+		return signManifest(config)
+	}
+	return nil
+}
+
+// describeDataFiles adds the existing data files of a table to its manifest entry, with their rows. The rows of a
+// table split into parts are those of all of its parts.
+func describeDataFiles(config Options, manifestTable *ManifestTable, files []string) error {
+	for _, dataFile := range files {
+		dataFileInfo, err := os.Stat(dataFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		manifestFile, err := describeFile(dataFile)
+		if err != nil {
+			return err
+		}
+		rows, err := countFileRows(config.Format, dataFile)
+		if err != nil {
+			return err
+		}
+		manifestTable.Files = append(manifestTable.Files, manifestFile)
+		manifestTable.Rows += rows
+		manifestTable.ExportedAt = dataFileInfo.ModTime().UTC()
+	}
+	return nil
+}
+
+// processTable dumps the schema and data of a single table
+func processTable(ctx context.Context, db *sql.DB, config Options, table, schemaDir, dataDir string, watermarks *watermarkStore, metadata map[string]TableMetadata, state *State, tableReport *TableReport) error {
+	err := withRetry(ctx, config.Retry, "dumping schema of "+table, func() error {
+		return dumpTableSchema(ctx, db, config, table, schemaDir)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dump schema: %w", err)
+	}
+
+	if target := metadata[table].Target; target != "" {
+		log.Printf("Skipping data of materialized view %s: it is exported with its TO table %s", table, target)
+		return nil
+	}
+	if tableMetadata := metadata[table]; !hasData(config, tableMetadata) {
+		switch {
+		case tableMetadata.DataThrough != "":
+			log.Printf("Skipping data of table %s: it is exported through Distributed table %s", table, tableMetadata.DataThrough)
+		case tableMetadata.Local != "":
+			log.Printf("Skipping data of Distributed table %s: it is exported with its local table %s", table, qualifiedName(tableMetadata.LocalDB, tableMetadata.Local))
+		default:
+			log.Printf("Skipping data of table %s: %s tables are exported without data", table, tableMetadata.Engine)
+		}
+		tableReport.Status = statusSkipped
+		return nil
+	}
+
+	if column, ok := config.TenantColumns[table]; ok {
+		if err := dumpTenantData(ctx, config, table, column, schemaDir, dataDir, db, tableReport); err != nil {
+			return fmt.Errorf("failed to dump data per tenant: %w", err)
+		}
+		return nil
+	}
+	if column, ok := config.IncrementalColumns[table]; ok {
+		if err := dumpTableDelta(ctx, config, table, column, dataDir, db, watermarks, tableReport); err != nil {
+			return fmt.Errorf("failed to dump incremental data: %w", err)
+		}
+		return nil
+	}
+	if partitions := tablePartitions(config, table); len(partitions) > 0 {
+		if err := dumpPartitionData(ctx, config, table, partitions, dataDir, db, tableReport); err != nil {
+			return fmt.Errorf("failed to dump data of partitions: %w", err)
+		}
+		return nil
+	}
+	// A watched export follows the changes of MergeTree tables per partition
+	if config.watch != nil && strings.HasSuffix(metadata[table].Engine, "MergeTree") {
+		if err := dumpChangedPartitions(ctx, config, table, dataDir, db, tableReport); err != nil {
+			return fmt.Errorf("failed to dump changed partitions: %w", err)
+		}
+		return nil
+	}
+	if err := dumpTableData(ctx, config, table, dataDir, db, state, tableReport); err != nil {
+		return fmt.Errorf("failed to dump data: %w", err)
+	}
+	return nil
+}
+
+// TableSize holds the row count and on-disk sizes of a table
+type TableSize struct {
+	Rows              int
+	CompressedBytes   int64
+	UncompressedBytes int64
+}
+
+// estimateExport prints the per-table sizes from system.parts and system.columns together with
+// the predicted dump size and duration. The TSV dump is predicted to be as large as the uncompressed data.
+func estimateExport(ctx context.Context, db *sql.DB, config Options) error {
+	var tables []string
+	var sizes map[string]TableSize
+	err := withRetry(ctx, config.Retry, "fetching table sizes", func() (err error) {
+		if tables, err = getTables(ctx, db, config.DBName); err != nil {
+			return err
+		}
+		sizes, err = getTableSizes(ctx, db, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch table sizes: %w", err)
+	}
+	tables = filterTables(config, tables)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "TABLE\tROWS\tCOMPRESSED\tUNCOMPRESSED\n")
+	var total TableSize
+	for _, table := range tables {
+		size := sizes[table]
+		if size.Rows == 0 {
+			// Tables outside the MergeTree family have no parts, so their rows are counted directly
+			if size.Rows, err = getTotalRowsWithRetry(ctx, config, table, "", db); err != nil {
+				return fmt.Errorf("failed to count rows of table %s: %w", table, err)
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\n", table, size.Rows, FormatBytes(size.CompressedBytes), FormatBytes(size.UncompressedBytes))
+		total.Rows += size.Rows
+		total.CompressedBytes += size.CompressedBytes
+		total.UncompressedBytes += size.UncompressedBytes
+	}
+	fmt.Fprintf(writer, "TOTAL\t%d\t%s\t%s\n", total.Rows, FormatBytes(total.CompressedBytes), FormatBytes(total.UncompressedBytes))
+	writer.Flush()
+
+	duration := time.Duration(float64(total.UncompressedBytes) / (config.EstimateThroughput * 1024 * 1024) * float64(time.Second))
+	fmt.Printf("Predicted dump size: %s\n", FormatBytes(total.UncompressedBytes))
+	fmt.Printf("Predicted duration at %.0f MB/s: %s\n", config.EstimateThroughput, duration.Round(time.Second))
+	if config.ParallelTables > 1 {
+		uncompressed := make(map[string]int64)
+		for _, table := range tables {
+			uncompressed[table] = sizes[table].UncompressedBytes
+		}
+		tables = largestFirst(tables, uncompressed)
+		duration, path := predictSchedule(tables, uncompressed, config.ParallelTables, config.EstimateThroughput)
+		fmt.Printf("Predicted duration with %d tables in parallel: %s\n", config.ParallelTables, duration.Round(time.Second))
+		fmt.Printf("Critical path: %s\n", formatPath(path, uncompressed))
+	}
+	return nil
+}
+
+// getTableSizes returns the sizes of the tables of the database that have active parts or column statistics
+func getTableSizes(ctx context.Context, db *sql.DB, dbName string) (map[string]TableSize, error) {
+	sizes := make(map[string]TableSize)
+
+	partsQuery := `SELECT table, sum(rows), sum(data_compressed_bytes), sum(data_uncompressed_bytes)
+		FROM system.parts WHERE database = ? AND active GROUP BY table`
+	if err := scanTableSizes(ctx, db, partsQuery, dbName, sizes, true); err != nil {
+		return nil, err
+	}
+
+	columnsQuery := `SELECT table, toUInt64(0), sum(data_compressed_bytes), sum(data_uncompressed_bytes)
+		FROM system.columns WHERE database = ? GROUP BY table`
+	if err := scanTableSizes(ctx, db, columnsQuery, dbName, sizes, false); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// scanTableSizes reads table sizes from the query into the map, keeping existing entries unless overwrite is set
+func scanTableSizes(ctx context.Context, db *sql.DB, query, dbName string, sizes map[string]TableSize, overwrite bool) error {
+	rows, err := db.QueryContext(ctx, query, dbName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table string
+		var size TableSize
+		if err := rows.Scan(&table, &size.Rows, &size.CompressedBytes, &size.UncompressedBytes); err != nil {
+			return err
+		}
+		if _, exists := sizes[table]; overwrite || !exists {
+			sizes[table] = size
+		}
+	}
+	return rows.Err()
+}
+
+// FormatBytes formats a byte count using binary units
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// markTableCompleted records the table as completed and drops its checkpoint
+func markTableCompleted(path string, state *State, table string) error {
+	return state.update(path, func() {
+		state.CompletedTables = append(state.CompletedTables, table)
+		delete(state.Checkpoints, table)
+	})
+}
+
+// filterTables returns the tables that pass the include and exclude filters
+func filterTables(config Options, tables []string) []string {
+	var selected []string
+	for _, table := range tables {
+		if isTableSelected(config, table) {
+			selected = append(selected, table)
+		}
+	}
+	return selected
+}
+
+// getDictionaries retrieves the names of all dictionaries created with
+// CREATE DICTIONARY in the specified database
+func getDictionaries(ctx context.Context, db *sql.DB, dbName string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM system.dictionaries WHERE database = ? ORDER BY name", dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dictionaries []string
+	for rows.Next() {
+		var dictionary string
+		if err := rows.Scan(&dictionary); err != nil {
+			return nil, err
+		}
+		dictionaries = append(dictionaries, dictionary)
+	}
+	return dictionaries, rows.Err()
+}
+
+// TableMetadata holds the engine of a table, the explicit TO table of a materialized view, and the local table of
+// a Distributed table
+type TableMetadata struct {
+	Engine  string
+	Target  string
+	LocalDB string
+	Local   string
+
+	// ExportsData is set on the Distributed table the data of its local table is exported through, and
+	// DataThrough on a local table to the Distributed table its data is exported through
+	ExportsData bool
+	DataThrough string
+
+	// SortingKey is the ORDER BY key of a MergeTree table
+	SortingKey string
+	// PartitionKey is the PARTITION BY key of a MergeTree table
+	PartitionKey string
+	// ShardingKey is the sharding key of a Distributed table
+	ShardingKey string
+}
+
+// getTableMetadata retrieves the engines of the tables of the specified database and the TO tables of its
+// materialized views. A materialized view storing its data in an implicit .inner table has no TO table.
+func getTableMetadata(ctx context.Context, db *sql.DB, dbName string) (map[string]TableMetadata, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, engine, create_table_query, sorting_key, partition_key FROM system.tables WHERE database = ?", dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]TableMetadata)
+	for rows.Next() {
+		var name, engine, createStmt, sortingKey, partitionKey string
+		if err := rows.Scan(&name, &engine, &createStmt, &sortingKey, &partitionKey); err != nil {
+			return nil, err
+		}
+		tableMetadata := TableMetadata{Engine: engine, SortingKey: sortingKey, PartitionKey: partitionKey}
+		switch engine {
+		case "MaterializedView":
+			tableMetadata.Target = materializedViewTarget(createStmt)
+		case "Distributed":
+			tableMetadata.LocalDB, tableMetadata.Local = distributedLocalTable(createStmt)
+			tableMetadata.LocalDB = cmp.Or(tableMetadata.LocalDB, dbName)
+			tableMetadata.ShardingKey = distributedShardingKey(createStmt)
+		}
+		metadata[name] = tableMetadata
+	}
+	return metadata, rows.Err()
+}
+
+// flushBuffers flushes the rows held in memory by the Buffer tables among the exported tables into their destination
+// tables with OPTIMIZE TABLE, so that the export of the destination tables includes them. The Buffer tables the
+// export does not select are left alone. A Buffer table that fails to flush is logged, and its rows are flushed by
+// ClickHouse in due time.
+func flushBuffers(ctx context.Context, db *sql.DB, config Options, metadata map[string]TableMetadata, tables []string) {
+	for _, table := range bufferTables(metadata, tables) {
+		if err := execWithRetry(ctx, db, config, "OPTIMIZE TABLE "+qualifiedName(config.DBName, table)); err != nil {
+			log.Printf("Warning: failed to flush Buffer table %s: %v", table, err)
+			continue
+		}
+		log.Printf("Flushed Buffer table %s into its destination table", table)
+	}
+}
+
+// bufferTables returns the Buffer tables among the tables, sorted
+func bufferTables(metadata map[string]TableMetadata, tables []string) []string {
+	var buffers []string
+	for _, table := range tables {
+		if metadata[table].Engine == "Buffer" {
+			buffers = append(buffers, table)
+		}
+	}
+	sort.Strings(buffers)
+	return buffers
+}
+
+// hasData checks if the data of a table is exported, which for a Distributed table means the data of the whole
+// cluster is exported through it
+func hasData(config Options, tableMetadata TableMetadata) bool {
+	if tableMetadata.DataThrough != "" {
+		return false
+	}
+	return tableMetadata.ExportsData || !skipsData(config, tableMetadata.Engine)
+}
+
+// assignDistributedData makes the first Distributed table over each local table export its data, so that the data
+// is exported exactly once, and skips the data of the local tables of the database read through them
+func assignDistributedData(dbName string, metadata map[string]TableMetadata) {
+	tables := make([]string, 0, len(metadata))
+	for table := range metadata {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	exportedThrough := make(map[string]string)
+	for _, table := range tables {
+		tableMetadata := metadata[table]
+		if tableMetadata.Engine != "Distributed" || tableMetadata.Local == "" {
+			continue
+		}
+		local := qualifiedName(tableMetadata.LocalDB, tableMetadata.Local)
+		if through, ok := exportedThrough[local]; ok {
+			log.Printf("Distributed table %s reads %s like %s, its data is exported through %s only", table, local, through, through)
+			continue
+		}
+		exportedThrough[local] = table
+		tableMetadata.ExportsData = true
+		metadata[table] = tableMetadata
+
+		if localMetadata, ok := metadata[tableMetadata.Local]; ok && tableMetadata.LocalDB == dbName {
+			localMetadata.DataThrough = table
+			metadata[tableMetadata.Local] = localMetadata
+		}
+	}
+}
+
+// materializedViewTarget returns the TO table of a CREATE MATERIALIZED VIEW statement, or an empty string
+// when it has none
+func materializedViewTarget(createStmt string) string {
+	if location := materializedViewQueryPattern.FindStringIndex(createStmt); location != nil {
+		createStmt = createStmt[:location[0]]
+	}
+	parts := materializedViewTargetPattern.FindStringSubmatch(createStmt)
+	if parts == nil {
+		return ""
+	}
+	return strings.ReplaceAll(parts[1], "`", "")
+}
+
+// dumpDictionarySchema dumps the definition of the specified dictionary
+func dumpDictionarySchema(ctx context.Context, db *sql.DB, config Options, dictionary, schemaDir string) error {
+	var createStmt string
+	query := fmt.Sprintf("SHOW CREATE DICTIONARY %s", qualifiedName(config.DBName, dictionary))
+	if err := db.QueryRowContext(ctx, query).Scan(&createStmt); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(schemaDir, dictionarySchemaDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeDumpFile(config, filepath.Join(dir, dictionary+".sql"), []byte(createStmt))
+}
+
+// dumpTableSchema dumps the schema of the specified table
+func dumpTableSchema(ctx context.Context, db *sql.DB, config Options, table, schemaDir string) error {
+	query := fmt.Sprintf("SHOW CREATE TABLE %s", qualifiedName(config.DBName, table))
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var createStmt string
+	for rows.Next() {
+		if err := rows.Scan(&createStmt); err != nil {
+			return err
+		}
+	}
+
+	schemaFile := fmt.Sprintf("%s/%s.sql", schemaDir, table)
+	return writeDumpFile(config, schemaFile, []byte(createStmt))
+}
+
+// dumpTableData dumps the data of the specified table using clickhouse-client in batches and logs the progress.
+// When the state holds a checkpoint for the table, the export continues after it and appends to the data file.
+func dumpTableData(ctx context.Context, config Options, table, dataDir string, db *sql.DB, state *State, tableReport *TableReport) error {
+	whereClause := tableWhereClause(config, table, "")
+	totalRows, err := getTotalRowsWithRetry(ctx, config, table, whereClause, db)
+	if err != nil {
+		return err
+	}
+	columns, err := selectColumns(ctx, db, config, table)
+	if err != nil {
+		return err
+	}
+
+	position := state.checkpoint(table)
+	if position.Key != "" {
+		log.Printf("Resuming export of table %s after %d rows", table, position.Rows)
+	}
+	output, err := createDataWriter(config, dataDir, table, position.Key != "")
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	return exportTableData(ctx, config, table, columns, whereClause, db, output, totalRows, position, tableReport, func(position TableCheckpoint) error {
+		return state.update(config.StateFile, func() {
+			state.Checkpoints[table] = position
+		})
+	})
+}
+
+// dumpTableDelta dumps only the rows newer than the stored high-water mark of the table
+// and appends them to a dated delta file
+func dumpTableDelta(ctx context.Context, config Options, table, column, dataDir string, db *sql.DB, watermarks *watermarkStore, tableReport *TableReport) error {
+	previous, ok, err := watermarks.begin(table)
+	if err != nil {
+		return err
+	}
+	var condition string
+	if ok {
+		condition = fmt.Sprintf("%s > %s", quoteIdentifier(column), quoteString(previous))
+	}
+
+	var (
+		totalRows     int
+		highWaterMark string
+	)
+	deltaQuery := fmt.Sprintf("SELECT count(), toString(max(%s)) FROM %s%s", quoteIdentifier(column), sourceFrom(config, table),
+		formatWhere(tableWhereClause(config, table, condition)))
+	err = withRetry(ctx, config.Retry, "fetching high-water mark of "+table, func() error {
+		return db.QueryRowContext(ctx, deltaQuery).Scan(&totalRows, &highWaterMark)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch high-water mark: %w", err)
+	}
+	if totalRows == 0 {
+		log.Printf("No new rows for table %s since %s", table, previous)
+		return nil
+	}
+	columns, err := selectColumns(ctx, db, config, table)
+	if err != nil {
+		return err
+	}
+
+	deltaFile, err := createDeltaFile(config, dataDir, table)
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	info, err := deltaFile.Stat()
+	if err != nil {
+		return err
+	}
+	if err := watermarks.prepare(table, pendingDelta{Watermark: highWaterMark, File: deltaFile.Name(), Size: info.Size()}); err != nil {
+		return fmt.Errorf("failed to record the pending delta: %w", err)
+	}
+	bounded := fmt.Sprintf("%s <= %s", quoteIdentifier(column), quoteString(highWaterMark))
+	if condition != "" {
+		bounded = condition + " AND " + bounded
+	}
+	output := &dataWriter{config: config, table: table, file: deltaFile, headed: info.Size() > 0}
+	if err := exportTableData(ctx, config, table, columns, tableWhereClause(config, table, bounded), db, output, totalRows, TableCheckpoint{}, tableReport, nil); err != nil {
+		return err
+	}
+	if err := deltaFile.Sync(); err != nil {
+		return err
+	}
+	return watermarks.commit(table, highWaterMark)
+}
+
+// getTotalRows returns the total number of rows in the specified table matching the optional WHERE clause
+func getTotalRows(ctx context.Context, from, whereClause string, db *sql.DB) (int, error) {
+	var totalRows int
+	countQuery := fmt.Sprintf("SELECT count() FROM %s%s", from, formatWhere(whereClause))
+	if err := db.QueryRowContext(ctx, countQuery).Scan(&totalRows); err != nil {
+		return 0, err
+	}
+	return totalRows, nil
+}
+
+// getTotalRowsWithRetry counts the rows of the table, retrying transient errors according to the retry policy
+func getTotalRowsWithRetry(ctx context.Context, config Options, table, whereClause string, db *sql.DB) (totalRows int, err error) {
+	err = withRetry(ctx, config.Retry, "counting rows of "+table, func() error {
+		totalRows, err = getTotalRows(ctx, sourceFrom(config, table), whereClause, db)
+		return err
+	})
+	return totalRows, err
+}
+
+// tableWhereClause combines the configured filter, sampling condition, partitions and date range of the table with an
+// additional condition
+func tableWhereClause(config Options, table, condition string) string {
+	return joinConditions(config.TableFilters[table], sampleCondition(config, table), partitionCondition(config, table),
+		dateRangeCondition(config, table), condition)
+}
+
+// joinConditions combines the non-empty conditions with AND
+func joinConditions(clauses ...string) string {
+	var conditions []string
+	for _, clause := range clauses {
+		if clause != "" {
+			conditions = append(conditions, "("+clause+")")
+		}
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// sampleResolution is the number of hash buckets used to select a sample, which bounds its precision
+const sampleResolution = 1000000
+
+// sampleCondition returns a deterministic condition selecting the configured sample fraction of the table's rows
+// by hashing the sample key, or all columns when no key is configured, or an empty string when sampling is disabled
+func sampleCondition(config Options, table string) string {
+	fraction := config.Sample
+	if override, ok := config.SampleOverrides[table]; ok {
+		fraction = override
+	}
+	if fraction <= 0 || fraction >= 1 {
+		return ""
+	}
+
+	key := "*"
+	if sampleKey, ok := config.SampleKeys[table]; ok {
+		key = sampleKey
+	}
+	return fmt.Sprintf("cityHash64(%s) %% %d < %d", key, sampleResolution, int(fraction*sampleResolution))
+}
+
+// formatWhere renders the optional WHERE clause for a query
+func formatWhere(whereClause string) string {
+	if whereClause == "" {
+		return ""
+	}
+	return " WHERE " + whereClause
+}
+
+// createDeltaFile opens the dated delta file of the table for appending, creating it if needed
+func createDeltaFile(config Options, dataDir, table string) (*os.File, error) {
+	deltaFile := deltaFilePath(config, dataDir, table)
+	if err := os.MkdirAll(filepath.Dir(deltaFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create delta directory: %w", err)
+	}
+	return os.OpenFile(deltaFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// deltaFilePath returns the path of today's delta file of the table
+func deltaFilePath(config Options, dataDir, table string) string {
+	return dataFilePath(config, filepath.Join(dataDir, "delta", time.Now().UTC().Format("2006-01-02")), table)
+}
+
+// exportTableData exports the table data in batches starting after the given checkpoint, logs the progress and
+// accumulates the exported rows and bytes in the table report.
+// The optional checkpoint function is called with the new checkpoint after each batch is written.
+// The batches of a table that does not fit in one, or whose export resumes from a checkpoint, are sorted by its paging
+// key and each starts after the key of the last row of the previous one, so that no batch reads the rows before it.
+func exportTableData(ctx context.Context, config Options, table, columns, whereClause string, db *sql.DB, output batchWriter, totalRows int, position TableCheckpoint, tableReport *TableReport, checkpoint func(position TableCheckpoint) error) error {
+	expectedRows := totalRows - position.Rows
+	exportedRows := 0
+	paged := position.Key != "" || totalRows > config.ChunkSize
+	key := pagingKey(config, table)
+	orderBy := orderByClause(config, table, paged)
+
+	for {
+		batchWhere := whereClause
+		if position.Key != "" {
+			batchWhere = joinConditions(batchWhere, keyCondition(key, ">", position))
+		}
+		var (
+			boundary TableCheckpoint
+			last     = true
+		)
+		if paged {
+			var err error
+			if boundary, last, err = batchBoundary(ctx, config, table, key, batchWhere, db); err != nil {
+				return fmt.Errorf("failed to find the end of the batch: %w", err)
+			}
+			if !last {
+				batchWhere = joinConditions(batchWhere, keyCondition(key, "<=", boundary))
+			}
+		}
+
+		rows, size, err := dumpBatch(ctx, config, table, columns, batchWhere, orderBy, output)
+		if err != nil {
+			return err
+		}
+		if err := output.finishBatch(rows); err != nil {
+			return fmt.Errorf("failed to close data file: %w", err)
+		}
+		exportedRows += rows
+		tableReport.Rows += rows
+		tableReport.Bytes += int64(size)
+		if err := config.RateLimit.limiter.wait(ctx, size, rows); err != nil {
+			return err
+		}
+
+		position.Rows += rows
+		logProgress(config, table, position.Rows, totalRows, tableReport.Bytes)
+		if last {
+			break
+		}
+
+		position.Key, position.Type = boundary.Key, boundary.Type
+		if checkpoint != nil {
+			if err := checkpoint(position); err != nil {
+				return fmt.Errorf("failed to save checkpoint: %w", err)
+			}
+		}
+	}
+
+	if exportedRows != expectedRows {
+		if config.Strict {
+			return fmt.Errorf("exported %d rows, expected %d", exportedRows, expectedRows)
+		}
+		log.Printf("Warning: exported %d rows of table %s, expected %d", exportedRows, table, expectedRows)
+	}
+	return nil
+}
+
+// batchBoundary returns the paging key of the last row of the next batch, whose rows match the WHERE clause, or
+// reports that the remaining rows fit in a single batch
+func batchBoundary(ctx context.Context, config Options, table, key, whereClause string, db *sql.DB) (boundary TableCheckpoint, last bool, err error) {
+	query := fmt.Sprintf("SELECT toString(tuple(%s)), toTypeName(tuple(%s)) FROM %s%s ORDER BY %s LIMIT 1 OFFSET %d%s", key, key,
+		sourceFrom(config, table), formatWhere(whereClause), key, config.ChunkSize-1, settingsClause(config.SelectSettings))
+	err = withRetry(ctx, config.Retry, "finding the end of the batch of "+table, func() error {
+		err := db.QueryRowContext(ctx, query).Scan(&boundary.Key, &boundary.Type)
+		if errors.Is(err, sql.ErrNoRows) {
+			last = true
+			return nil
+		}
+		return err
+	})
+	return boundary, last, err
+}
+
+// keyCondition compares the paging key of the rows with the key of a checkpoint
+func keyCondition(key, operator string, position TableCheckpoint) string {
+	return fmt.Sprintf("tuple(%s) %s CAST(%s, %s)", key, operator, quoteString(position.Key), quoteString(position.Type))
+}
+
+// dumpBatch executes the query to fetch a batch of data, writes it to the output file and returns the number of rows and bytes written
+func dumpBatch(ctx context.Context, config Options, table, columns, whereClause, orderBy string, output batchWriter) (int, int, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s%s%s%s", columns, sourceFrom(config, table), formatWhere(whereClause),
+		orderBy, settingsClause(config.SelectSettings))
+
+	var cmdOutput []byte
+	err := withRetry(ctx, config.Retry, "fetching batch of "+table, func() (err error) {
+		cmd := clickHouseClientCommand(ctx, config, "--query", query, "--format", config.Format.Name())
+		cmdOutput, err = cmd.Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return err
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to execute clickhouse-client: %w", err)
+	}
+
+	if err := output.writeBatch(cmdOutput); err != nil {
+		return 0, 0, fmt.Errorf("failed to write to output file: %w", err)
+	}
+	_, rows := splitHeader(config.Format, cmdOutput)
+	return config.Format.CountRows(rows), len(cmdOutput), nil
+}
+
+// sortingKeys returns the ORDER BY keys the data of the tables is sorted by. With OrderByPK, it logs the tables
+// without one, whose data is sorted by the hash of its rows.
+func sortingKeys(config Options, metadata map[string]TableMetadata, tables []string) map[string]string {
+	keys := make(map[string]string)
+	for _, table := range tables {
+		if key := metadata[table].SortingKey; key != "" {
+			keys[table] = key
+		} else if config.OrderByPK && metadata[table].Target == "" {
+			log.Printf("Table %s has no ORDER BY key: its data is sorted by the hash of its rows", table)
+		}
+	}
+	return keys
+}
+
+// finalEnginePattern matches the MergeTree engines that collapse, replace or aggregate the rows of a key on merge,
+// whose data SELECT ... FINAL reads as it is once fully merged
+var finalEnginePattern = regexp.MustCompile(`^(?:Replicated)?(?:Replacing|Collapsing|VersionedCollapsing|Summing|Aggregating|Coalescing|Graphite)MergeTree$`)
+
+// finalTables returns the tables matching the FINAL patterns whose data is read with FINAL, logging those whose
+// engine does not support it, whose data is exported as it is
+func finalTables(config Options, metadata map[string]TableMetadata, tables []string) map[string]bool {
+	final := make(map[string]bool)
+	for _, table := range tables {
+		if !matchesAnyPattern(config.FinalTables, table) {
+			continue
+		}
+		if !finalEnginePattern.MatchString(metadata[table].Engine) {
+			log.Printf("Table %s has the %s engine, which does not merge rows: its data is exported without FINAL", table, metadata[table].Engine)
+			continue
+		}
+		final[table] = true
+	}
+	return final
+}
+
+// sourceFrom returns the table expression the data of a table is read from: its qualified name, or that of its
+// snapshot table, followed by FINAL for the tables exported with FINAL, or the subquery of a named query
+func sourceFrom(config Options, table string) string {
+	if query, ok := config.queryTables[table]; ok {
+		return "(" + query + ")"
+	}
+	from := qualifiedName(config.DBName, sourceTable(config, table))
+	if config.finalTables[table] {
+		from += " FINAL"
+	}
+	return from
+}
+
+// orderByClause returns the ORDER BY clause sorting the exported data of a table by its paging key, with OrderByPK
+// or when its batches are paged
+func orderByClause(config Options, table string, paged bool) string {
+	if !config.OrderByPK && !paged {
+		return ""
+	}
+	return " ORDER BY " + pagingKey(config, table)
+}
+
+// pagingKey returns the key the batches of a table are paged by: its ORDER BY key, then the hash of the rows, so that
+// the rows with equal keys, and those of the tables without a key, are in a deterministic order too. Only identical
+// rows share a key, and a batch always ends after the last of them.
+func pagingKey(config Options, table string) string {
+	if key, ok := config.sortingKeys[table]; ok {
+		return key + ", cityHash64(*)"
+	}
+	return "cityHash64(*)"
+}
+
+// logProgress reports the progress of the data export to the progress callback, or logs it when there is none
+func logProgress(config Options, table string, exportedRows, totalRows int, bytes int64) {
+	if config.OnProgress != nil {
+		reportProgress(config, Progress{Operation: "export", Table: table, Rows: min(exportedRows, totalRows), TotalRows: totalRows, Bytes: bytes})
+		return
+	}
+	percentageExported := (float64(exportedRows) / float64(totalRows)) * 100
+	if percentageExported > 100 {
+		percentageExported = 100
+	}
+	log.Printf("Export progress for table %s: %.2f%%", table, percentageExported)
+}
@@ -0,0 +1,60 @@
+package chdump
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOrderByClause(t *testing.T) {
+	tests := []struct {
+		name  string
+		table string
+		paged bool
+		pk    bool
+		want  string
+	}{
+		{name: "paged by sorting key", table: "orders", paged: true, want: " ORDER BY customer_id, created_at, cityHash64(*)"},
+		{name: "paged without sorting key", table: "events", paged: true, want: " ORDER BY cityHash64(*)"},
+		{name: "single batch", table: "orders", want: ""},
+		{name: "single batch with orderByPK", table: "orders", pk: true, want: " ORDER BY customer_id, created_at, cityHash64(*)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Options{OrderByPK: test.pk, sortingKeys: map[string]string{"orders": "customer_id, created_at"}}
+			if got := orderByClause(config, test.table, test.paged); got != test.want {
+				t.Errorf("orderByClause() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestKeyCondition(t *testing.T) {
+	position := TableCheckpoint{Key: `(42,'it\'s',123)`, Type: "Tuple(UInt64, String, UInt64)"}
+	got := keyCondition("customer_id, name, cityHash64(*)", ">", position)
+	want := `tuple(customer_id, name, cityHash64(*)) > CAST('(42,\'it\\\'s\',123)', 'Tuple(UInt64, String, UInt64)')`
+	if got != want {
+		t.Errorf("keyCondition() = %q, want %q", got, want)
+	}
+}
+
+func TestJoinConditions(t *testing.T) {
+	if got, want := joinConditions("", "a = 1", "", "b > 2"), "(a = 1) AND (b > 2)"; got != want {
+		t.Errorf("joinConditions() = %q, want %q", got, want)
+	}
+	if got := joinConditions("", ""); got != "" {
+		t.Errorf("joinConditions() = %q, want no condition", got)
+	}
+}
+
+func TestBufferTables(t *testing.T) {
+	metadata := map[string]TableMetadata{
+		"events":        {Engine: "MergeTree"},
+		"events_buffer": {Engine: "Buffer"},
+		"logs_buffer":   {Engine: "Buffer"},
+		"audit_buffer":  {Engine: "Buffer"},
+	}
+	got := bufferTables(metadata, []string{"logs_buffer", "events", "events_buffer"})
+	if want := []string{"events_buffer", "logs_buffer"}; !slices.Equal(got, want) {
+		t.Errorf("bufferTables() = %v, want %v", got, want)
+	}
+}
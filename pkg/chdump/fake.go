@@ -0,0 +1,73 @@
+package chdump
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The values the fake names, cities and companies are picked from
+var (
+	fakeFirstNames = []string{"James", "Mary", "John", "Patricia", "Robert", "Jennifer", "Michael", "Linda", "William",
+		"Elizabeth", "David", "Barbara", "Richard", "Susan", "Joseph", "Jessica", "Thomas", "Sarah", "Charles", "Karen",
+		"Daniel", "Nancy", "Matthew", "Lisa", "Anthony", "Betty", "Mark", "Margaret", "Paul", "Sandra", "Steven",
+		"Ashley", "Andrew", "Emily", "Kenneth", "Donna", "Joshua", "Michelle", "Kevin", "Carol", "Brian", "Amanda",
+		"George", "Melissa", "Edward", "Deborah", "Ronald", "Stephanie", "Timothy", "Rebecca", "Jason", "Laura",
+		"Jeffrey", "Sharon", "Ryan", "Cynthia", "Jacob", "Kathleen", "Gary", "Amy", "Nicholas", "Angela", "Eric",
+		"Helen", "Jonathan", "Anna", "Stephen", "Brenda", "Larry", "Pamela", "Justin", "Nicole", "Scott", "Emma"}
+	fakeLastNames = []string{"Smith", "Johnson", "Williams", "Brown", "Jones", "Garcia", "Miller", "Davis", "Rodriguez",
+		"Martinez", "Hernandez", "Lopez", "Gonzalez", "Wilson", "Anderson", "Thomas", "Taylor", "Moore", "Jackson",
+		"Martin", "Lee", "Perez", "Thompson", "White", "Harris", "Sanchez", "Clark", "Ramirez", "Lewis", "Robinson",
+		"Walker", "Young", "Allen", "King", "Wright", "Scott", "Torres", "Nguyen", "Hill", "Flores", "Green", "Adams",
+		"Nelson", "Baker", "Hall", "Rivera", "Campbell", "Mitchell", "Carter", "Roberts", "Gomez", "Phillips", "Evans",
+		"Turner", "Diaz", "Parker", "Cruz", "Edwards", "Collins", "Reyes", "Stewart", "Morris", "Morales", "Murphy"}
+	fakeCities = []string{"Springfield", "Riverside", "Franklin", "Greenville", "Bristol", "Clinton", "Fairview",
+		"Salem", "Madison", "Georgetown", "Arlington", "Ashland", "Burlington", "Manchester", "Oxford", "Clayton",
+		"Jackson", "Milton", "Auburn", "Dayton", "Lexington", "Milford", "Winchester", "Hudson", "Kingston", "Newport"}
+	fakeCompanyWords = []string{"Acme", "Globex", "Initech", "Umbrella", "Stark", "Wayne", "Wonka", "Hooli", "Vandelay",
+		"Cyberdyne", "Soylent", "Tyrell", "Aperture", "Gringotts", "Monarch", "Oscorp", "Massive", "Dynamic",
+		"Pioneer", "Summit", "Evergreen", "Northwind", "Contoso", "Fabrikam"}
+	fakeCompanySuffixes = []string{"Inc", "LLC", "Ltd", "Group", "Holdings", "Systems", "Industries", "Labs", "Partners"}
+)
+
+// fakeValues build the expressions of the fake values of every kind, from a function returning the expression of
+// a hash of the masked value for each part of the fake value. A value is always replaced by the same fake value, so
+// that the masked columns still join across tables.
+var fakeValues = map[string]func(hash func(part string) string) string{
+	"firstName": func(hash func(string) string) string { return pickFake(fakeFirstNames, hash("first")) },
+	"lastName":  func(hash func(string) string) string { return pickFake(fakeLastNames, hash("last")) },
+	"name": func(hash func(string) string) string {
+		return fmt.Sprintf("concat(%s, ' ', %s)", pickFake(fakeFirstNames, hash("first")), pickFake(fakeLastNames, hash("last")))
+	},
+	"email": func(hash func(string) string) string {
+		return fmt.Sprintf("concat(lower(%s), '.', lower(%s), toString(%s %% 1000), '@example.com')",
+			pickFake(fakeFirstNames, hash("first")), pickFake(fakeLastNames, hash("last")), hash("number"))
+	},
+	// The phone numbers are in the 555-01XX range reserved for fiction
+	"phone": func(hash func(string) string) string {
+		return fmt.Sprintf("concat('+1-', toString(200 + %s %% 800), '-555-01', leftPad(toString(%s %% 100), 2, '0'))", hash("area"), hash("number"))
+	},
+	"city": func(hash func(string) string) string { return pickFake(fakeCities, hash("city")) },
+	"company": func(hash func(string) string) string {
+		return fmt.Sprintf("concat(%s, ' ', %s)", pickFake(fakeCompanyWords, hash("company")), pickFake(fakeCompanySuffixes, hash("suffix")))
+	},
+}
+
+// pickFake returns the expression picking one of the values by the hash
+func pickFake(values []string, hash string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = quoteString(value)
+	}
+	return fmt.Sprintf("arrayElement([%s], 1 + %s %% %d)", strings.Join(quoted, ", "), hash, len(values))
+}
+
+// fakeKinds returns the kinds of fake values in alphabetical order
+func fakeKinds() []string {
+	kinds := make([]string, 0, len(fakeValues))
+	for kind := range fakeValues {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
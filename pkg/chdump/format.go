@@ -0,0 +1,251 @@
+package chdump
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format is a format of the data files of a dump. The export asks ClickHouse for the data in the format and the
+// import inserts the data files with it, so a new format only has to implement this interface and be set in
+// Options.Format.
+type Format interface {
+	// Name returns the name of the format in the FORMAT clause of ClickHouse, e.g. TSV
+	Name() string
+	// Extension returns the extension of the data files, including the dot
+	Extension() string
+	// CountRows returns the number of rows in a chunk of the data as ClickHouse outputs it, which may end in the
+	// middle of a row
+	CountRows(data []byte) int
+}
+
+// Encoder is implemented by formats that transform the data ClickHouse outputs before it is written to the data
+// file, e.g. to compress it. Every batch of the export is encoded on its own and appended to the data file.
+type Encoder interface {
+	Encode(w io.Writer) io.WriteCloser
+}
+
+// Decoder is implemented by formats that transform the data file back into the data ClickHouse inserts
+type Decoder interface {
+	Decode(r io.Reader) (io.ReadCloser, error)
+}
+
+// Header is implemented by formats whose data starts with header lines describing the columns. ClickHouse outputs
+// the header with every batch of the export, so it is kept at the start of every data file only, and the rows of
+// the data leave it out.
+type Header interface {
+	// HeaderLines returns the number of header lines
+	HeaderLines() int
+}
+
+// tsvFormat is the tab-separated format, in which every row is exactly one line since newlines inside values are
+// escaped
+type tsvFormat struct{}
+
+func (tsvFormat) Name() string      { return "TSV" }
+func (tsvFormat) Extension() string { return ".tsv" }
+
+func (tsvFormat) CountRows(data []byte) int {
+	return bytes.Count(data, []byte("\n"))
+}
+
+// TSV is the default format of the data files
+var TSV Format = tsvFormat{}
+
+// tsvWithNamesAndTypesFormat is the tab-separated format starting with the names and types of the columns, which
+// the import checks against the target table and inserts the columns by name with
+type tsvWithNamesAndTypesFormat struct{ tsvFormat }
+
+func (tsvWithNamesAndTypesFormat) Name() string      { return "TSVWithNamesAndTypes" }
+func (tsvWithNamesAndTypesFormat) Extension() string { return ".typed.tsv" }
+func (tsvWithNamesAndTypesFormat) HeaderLines() int  { return 2 }
+
+// TSVWithNamesAndTypes is the format of the data files with the names and types of the columns in their header
+var TSVWithNamesAndTypes Format = tsvWithNamesAndTypesFormat{}
+
+// ParseFormat returns the format of the data files of a name, TSV or TSVWithNamesAndTypes
+func ParseFormat(name string) (Format, error) {
+	for _, format := range []Format{TSV, TSVWithNamesAndTypes} {
+		if strings.EqualFold(name, format.Name()) {
+			return format, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown format %q, expected TSV or TSVWithNamesAndTypes", name)
+}
+
+// headerLines returns the number of header lines of the data of the format, looking through the encryption
+func headerLines(format Format) int {
+	if encrypted, ok := format.(encryptedFormat); ok {
+		format = encrypted.Format
+	}
+	if header, ok := format.(Header); ok {
+		return header.HeaderLines()
+	}
+	return 0
+}
+
+// splitHeader splits data of the format as ClickHouse outputs it into its header and its rows
+func splitHeader(format Format, data []byte) ([]byte, []byte) {
+	end := 0
+	for range headerLines(format) {
+		i := bytes.IndexByte(data[end:], '\n')
+		if i < 0 {
+			return data, nil
+		}
+		end += i + 1
+	}
+	return data[:end], data[end:]
+}
+
+// dataFilePath returns the path of the data file of the table in the data directory
+func dataFilePath(config Options, dataDir, table string) string {
+	return filepath.Join(dataDir, table+config.Format.Extension())
+}
+
+// partFilePath returns the path of a numbered part of the data of the table in the data directory, such as
+// events.0001.tsv
+func partFilePath(config Options, dataDir, table string, part int) string {
+	return filepath.Join(dataDir, fmt.Sprintf("%s.%04d%s", table, part, config.Format.Extension()))
+}
+
+// partNumberPattern matches the part number at the end of the name of a part, without its extension
+var partNumberPattern = regexp.MustCompile(`^(.+)\.(\d{4,})$`)
+
+// dataFileTable returns the table of a data file of the data directory, whether it holds all of the data of the
+// table or of one of its partitions, or is one of their numbered parts
+func dataFileTable(config Options, name string) (string, bool) {
+	table, ok := strings.CutSuffix(name, config.Format.Extension())
+	if !ok {
+		return "", false
+	}
+	if parts := partNumberPattern.FindStringSubmatch(table); parts != nil {
+		table = parts[1]
+	}
+	if parts := partitionFilePattern.FindStringSubmatch(table); parts != nil {
+		table = parts[1]
+	}
+	return table, true
+}
+
+// dataFiles returns the data files of the table in the data directory: its single data file, its numbered parts in
+// order, and then the data files of its partitions with their parts, by partition. A table without data files has
+// none.
+func dataFiles(config Options, dataDir, table string) ([]string, error) {
+	var files []string
+	path := dataFilePath(config, dataDir, table)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dataDir)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	numbers := make(map[string]int)
+	partitions := make(map[string]string)
+	var parts []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), config.Format.Extension())
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dataDir, entry.Name())
+		match := partNumberPattern.FindStringSubmatch(name)
+		if match != nil {
+			name = match[1]
+			numbers[path], _ = strconv.Atoi(match[2])
+		}
+		if partition := partitionFilePattern.FindStringSubmatch(name); partition != nil && partition[1] == table {
+			partitions[path] = partition[2]
+		} else if name != table || match == nil {
+			continue
+		}
+		parts = append(parts, path)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		if partitions[parts[i]] != partitions[parts[j]] {
+			return partitions[parts[i]] < partitions[parts[j]]
+		}
+		return numbers[parts[i]] < numbers[parts[j]]
+	})
+	return append(files, parts...), nil
+}
+
+// hasDataFiles checks if the table has data files in the data directory
+func hasDataFiles(config Options, dataDir, table string) bool {
+	files, err := dataFiles(config, dataDir, table)
+	return err == nil && len(files) > 0
+}
+
+// writeBatch writes a batch of data as ClickHouse outputs it to the data file, encoding it if the format does
+func writeBatch(format Format, w io.Writer, data []byte) error {
+	encoder, ok := format.(Encoder)
+	if !ok {
+		_, err := w.Write(data)
+		return err
+	}
+	encoded := encoder.Encode(w)
+	if _, err := encoded.Write(data); err != nil {
+		encoded.Close()
+		return err
+	}
+	return encoded.Close()
+}
+
+// openDataFile opens the data file for reading the data ClickHouse inserts, decoding it if the format does
+func openDataFile(format Format, path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder, ok := format.(Decoder)
+	if !ok {
+		return file, nil
+	}
+	decoded, err := decoder.Decode(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return &decodedFile{ReadCloser: decoded, file: file}, nil
+}
+
+// decodedFile is a decoded data file, which closes the file together with its decoder
+type decodedFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+// Close closes the decoder and the file
+func (f *decodedFile) Close() error {
+	err := f.ReadCloser.Close()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// countFileRows returns the number of rows in the data file
+func countFileRows(format Format, path string) (int, error) {
+	dataFile, err := openDataFile(format, path)
+	if err != nil {
+		return 0, err
+	}
+	defer dataFile.Close()
+	reader := &countingReader{reader: dataFile, format: format}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return max(reader.rows-headerLines(format), 0), nil
+}
@@ -0,0 +1,124 @@
+package chdump
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// GPGConfig holds the settings of the gpg command, which encrypts the data keys of the dump files to GPG
+// recipients, signs the manifest of the export and verifies the signature on import
+type GPGConfig struct {
+	// Path is the path of the gpg command, gpg when unset
+	Path string
+	// SignKey is the key ID, fingerprint or user ID of the secret key signing the manifest of the export
+	SignKey string
+	// TrustedSigners are the fingerprints, or key IDs, of the keys whose signature of the manifest the import
+	// requires. Without them a signature found next to the manifest is verified against the keyring.
+	TrustedSigners []string
+}
+
+// signatureSuffix is appended to the path of the manifest to get the path of its detached signature
+const signatureSuffix = ".asc"
+
+// gpgTimeout bounds the gpg commands, which may wait for the agent to unlock a key
+const gpgTimeout = 5 * time.Minute
+
+// runGPG runs the gpg command in batch mode with the input and returns its output
+func runGPG(settings GPGConfig, input []byte, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gpgTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, settings.Path, append([]string{"--batch", "--yes", "--no-tty"}, args...)...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return output, fmt.Errorf("%s %s: %w: %s", settings.Path, args[len(args)-1], err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// gpgEncrypt encrypts a data key to the recipients, whose public keys must be in the keyring. They are trusted
+// as given, since the recipients of the dump are chosen by whoever runs the export.
+func gpgEncrypt(settings GPGConfig, recipients []string, key []byte) ([]byte, error) {
+	args := []string{"--trust-model", "always", "--auto-key-locate", "local"}
+	for _, recipient := range recipients {
+		args = append(args, "--recipient", recipient)
+	}
+	wrappedKey, err := runGPG(settings, key, append(args, "--encrypt")...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt the data key to %s: %w", strings.Join(recipients, ", "), err)
+	}
+	return wrappedKey, nil
+}
+
+// gpgDecrypt decrypts a data key with a secret key of the keyring
+func gpgDecrypt(settings GPGConfig, wrappedKey []byte) ([]byte, error) {
+	key, err := runGPG(settings, wrappedKey, "--quiet", "--decrypt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the data key: %w", err)
+	}
+	return key, nil
+}
+
+// signManifest writes the detached signature of the manifest with the signing key
+func signManifest(config Options) error {
+	path := config.ManifestFile + signatureSuffix
+	if _, err := runGPG(config.GPG, nil, "--local-user", config.GPG.SignKey, "--armor", "--output", path, "--detach-sign", config.ManifestFile); err != nil {
+		return fmt.Errorf("failed to sign the manifest: %w", err)
+	}
+	log.Printf("Signed the manifest with %s in %s", config.GPG.SignKey, path)
+	return nil
+}
+
+// verifyManifestSignature verifies the detached signature of the manifest, which must be made by one of the
+// trusted signers when there are any. Without trusted signers, a manifest without a signature is accepted.
+func verifyManifestSignature(config Options) error {
+	path := config.ManifestFile + signatureSuffix
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) && len(config.GPG.TrustedSigners) == 0 {
+			return nil
+		}
+		return fmt.Errorf("the manifest must be signed: %w", err)
+	}
+	status, err := runGPG(config.GPG, nil, "--status-fd", "1", "--verify", path, config.ManifestFile)
+	if err != nil {
+		return fmt.Errorf("invalid signature of the manifest: %w", err)
+	}
+
+	// A VALIDSIG status line holds the fingerprint of the signing key and, last, that of its primary key
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" || fields[1] != "VALIDSIG" {
+			continue
+		}
+		signer, primary := fields[2], fields[len(fields)-1]
+		if len(config.GPG.TrustedSigners) == 0 || trustedSigner(config.GPG.TrustedSigners, signer, primary) {
+			log.Printf("Manifest signature verified: signed by %s", primary)
+			return nil
+		}
+		return fmt.Errorf("the manifest is signed by %s, which is not a trusted signer", primary)
+	}
+	return errors.New("invalid signature of the manifest: gpg reported no valid signature")
+}
+
+// trustedSigner reports whether one of the fingerprints is trusted, the trusted signers being fingerprints or
+// key IDs, which are their suffixes
+func trustedSigner(trustedSigners []string, fingerprints ...string) bool {
+	for _, trusted := range trustedSigners {
+		trusted = strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(trusted, "0x"), " ", ""))
+		for _, fingerprint := range fingerprints {
+			if trusted != "" && strings.HasSuffix(strings.ToUpper(fingerprint), trusted) {
+				return true
+			}
+		}
+	}
+	return false
+}
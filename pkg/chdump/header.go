@@ -0,0 +1,128 @@
+package chdump
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// Column is a column of a table with its type
+type Column struct {
+	Name string
+	Type string
+}
+
+// readHeader reads the names and types of the columns from the header of a data file of the TSVWithNamesAndTypes
+// format. An empty file has no columns.
+func readHeader(format Format, path string) ([]Column, error) {
+	dataFile, err := openDataFile(format, path)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	reader := bufio.NewReader(dataFile)
+	var lines [][]string
+	for range 2 {
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			if len(lines) == 0 {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to read the header of %s: %w", path, err)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(line, "\n"), "\t"))
+	}
+	names, types := lines[0], lines[1]
+	if len(names) != len(types) {
+		return nil, fmt.Errorf("invalid header of %s: %d column names and %d types", path, len(names), len(types))
+	}
+	columns := make([]Column, len(names))
+	for i := range names {
+		columns[i] = Column{Name: unescapeTSV(names[i]), Type: unescapeTSV(types[i])}
+	}
+	return columns, nil
+}
+
+// insertableColumns returns the columns of a table an INSERT writes, leaving out the MATERIALIZED, ALIAS and
+// EPHEMERAL columns
+func insertableColumns(ctx context.Context, db *sql.DB, config Options, table string) ([]Column, error) {
+	return tableColumns(ctx, db, config, table, "default_kind NOT IN ('MATERIALIZED', 'ALIAS', 'EPHEMERAL')")
+}
+
+// tableColumns returns the columns of a table matching the condition on system.columns in order
+func tableColumns(ctx context.Context, db *sql.DB, config Options, table, condition string) ([]Column, error) {
+	var columns []Column
+	err := withRetry(ctx, config.Retry, "fetching columns of "+table, func() error {
+		columns = nil
+		rows, err := db.QueryContext(ctx, "SELECT name, type FROM system.columns WHERE database = ? AND table = ? "+
+			"AND "+condition+" ORDER BY position", config.DBName, table)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var column Column
+			if err := rows.Scan(&column.Name, &column.Type); err != nil {
+				return err
+			}
+			columns = append(columns, column)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch columns of table %s: %w", table, err)
+	}
+	return columns, nil
+}
+
+// checkHeader checks the columns in the header of a data file against the columns of the table before the file is
+// inserted. Columns of the file missing from the table or of another type fail the import, since their data would
+// be lost or misread. Columns of the table missing from the file get their defaults, and columns in another order
+// are inserted by name, both with a warning.
+func checkHeader(ctx context.Context, db *sql.DB, config Options, table, path string) error {
+	fileColumns, err := readHeader(config.Format, path)
+	if err != nil || fileColumns == nil {
+		return err
+	}
+	tableColumns, err := insertableColumns(ctx, db, config, table)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, column := range fileColumns {
+		i := slices.IndexFunc(tableColumns, func(c Column) bool { return c.Name == column.Name })
+		switch {
+		case i < 0:
+			mismatches = append(mismatches, fmt.Sprintf("column %s is missing from the table", column.Name))
+		case tableColumns[i].Type != column.Type:
+			mismatches = append(mismatches, fmt.Sprintf("column %s is %s in the file and %s in the table", column.Name, column.Type, tableColumns[i].Type))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("columns of %s do not match table %s: %s", path, table, strings.Join(mismatches, "; "))
+	}
+
+	for _, column := range tableColumns {
+		if !slices.ContainsFunc(fileColumns, func(c Column) bool { return c.Name == column.Name }) {
+			log.Printf("Warning: column %s of table %s is missing from %s and gets its default value", column.Name, table, path)
+		}
+	}
+	if !slices.EqualFunc(fileColumns, tableColumns, func(a, b Column) bool { return a.Name == b.Name }) {
+		log.Printf("Columns of %s are in another order than in table %s: they are inserted by name", path, table)
+	}
+	return nil
+}
+
+// tsvUnescaper reverses the escaping of the characters that TSV fields cannot hold
+var tsvUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r", `\0`, "\x00", `\'`, "'")
+
+// unescapeTSV unescapes the value of a TSV field
+func unescapeTSV(value string) string {
+	return tsvUnescaper.Replace(value)
+}
@@ -0,0 +1,113 @@
+package chdump
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Hook is a SQL statement or a shell command run before or after an export or import
+type Hook struct {
+	// SQL is a statement run on the server of the command, e.g. SYSTEM FLUSH LOGS
+	SQL string
+	// Command is a shell command, run with sh -c
+	Command string
+	// Warn logs the failure of the hook instead of failing the run
+	Warn bool
+	// OnSuccess runs a post hook only when the run succeeded
+	OnSuccess bool
+}
+
+// String returns the statement or command of the hook
+func (h Hook) String() string {
+	if h.SQL != "" {
+		return h.SQL
+	}
+	return h.Command
+}
+
+// Hooks are the hooks run before and after the export and the import. The post hooks run whatever the result of
+// the run, e.g. to resume the ingestion paused by a pre hook, unless they are only run on success.
+type Hooks struct {
+	PreExport  []Hook
+	PostExport []Hook
+	PreImport  []Hook
+	PostImport []Hook
+}
+
+// withHooks runs the pre hooks of a command, the command, and then its post hooks. A failing pre hook fails the
+// command before it starts, unless the hook only warns.
+func withHooks(ctx context.Context, config Options, command string, pre, post []Hook, run func() error) error {
+	if err := runHooks(ctx, config, command, "pre", pre, nil); err != nil {
+		return err
+	}
+	err := run()
+	// The post hooks run even when the command is interrupted, e.g. to resume the ingestion
+	if hookErr := runHooks(context.WithoutCancel(ctx), config, command, "post", post, err); err == nil {
+		err = hookErr
+	}
+	return err
+}
+
+// runHooks runs the hooks of a stage of the command, given the result of the command for the post hooks
+func runHooks(ctx context.Context, config Options, command, stage string, hooks []Hook, runErr error) error {
+	for _, hook := range hooks {
+		if stage == "post" && hook.OnSuccess && runErr != nil {
+			log.Printf("Skipping %s-%s hook %q: the %s failed", stage, command, hook, command)
+			continue
+		}
+		log.Printf("Running %s-%s hook %q", stage, command, hook)
+		var err error
+		if hook.SQL != "" {
+			err = runSQLHook(ctx, config, hook.SQL)
+		} else {
+			err = runCommandHook(ctx, config, command, stage, hook.Command, runErr)
+		}
+		if err == nil {
+			continue
+		}
+		if hook.Warn {
+			log.Printf("Warning: %s-%s hook %q failed: %v", stage, command, hook, err)
+			continue
+		}
+		return fmt.Errorf("%s-%s hook %q failed: %w", stage, command, hook, err)
+	}
+	return nil
+}
+
+// runSQLHook runs the statement of a hook on the server
+func runSQLHook(ctx context.Context, config Options, statement string) error {
+	db, err := createDBConnection(ctx, config, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, statement)
+	return err
+}
+
+// runCommandHook runs the shell command of a hook, with the command, stage, databases and dump directory of the
+// run, and the result of the run for the post hooks, in CHDUMP_* environment variables
+func runCommandHook(ctx context.Context, config Options, command, stage, shellCommand string, runErr error) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", shellCommand)
+	cmd.Stdout, cmd.Stderr = log.Writer(), log.Writer()
+	cmd.Env = append(os.Environ(),
+		"CHDUMP_COMMAND="+command,
+		"CHDUMP_STAGE="+stage,
+		"CHDUMP_HOST="+config.Host,
+		"CHDUMP_DATABASES="+strings.Join(config.Databases, ","),
+		"CHDUMP_DUMP_DIR="+config.DumpDir,
+	)
+	if stage == "post" {
+		status := "succeeded"
+		if runErr != nil {
+			status = "failed"
+			cmd.Env = append(cmd.Env, "CHDUMP_ERROR="+runErr.Error())
+		}
+		cmd.Env = append(cmd.Env, "CHDUMP_STATUS="+status)
+	}
+	return cmd.Run()
+}
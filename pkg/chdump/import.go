@@ -0,0 +1,1709 @@
+package chdump
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// importServer runs the import, verify or diff command for every database of the dump, creating the user-defined
+// functions before the databases and the access entities after them on import. The dump is read from the
+// per-database layout when more than one database is imported or multiDatabase is set.
+func importServer(ctx context.Context, command string, config Options, multiDatabase bool) error {
+	databases, err := dumpDatabases(config)
+	if err != nil {
+		return fmt.Errorf("failed to resolve databases: %w", err)
+	}
+
+	// Process each database, reading the per-database dump layout when more than one is imported
+	multiDatabase = multiDatabase || config.AllDatabases || config.Timestamped || len(databases) > 1
+
+	// Named collections and user-defined functions are created before the databases so that the tables,
+	// dictionaries and views using them can be created
+	if command == "import" {
+		if err := importNamedCollections(ctx, config, serverDir(config, multiDatabase, "named_collections")); err != nil {
+			return fmt.Errorf("failed to import named collections: %w", err)
+		}
+		if err := importFunctions(ctx, config, serverDir(config, multiDatabase, "functions")); err != nil {
+			return fmt.Errorf("failed to import user-defined functions: %w", err)
+		}
+	}
+	var failedDatabases []string
+	for i, dbName := range databases {
+		// Fetch the credentials again so that a long run picks up rotated ones
+		if i > 0 {
+			if err := refreshCredentials(ctx, &config); err != nil {
+				return fmt.Errorf("failed to fetch credentials: %w", err)
+			}
+		}
+		startedAt := time.Now()
+		dbDir, err := databaseDir(config, dbName, multiDatabase, false)
+		if err == nil {
+			dbConfig, schemaDir, dataDir := databaseConfig(config, dbName, dbDir)
+			err = runCommand(ctx, command, dbConfig, schemaDir, dataDir)
+		}
+		// The verification of a migration has no report of its own, its outcome is added to that of the migration
+		if command == "verify" {
+			config.migration.addOutcome(command, dbName, startedAt, err)
+		}
+		if err != nil {
+			log.Printf("Command %s failed for database %s: %v", command, dbName, err)
+			if config.FailFast || ctx.Err() != nil {
+				return err
+			}
+			failedDatabases = append(failedDatabases, dbName)
+		}
+	}
+	// Access entities are restored after the databases so that row policies and grants find their tables
+	if config.IncludeAccess && command == "import" {
+		if err := importAccess(ctx, config, serverDir(config, multiDatabase, "access")); err != nil {
+			return fmt.Errorf("failed to import access entities: %w", err)
+		}
+	}
+	if len(failedDatabases) > 0 {
+		return fmt.Errorf("failed for %d database(s): %s", len(failedDatabases), strings.Join(failedDatabases, ", "))
+	}
+	return nil
+}
+
+// dumpDatabases returns the databases to import, listing every database directory of the dump when requested
+func dumpDatabases(config Options) ([]string, error) {
+	if !config.AllDatabases {
+		return config.Databases, nil
+	}
+
+	entries, err := os.ReadDir(config.DumpDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dump directory: %w", err)
+	}
+	var databases []string
+	for _, entry := range entries {
+		// The functions, named collections and access directories hold objects of the server rather than a database
+		if entry.IsDir() && !slices.Contains([]string{"functions", "named_collections", "access"}, entry.Name()) {
+			databases = append(databases, entry.Name())
+		}
+	}
+	return databases, nil
+}
+
+// createFunctionPattern matches the beginning of a CREATE FUNCTION statement
+var createFunctionPattern = regexp.MustCompile(`(?i)^\s*CREATE\s+FUNCTION\s+(?:IF\s+NOT\s+EXISTS\s+)?`)
+
+// importFunctions creates the dumped SQL user-defined functions. Functions that already exist are left unchanged.
+func importFunctions(ctx context.Context, config Options, dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read functions directory: %w", err)
+	}
+
+	db, err := createDBConnection(ctx, config, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".sql" {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		content, err := readDumpFile(config, path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		statement := createFunctionPattern.ReplaceAllString(string(content), "CREATE FUNCTION IF NOT EXISTS ")
+		statement = addOnCluster(config.OnCluster, statement)
+		if config.DryRun {
+			fmt.Printf("-- Would run %s:\n%s;\n", path, strings.TrimSpace(statement))
+			continue
+		}
+		err = withRetry(ctx, config.Retry, "creating function "+file.Name(), func() error {
+			_, err := db.ExecContext(ctx, statement)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create function from %s: %w", path, err)
+		}
+		log.Printf("Function imported from %s", path)
+	}
+	return nil
+}
+
+// accessFiles lists the files of the access directory in the order they are restored
+var accessFiles = []string{"roles", "settings_profiles", "users", "row_policies", "quotas", "grants"}
+
+// createAccessEntityPattern matches the beginning of a CREATE statement of an access entity
+var createAccessEntityPattern = regexp.MustCompile(`(?i)^\s*CREATE\s+(USER|ROLE|ROW\s+POLICY|QUOTA|SETTINGS\s+PROFILE)\s+(?:IF\s+NOT\s+EXISTS\s+)?`)
+
+// importAccess replays the dumped access entities and grants. Entities that already exist are left unchanged.
+func importAccess(ctx context.Context, config Options, dir string) error {
+	db, err := createDBConnection(ctx, config, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, name := range accessFiles {
+		path := filepath.Join(dir, name+".sql")
+		content, err := readDumpFile(config, path)
+		if os.IsNotExist(err) {
+			log.Printf("Skipping %s: file not found", path)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		var count int
+		for _, statement := range strings.Split(string(content), ";\n") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			statement = createAccessEntityPattern.ReplaceAllString(statement, "CREATE $1 IF NOT EXISTS ")
+			if config.DryRun {
+				fmt.Printf("-- Would run %s:\n%s;\n", path, statement)
+				continue
+			}
+			err := withRetry(ctx, config.Retry, "executing "+name, func() error {
+				_, err := db.ExecContext(ctx, statement)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to execute statement of %s: %w", path, err)
+			}
+			count++
+		}
+		log.Printf("Imported %d statement(s) from %s", count, path)
+	}
+	return nil
+}
+
+// runCommand runs the subcommand against a single database
+func runCommand(ctx context.Context, command string, config Options, schemaDir, dataDir string) error {
+	switch {
+	case command == "verify":
+		return runVerify(ctx, config, schemaDir, dataDir)
+	case command == "diff":
+		return runDiff(ctx, config, schemaDir, dataDir)
+	case command == "schema":
+		return runSchemaSync(ctx, config, schemaDir)
+	case config.DryRun:
+		return runDryRun(ctx, config, schemaDir, dataDir)
+	default:
+		return runImport(ctx, config, schemaDir, dataDir)
+	}
+}
+
+// runImport validates the dump and imports its schema and data into the database
+func runImport(ctx context.Context, config Options, schemaDir, dataDir string) error {
+	// Validate the dump against its manifest before touching the database
+	if config.SkipManifestCheck {
+		log.Println("Skipping manifest validation")
+	} else if err := validateManifest(config, schemaDir, dataDir); err != nil {
+		return fmt.Errorf("manifest validation failed: %w", err)
+	}
+
+	// Create and test the initial database connection
+	db, err := createDBConnection(ctx, config, "")
+	if err != nil {
+		return fmt.Errorf("initial database connection failed: %w", err)
+	}
+	defer db.Close()
+	if config.serverVersion, err = checkServerVersion(ctx, db, config, importFeatures); err != nil {
+		return err
+	}
+	warnNewerDump(config, config.serverVersion)
+
+	// Ensure the database exists
+	err = withRetry(ctx, config.Retry, "creating database", func() error {
+		return createDatabaseIfNotExists(ctx, db, config, schemaDir)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create database: %w", err)
+	}
+
+	// Reconnect to the database with the specified database name
+	db, err = createDBConnection(ctx, config, config.DBName)
+	if err != nil {
+		return fmt.Errorf("database connection to %s failed: %w", config.DBName, err)
+	}
+	defer db.Close()
+
+	// Import schema and data
+	if err := importData(ctx, db, schemaDir, dataDir, config); err != nil {
+		return fmt.Errorf("failed to import data: %w", err)
+	}
+	return nil
+}
+
+// runVerify validates the size and SHA-256 of the dump files against the manifest without connecting to the server,
+// so that a dump can be checked wherever it is stored. With VerifyTarget, it then compares the row count and checksum
+// of every table in the database with the values recorded in the manifest.
+func runVerify(ctx context.Context, config Options, schemaDir, dataDir string) error {
+	if err := validateManifest(config, schemaDir, dataDir); err != nil {
+		return err
+	}
+	if !config.VerifyTarget {
+		log.Printf("The dump of database %s matches its manifest", config.DumpDBName)
+		return nil
+	}
+	manifest, err := loadManifest(config.ManifestFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := createDBConnection(ctx, config, config.DBName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var mismatchedTables []string
+	for _, table := range manifest.Tables {
+		if !isTableSelected(config, table.Name) {
+			continue
+		}
+		// The schema file is the only file of the tables whose data was not exported
+		if table.Incremental || len(table.Files) < 2 {
+			log.Printf("Skipping verification of table %s: no data recorded in the manifest", table.Name)
+			continue
+		}
+		if table.Checksum == "" {
+			log.Printf("No checksum recorded for table %s in the manifest: only its row count is verified", table.Name)
+		}
+
+		var rows int
+		var checksum string
+		err := withRetry(ctx, config.Retry, "verifying table "+table.Name, func() (err error) {
+			if rows, err = countRows(ctx, db, config.DBName, targetTableName(config, table.Name)); err != nil {
+				return err
+			}
+			if table.Checksum != "" {
+				checksum, err = getTableChecksum(ctx, db, qualifiedName(config.DBName, targetTableName(config, table.Name)), "*", "")
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to verify table %s: %w", table.Name, err)
+		}
+
+		if rows != table.Rows || checksum != table.Checksum {
+			log.Printf("Table %s does not match the dump: %d rows with checksum %s, expected %d rows with checksum %s",
+				table.Name, rows, checksum, table.Rows, table.Checksum)
+			mismatchedTables = append(mismatchedTables, table.Name)
+			continue
+		}
+		log.Printf("Table %s verified: %d rows, checksum %s", table.Name, rows, checksum)
+	}
+
+	if len(mismatchedTables) > 0 {
+		return fmt.Errorf("%d table(s) do not match the dump: %s", len(mismatchedTables), strings.Join(mismatchedTables, ", "))
+	}
+	log.Printf("All tables of database %s match the dump", config.DBName)
+	return nil
+}
+
+// runDiff compares the source database, or the dump when no source host is configured, with the target database
+// by row counts and content checksums per table and partition, and prints the tables that diverge
+func runDiff(ctx context.Context, config Options, schemaDir, dataDir string) error {
+	if config.SourceHost == "" {
+		log.Println("No source host configured, comparing the dump with the target database")
+		config.VerifyTarget = true
+		return runVerify(ctx, config, schemaDir, dataDir)
+	}
+
+	source := sourceConfig(config)
+	sourceDB, err := createDBConnection(ctx, source, source.DBName)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	defer sourceDB.Close()
+
+	targetDB, err := createDBConnection(ctx, config, config.DBName)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	defer targetDB.Close()
+
+	var sourceTables, targetTables []string
+	err = withRetry(ctx, config.Retry, "fetching tables", func() (err error) {
+		if sourceTables, err = getTables(ctx, sourceDB, source.DBName); err != nil {
+			return err
+		}
+		targetTables, err = getTables(ctx, targetDB, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch tables: %w", err)
+	}
+
+	tables := slices.Clone(sourceTables)
+	for _, table := range targetTables {
+		if !slices.Contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+	tables = slices.DeleteFunc(tables, func(table string) bool { return !isTableSelected(config, table) })
+	slices.Sort(tables)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "TABLE\tPARTITION\tSOURCE ROWS\tTARGET ROWS\tSTATUS\n")
+
+	var divergedTables []string
+	for _, table := range tables {
+		if !slices.Contains(sourceTables, table) || !slices.Contains(targetTables, table) {
+			status := "missing in target"
+			if !slices.Contains(sourceTables, table) {
+				status = "missing in source"
+			}
+			fmt.Fprintf(writer, "%s\t\t\t\t%s\n", table, status)
+			divergedTables = append(divergedTables, table)
+			continue
+		}
+
+		var sourcePartitions, targetPartitions map[string]PartitionChecksum
+		err := withRetry(ctx, config.Retry, "computing checksums of "+table, func() (err error) {
+			if sourcePartitions, err = getPartitionChecksums(ctx, sourceDB, source.DBName, table); err != nil {
+				return err
+			}
+			targetPartitions, err = getPartitionChecksums(ctx, targetDB, config.DBName, table)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to compute checksums of table %s: %w", table, err)
+		}
+
+		if diverged := printPartitionDiff(writer, table, sourcePartitions, targetPartitions); diverged {
+			divergedTables = append(divergedTables, table)
+		}
+	}
+	writer.Flush()
+
+	if len(divergedTables) > 0 {
+		return fmt.Errorf("%d table(s) diverge: %s", len(divergedTables), strings.Join(divergedTables, ", "))
+	}
+	log.Printf("All tables of database %s match the source database %s", config.DBName, source.DBName)
+	return nil
+}
+
+// sourceConfig returns the configuration of the source database, falling back to the target settings
+func sourceConfig(config Options) Options {
+	source := config
+	source.Host = config.SourceHost
+	source.SSH.tunnel = nil
+	// The source is connected with its own credentials rather than the ones of the secret store
+	source.Vault, source.AWS = VaultConfig{}, AWSConfig{}
+	if config.SSH.tunnel != nil {
+		// The port of the config is the local end of the tunnel, the source is reached directly
+		_, source.Port, _ = net.SplitHostPort(config.SSH.tunnel.remoteAddr())
+	}
+	if config.SourcePort != "" {
+		source.Port = config.SourcePort
+	}
+	if config.SourceUser != "" {
+		source.User = config.SourceUser
+	}
+	if config.SourcePassword != "" {
+		source.Password = config.SourcePassword
+	}
+	if config.SourceDBName != "" {
+		source.DBName = config.SourceDBName
+	}
+	return source
+}
+
+// PartitionChecksum holds the row count and content checksum of a partition
+type PartitionChecksum struct {
+	Rows     int
+	Checksum string
+}
+
+// getPartitionChecksums returns the row count and checksum of every partition of the table.
+// Tables outside the MergeTree family are treated as a single partition named "all".
+func getPartitionChecksums(ctx context.Context, db *sql.DB, dbName, table string) (map[string]PartitionChecksum, error) {
+	engine, err := getTableEngine(ctx, db, table, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	partitionExpr := "'all'"
+	if strings.HasSuffix(engine, "MergeTree") {
+		partitionExpr = "_partition_id"
+	}
+	query := fmt.Sprintf("SELECT %s AS partition, count(), toString(groupBitXor(cityHash64(*))) FROM %s GROUP BY partition",
+		partitionExpr, qualifiedName(dbName, table))
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := make(map[string]PartitionChecksum)
+	for rows.Next() {
+		var partition string
+		var checksum PartitionChecksum
+		if err := rows.Scan(&partition, &checksum.Rows, &checksum.Checksum); err != nil {
+			return nil, err
+		}
+		partitions[partition] = checksum
+	}
+	return partitions, rows.Err()
+}
+
+// printPartitionDiff prints the partitions of the table that differ between source and target and reports whether any do
+func printPartitionDiff(writer io.Writer, table string, source, target map[string]PartitionChecksum) bool {
+	var partitions []string
+	for partition := range source {
+		partitions = append(partitions, partition)
+	}
+	for partition := range target {
+		if _, ok := source[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+	}
+	slices.Sort(partitions)
+
+	diverged := false
+	for _, partition := range partitions {
+		sourcePartition, inSource := source[partition]
+		targetPartition, inTarget := target[partition]
+		if inSource && inTarget && sourcePartition == targetPartition {
+			continue
+		}
+		status := "checksum differs"
+		switch {
+		case !inTarget:
+			status = "missing in target"
+		case !inSource:
+			status = "missing in source"
+		case sourcePartition.Rows != targetPartition.Rows:
+			status = "row count differs"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%s\n", table, partition, sourcePartition.Rows, targetPartition.Rows, status)
+		diverged = true
+	}
+	if !diverged {
+		fmt.Fprintf(writer, "%s\t\t\t\tidentical\n", table)
+	}
+	return diverged
+}
+
+// runDryRun prints the CREATE statements that would run, the data files that would be loaded and the
+// mismatches detected between the dump and the target server, without changing anything
+func runDryRun(ctx context.Context, config Options, schemaDir, dataDir string) error {
+	var mismatches []string
+	if config.SkipManifestCheck {
+		log.Println("Skipping manifest validation")
+	} else if err := validateManifest(config, schemaDir, dataDir); err != nil {
+		mismatches = append(mismatches, err.Error())
+	}
+
+	db, err := createDBConnection(ctx, config, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if config.serverVersion, err = checkServerVersion(ctx, db, config, importFeatures); err != nil {
+		mismatches = append(mismatches, err.Error())
+	}
+	warnNewerDump(config, config.serverVersion)
+
+	var existingTables []string
+	err = withRetry(ctx, config.Retry, "fetching existing tables", func() (err error) {
+		existingTables, err = getExistingTables(ctx, db, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch existing tables: %w", err)
+	}
+
+	createDatabase, err := createDatabaseQuery(config, schemaDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("-- Would run: %s\n", createDatabase)
+
+	schemaFiles, err := listSchemaFiles(config, schemaDir)
+	if err != nil {
+		return err
+	}
+	var schemaTables []string
+	for _, file := range schemaFiles {
+		table := file.Table
+		schemaTables = append(schemaTables, table)
+
+		fmt.Printf("-- Would run %s:\n", file.Path)
+		for _, statement := range schemaStatements(config, file, rewriteSchema(config, file.Content)) {
+			fmt.Printf("%s;\n", strings.TrimSpace(statement))
+		}
+		if slices.Contains(existingTables, targetTableName(config, table)) {
+			mismatches = append(mismatches, fmt.Sprintf("table %s.%s already exists in the target", config.DBName, targetTableName(config, table)))
+		}
+	}
+
+	if err := validateSchemaFiles(ctx, db, config, schemaFiles); err != nil {
+		mismatches = append(mismatches, err.Error())
+	}
+
+	dataFiles, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+	for _, file := range dataFiles {
+		table, ok := dataFileTable(config, file.Name())
+		if !ok {
+			continue
+		}
+		if !isTableSelected(config, table) {
+			continue
+		}
+		fmt.Printf("-- Would load %s (%d bytes) into %s.%s\n", filepath.Join(dataDir, file.Name()), file.Size(), config.DBName, targetTableName(config, table))
+		mismatch := fmt.Sprintf("data file for table %s has no schema file and the table does not exist in the target", table)
+		if !slices.Contains(schemaTables, table) && !slices.Contains(existingTables, targetTableName(config, table)) && !slices.Contains(mismatches, mismatch) {
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+
+	for _, mismatch := range mismatches {
+		fmt.Printf("-- Mismatch: %s\n", mismatch)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d mismatch(es) detected", len(mismatches))
+	}
+	log.Println("Dry run completed, no mismatches detected")
+	return nil
+}
+
+// getExistingTables returns the tables of the database in the target, or none if the database does not exist
+func getExistingTables(ctx context.Context, db *sql.DB, dbName string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM system.tables WHERE database = ?", dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// importData imports the schema and data from the specified directories
+func importData(ctx context.Context, db *sql.DB, schemaDir, dataDir string, config Options) (err error) {
+	report := &Report{Operation: "import", DBName: config.DBName, StartedAt: time.Now()}
+	defer func() {
+		if reportErr := writeReport(config, report, err); reportErr != nil {
+			log.Printf("Failed to write report: %v", reportErr)
+		}
+	}()
+
+	state, err := loadState(config, "import")
+	if err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+
+	schemaFiles, err := listSchemaFiles(config, schemaDir)
+	if err != nil {
+		return err
+	}
+	// Materialized views are created after the data of the other tables is loaded so that loading it does not
+	// trigger them, then their own data is loaded
+	tableFiles, viewFiles := splitMaterializedViews(config, schemaFiles)
+	var views []string
+	for _, file := range viewFiles {
+		views = append(views, file.Table)
+	}
+
+	// Report every invalid schema file before creating any object
+	if err := validateSchemaFiles(ctx, db, config, schemaFiles); err != nil {
+		return err
+	}
+
+	// An atomic restore loads the tables with data into staging tables swapped with them once loaded
+	staged := stagedTables(config, tableFiles, dataDir)
+	if config.mappedInserts, err = mappedInserts(config, schemaFiles); err != nil {
+		return err
+	}
+
+	// Import schema and views
+	if err := importSchema(ctx, db, tableFiles, config, state, staged); err != nil {
+		return err
+	}
+	if config.AllowSchemaDrift {
+		if config.mappedInserts, err = driftInserts(ctx, db, config, tableFiles, staged); err != nil {
+			return err
+		}
+	}
+
+	// Compare the keys of the tables with those of the source, and insert the data of a shard-aware import through
+	// Distributed tables spreading it over the shards
+	config.manifestTables = manifestTables(config)
+	if err := checkTableKeys(ctx, db, config, tableFiles, config.manifestTables); err != nil {
+		return err
+	}
+	inserts, dropDistributed, err := distributedInserts(ctx, db, config, tableFiles, dataDir, config.manifestTables)
+	defer dropDistributed()
+	if err != nil {
+		return err
+	}
+	config.distributedInserts = inserts
+
+	// Refuse to load the tables whose columns do not match the dump
+	mismatched, err := checkSchemas(ctx, db, config, tableFiles, staged)
+	if err != nil {
+		return err
+	}
+	var failedTables []string
+	for _, file := range tableFiles {
+		reason, mismatch := mismatched[file.Table]
+		table := targetTableName(config, file.Table)
+		if !mismatch || slices.Contains(state.CompletedTables, table) || !hasDataFiles(config, dataDir, file.Table) {
+			continue
+		}
+		report.Tables = append(report.Tables, &TableReport{Table: table, Status: statusFailed, Error: reason})
+		if config.FailFast {
+			return fmt.Errorf("failed to import data for table %s: %s", table, reason)
+		}
+		failedTables = append(failedTables, table)
+	}
+
+	// Import data for tables
+	failedData, err := importTableDataFromDir(ctx, db, dataDir, config, state, report, staged, func(table string) bool {
+		_, mismatch := mismatched[table]
+		return !slices.Contains(views, table) && !mismatch
+	})
+	if err != nil {
+		return err
+	}
+	failedTables = append(failedTables, failedData...)
+
+	// Import materialized views and the data of those with an implicit .inner table
+	if err := importSchema(ctx, db, viewFiles, config, state, nil); err != nil {
+		return err
+	}
+	failedViews, err := importTableDataFromDir(ctx, db, dataDir, config, state, report, nil, func(table string) bool {
+		return slices.Contains(views, table)
+	})
+	if err != nil {
+		return err
+	}
+	failedTables = append(failedTables, failedViews...)
+
+	// Remove the duplicate rows that retried inserts may have left
+	if len(config.DeduplicateTables) > 0 {
+		failedDeduplication, err := deduplicateTables(ctx, db, config, tableFiles, failedTables)
+		if err != nil {
+			return err
+		}
+		failedTables = append(failedTables, failedDeduplication...)
+	}
+
+	// Check for tables whose data is missing from the dump
+	missingTables, err := findTablesWithoutData(ctx, db, schemaFiles, dataDir, config)
+	if err != nil {
+		return err
+	}
+	for _, table := range missingTables {
+		tableReport := &TableReport{Table: table, Status: statusSkipped, Error: "no data file found"}
+		report.Tables = append(report.Tables, tableReport)
+		if !config.Strict {
+			log.Printf("Warning: no data file found for table %s", table)
+			continue
+		}
+		log.Printf("No data file found for table %s", table)
+		tableReport.Status = statusFailed
+		if config.FailFast || ctx.Err() != nil {
+			return fmt.Errorf("no data file found for table %s", table)
+		}
+		failedTables = append(failedTables, table)
+	}
+
+	// Check that the tables have the indexes and projections of the dump
+	incompleteTables, err := verifyIndexes(ctx, db, config, tableFiles)
+	if err != nil {
+		return err
+	}
+	if config.Strict {
+		for _, table := range incompleteTables {
+			if config.FailFast || ctx.Err() != nil {
+				return fmt.Errorf("table %s lacks indexes or projections of the dump", table)
+			}
+			failedTables = append(failedTables, table)
+		}
+	}
+
+	if len(failedTables) > 0 {
+		return fmt.Errorf("%d table(s) failed: %s", len(failedTables), strings.Join(failedTables, ", "))
+	}
+	return nil
+}
+
+// validateSchemaFiles parses the rewritten statements of the schema files with EXPLAIN AST on the server, without
+// executing them, and returns an error listing every file the server cannot parse
+func validateSchemaFiles(ctx context.Context, db *sql.DB, config Options, schemaFiles []SchemaFile) error {
+	if !versionAtLeast(config.serverVersion, explainASTVersion) {
+		log.Printf("Skipping schema validation: ClickHouse %s does not support EXPLAIN AST", config.serverVersion)
+		return nil
+	}
+	var invalid []string
+	for _, file := range schemaFiles {
+		var err error
+		for _, statement := range schemaStatements(config, file, rewriteSchema(config, file.Content)) {
+			err = withRetry(ctx, config.Retry, "validating schema file "+file.Name, func() error {
+				rows, err := db.QueryContext(ctx, "EXPLAIN AST "+statement)
+				if err != nil {
+					return err
+				}
+				return rows.Close()
+			})
+			if err != nil {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Invalid schema file %s: %v", file.Path, err)
+			invalid = append(invalid, file.Path)
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%d invalid schema file(s): %s", len(invalid), strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// importSchema imports the schema from the specified directory. An atomic restore creates the staged tables under
+// the names of their staging tables and keeps the other objects that already exist.
+func importSchema(ctx context.Context, db *sql.DB, schemaFiles []SchemaFile, config Options, state *State, staged map[string]bool) error {
+	for _, file := range schemaFiles {
+		if slices.Contains(state.CompletedSchemas, file.Name) {
+			log.Printf("Skipping schema %s: already imported in a previous run", file.Name)
+			continue
+		}
+		statement := rewriteSchema(config, file.Content)
+		if config.AtomicRestore {
+			var err error
+			if statement, err = atomicSchema(ctx, db, config, file, staged); err != nil {
+				return err
+			}
+			if statement == "" {
+				log.Printf("Skipping schema %s: %s already exists", file.Name, targetTableName(config, file.Table))
+				continue
+			}
+		} else if len(tablePartitions(config, file.Table)) > 0 {
+			// The selected partitions are restored into the table when it exists
+			exists, err := tableExists(ctx, db, config, targetTableName(config, file.Table))
+			if err != nil {
+				return err
+			}
+			if exists {
+				log.Printf("Skipping schema %s: %s already exists, its partitions are replaced", file.Name, targetTableName(config, file.Table))
+				continue
+			}
+		}
+		if err := execSchemaStatements(ctx, db, config, file, schemaStatements(config, file, statement)); err != nil {
+			return fmt.Errorf("failed to execute schema file %s: %w", file.Path, err)
+		}
+		log.Printf("Schema imported for %s", file.Name)
+		state.CompletedSchemas = append(state.CompletedSchemas, file.Name)
+		if err := saveState(config.StateFile, state); err != nil {
+			return fmt.Errorf("failed to save state: %w", err)
+		}
+	}
+	return nil
+}
+
+// SchemaFile is a CREATE statement of the dump, with the other statements of its file such as SET statements or the
+// materialized views of the table
+type SchemaFile struct {
+	Name       string // path relative to the schema directory, used as the checkpoint key
+	Path       string
+	Table      string
+	Content    string   // the statement creating the object
+	Statements []string // all the statements of the file in order, Content included
+}
+
+// listSchemaFiles reads the selected schema files of tables, views and dictionaries in the order they must be created
+func listSchemaFiles(config Options, schemaDir string) ([]SchemaFile, error) {
+	tableFiles, err := readSchemaFiles(config, schemaDir, "")
+	if err != nil {
+		return nil, err
+	}
+	dictionaryFiles, err := readSchemaFiles(config, schemaDir, dictionarySchemaDir)
+	if err != nil {
+		return nil, err
+	}
+	return sortSchemaFiles(config, append(tableFiles, dictionaryFiles...)), nil
+}
+
+// sortSchemaFiles orders the schema files topologically so that every object is created after the objects of the
+// dump it references. Objects in a dependency cycle are created in directory order.
+func sortSchemaFiles(config Options, files []SchemaFile) []SchemaFile {
+	index := make(map[string]int)
+	for i, file := range files {
+		index[file.Table] = i
+	}
+	dependencies := make([][]int, len(files))
+	for i, file := range files {
+		for _, reference := range schemaReferences(config, strings.Join(file.Statements, ";\n")) {
+			if j, ok := index[reference]; ok && j != i && !slices.Contains(dependencies[i], j) {
+				dependencies[i] = append(dependencies[i], j)
+			}
+		}
+	}
+
+	sorted := make([]SchemaFile, 0, len(files))
+	created := make([]bool, len(files))
+	for len(sorted) < len(files) {
+		progress := false
+		for i, file := range files {
+			if created[i] || slices.ContainsFunc(dependencies[i], func(j int) bool { return !created[j] }) {
+				continue
+			}
+			sorted = append(sorted, file)
+			created[i] = true
+			progress = true
+		}
+		if progress {
+			continue
+		}
+		i := slices.Index(created, false)
+		log.Printf("Warning: schema %s is part of a dependency cycle, creating it in directory order", files[i].Name)
+		sorted = append(sorted, files[i])
+		created[i] = true
+	}
+	return sorted
+}
+
+// materializedViewPattern matches a CREATE MATERIALIZED VIEW statement
+var materializedViewPattern = regexp.MustCompile(`(?is)^\s*CREATE\s+MATERIALIZED\s+VIEW\b`)
+
+// populatePattern matches the POPULATE keyword of a CREATE MATERIALIZED VIEW statement
+var populatePattern = regexp.MustCompile(`(?i)\s+POPULATE\b`)
+
+// splitMaterializedViews splits the sorted schema files into those created before the data is loaded and the
+// materialized views, together with the objects that depend on them, created afterwards
+func splitMaterializedViews(config Options, files []SchemaFile) ([]SchemaFile, []SchemaFile) {
+	var tables, views []SchemaFile
+	var deferred []string
+	for _, file := range files {
+		isDeferred := materializedViewPattern.MatchString(file.Content)
+		for _, reference := range schemaReferences(config, file.Content) {
+			isDeferred = isDeferred || (reference != file.Table && slices.Contains(deferred, reference))
+		}
+		if isDeferred {
+			deferred = append(deferred, file.Table)
+			views = append(views, file)
+		} else {
+			tables = append(tables, file)
+		}
+	}
+	return tables, views
+}
+
+// materializedViewHead returns the part of a CREATE MATERIALIZED VIEW statement before its SELECT query
+func materializedViewHead(statement string) string {
+	if location := materializedViewQueryPattern.FindStringIndex(statement); location != nil {
+		return statement[:location[0]]
+	}
+	return statement
+}
+
+// hasTargetTable checks if a CREATE MATERIALIZED VIEW statement writes into an explicit TO table, in which case
+// its data is restored with that table
+func hasTargetTable(statement string) bool {
+	return materializedViewPattern.MatchString(statement) && materializedViewTargetPattern.MatchString(materializedViewHead(statement))
+}
+
+// stripPopulate removes the POPULATE keyword from a CREATE MATERIALIZED VIEW statement, since the data of the view
+// is restored from the dump
+func stripPopulate(statement string) string {
+	if !materializedViewPattern.MatchString(statement) {
+		return statement
+	}
+	head := materializedViewHead(statement)
+	return populatePattern.ReplaceAllString(head, "") + statement[len(head):]
+}
+
+// stringLiteralPattern matches a single-quoted string literal, capturing its content
+var stringLiteralPattern = regexp.MustCompile(`'((?:[^'\\]|\\.)*)'`)
+
+// engineArgumentsPattern matches the table engine of a CREATE statement up to its opening parenthesis
+var engineArgumentsPattern = regexp.MustCompile(`(?i)\bENGINE\s*=\s*\w+\(`)
+
+// schemaReferences returns the candidate names of the objects of the dump referenced by a CREATE statement: names
+// qualified with the database of the dump, string literals such as dictGet arguments and dictionary sources, and
+// the engine arguments such as the local table of a Distributed table
+func schemaReferences(config Options, statement string) []string {
+	var references []string
+	for _, parts := range qualifiedNamePattern.FindAllStringSubmatch(statement, -1) {
+		if parts[2] == config.DumpDBName {
+			references = append(references, parts[5])
+		}
+	}
+	for _, parts := range stringLiteralPattern.FindAllStringSubmatch(statement, -1) {
+		references = append(references, strings.TrimPrefix(parts[1], config.DumpDBName+"."))
+	}
+	if location := engineArgumentsPattern.FindStringIndex(statement); location != nil {
+		args, _ := splitArguments(statement, location[1])
+		for _, arg := range args {
+			references = append(references, strings.Trim(strings.TrimSpace(arg), "'`\""))
+		}
+	}
+	return references
+}
+
+// readSchemaFiles reads the .sql files of the selected tables in a subdirectory of the schema directory. A
+// missing subdirectory holds no files.
+func readSchemaFiles(config Options, schemaDir, subdir string) ([]SchemaFile, error) {
+	dir := filepath.Join(schemaDir, subdir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if subdir != "" && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read schema directory: %w", err)
+	}
+
+	var schemaFiles []SchemaFile
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".sql" {
+			continue
+		}
+		table := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if !isTableSelected(config, table) {
+			continue
+		}
+		if isInnerTable(table) {
+			log.Printf("Skipping schema %s: the table is created by its materialized view", file.Name())
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		content, err := readDumpFile(config, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema file %s: %w", path, err)
+		}
+		statements := splitStatements(string(content))
+		schemaFiles = append(schemaFiles, SchemaFile{
+			Name:       filepath.ToSlash(filepath.Join(subdir, file.Name())),
+			Path:       path,
+			Table:      table,
+			Content:    primaryStatement(statements),
+			Statements: statements,
+		})
+	}
+	return schemaFiles, nil
+}
+
+// importTableDataFromDir imports data for tables from the specified directory and returns the tables that failed
+func importTableDataFromDir(ctx context.Context, db *sql.DB, dataDir string, config Options, state *State, report *Report, staged map[string]bool, include func(table string) bool) ([]string, error) {
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	var dumpTables []string
+	for _, file := range entries {
+		if dumpTable, ok := dataFileTable(config, file.Name()); ok && !slices.Contains(dumpTables, dumpTable) {
+			if isTableSelected(config, dumpTable) && !isInnerTable(dumpTable) && include(dumpTable) {
+				dumpTables = append(dumpTables, dumpTable)
+			}
+		}
+	}
+	if len(dumpTables) > 0 {
+		reportProgress(config, Progress{Operation: "import", Tables: len(dumpTables)})
+	}
+
+	var pending []string
+	for _, dumpTable := range dumpTables {
+		if table := targetTableName(config, dumpTable); slices.Contains(state.CompletedTables, table) {
+			log.Printf("Skipping table %s: already imported in a previous run", table)
+			skipTableReport(config, report, table)
+			continue
+		}
+		pending = append(pending, dumpTable)
+	}
+	if config.ParallelTables > 1 {
+		pending = scheduleImport(config, dataDir, pending)
+	}
+
+	var mu sync.Mutex
+	var failedTables []string
+	err = runTables(pending, config.ParallelTables, func(dumpTable string) error {
+		table := targetTableName(config, dumpTable)
+		tableReport := startTableReport(report, table)
+		files, err := dataFiles(config, dataDir, dumpTable)
+		// A selection of partitions replaces those partitions of the table with the data files of the dump
+		if partitions := tablePartitions(config, dumpTable); err == nil && len(partitions) > 0 {
+			if files, err = partitionDataFiles(config, dumpTable, files, partitions); err == nil {
+				err = dropPartitions(ctx, db, config, table, partitions)
+			}
+		}
+		recorded := recordedRows(config, dumpTable, files)
+		switch {
+		case err != nil:
+		case staged[dumpTable]:
+			err = restoreAtomically(ctx, config, table, files, recorded, db, tableReport)
+		case config.distributedInserts[table] != "":
+			err = importTableData(ctx, config, config.distributedInserts[table], files, recorded, db, tableReport)
+		default:
+			err = importTableData(ctx, config, table, files, recorded, db, tableReport)
+		}
+		finishTableReport(config, report, tableReport, err)
+		if err != nil {
+			log.Printf("Failed to import data for table %s: %v", table, err)
+			if config.FailFast || ctx.Err() != nil {
+				return fmt.Errorf("failed to import data for table %s: %w", table, err)
+			}
+			// Skip this table and continue with the next one
+			mu.Lock()
+			failedTables = append(failedTables, table)
+			mu.Unlock()
+			return nil
+		}
+		log.Printf("Data imported for table %s", table)
+		err = state.update(config.StateFile, func() {
+			state.CompletedTables = append(state.CompletedTables, table)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save state: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return failedTables, nil
+}
+
+// scheduleImport orders the tables imported in parallel largest first by the size of their data files, and logs the
+// predicted duration and critical path of the import
+func scheduleImport(config Options, dataDir string, dumpTables []string) []string {
+	sizes := make(map[string]int64)
+	for _, dumpTable := range dumpTables {
+		files, _ := dataFiles(config, dataDir, dumpTable)
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				sizes[dumpTable] += info.Size()
+			}
+		}
+	}
+	dumpTables = largestFirst(dumpTables, sizes)
+	logSchedule(config, "import", dumpTables, sizes)
+	return dumpTables
+}
+
+// findTablesWithoutData returns the tables that have a schema file but no data file, ignoring views, dictionaries,
+// materialized views whose data is restored with their TO table, and local tables whose data is restored through
+// a Distributed table
+func findTablesWithoutData(ctx context.Context, db *sql.DB, schemaFiles []SchemaFile, dataDir string, config Options) ([]string, error) {
+	restoredThrough := make(map[string]bool)
+	for _, file := range schemaFiles {
+		dbName, local := distributedLocalTable(file.Content)
+		if local == "" || (dbName != "" && dbName != config.DumpDBName) {
+			continue
+		}
+		if hasDataFiles(config, dataDir, file.Table) {
+			restoredThrough[local] = true
+		}
+	}
+
+	var missingTables []string
+	for _, file := range schemaFiles {
+		if strings.HasPrefix(file.Name, dictionarySchemaDir+"/") || hasTargetTable(file.Content) || restoredThrough[file.Table] {
+			continue
+		}
+		if hasDataFiles(config, dataDir, file.Table) {
+			continue
+		}
+
+		table := targetTableName(config, file.Table)
+		var engine string
+		err := withRetry(ctx, config.Retry, "checking table engine of "+table, func() (err error) {
+			engine, err = getTableEngine(ctx, db, table, config.DBName)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the engine of table %s: %w", table, err)
+		}
+		if !skipsData(config, engine) {
+			missingTables = append(missingTables, table)
+		}
+	}
+	return missingTables, nil
+}
+
+// importProgressInterval is the minimum interval between the progress reports of the data import of a table
+const importProgressInterval = 500 * time.Millisecond
+
+// importTableData imports the data files of the specified table, its single data file or its numbered parts, using
+// clickhouse-client and records the imported rows and bytes in the table report. Every part is retried on its own.
+// The row count is verified against the rows recorded in the manifest, or the rows read from the files without one.
+func importTableData(ctx context.Context, config Options, table string, dataFiles []string, recorded *int, db *sql.DB, tableReport *TableReport) error {
+	if len(dataFiles) == 1 {
+		log.Printf("Importing data for table %s from file %s", table, dataFiles[0])
+	} else {
+		log.Printf("Importing data for table %s from %d files", table, len(dataFiles))
+	}
+
+	// Check if the table holds data of its own
+	var engine string
+	err := withRetry(ctx, config.Retry, "checking table engine of "+table, func() (err error) {
+		engine, err = getTableEngine(ctx, db, table, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check the engine of table %s: %w", table, err)
+	}
+	// A Distributed table only has a data file when its data was exported through it, and restoring the data
+	// through it spreads the rows over the shards
+	if skipsData(config, engine) && engine != "Distributed" {
+		log.Printf("Skipping data import for %s table %s", engine, table)
+		tableReport.Status = statusSkipped
+		return nil
+	}
+
+	// Check if the data files exist and are not empty
+	if len(dataFiles) == 0 {
+		return fmt.Errorf("no data file found for table %s", table)
+	}
+	var totalBytes int64
+	for _, dataFilePath := range dataFiles {
+		fileInfo, err := os.Stat(dataFilePath)
+		if os.IsNotExist(err) {
+			log.Printf("Data file does not exist: %s", dataFilePath)
+			return fmt.Errorf("data file does not exist: %s", dataFilePath)
+		}
+		if err != nil {
+			return err
+		}
+		totalBytes += fileInfo.Size()
+	}
+	if totalBytes == 0 {
+		log.Printf("Data file is empty: %s", strings.Join(dataFiles, ", "))
+		return nil // Skip importing for empty data files
+	}
+
+	log.Printf("Data of table %s exists and is not empty. Size: %d bytes", table, totalBytes)
+
+	// The header of a table with a column map matches its schema in the dump rather than the target table
+	if _, mapped := mappedInsert(config, table); headerLines(config.Format) > 0 && !mapped {
+		for _, dataFilePath := range dataFiles {
+			if err := checkHeader(ctx, db, config, table, dataFilePath); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Count the rows already present so that only the inserted rows are verified
+	rowsBefore, err := countRowsWithRetry(ctx, config, table, db)
+	if err != nil {
+		return fmt.Errorf("failed to count rows of table %s: %w", table, err)
+	}
+
+	tableReport.SkippedRows = 0
+	for i, dataFilePath := range dataFiles {
+		err := insertDataFile(ctx, config, table, dataFilePath, totalBytes, tableReport)
+		// The rejected rows are kept even when the insert exceeded the error thresholds, to find out why
+		if tolerant(config) {
+			rejectedRows, rejectedErr := writeRejectedRows(config, table, i > 0)
+			if rejectedErr != nil {
+				log.Printf("Warning: failed to write the rejected rows of table %s: %v", table, rejectedErr)
+			}
+			tableReport.SkippedRows += rejectedRows
+		}
+		if err != nil {
+			// Log the problematic rows for debugging
+			log.Printf("Error executing clickhouse-client: %v", err)
+			return fmt.Errorf("failed to execute clickhouse-client: %w", err)
+		}
+	}
+
+	if config.VerifyRowCounts {
+		expectedRows := tableReport.Rows
+		if recorded != nil {
+			expectedRows = *recorded
+		}
+		skippedRows, err := verifyRowCount(ctx, config, table, db, rowsBefore, expectedRows, tableReport)
+		if err != nil {
+			return err
+		}
+		tableReport.SkippedRows = max(tableReport.SkippedRows, skippedRows)
+	}
+
+	log.Printf("Data import for table %s completed successfully", table)
+	return nil
+}
+
+// insertDataFile inserts a data file into the table, adding its rows and bytes to the table report, whose progress
+// is reported against the total size of the data files of the table
+func insertDataFile(ctx context.Context, config Options, table, dataFilePath string, totalBytes int64, tableReport *TableReport) error {
+	// A retried insert sends the whole file again with the same deduplication token, so that ClickHouse drops the
+	// blocks a failed attempt already inserted rather than duplicating their rows
+	token, err := deduplicationToken(dataFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to compute the deduplication token of %s: %w", dataFilePath, err)
+	}
+	settings := insertSettings(config)
+	settings["insert_deduplication_token"] = token
+
+	var lastProgress time.Time
+	return withRetry(ctx, config.Retry, "importing data of "+table, func() error {
+		// Open the data file for every attempt so that a retried insert sends the whole file again
+		dataFile, err := openDataFile(config.Format, dataFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to open data file %s: %w", dataFilePath, err)
+		}
+		defer dataFile.Close()
+
+		dataReader := &countingReader{reader: throttle(ctx, config, dataFile), format: config.Format, onRead: func(r *countingReader) {
+			if time.Since(lastProgress) >= importProgressInterval {
+				lastProgress = time.Now()
+				reportProgress(config, Progress{Operation: "import", Table: table, Rows: tableReport.Rows + r.rows, Bytes: tableReport.Bytes + r.bytes, TotalBytes: totalBytes})
+			}
+		}}
+		var stderr bytes.Buffer
+		query := fmt.Sprintf("INSERT INTO %s FORMAT %s", qualifiedName(config.DBName, table), config.Format.Name())
+		if insert, ok := mappedInsert(config, table); ok {
+			query = fmt.Sprintf("INSERT INTO %s %s FORMAT %s", qualifiedName(config.DBName, table), insert, config.Format.Name())
+		}
+		args := []string{"--query", query}
+		args = append(args, settingsArgs(settings)...)
+		if tolerant(config) {
+			rejectedArgs, err := rejectedRowsArgs(config, table)
+			if err != nil {
+				return err
+			}
+			args = append(args, rejectedArgs...)
+		}
+		cmd := clickHouseClientCommand(ctx, config, args...)
+		cmd.Stdin = dataReader
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		tableReport.Rows += max(dataReader.rows-headerLines(config.Format), 0)
+		tableReport.Bytes += dataReader.bytes
+		return nil
+	})
+}
+
+// deduplicationToken returns the insert deduplication token of a data file, derived from its path and checksum
+func deduplicationToken(dataFilePath string) (string, error) {
+	file, err := describeFile(dataFilePath)
+	if err != nil {
+		return "", err
+	}
+	return file.Path + ":" + file.SHA256, nil
+}
+
+// verifyRowCount checks that the table grew by the expected number of rows since the import started, records both
+// counts in the table report, and returns the number of broken rows skipped within the error thresholds
+func verifyRowCount(ctx context.Context, config Options, table string, db *sql.DB, rowsBefore, expectedRows int, tableReport *TableReport) (int, error) {
+	rowsAfter, err := countRowsWithRetry(ctx, config, table, db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count rows of table %s: %w", table, err)
+	}
+	insertedRows := rowsAfter - rowsBefore
+	tableReport.ExpectedRows, tableReport.InsertedRows = expectedRows, insertedRows
+	return checkRowCount(config, table, insertedRows, expectedRows)
+}
+
+// checkRowCount compares the rows inserted into the table with the expected rows, and returns the number of broken
+// rows skipped within the error thresholds
+func checkRowCount(config Options, table string, insertedRows, expectedRows int) (int, error) {
+	if skippedRows := expectedRows - insertedRows; skippedRows > 0 && withinErrorThresholds(config, skippedRows, expectedRows) {
+		log.Printf("Warning: %d broken row(s) of table %s skipped: %d rows inserted, expected %d", skippedRows, table, insertedRows, expectedRows)
+		return skippedRows, nil
+	}
+	if insertedRows != expectedRows {
+		return 0, fmt.Errorf("row count mismatch for table %s: inserted %d rows, expected %d", table, insertedRows, expectedRows)
+	}
+	log.Printf("Row count verified for table %s: %d rows inserted", table, expectedRows)
+	return 0, nil
+}
+
+// recordedRows returns the number of rows the manifest records for the table of the dump when the data files to
+// import are all of its data files, or nil when the dump has no manifest or only some of the files are imported,
+// whose rows are then counted as they are read
+func recordedRows(config Options, dumpTable string, dataFiles []string) *int {
+	manifestTable, ok := config.manifestTables[dumpTable]
+	if !ok {
+		return nil
+	}
+	recorded := make(map[string]bool)
+	for _, file := range manifestTable.Files {
+		if !strings.HasSuffix(file.Path, ".sql") {
+			recorded[filepath.Base(filepath.FromSlash(file.Path))] = true
+		}
+	}
+	if len(recorded) != len(dataFiles) {
+		return nil
+	}
+	for _, dataFile := range dataFiles {
+		if !recorded[filepath.Base(dataFile)] {
+			return nil
+		}
+	}
+	return &manifestTable.Rows
+}
+
+// insertSettings returns the settings of the INSERT of the data files: the error thresholds letting it skip broken
+// rows, and the configured insert settings, which take precedence
+func insertSettings(config Options) map[string]string {
+	settings := make(map[string]string)
+	if config.AllowErrors > 0 {
+		settings["input_format_allow_errors_num"] = strconv.Itoa(config.AllowErrors)
+	}
+	if config.AllowErrorsRatio > 0 {
+		settings["input_format_allow_errors_ratio"] = strconv.FormatFloat(config.AllowErrorsRatio, 'f', -1, 64)
+	}
+	if config.ShardCluster != "" && !config.AsyncDistributed {
+		// The inserts through Distributed tables return once the rows are written to the shards, which the row
+		// count verification reads
+		settings["insert_distributed_sync"] = "1"
+	}
+	for name, value := range config.InsertSettings {
+		settings[name] = value
+	}
+	return settings
+}
+
+// withinErrorThresholds checks if the number of skipped rows is within the error thresholds. Like ClickHouse, which
+// fails the insert only when both thresholds are exceeded, either threshold allows the skipped rows.
+func withinErrorThresholds(config Options, skippedRows, expectedRows int) bool {
+	return skippedRows <= config.AllowErrors || float64(skippedRows) <= config.AllowErrorsRatio*float64(expectedRows)
+}
+
+// countRowsWithRetry returns the number of rows in the table, retrying transient errors according to the retry policy
+func countRowsWithRetry(ctx context.Context, config Options, table string, db *sql.DB) (rows int, err error) {
+	err = withRetry(ctx, config.Retry, "counting rows of "+table, func() error {
+		rows, err = countRows(ctx, db, config.DBName, table)
+		return err
+	})
+	return rows, err
+}
+
+// countRows returns the number of rows in the table
+func countRows(ctx context.Context, db *sql.DB, dbName, table string) (int, error) {
+	var rows int
+	query := fmt.Sprintf("SELECT count() FROM %s", qualifiedName(dbName, table))
+	if err := db.QueryRowContext(ctx, query).Scan(&rows); err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
+
+// validateManifest checks the signature of the manifest, that every file listed in it exists with the recorded
+// size and checksum, and warns about dump files that are not listed in it
+func validateManifest(config Options, schemaDir, dataDir string) error {
+	if err := verifyManifestSignature(config); err != nil {
+		return err
+	}
+	manifest, err := loadManifest(config.ManifestFile)
+	if err != nil {
+		return err
+	}
+	log.Printf("Validating dump of database %s exported from ClickHouse %s by version %s of the tool at %s",
+		manifest.DBName, manifest.ServerVersion, manifest.ToolVersion, manifest.CreatedAt.Format(time.RFC3339))
+
+	listedFiles := make(map[string]bool)
+	tables := append(slices.Clone(manifest.Tables), manifest.Dictionaries...)
+	if manifest.Database != nil {
+		tables = append(tables, ManifestTable{Name: manifest.DBName, Files: []ManifestFile{*manifest.Database}})
+	}
+	for _, table := range tables {
+		for _, expected := range table.Files {
+			actual, err := describeFile(filepath.FromSlash(expected.Path))
+			if err != nil {
+				return fmt.Errorf("failed to check file %s of table %s: %w", expected.Path, table.Name, err)
+			}
+			if actual.Size != expected.Size || actual.SHA256 != expected.SHA256 {
+				return fmt.Errorf("file %s of table %s does not match the manifest: got %d bytes with SHA-256 %s, expected %d bytes with SHA-256 %s",
+					expected.Path, table.Name, actual.Size, actual.SHA256, expected.Size, expected.SHA256)
+			}
+			listedFiles[filepath.Clean(filepath.FromSlash(expected.Path))] = true
+		}
+	}
+
+	dictionaryDir := filepath.Join(schemaDir, dictionarySchemaDir)
+	for dir, ext := range map[string]string{schemaDir: ".sql", dictionaryDir: ".sql", dataDir: config.Format.Extension()} {
+		files, err := ioutil.ReadDir(dir)
+		if dir == dictionaryDir && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read directory %s: %w", dir, err)
+		}
+		for _, file := range files {
+			filePath := filepath.Join(dir, file.Name())
+			if strings.HasSuffix(file.Name(), ext) && !listedFiles[filePath] {
+				log.Printf("Warning: file %s is not listed in the manifest", filePath)
+			}
+		}
+	}
+
+	log.Printf("Manifest validated: %d table(s) and %d dictionary(ies) match", len(manifest.Tables), len(manifest.Dictionaries))
+	return nil
+}
+
+// loadManifest reads and parses the manifest file
+func loadManifest(path string) (*Manifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// qualifiedNamePattern matches database-qualified names such as db.table or `db`.`table`
+var qualifiedNamePattern = regexp.MustCompile("(`?)([A-Za-z_][A-Za-z0-9_]*)(`?)\\.(`?)([A-Za-z_][A-Za-z0-9_]*)(`?)")
+
+// rewriteSchema applies the configured rewrites to a CREATE statement of the dump before it is executed
+func rewriteSchema(config Options, statement string) string {
+	statement = renameQualifiedNames(config, statement)
+	if config.Dereplicate {
+		statement = dereplicate(statement)
+	}
+	statement = rewriteReplicatedPaths(config, statement)
+	statement = rewriteUUIDs(config, statement)
+	statement = remapStorage(config, statement)
+	if !config.KeepPopulate {
+		statement = stripPopulate(statement)
+	}
+	statement = addOnCluster(config.OnCluster, statement)
+	return statement
+}
+
+// renameQualifiedNames applies the configured database and table renames, prefix and suffix to the qualified names
+// of a CREATE statement. Tables are renamed only where they are qualified with the database of the dump.
+func renameQualifiedNames(config Options, statement string) string {
+	if len(config.RenameDatabases) == 0 && len(config.RenameTables) == 0 && config.TablePrefix == "" && config.TableSuffix == "" {
+		return statement
+	}
+	return qualifiedNamePattern.ReplaceAllStringFunc(statement, func(name string) string {
+		parts := qualifiedNamePattern.FindStringSubmatch(name)
+		database, table := parts[2], parts[5]
+		if database == config.DumpDBName {
+			table = targetTableName(config, table)
+		}
+		if renamed, ok := config.RenameDatabases[database]; ok {
+			database = renamed
+		}
+		return parts[1] + database + parts[3] + "." + parts[4] + table + parts[6]
+	})
+}
+
+// replicatedEnginePattern matches a Replicated*MergeTree engine with its explicit ZooKeeper path and replica name
+// arguments, capturing whether further engine arguments follow
+var replicatedEnginePattern = regexp.MustCompile(`(Replicated\w*MergeTree)\(\s*'(?:[^'\\]|\\.)*'\s*,\s*'(?:[^'\\]|\\.)*'\s*(,\s*)?`)
+
+// rewriteReplicatedPaths rewrites the ZooKeeper path and replica name of Replicated engines according to the
+// configured mode: "macros" replaces them with the path and replica templates, "strip" removes them so that the
+// server defaults apply, and "keep" leaves them unchanged
+func rewriteReplicatedPaths(config Options, statement string) string {
+	switch config.ReplicatedPaths {
+	case "macros":
+		return replicatedEnginePattern.ReplaceAllStringFunc(statement, func(engine string) string {
+			parts := replicatedEnginePattern.FindStringSubmatch(engine)
+			return fmt.Sprintf("%s('%s', '%s'%s", parts[1], config.ReplicaPathTemplate, config.ReplicaNameTemplate, parts[2])
+		})
+	case "strip":
+		return replicatedEnginePattern.ReplaceAllString(statement, "${1}(")
+	default:
+		return statement
+	}
+}
+
+// uuidClausePattern matches the UUID clause of a CREATE statement, which SHOW CREATE TABLE includes on an Atomic
+// database, and the UUID clause of the inner table of a materialized view
+var uuidClausePattern = regexp.MustCompile(`(?i)\s+(TO\s+INNER\s+)?UUID\s+'[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}'`)
+
+// rewriteUUIDs strips the UUID clauses of a CREATE statement so that the server assigns new UUIDs, or replaces them
+// with random UUIDs, so that the objects do not collide with those they were exported from on the same server
+func rewriteUUIDs(config Options, statement string) string {
+	switch config.TableUUIDs {
+	case "strip":
+		return uuidClausePattern.ReplaceAllString(statement, "")
+	case "regenerate":
+		return uuidClausePattern.ReplaceAllStringFunc(statement, func(clause string) string {
+			return " " + uuidClausePattern.FindStringSubmatch(clause)[1] + "UUID '" + randomUUID() + "'"
+		})
+	default:
+		return statement
+	}
+}
+
+// randomUUID returns a random version 4 UUID
+func randomUUID() string {
+	var uuid [16]byte
+	binary.BigEndian.PutUint64(uuid[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(uuid[8:], rand.Uint64())
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// replicatedEngineNamePattern matches a Replicated*MergeTree engine name together with its optional explicit
+// ZooKeeper path and replica name arguments
+var replicatedEngineNamePattern = regexp.MustCompile(`\bReplicated(\w*MergeTree)(\(\s*'(?:[^'\\]|\\.)*'\s*,\s*'(?:[^'\\]|\\.)*'\s*(,\s*)?)?`)
+
+// dereplicate rewrites Replicated*MergeTree engines to their non-replicated counterparts and Distributed engines to
+// Merge engines reading the local table, so that production schemas can be loaded into a single node without ZooKeeper
+func dereplicate(statement string) string {
+	statement = replicatedEngineNamePattern.ReplaceAllStringFunc(statement, func(engine string) string {
+		parts := replicatedEngineNamePattern.FindStringSubmatch(engine)
+		if parts[2] == "" {
+			return parts[1]
+		}
+		return parts[1] + "("
+	})
+
+	location := distributedEnginePattern.FindStringIndex(statement)
+	if location == nil {
+		return statement
+	}
+	args, end := splitArguments(statement, location[1])
+	if len(args) < 3 {
+		return statement
+	}
+	table := strings.Trim(strings.TrimSpace(args[2]), "'`\"")
+	merge := fmt.Sprintf("Merge(%s, '^%s$')", strings.TrimSpace(args[1]), regexp.QuoteMeta(table))
+	return statement[:location[1]-len("Distributed(")] + merge + statement[end:]
+}
+
+// storagePolicyPattern matches the storage_policy setting together with its surrounding commas
+var storagePolicyPattern = regexp.MustCompile(`(?i)(,\s*)?\bstorage_policy\s*=\s*'((?:[^'\\]|\\.)*)'(\s*,\s*)?`)
+
+// emptySettingsPattern matches a SETTINGS clause left without settings
+var emptySettingsPattern = regexp.MustCompile(`(?im)\s*\bSETTINGS\s*$`)
+
+// ttlMovePattern matches the destination of a TTL move
+var ttlMovePattern = regexp.MustCompile(`(?i)\bTO\s+(DISK|VOLUME)\s+'((?:[^'\\]|\\.)*)'`)
+
+// ttlClausePattern matches the TTL clause of a table, which SHOW CREATE TABLE writes on its own line
+var ttlClausePattern = regexp.MustCompile(`(?m)^TTL\s+([^\n]*)(\n?)`)
+
+// remapStorage applies the configured storage policy, disk and volume remapping to a CREATE statement,
+// or strips the storage policy and TTL moves when requested
+func remapStorage(config Options, statement string) string {
+	statement = storagePolicyPattern.ReplaceAllStringFunc(statement, func(setting string) string {
+		parts := storagePolicyPattern.FindStringSubmatch(setting)
+		if config.StripStoragePolicy {
+			if parts[1] != "" && parts[3] != "" {
+				return ", "
+			}
+			return ""
+		}
+		if policy, ok := config.StoragePolicyMap[parts[2]]; ok {
+			return fmt.Sprintf("%sstorage_policy = '%s'%s", parts[1], policy, parts[3])
+		}
+		return setting
+	})
+	if config.StripStoragePolicy {
+		statement = emptySettingsPattern.ReplaceAllString(statement, "")
+	}
+
+	if config.StripTTLMoves {
+		return ttlClausePattern.ReplaceAllStringFunc(statement, func(clause string) string {
+			parts := ttlClausePattern.FindStringSubmatch(clause)
+			var kept []string
+			for _, element := range splitTopLevel(parts[1]) {
+				if !ttlMovePattern.MatchString(element) {
+					kept = append(kept, strings.TrimSpace(element))
+				}
+			}
+			if len(kept) == 0 {
+				return ""
+			}
+			return "TTL " + strings.Join(kept, ", ") + parts[2]
+		})
+	}
+	return ttlMovePattern.ReplaceAllStringFunc(statement, func(move string) string {
+		parts := ttlMovePattern.FindStringSubmatch(move)
+		mapping := config.DiskMap
+		if strings.EqualFold(parts[1], "VOLUME") {
+			mapping = config.VolumeMap
+		}
+		if target, ok := mapping[parts[2]]; ok {
+			return fmt.Sprintf("TO %s '%s'", strings.ToUpper(parts[1]), target)
+		}
+		return move
+	})
+}
+
+// splitTopLevel splits a list at its top-level commas, ignoring commas inside parentheses and quotes
+func splitTopLevel(list string) []string {
+	args, _ := splitArguments(list+")", 0)
+	return args
+}
+
+// createObjectPattern matches the beginning of a CREATE statement up to and including the name of the created object
+var createObjectPattern = regexp.MustCompile("(?is)^\\s*CREATE\\s+(?:OR\\s+REPLACE\\s+)?(?:TEMPORARY\\s+)?" +
+	"(?:TABLE|VIEW|MATERIALIZED\\s+VIEW|LIVE\\s+VIEW|WINDOW\\s+VIEW|DICTIONARY|DATABASE|FUNCTION)\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?" +
+	"(?:`[^`]+`|\\w+)(?:\\.(?:`[^`]+`|\\w+))?")
+
+// onClusterPattern matches an existing ON CLUSTER clause
+var onClusterPattern = regexp.MustCompile(`(?i)\bON\s+CLUSTER\b`)
+
+// addOnCluster adds an ON CLUSTER clause after the name of the created object so that the statement runs on every
+// host of the cluster. Statements that already have one are left unchanged.
+func addOnCluster(cluster, statement string) string {
+	if cluster == "" || onClusterPattern.MatchString(statement) {
+		return statement
+	}
+	location := createObjectPattern.FindStringIndex(statement)
+	if location == nil {
+		return statement
+	}
+	return statement[:location[1]] + " ON CLUSTER " + quoteIdentifier(cluster) + statement[location[1]:]
+}
+
+// targetTableName returns the name a table of the dump is restored under, applying the rename mapping
+// and then the configured prefix and suffix
+func targetTableName(config Options, table string) string {
+	if renamed, ok := config.RenameTables[table]; ok {
+		table = renamed
+	}
+	return config.TablePrefix + table + config.TableSuffix
+}
+
+// getTableEngine returns the engine of the specified table
+func getTableEngine(ctx context.Context, db *sql.DB, table, dbName string) (string, error) {
+	var engine string
+	err := db.QueryRowContext(ctx, "SELECT engine FROM system.tables WHERE database = ? AND name = ?", dbName, table).Scan(&engine)
+	return engine, err
+}
@@ -0,0 +1,279 @@
+package chdump
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeduplicationToken(t *testing.T) {
+	dir := t.TempDir()
+	orders := filepath.Join(dir, "orders.tsv")
+	customers := filepath.Join(dir, "customers.tsv")
+	for _, path := range []string{orders, customers} {
+		if err := os.WriteFile(path, []byte("1\tfirst\n2\tsecond\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	token, err := deduplicationToken(orders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := deduplicationToken(orders); again != token {
+		t.Errorf("deduplicationToken() = %q then %q, want the same token for every attempt", token, again)
+	}
+	if !strings.HasPrefix(token, filepath.ToSlash(orders)+":") {
+		t.Errorf("deduplicationToken() = %q, want it to start with the path of the file", token)
+	}
+	if other, _ := deduplicationToken(customers); other == token {
+		t.Errorf("deduplicationToken() = %q for two files, want distinct tokens", token)
+	}
+
+	if err := os.WriteFile(orders, []byte("1\tfirst\n2\tchanged\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := deduplicationToken(orders); changed == token {
+		t.Errorf("deduplicationToken() = %q after the file changed, want another token", changed)
+	}
+	if _, err := deduplicationToken(filepath.Join(dir, "missing.tsv")); err == nil {
+		t.Error("deduplicationToken() of a missing file succeeded")
+	}
+}
+
+func TestRecordedRows(t *testing.T) {
+	config := Options{manifestTables: map[string]ManifestTable{
+		"orders": {Name: "orders", Rows: 1200, Files: []ManifestFile{
+			{Path: "dump/sales/schema/orders.sql"},
+			{Path: "dump/sales/data/orders.1.tsv"},
+			{Path: "dump/sales/data/orders.2.tsv"},
+		}},
+	}}
+	tests := []struct {
+		name  string
+		table string
+		files []string
+		want  int
+		ok    bool
+	}{
+		{name: "all files", table: "orders", files: []string{"/restore/sales/data/orders.1.tsv", "/restore/sales/data/orders.2.tsv"}, want: 1200, ok: true},
+		{name: "some files", table: "orders", files: []string{"/restore/sales/data/orders.1.tsv"}},
+		{name: "other files", table: "orders", files: []string{"/restore/sales/data/orders.1.tsv", "/restore/sales/data/orders.3.tsv"}},
+		{name: "not in the manifest", table: "customers", files: []string{"/restore/sales/data/customers.tsv"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := recordedRows(config, test.table, test.files)
+			if (got != nil) != test.ok || (got != nil && *got != test.want) {
+				t.Errorf("recordedRows() = %v, want %d (%v)", got, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestCheckRowCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Options
+		inserted int
+		expected int
+		skipped  int
+		wantErr  bool
+	}{
+		{name: "match", inserted: 1200, expected: 1200},
+		{name: "missing rows", inserted: 1100, expected: 1200, wantErr: true},
+		{name: "extra rows", inserted: 1300, expected: 1200, wantErr: true},
+		{name: "missing rows within the thresholds", config: Options{AllowErrors: 100}, inserted: 1100, expected: 1200, skipped: 100},
+		{name: "missing rows beyond the thresholds", config: Options{AllowErrors: 99}, inserted: 1100, expected: 1200, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			skipped, err := checkRowCount(test.config, "orders", test.inserted, test.expected)
+			if skipped != test.skipped || (err != nil) != test.wantErr {
+				t.Errorf("checkRowCount() = %d, %v, want %d skipped rows and error %v", skipped, err, test.skipped, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRenameQualifiedNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Options
+		statement string
+		want      string
+	}{
+		{
+			name:      "no renames",
+			config:    Options{DumpDBName: "sales"},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+		{
+			name:      "database rename",
+			config:    Options{DumpDBName: "sales", RenameDatabases: map[string]string{"sales": "sales_copy"}},
+			statement: "CREATE VIEW sales.totals AS SELECT sum(amount) FROM sales.orders",
+			want:      "CREATE VIEW sales_copy.totals AS SELECT sum(amount) FROM sales_copy.orders",
+		},
+		{
+			name:      "backquoted names",
+			config:    Options{DumpDBName: "sales", RenameDatabases: map[string]string{"sales": "staging"}},
+			statement: "CREATE TABLE `sales`.`orders` (id UInt64) ENGINE = Memory",
+			want:      "CREATE TABLE `staging`.`orders` (id UInt64) ENGINE = Memory",
+		},
+		{
+			name:      "table rename, prefix and suffix",
+			config:    Options{DumpDBName: "sales", RenameTables: map[string]string{"orders": "orders_v2"}, TablePrefix: "tmp_", TableSuffix: "_restored"},
+			statement: "CREATE MATERIALIZED VIEW sales.daily TO sales.orders AS SELECT * FROM sales.events",
+			want:      "CREATE MATERIALIZED VIEW sales.tmp_daily_restored TO sales.tmp_orders_v2_restored AS SELECT * FROM sales.tmp_events_restored",
+		},
+		{
+			name:      "tables of other databases keep their names",
+			config:    Options{DumpDBName: "sales", TablePrefix: "tmp_", RenameDatabases: map[string]string{"shared": "shared_copy"}},
+			statement: "CREATE VIEW sales.enriched AS SELECT * FROM sales.orders JOIN shared.currencies USING (currency)",
+			want:      "CREATE VIEW sales.tmp_enriched AS SELECT * FROM sales.tmp_orders JOIN shared_copy.currencies USING (currency)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := renameQualifiedNames(test.config, test.statement); got != test.want {
+				t.Errorf("renameQualifiedNames() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+// rewriteTest is a CREATE statement of the dump and the statement rewriteSchema makes of it with the config
+type rewriteTest struct {
+	name      string
+	config    Options
+	statement string
+	want      string
+}
+
+// testRewriteSchema checks the rewriting of the statements of the tests
+func testRewriteSchema(t *testing.T, tests []rewriteTest) {
+	t.Helper()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rewriteSchema(test.config, test.statement); got != test.want {
+				t.Errorf("rewriteSchema() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRewriteSchemaOnCluster(t *testing.T) {
+	testRewriteSchema(t, []rewriteTest{
+		{
+			name:      "added",
+			config:    Options{DumpDBName: "sales", OnCluster: "main"},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id",
+			want:      "CREATE TABLE sales.orders ON CLUSTER `main` (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+		{
+			name:      "renamed on a cluster",
+			config:    Options{DumpDBName: "sales", RenameDatabases: map[string]string{"sales": "staging"}, OnCluster: "main"},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id",
+			want:      "CREATE TABLE staging.orders ON CLUSTER `main` (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+		{
+			name:      "existing ON CLUSTER kept",
+			config:    Options{DumpDBName: "sales", OnCluster: "main"},
+			statement: "CREATE TABLE sales.orders ON CLUSTER other (id UInt64) ENGINE = MergeTree ORDER BY id",
+			want:      "CREATE TABLE sales.orders ON CLUSTER other (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+	})
+}
+
+func TestRewriteSchemaReplicatedPaths(t *testing.T) {
+	testRewriteSchema(t, []rewriteTest{
+		{
+			name:      "kept",
+			config:    Options{DumpDBName: "sales", ReplicatedPaths: "keep"},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/orders', '{replica}') ORDER BY id",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/orders', '{replica}') ORDER BY id",
+		},
+		{
+			name:      "replaced with macros",
+			config:    Options{DumpDBName: "sales", ReplicatedPaths: "macros", ReplicaPathTemplate: "/clickhouse/tables/{uuid}/{shard}", ReplicaNameTemplate: "{replica}"},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplicatedMergeTree('/old/path', 'host1') ORDER BY id",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{uuid}/{shard}', '{replica}') ORDER BY id",
+		},
+		{
+			name:      "stripped",
+			config:    Options{DumpDBName: "sales", ReplicatedPaths: "strip"},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplicatedMergeTree('/old/path', 'host1') ORDER BY id",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplicatedMergeTree() ORDER BY id",
+		},
+	})
+}
+
+func TestRewriteSchemaDereplicate(t *testing.T) {
+	testRewriteSchema(t, []rewriteTest{
+		{
+			name:      "MergeTree",
+			config:    Options{DumpDBName: "sales", Dereplicate: true},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/orders', '{replica}') ORDER BY id",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree() ORDER BY id",
+		},
+		{
+			name:      "engine parameters kept",
+			config:    Options{DumpDBName: "sales", Dereplicate: true},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/orders', '{replica}', version) ORDER BY id",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = ReplacingMergeTree(version) ORDER BY id",
+		},
+	})
+}
+
+func TestRewriteSchemaStoragePolicy(t *testing.T) {
+	testRewriteSchema(t, []rewriteTest{
+		{
+			name:      "mapped",
+			config:    Options{DumpDBName: "sales", StoragePolicyMap: map[string]string{"hot_cold": "default"}},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'hot_cold', index_granularity = 8192",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'default', index_granularity = 8192",
+		},
+		{
+			name:      "stripped",
+			config:    Options{DumpDBName: "sales", StripStoragePolicy: true},
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'hot_cold'",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+	})
+}
+
+func TestRewriteSchemaPopulate(t *testing.T) {
+	testRewriteSchema(t, []rewriteTest{
+		{
+			name:      "stripped",
+			config:    Options{DumpDBName: "sales"},
+			statement: "CREATE MATERIALIZED VIEW sales.daily ENGINE = SummingMergeTree ORDER BY day POPULATE AS SELECT toDate(ts) AS day, count() AS c FROM sales.events GROUP BY day",
+			want:      "CREATE MATERIALIZED VIEW sales.daily ENGINE = SummingMergeTree ORDER BY day AS SELECT toDate(ts) AS day, count() AS c FROM sales.events GROUP BY day",
+		},
+		{
+			name:      "kept",
+			config:    Options{DumpDBName: "sales", KeepPopulate: true},
+			statement: "CREATE MATERIALIZED VIEW sales.daily ENGINE = SummingMergeTree ORDER BY day POPULATE AS SELECT toDate(ts) AS day, count() AS c FROM sales.events GROUP BY day",
+			want:      "CREATE MATERIALIZED VIEW sales.daily ENGINE = SummingMergeTree ORDER BY day POPULATE AS SELECT toDate(ts) AS day, count() AS c FROM sales.events GROUP BY day",
+		},
+	})
+}
+
+func TestRewriteSchemaUUIDs(t *testing.T) {
+	testRewriteSchema(t, []rewriteTest{
+		{
+			name:      "stripped",
+			config:    Options{DumpDBName: "sales", TableUUIDs: "strip"},
+			statement: "CREATE TABLE sales.orders UUID '0f1e2d3c-4b5a-4968-8776-a5b4c3d2e1f0' (id UInt64) ENGINE = MergeTree ORDER BY id",
+			want:      "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+		{
+			name:      "kept",
+			config:    Options{DumpDBName: "sales", TableUUIDs: "keep"},
+			statement: "CREATE TABLE sales.orders UUID '0f1e2d3c-4b5a-4968-8776-a5b4c3d2e1f0' (id UInt64) ENGINE = MergeTree ORDER BY id",
+			want:      "CREATE TABLE sales.orders UUID '0f1e2d3c-4b5a-4968-8776-a5b4c3d2e1f0' (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+	})
+}
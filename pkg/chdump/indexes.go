@@ -0,0 +1,107 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// tableIndexes returns the names of the data skipping indexes and of the projections of a CREATE TABLE statement
+func tableIndexes(statement string) ([]string, []string) {
+	var indexes, projections []string
+	for _, element := range tableElements(statement) {
+		fields := strings.Fields(element)
+		if len(fields) < 2 {
+			continue
+		}
+		name, _ := splitColumnName(strings.TrimSpace(element[len(fields[0]):]))
+		if end := strings.IndexFunc(name, func(r rune) bool { return r == '(' || unicode.IsSpace(r) }); end > 0 && fields[1][0] != '`' {
+			name = name[:end]
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "INDEX":
+			indexes = append(indexes, name)
+		case "PROJECTION":
+			projections = append(projections, name)
+		}
+	}
+	return indexes, projections
+}
+
+// verifyIndexes checks that the restored tables have the data skipping indexes and projections of their schema
+// files, which a target table created beforehand may lack, and materializes them when requested. It returns the
+// tables that lack some of them.
+func verifyIndexes(ctx context.Context, db *sql.DB, config Options, schemaFiles []SchemaFile) ([]string, error) {
+	var incomplete []string
+	for _, file := range schemaFiles {
+		if !createTablePattern.MatchString(file.Content) {
+			continue
+		}
+		indexes, projections := tableIndexes(file.Content)
+		if len(indexes) == 0 && len(projections) == 0 {
+			continue
+		}
+		table := targetTableName(config, file.Table)
+		exists, err := tableExists(ctx, db, config, table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		var statement string
+		err = withRetry(ctx, config.Retry, "fetching schema of table "+table, func() error {
+			return db.QueryRowContext(ctx, "SHOW CREATE TABLE "+qualifiedName(config.DBName, table)).Scan(&statement)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch schema of table %s: %w", table, err)
+		}
+
+		targetIndexes, targetProjections := tableIndexes(statement)
+		var missing []string
+		for _, index := range indexes {
+			if !slices.Contains(targetIndexes, index) {
+				missing = append(missing, "index "+index)
+			}
+		}
+		for _, projection := range projections {
+			if !slices.Contains(targetProjections, projection) {
+				missing = append(missing, "projection "+projection)
+			}
+		}
+		if len(missing) > 0 {
+			log.Printf("Warning: table %s lacks the %s of the dump", table, strings.Join(missing, ", "))
+			incomplete = append(incomplete, table)
+			continue
+		}
+		if config.MaterializeIndexes {
+			if err := materializeIndexes(ctx, db, config, table, indexes, projections); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return incomplete, nil
+}
+
+// materializeIndexes starts the mutations building the data skipping indexes and projections of a table for the
+// parts written before they were added. The mutations run in the background.
+func materializeIndexes(ctx context.Context, db *sql.DB, config Options, table string, indexes, projections []string) error {
+	var statements []string
+	for _, index := range indexes {
+		statements = append(statements, alterTableQuery(config, table)+" MATERIALIZE INDEX "+quoteIdentifier(index))
+	}
+	for _, projection := range projections {
+		statements = append(statements, alterTableQuery(config, table)+" MATERIALIZE PROJECTION "+quoteIdentifier(projection))
+	}
+	for _, statement := range statements {
+		if err := execWithRetry(ctx, db, config, statement); err != nil {
+			return fmt.Errorf("failed to materialize the indexes of table %s: %w", table, err)
+		}
+	}
+	log.Printf("Materializing %d index(es) and %d projection(s) of table %s", len(indexes), len(projections), table)
+	return nil
+}
@@ -0,0 +1,221 @@
+package chdump
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimestampFormat is the layout of the names of timestamped dump directories
+const TimestampFormat = "20060102T150405Z"
+
+// LatestLink is the symbolic link to the latest complete timestamped dump of a database, or the marker file holding
+// its name where symbolic links are not supported
+const LatestLink = "latest"
+
+// FailedSuffix marks the timestamped dump directory of a failed export
+const FailedSuffix = ".failed"
+
+// databaseDir returns the directory of the dump of a database: none with the single-database layout,
+// <dumpDir>/<db> with the per-database layout, and <dumpDir>/<db>/<timestamp> with the timestamped one. The export
+// writes the timestamped dump of the run, or the unfinished one it resumes, and the other commands read the dump
+// selected by From, the latest one by default.
+func databaseDir(config Options, dbName string, multiDatabase, export bool) (string, error) {
+	if !config.Timestamped {
+		if !multiDatabase {
+			return "", nil
+		}
+		return filepath.Join(config.DumpDir, dbName), nil
+	}
+
+	root := filepath.Join(config.DumpDir, dbName)
+	if export && config.Resume {
+		if unfinished, err := unfinishedDump(root); err != nil || unfinished != "" {
+			return unfinished, err
+		}
+	}
+	if export {
+		return filepath.Join(root, config.timestamp), nil
+	}
+	dumps, err := databaseDumps(root, dbName, config.ManifestFile)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("no dump of database %s in %s", dbName, config.DumpDir)
+	}
+	if err != nil {
+		return "", err
+	}
+	for i := len(dumps) - 1; i >= 0; i-- {
+		dump := dumps[i]
+		if dump.Status == "complete" && (config.From == "" || config.From == LatestLink && dump.Latest ||
+			config.From != LatestLink && strings.HasPrefix(dump.Timestamp, config.From)) {
+			log.Printf("Reading the dump %s of database %s", dump.Timestamp, dbName)
+			return dump.Path, nil
+		}
+	}
+	if config.From == "" || config.From == LatestLink {
+		return "", fmt.Errorf("no complete dump of database %s in %s", dbName, root)
+	}
+	return "", fmt.Errorf("no complete dump of database %s in %s matches %s", dbName, root, config.From)
+}
+
+// dumpPrefixPattern matches a timestamp of the TimestampFormat layout, or a prefix of it
+var dumpPrefixPattern = regexp.MustCompile(`^\d{4}(\d{2}(\d{2}(T(\d{2}(\d{2}(\d{2}Z?)?)?)?)?)?)?$`)
+
+// Dump is a timestamped dump of a database
+type Dump struct {
+	Database  string
+	Timestamp string
+	Path      string
+	Status    string // complete, failed, or unfinished when it is newer than the latest complete dump
+	Latest    bool   // whether the latest link points to the dump
+	Tables    int    // number of tables of the manifest, 0 when the dump has none
+	Rows      int
+	Bytes     int64
+}
+
+// ListDumps returns the timestamped dumps of the databases of the options, or of every database of the dump
+// directory when no database is given, ordered by database and timestamp
+func ListDumps(options Options) ([]Dump, error) {
+	setDefaults(&options)
+	options.AllDatabases = options.AllDatabases || len(options.Databases) == 0
+	databases, err := dumpDatabases(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var dumps []Dump
+	for _, dbName := range databases {
+		databaseDumps, err := databaseDumps(filepath.Join(options.DumpDir, dbName), dbName, options.ManifestFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		dumps = append(dumps, databaseDumps...)
+	}
+	return dumps, nil
+}
+
+// databaseDumps returns the timestamped dumps of the directory of a database in chronological order, with the
+// number of tables, rows and bytes of their manifests
+func databaseDumps(root, dbName, manifestFile string) ([]Dump, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := LatestDump(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var dumps []Dump
+	for _, entry := range entries {
+		timestamp := strings.TrimSuffix(entry.Name(), FailedSuffix)
+		if _, err := time.Parse(TimestampFormat, timestamp); err != nil || !entry.IsDir() {
+			continue
+		}
+		dump := Dump{Database: dbName, Timestamp: timestamp, Path: filepath.Join(root, entry.Name()), Status: "complete", Latest: timestamp == latest}
+		switch {
+		case timestamp != entry.Name():
+			dump.Status = "failed"
+		case latest == "" || timestamp > latest:
+			dump.Status = "unfinished"
+		}
+		if manifest, err := loadManifest(relocatePath(dump.Path, manifestFile)); err == nil {
+			dump.Tables = len(manifest.Tables)
+			for _, table := range manifest.Tables {
+				dump.Rows += table.Rows
+				for _, file := range table.Files {
+					dump.Bytes += file.Size
+				}
+			}
+		}
+		dumps = append(dumps, dump)
+	}
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].Timestamp < dumps[j].Timestamp })
+	return dumps, nil
+}
+
+// unfinishedDump returns the newest timestamped dump of the directory newer than the latest complete one, restoring
+// its name if it was marked as failed, or nothing when there is none
+func unfinishedDump(root string) (string, error) {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	latest, err := LatestDump(root)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var unfinished []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), FailedSuffix)
+		if _, err := time.Parse(TimestampFormat, name); err == nil && entry.IsDir() && name > latest {
+			unfinished = append(unfinished, entry.Name())
+		}
+	}
+	if len(unfinished) == 0 {
+		return "", nil
+	}
+	sort.Strings(unfinished)
+	dir := filepath.Join(root, unfinished[len(unfinished)-1])
+	if resumed := strings.TrimSuffix(dir, FailedSuffix); resumed != dir {
+		if err := os.Rename(dir, resumed); err != nil {
+			return "", err
+		}
+		dir = resumed
+	}
+	log.Printf("Resuming the unfinished dump %s", dir)
+	return dir, nil
+}
+
+// LatestDump returns the name of the latest complete timestamped dump of the directory of a database
+func LatestDump(root string) (string, error) {
+	path := filepath.Join(root, LatestLink)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		return filepath.Base(target), err
+	}
+	content, err := os.ReadFile(path)
+	return strings.TrimSpace(string(content)), err
+}
+
+// finishTimestampedDump points the latest link of the database to its timestamped dump once it is complete and
+// prunes the older dumps beyond the retention policy, or marks the dump as failed
+func finishTimestampedDump(config Options, dir string, exportErr error) error {
+	root, name := filepath.Dir(dir), filepath.Base(dir)
+	if exportErr != nil {
+		if _, err := os.Stat(dir); err != nil {
+			return nil
+		}
+		return os.Rename(dir, dir+FailedSuffix)
+	}
+
+	// The link is replaced atomically, so that an import never finds it missing
+	temporary := filepath.Join(root, LatestLink+".tmp")
+	os.Remove(temporary)
+	if err := os.Symlink(name, temporary); err != nil {
+		if err := os.WriteFile(temporary, []byte(name+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(temporary, filepath.Join(root, LatestLink)); err != nil {
+		return err
+	}
+	log.Printf("The latest dump of %s is now %s", root, name)
+
+	if config.Retention.Enabled() {
+		return PruneDumps(root, config.Retention)
+	}
+	return nil
+}
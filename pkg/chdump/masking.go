@@ -0,0 +1,179 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MaskRules are the masking rules of the columns of a table, applied by the export so that the masked values never
+// leave the source server:
+//
+//	null                      the default value of the column, NULL when it is Nullable
+//	hash[:salt]               the SHA-256 of the value in hex for strings, its SipHash for integers and floats,
+//	                          and a UUID made of its SHA-256 for UUIDs; other types are not supported
+//	constant:value            the value, converted to the type of the column
+//	regex:/pattern/replace/   the value with every match of the regular expression replaced, any character
+//	                          following regex: being the delimiter
+//	fake:kind[:salt]          a realistic fake value of the kind (name, firstName, lastName, email, phone, city
+//	                          or company) picked by the hash of the value
+type MaskRules map[string]string
+
+// maskRule is a parsed masking rule
+type maskRule struct {
+	kind     string // null, hash, constant, regex or fake
+	argument string // the salt or constant
+	fake     string // the kind of fake value
+	pattern  string
+	replace  string
+}
+
+// parseMaskRule parses a masking rule
+func parseMaskRule(rule string) (maskRule, error) {
+	kind, argument, _ := strings.Cut(rule, ":")
+	switch kind {
+	case "null":
+		if argument != "" {
+			return maskRule{}, fmt.Errorf("invalid masking rule %q: null takes no argument", rule)
+		}
+	case "hash", "constant":
+	case "regex":
+		if argument == "" {
+			return maskRule{}, fmt.Errorf("invalid masking rule %q, expected regex:/pattern/replacement/", rule)
+		}
+		parts := strings.Split(argument[1:], argument[:1])
+		if len(parts) != 3 || parts[2] != "" {
+			return maskRule{}, fmt.Errorf("invalid masking rule %q, expected regex:/pattern/replacement/", rule)
+		}
+		if _, err := regexp.Compile(parts[0]); err != nil {
+			return maskRule{}, fmt.Errorf("invalid masking rule %q: %w", rule, err)
+		}
+		return maskRule{kind: kind, pattern: parts[0], replace: parts[1]}, nil
+	case "fake":
+		fake, salt, _ := strings.Cut(argument, ":")
+		if _, ok := fakeValues[fake]; !ok {
+			return maskRule{}, fmt.Errorf("invalid masking rule %q, expected fake:kind with a kind among %s", rule, strings.Join(fakeKinds(), ", "))
+		}
+		return maskRule{kind: kind, argument: salt, fake: fake}, nil
+	default:
+		return maskRule{}, fmt.Errorf("invalid masking rule %q, expected null, hash, constant, regex or fake", rule)
+	}
+	return maskRule{kind: kind, argument: argument}, nil
+}
+
+// validateMasks checks the masking rules of the options
+func validateMasks(masks map[string]MaskRules) error {
+	for table, columns := range masks {
+		for column, rule := range columns {
+			if _, err := parseMaskRule(rule); err != nil {
+				return fmt.Errorf("column %s of table %s: %w", column, table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stringTypePattern matches the string types, possibly Nullable or LowCardinality, capturing the size of a
+// FixedString
+var stringTypePattern = regexp.MustCompile(`^(?:Nullable\(|LowCardinality\()*(?:String|FixedString\((\d+)\))\)*$`)
+
+// numericTypePattern matches the integer and floating-point types, possibly Nullable or LowCardinality, which the
+// SipHash of a value converts to, truncated to the width of the smaller integers
+var numericTypePattern = regexp.MustCompile(`^(?:Nullable\(|LowCardinality\()*(?:U?Int(?:8|16|32|64|128|256)|Float(?:32|64))\)*$`)
+
+// uuidTypePattern matches the UUID type, possibly Nullable
+var uuidTypePattern = regexp.MustCompile(`^(?:Nullable\()?UUID\)?$`)
+
+// expression returns the expression of the masked value of a column of the type. The value keeps the type of the
+// column, so that the dump restores into the same schema and the checksum of the masked data matches the restored
+// table. It fails for the hash rule on the types a hash does not convert to.
+func (r maskRule) expression(column, columnType string) (string, error) {
+	value := quoteIdentifier(column)
+	var masked string
+	switch r.kind {
+	case "null":
+		return fmt.Sprintf("defaultValueOfTypeName(%s)", quoteString(columnType)), nil
+	case "hash":
+		salted := fmt.Sprintf("concat(%s, toString(%s))", quoteString(r.argument), value)
+		match := stringTypePattern.FindStringSubmatch(columnType)
+		switch {
+		case match != nil && match[1] != "":
+			masked = fmt.Sprintf("substring(lower(hex(SHA256(%s))), 1, %s)", salted, match[1])
+		case match != nil:
+			masked = fmt.Sprintf("lower(hex(SHA256(%s)))", salted)
+		case numericTypePattern.MatchString(columnType):
+			masked = fmt.Sprintf("sipHash64(%s)", salted)
+		case uuidTypePattern.MatchString(columnType):
+			masked = fmt.Sprintf("reinterpretAsUUID(substring(SHA256(%s), 1, 16))", salted)
+		default:
+			return "", fmt.Errorf("the hash rule does not support the %s type of column %s, mask it with null or constant instead", columnType, column)
+		}
+	case "constant":
+		masked = quoteString(r.argument)
+	case "regex":
+		masked = fmt.Sprintf("replaceRegexpAll(toString(%s), %s, %s)", value, quoteString(r.pattern), quoteString(r.replace))
+	case "fake":
+		masked = fakeValues[r.fake](func(part string) string {
+			return fmt.Sprintf("sipHash64(concat(%s, toString(%s)))", quoteString(r.argument+"#"+part+"#"), value)
+		})
+	}
+	return fmt.Sprintf("CAST(%s, %s)", masked, quoteString(columnType)), nil
+}
+
+// selectColumns returns the columns of the SELECT exporting the table: the expression list configured for the table,
+// or all of its columns, with those that have masking rules replaced by their masked values
+func selectColumns(ctx context.Context, db *sql.DB, config Options, table string) (string, error) {
+	if expressions, ok := config.TableSelects[table]; ok {
+		return expressions, nil
+	}
+	masks := config.ColumnMasks[table]
+	if len(masks) == 0 {
+		return "*", nil
+	}
+
+	types := make(map[string]string)
+	err := withRetry(ctx, config.Retry, "fetching column types of "+table, func() error {
+		rows, err := db.QueryContext(ctx, "SELECT name, type FROM system.columns WHERE database = ? AND table = ?", config.DBName, table)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name, columnType string
+			if err := rows.Scan(&name, &columnType); err != nil {
+				return err
+			}
+			types[name] = columnType
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	columns := make([]string, 0, len(masks))
+	for column := range masks {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	replacements := make([]string, 0, len(columns))
+	for _, column := range columns {
+		columnType, ok := types[column]
+		if !ok {
+			return "", fmt.Errorf("masked column %s does not exist in table %s", column, table)
+		}
+		rule, err := parseMaskRule(masks[column])
+		if err != nil {
+			return "", err
+		}
+		expression, err := rule.expression(column, columnType)
+		if err != nil {
+			return "", fmt.Errorf("failed to mask table %s: %w", table, err)
+		}
+		replacements = append(replacements, expression+" AS "+quoteIdentifier(column))
+	}
+	return "* REPLACE (" + strings.Join(replacements, ", ") + ")", nil
+}
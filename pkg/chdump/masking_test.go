@@ -0,0 +1,90 @@
+package chdump
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMaskRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    maskRule
+		wantErr bool
+	}{
+		{rule: "null", want: maskRule{kind: "null"}},
+		{rule: "null:x", wantErr: true},
+		{rule: "hash", want: maskRule{kind: "hash"}},
+		{rule: "hash:3f9a1c", want: maskRule{kind: "hash", argument: "3f9a1c"}},
+		{rule: "constant:Jane Doe", want: maskRule{kind: "constant", argument: "Jane Doe"}},
+		{rule: "constant:a:b", want: maskRule{kind: "constant", argument: "a:b"}},
+		{rule: `regex:/\d/#/`, want: maskRule{kind: "regex", pattern: `\d`, replace: "#"}},
+		{rule: "regex:|/|-|", want: maskRule{kind: "regex", pattern: "/", replace: "-"}},
+		{rule: "regex:/a/b/", want: maskRule{kind: "regex", pattern: "a", replace: "b"}},
+		{rule: "regex:", wantErr: true},
+		{rule: "regex:/a/b", wantErr: true},
+		{rule: "regex:/a/b/c", wantErr: true},
+		{rule: "regex:/(/x/", wantErr: true},
+		{rule: "fake:email", want: maskRule{kind: "fake", fake: "email"}},
+		{rule: "fake:name:3f9a1c", want: maskRule{kind: "fake", fake: "name", argument: "3f9a1c"}},
+		{rule: "fake:ssn", wantErr: true},
+		{rule: "fake", wantErr: true},
+		{rule: "redact", wantErr: true},
+		{rule: "", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseMaskRule(test.rule)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseMaskRule(%q) = %+v, want an error", test.rule, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMaskRule(%q) error = %v", test.rule, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseMaskRule(%q) = %+v, want %+v", test.rule, got, test.want)
+		}
+	}
+}
+
+func TestHashMaskExpression(t *testing.T) {
+	tests := []struct {
+		columnType string
+		want       string // a part of the expression, empty when the type is not supported
+	}{
+		{"String", "lower(hex(SHA256("},
+		{"LowCardinality(Nullable(String))", "lower(hex(SHA256("},
+		{"FixedString(8)", "substring(lower(hex(SHA256(concat('s', toString(`c`))))), 1, 8)"},
+		{"UInt64", "sipHash64("},
+		{"Nullable(Int32)", "sipHash64("},
+		{"Float64", "sipHash64("},
+		{"UUID", "reinterpretAsUUID(substring(SHA256("},
+		{"Nullable(UUID)", "reinterpretAsUUID("},
+		{"IPv6", ""},
+		{"Date", ""},
+		{"Decimal(18, 2)", ""},
+		{"Array(String)", ""},
+		{"Map(String, UInt64)", ""},
+		{"Tuple(a String, b UInt8)", ""},
+		{"Enum8('a' = 1)", ""},
+	}
+	rule := maskRule{kind: "hash", argument: "s"}
+	for _, test := range tests {
+		got, err := rule.expression("c", test.columnType)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("expression of hash for %s = %s, want an error", test.columnType, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expression of hash for %s error = %v", test.columnType, err)
+			continue
+		}
+		if !strings.Contains(got, test.want) || !strings.HasSuffix(got, ", "+quoteString(test.columnType)+")") {
+			t.Errorf("expression of hash for %s = %s, want it to contain %s and keep the type", test.columnType, got, test.want)
+		}
+	}
+}
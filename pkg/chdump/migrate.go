@@ -0,0 +1,173 @@
+package chdump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// MigrationReport summarizes a migration from a source server to a target server: the outcome of each of its steps,
+// with the reports of the databases the step processed
+type MigrationReport struct {
+	Source     string           `json:"source"`
+	Target     string           `json:"target"`
+	Status     string           `json:"status"`
+	Error      string           `json:"error,omitempty"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	Steps      []*MigrationStep `json:"steps"`
+	// mu guards the steps of the report, whose databases may be reported concurrently
+	mu sync.Mutex
+}
+
+// MigrationStep describes the outcome of a step of a migration: export, import or verify
+type MigrationStep struct {
+	Step            string    `json:"step"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Databases       []*Report `json:"databases"`
+}
+
+// migrate exports the databases of the source server into the per-database layout of the dump directory, imports
+// them into the target server, transformed by the renames, column maps and other import settings, and verifies the
+// imported databases against the dump. The steps stop at the first failing one, and a single report of them is
+// written into the dump directory.
+func migrate(ctx context.Context, config Options) (err error) {
+	if err := os.MkdirAll(config.DumpDir, 0755); err != nil {
+		return fmt.Errorf("failed to create dump directory: %w", err)
+	}
+	report := &MigrationReport{Source: config.SourceHost, Target: config.Host, StartedAt: time.Now()}
+	config.migration = report
+	path := relocatePath(config.DumpDir, config.ReportFile)
+	defer func() {
+		if reportErr := writeMigrationReport(path, report, err); reportErr != nil {
+			log.Printf("Failed to write migration report: %v", reportErr)
+		}
+	}()
+
+	source := sourceConfig(config)
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"export", func() error {
+			return withHooks(ctx, source, "export", config.Hooks.PreExport, config.Hooks.PostExport, func() error {
+				return exportServer(ctx, source, true)
+			})
+		}},
+		{"import", func() error {
+			return withHooks(ctx, config, "import", config.Hooks.PreImport, config.Hooks.PostImport, func() error {
+				return importServer(ctx, "import", config, true)
+			})
+		}},
+		{"verify", func() error {
+			verify := config
+			verify.VerifyTarget = true
+			return importServer(ctx, "verify", verify, true)
+		}},
+	}
+	for _, step := range steps {
+		if err := runMigrationStep(report, step.name, step.run); err != nil {
+			return fmt.Errorf("%s step of the migration failed: %w", step.name, err)
+		}
+	}
+	return nil
+}
+
+// runMigrationStep runs a step of the migration, logging its start and outcome and recording it in the report
+func runMigrationStep(report *MigrationReport, name string, run func() error) error {
+	step := &MigrationStep{Step: name}
+	report.mu.Lock()
+	report.Steps = append(report.Steps, step)
+	report.mu.Unlock()
+
+	log.Printf("Migration from %s to %s: %s step started", report.Source, report.Target, name)
+	startedAt := time.Now()
+	err := run()
+	duration := time.Since(startedAt)
+
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	step.DurationSeconds = duration.Seconds()
+	step.Status = statusSuccess
+	if err != nil {
+		step.Status = statusFailed
+		step.Error = err.Error()
+		log.Printf("Migration from %s to %s: %s step failed after %s: %v", report.Source, report.Target, name, duration.Round(time.Millisecond), err)
+		return err
+	}
+	log.Printf("Migration from %s to %s: %s step finished in %s", report.Source, report.Target, name, duration.Round(time.Millisecond))
+	return nil
+}
+
+// addReport adds the report of a database to the running step of the migration, if the run is part of one
+func (r *MigrationReport) addReport(report *Report) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Steps) > 0 {
+		step := r.Steps[len(r.Steps)-1]
+		step.Databases = append(step.Databases, report)
+	}
+}
+
+// addOutcome adds the outcome of an operation on a database without a report of its own to the running step of the
+// migration, if the run is part of one
+func (r *MigrationReport) addOutcome(operation, dbName string, startedAt time.Time, err error) {
+	report := &Report{Operation: operation, DBName: dbName, Status: statusSuccess, StartedAt: startedAt, FinishedAt: time.Now()}
+	if err != nil {
+		report.Status = statusFailed
+		report.Error = err.Error()
+	}
+	r.addReport(report)
+}
+
+// writeMigrationReport completes the report of the migration with its outcome, writes it to the file and prints a
+// summary of the steps and their databases
+func writeMigrationReport(path string, report *MigrationReport, runErr error) error {
+	report.FinishedAt = time.Now()
+	report.Status = statusSuccess
+	if runErr != nil {
+		report.Status = statusFailed
+		report.Error = runErr.Error()
+	}
+
+	printMigrationSummary(report)
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// printMigrationSummary prints a human-readable summary of the migration report to stdout, a line per database of
+// every step
+func printMigrationSummary(report *MigrationReport) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "STEP\tDATABASE\tSTATUS\tTABLES\tROWS\tBYTES\tDURATION\tERROR\n")
+	for _, step := range report.Steps {
+		fmt.Fprintf(writer, "%s\t\t%s\t\t\t\t%.2fs\t%s\n", step.Step, step.Status, step.DurationSeconds, step.Error)
+		for _, database := range step.Databases {
+			var rows int
+			var bytes int64
+			for _, tableReport := range database.Tables {
+				rows += tableReport.Rows
+				bytes += tableReport.Bytes
+			}
+			fmt.Fprintf(writer, "\t%s\t%s\t%d\t%d\t%d\t%.2fs\t%s\n", database.DBName, database.Status, len(database.Tables), rows, bytes,
+				database.FinishedAt.Sub(database.StartedAt).Seconds(), database.Error)
+		}
+	}
+	writer.Flush()
+	fmt.Printf("Migration from %s to %s finished with status %s in %s\n", report.Source, report.Target, report.Status,
+		report.FinishedAt.Sub(report.StartedAt).Round(time.Millisecond))
+}
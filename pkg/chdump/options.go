@@ -0,0 +1,298 @@
+package chdump
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Options holds the settings of a command. Settings of the export only are ignored by the import commands and
+// vice versa.
+type Options struct {
+	Host                 string
+	Port                 string
+	HostStrategy         string
+	User                 string
+	Password             string
+	DBName               string
+	ReadTimeout          int
+	WriteTimeout         int
+	ClickHouseClientPath string
+	StateFile            string
+	Resume               bool
+	FailFast             bool
+	Strict               bool
+	ParallelTables       int
+	ReportFile           string
+	ManifestFile         string
+	Databases            []string
+	AllDatabases         bool
+	DumpDir              string
+	// Timestamped lays out every database as <dumpDir>/<db>/<timestamp>/{schema,data}, with a latest link to the
+	// last complete dump that the commands reading the dump follow unless From selects another one
+	Timestamped bool
+	// From selects the timestamped dump read by the import, verify and diff commands: latest, its timestamp, or a
+	// prefix of it such as a date for the latest complete dump of that day. It implies Timestamped.
+	From            string
+	IncludeTables   []TablePattern
+	ExcludeTables   []TablePattern
+	TablesFile      string
+	IncludeAccess   bool
+	SkipDataEngines []string
+
+	// Export settings
+	Cluster            string
+	ParallelShards     int
+	ChunkSize          int
+	IncrementalColumns map[string]string
+	WatermarkFile      string
+	Estimate           bool
+	EstimateThroughput float64
+	TableFilters       map[string]string
+	TableSelects       map[string]string
+	Sample             float64
+	SampleOverrides    map[string]float64
+	SampleKeys         map[string]string
+	DistributedData    bool
+	SelectSettings     map[string]string
+	DiskSpaceCheck     string
+	MaxFileSize        int64
+	MaxRowsPerFile     int
+	Freeze             bool
+	OrderByPK          bool
+	FinalTables        []TablePattern
+	// ColumnMasks maps tables to the masking rules of their columns, applied to the exported data
+	ColumnMasks map[string]MaskRules
+	// TenantColumns maps tables to the columns holding the tenant of their rows, whose data is exported into the
+	// dumps of the tenants
+	TenantColumns map[string]string
+	// Since and Until bound the dates of the exported rows, as dates such as 2024-01-01 or numbers of days before the
+	// export such as 90d, on the column of DateColumns of a table or of its partition key on a date
+	Since       string
+	Until       string
+	DateColumns map[string]string
+	// Partitions maps tables to the IDs of the partitions the export dumps into data files of their own and the
+	// import restores, replacing them; the partitions of the empty table name apply to every other table
+	Partitions map[string][]string
+	// Queries maps names to the SELECT queries whose results the query export dumps as tables of those names
+	Queries map[string]string
+	// Watch keeps the export running, exporting the data that arrived since the previous cycle every WatchInterval
+	Watch         bool
+	WatchInterval time.Duration
+	// Retention prunes the older timestamped dumps of a database once its export succeeds
+	Retention RetentionPolicy
+	// timestamp is the timestamp of the dumps written by the export
+	timestamp string
+	// snapshots maps the tables of a frozen export to the snapshot tables their data is read from
+	snapshots map[string]string
+	// sortingKeys maps the exported tables to the ORDER BY keys their sorted batches are sorted by
+	sortingKeys map[string]string
+	// finalTables holds the tables of the export whose data is read with FINAL
+	finalTables map[string]bool
+	// dateColumns maps the tables of an export with a date range to the columns the range applies to
+	dateColumns map[string]string
+	// queryTables maps the tables of a query export to the queries their data is read from
+	queryTables map[string]string
+	// mappedInserts maps the target tables of an import with column maps to the INSERT statements mapping them
+	mappedInserts map[string]string
+	// distributedInserts maps the target tables of a shard-aware import to the Distributed tables their data is
+	// inserted through
+	distributedInserts map[string]string
+	// manifestTables maps the tables of the dump of an import to their manifest entries, empty without a manifest
+	manifestTables map[string]ManifestTable
+	// serverVersion is the version of the server of the run, empty until it is fetched
+	serverVersion string
+	// migration is the report of the migration the run is a step of, nil outside of a migration
+	migration *MigrationReport
+	// watch is the state carried over between the cycles of a watched export, nil outside of the watch mode
+	watch *watchState
+
+	// Import settings
+	SkipManifestCheck   bool
+	VerifyRowCounts     bool
+	VerifyTarget        bool
+	DryRun              bool
+	DumpDBName          string
+	RenameDatabases     map[string]string
+	RenameTables        map[string]string
+	TablePrefix         string
+	TableSuffix         string
+	OnCluster           string
+	Dereplicate         bool
+	ReplicatedPaths     string
+	TableUUIDs          string
+	StoragePolicyMap    map[string]string
+	StripStoragePolicy  bool
+	DiskMap             map[string]string
+	VolumeMap           map[string]string
+	StripTTLMoves       bool
+	KeepPopulate        bool
+	AtomicRestore       bool
+	AllowErrors         int
+	AllowErrorsRatio    float64
+	SkipBrokenRows      bool
+	RejectedDir         string
+	InsertSettings      map[string]string
+	ColumnMaps          map[string]ColumnMap
+	AllowSchemaDrift    bool
+	Force               bool
+	Apply               bool
+	MaterializeIndexes  bool
+	DeduplicateTables   []TablePattern
+	ShardCluster        string
+	ShardingKeys        map[string]string
+	AsyncDistributed    bool
+	ReplicaPathTemplate string
+	ReplicaNameTemplate string
+	SourceHost          string
+	SourcePort          string
+	SourceUser          string
+	SourcePassword      string
+	SourceDBName        string
+	SyncInterval        time.Duration
+
+	Vault VaultConfig
+	AWS   AWSConfig
+	TLS   TLSConfig
+	SSH   SSHConfig
+	Retry RetryPolicy
+	// Encryption encrypts the data and schema files of the export and decrypts them on import
+	Encryption EncryptionConfig
+	// Hooks are the SQL statements and shell commands run before and after the export and import
+	Hooks Hooks
+	// GPG encrypts the data keys of the dump files to GPG recipients and signs and verifies the manifest
+	GPG GPGConfig
+	// RateLimit bounds the bytes and rows per second of the data exported or imported
+	RateLimit RateLimit
+
+	// Format is the format of the data files, TSV when unset
+	Format Format
+	// OnProgress, when set, is called as the data of a table is exported and when a table is finished
+	OnProgress func(Progress)
+}
+
+// redacted replaces secrets in logged values
+const redacted = "******"
+
+// String formats the configuration for logging with the passwords redacted
+func (c Options) String() string {
+	if c.Password != "" {
+		c.Password = redacted
+	}
+	if c.Vault.Token != "" {
+		c.Vault.Token = redacted
+	}
+	if c.Vault.SecretID != "" {
+		c.Vault.SecretID = redacted
+	}
+	if c.SourcePassword != "" {
+		c.SourcePassword = redacted
+	}
+	type plainOptions Options
+	return fmt.Sprint(plainOptions(c))
+}
+
+// serverDir returns the directory of objects that belong to the server rather than to a database, such as access
+// entities, user-defined functions and named collections
+func serverDir(config Options, multiDatabase bool, name string) string {
+	if multiDatabase {
+		return filepath.Join(config.DumpDir, name)
+	}
+	return "./" + name
+}
+
+// databaseConfig returns the configuration and dump directories of a single database, restored under its
+// renamed name if a database rename applies. With the directory of the database returned by databaseDir, the
+// database is laid out as <dir>/schema and <dir>/data, and the relative paths of the per-run files are moved into
+// the directory. The watermarks of a timestamped dump are kept next to the timestamped directories, so that the
+// incremental exports carry on from one run to the next.
+func databaseConfig(config Options, dbName, dbDir string) (Options, string, string) {
+	config.DumpDBName = dbName
+	config.DBName = dbName
+	if renamed, ok := config.RenameDatabases[dbName]; ok {
+		config.DBName = renamed
+	}
+	if dbDir == "" {
+		return config, "./schema", "./data"
+	}
+
+	config.SourceDBName = ""
+	config.StateFile = relocatePath(dbDir, config.StateFile)
+	config.ReportFile = relocatePath(dbDir, config.ReportFile)
+	config.ManifestFile = relocatePath(dbDir, config.ManifestFile)
+	config.RejectedDir = relocatePath(dbDir, config.RejectedDir)
+	if config.Timestamped {
+		config.WatermarkFile = relocatePath(filepath.Dir(dbDir), config.WatermarkFile)
+	} else {
+		config.WatermarkFile = relocatePath(dbDir, config.WatermarkFile)
+	}
+	return config, filepath.Join(dbDir, "schema"), filepath.Join(dbDir, "data")
+}
+
+// relocatePath moves a relative path into the directory, leaving absolute paths unchanged
+func relocatePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// TablePattern matches table names with a glob, or with a regular expression when written as /regex/
+type TablePattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+// GlobPattern returns a pattern matching table names with the glob
+func GlobPattern(glob string) TablePattern {
+	return TablePattern{glob: glob}
+}
+
+// ParseTablePatterns parses a comma-separated list of table globs and /regex/ patterns
+func ParseTablePatterns(value string) ([]TablePattern, error) {
+	var patterns []TablePattern
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			regex, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid table regex %q: %w", pattern, err)
+			}
+			patterns = append(patterns, TablePattern{regex: regex})
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid table glob %q: %w", pattern, err)
+		}
+		patterns = append(patterns, TablePattern{glob: pattern})
+	}
+	return patterns, nil
+}
+
+// matchesAnyPattern reports whether the table matches at least one of the patterns
+func matchesAnyPattern(patterns []TablePattern, table string) bool {
+	for _, pattern := range patterns {
+		if pattern.regex != nil {
+			if pattern.regex.MatchString(table) {
+				return true
+			}
+		} else if matched, _ := path.Match(pattern.glob, table); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isTableSelected reports whether the table passes the include and exclude filters
+func isTableSelected(config Options, table string) bool {
+	if len(config.IncludeTables) > 0 && !matchesAnyPattern(config.IncludeTables, table) {
+		return false
+	}
+	return !matchesAnyPattern(config.ExcludeTables, table)
+}
@@ -0,0 +1,90 @@
+package chdump
+
+import "testing"
+
+func TestParseTablePatterns(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		matches   []string
+		unmatched []string
+		wantErr   bool
+	}{
+		{
+			name:      "exact names",
+			value:     "orders,customers",
+			matches:   []string{"orders", "customers"},
+			unmatched: []string{"orders_old", "order"},
+		},
+		{
+			name:      "globs",
+			value:     "tmp_*, scratch_?",
+			matches:   []string{"tmp_", "tmp_orders", "scratch_1"},
+			unmatched: []string{"scratch_12", "orders_tmp_"},
+		},
+		{
+			name:      "regex",
+			value:     "/^customer_(eu|us)$/",
+			matches:   []string{"customer_eu", "customer_us"},
+			unmatched: []string{"customer_asia", "customer_eu_old"},
+		},
+		{
+			name:      "unanchored regex",
+			value:     "/_old/",
+			matches:   []string{"orders_old", "customers_old_2023"},
+			unmatched: []string{"orders"},
+		},
+		{
+			name:      "globs and regexes together",
+			value:     "events_*,/^audit/",
+			matches:   []string{"events_2024", "audit_log"},
+			unmatched: []string{"log_audit"},
+		},
+		{
+			name:      "empty items are skipped",
+			value:     " , orders,,",
+			matches:   []string{"orders"},
+			unmatched: []string{""},
+		},
+		{
+			name:      "lone slash is a glob",
+			value:     "/",
+			matches:   []string{"/"},
+			unmatched: []string{"orders"},
+		},
+		{
+			name:    "invalid regex",
+			value:   "/(unclosed/",
+			wantErr: true,
+		},
+		{
+			name:    "invalid glob",
+			value:   "orders_[",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patterns, err := ParseTablePatterns(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseTablePatterns(%q) succeeded, want an error", test.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTablePatterns(%q) error = %v", test.value, err)
+			}
+			for _, table := range test.matches {
+				if !matchesAnyPattern(patterns, table) {
+					t.Errorf("ParseTablePatterns(%q) does not match %q", test.value, table)
+				}
+			}
+			for _, table := range test.unmatched {
+				if matchesAnyPattern(patterns, table) {
+					t.Errorf("ParseTablePatterns(%q) matches %q", test.value, table)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// partitionFilePattern matches the name of a data file of a partition of a table, without its extension and part
+// number, such as events.partition-202401
+var partitionFilePattern = regexp.MustCompile(`^(.+)\.partition-([^.]+)$`)
+
+// partitionFileTable returns the name the data files of a partition of a table are written under
+func partitionFileTable(table, partition string) string {
+	return table + ".partition-" + partition
+}
+
+// dataFilePartition returns the partition of a data file of a table, or an empty string for a file holding the data
+// of the whole table
+func dataFilePartition(config Options, path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), config.Format.Extension())
+	if match := partNumberPattern.FindStringSubmatch(name); match != nil {
+		name = match[1]
+	}
+	if match := partitionFilePattern.FindStringSubmatch(name); match != nil {
+		return match[2]
+	}
+	return ""
+}
+
+// tablePartitions returns the IDs of the partitions of a table selected for the export and import, those given for
+// every table unless the table has its own, or none when the whole table is selected
+func tablePartitions(config Options, table string) []string {
+	if partitions, ok := config.Partitions[table]; ok {
+		return partitions
+	}
+	return config.Partitions[""]
+}
+
+// partitionCondition returns the condition selecting the rows of the selected partitions of a table, or an empty
+// string when the whole table is selected. The results of named queries have no partitions.
+func partitionCondition(config Options, table string) string {
+	partitions := tablePartitions(config, table)
+	if _, query := config.queryTables[table]; len(partitions) == 0 || query {
+		return ""
+	}
+	quoted := make([]string, len(partitions))
+	for i, partition := range partitions {
+		quoted[i] = quoteString(partition)
+	}
+	return "_partition_id IN (" + strings.Join(quoted, ", ") + ")"
+}
+
+// dumpPartitionData dumps the data of the selected partitions of a table, each into data files of its own, so that
+// single partitions can be restored. A partition without rows gets an empty data file, which restores it empty.
+func dumpPartitionData(ctx context.Context, config Options, table string, partitions []string, dataDir string, db *sql.DB, tableReport *TableReport) error {
+	// The data files of a previous export of the table are replaced
+	files, err := dataFiles(config, dataDir, table)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return dumpPartitions(ctx, config, table, partitions, dataDir, db, tableReport)
+}
+
+// dumpPartitions dumps the data of partitions of a table into data files of their own, replacing those of a previous
+// export of the partitions
+func dumpPartitions(ctx context.Context, config Options, table string, partitions []string, dataDir string, db *sql.DB, tableReport *TableReport) error {
+	files, err := dataFiles(config, dataDir, table)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !slices.Contains(partitions, dataFilePartition(config, file)) {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	columns, err := selectColumns(ctx, db, config, table)
+	if err != nil {
+		return err
+	}
+
+	for _, partition := range partitions {
+		whereClause := tableWhereClause(config, table, "_partition_id = "+quoteString(partition))
+		totalRows, err := getTotalRowsWithRetry(ctx, config, table, whereClause, db)
+		if err != nil {
+			return err
+		}
+		output, err := createDataWriter(config, dataDir, partitionFileTable(table, partition), false)
+		if err != nil {
+			return err
+		}
+		err = exportTableData(ctx, config, table, columns, whereClause, db, output, totalRows, TableCheckpoint{}, tableReport, nil)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to dump partition %s: %w", partition, err)
+		}
+		log.Printf("Exported %d row(s) of partition %s of table %s", totalRows, partition, table)
+	}
+	return nil
+}
+
+// partitionDataFiles returns the data files of the selected partitions of a table, in the order of the partitions,
+// failing when the dump holds no data file of one of them
+func partitionDataFiles(config Options, table string, files, partitions []string) ([]string, error) {
+	var selected []string
+	for _, partition := range partitions {
+		found := false
+		for _, file := range files {
+			if dataFilePartition(config, file) == partition {
+				selected = append(selected, file)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("the dump holds no data file of partition %s of table %s", partition, table)
+		}
+	}
+	return selected, nil
+}
+
+// dropPartitions drops the selected partitions of a table before their data is restored, so that the restored
+// partitions replace them
+func dropPartitions(ctx context.Context, db *sql.DB, config Options, table string, partitions []string) error {
+	for _, partition := range partitions {
+		query := alterTableQuery(config, table) + " DROP PARTITION ID " + quoteString(partition)
+		if err := execWithRetry(ctx, db, config, query); err != nil {
+			return fmt.Errorf("failed to drop partition %s of table %s: %w", partition, table, err)
+		}
+		log.Printf("Dropped partition %s of table %s to restore it", partition, table)
+	}
+	return nil
+}
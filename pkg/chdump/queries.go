@@ -0,0 +1,183 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportQueries dumps the results of the named queries into the dump of the database, each as a table of its name
+// with a schema synthesized from the columns of the result, so that derived datasets are imported like the tables
+// of the dump. A timestamped dump receives them in its latest dump.
+func exportQueries(ctx context.Context, config Options) (err error) {
+	if len(config.Queries) == 0 {
+		return errors.New("no queries to export")
+	}
+	if config.DBName == "" || config.AllDatabases {
+		return errors.New("the results of queries are exported into the dump of a single database")
+	}
+
+	db, err := createDBConnection(ctx, config, config.DBName)
+	if err != nil {
+		return fmt.Errorf("database connection failed: %w", err)
+	}
+	defer db.Close()
+	if config.serverVersion, err = checkServerVersion(ctx, db, config, exportFeatures); err != nil {
+		return err
+	}
+
+	dbDir, err := databaseDir(config, config.DBName, false, false)
+	if err != nil {
+		return err
+	}
+	config, schemaDir, dataDir := databaseConfig(config, config.DBName, dbDir)
+	if err := createDirectories(schemaDir, dataDir); err != nil {
+		return err
+	}
+	config.queryTables = config.Queries
+
+	report := &Report{Operation: "export", DBName: config.DBName, StartedAt: time.Now()}
+	defer func() {
+		if reportErr := writeReport(config, report, err); reportErr != nil {
+			log.Printf("Failed to write report: %v", reportErr)
+		}
+	}()
+
+	names := make([]string, 0, len(config.Queries))
+	for name := range config.Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reportProgress(config, Progress{Operation: "export", Tables: len(names)})
+	var exported, failed []string
+	for _, name := range names {
+		tableReport := startTableReport(report, name)
+		err := exportQuery(ctx, db, config, name, schemaDir, dataDir, tableReport)
+		finishTableReport(config, report, tableReport, err)
+		if err != nil {
+			log.Printf("Error exporting query %s: %v", name, err)
+			if config.FailFast || ctx.Err() != nil {
+				return fmt.Errorf("failed to export query %s: %w", name, err)
+			}
+			failed = append(failed, name)
+			continue
+		}
+		exported = append(exported, name)
+	}
+
+	if err := addQueriesToManifest(config, schemaDir, dataDir, exported); err != nil {
+		return fmt.Errorf("failed to update manifest: %w", err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d query(ies) failed: %s", len(failed), len(names), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// exportQuery dumps the synthesized schema and the result of a named query
+func exportQuery(ctx context.Context, db *sql.DB, config Options, name, schemaDir, dataDir string, tableReport *TableReport) error {
+	var columns []string
+	err := withRetry(ctx, config.Retry, "describing query "+name, func() (err error) {
+		columns, err = describeQuery(ctx, db, config.Queries[name])
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe query: %w", err)
+	}
+	schemaFile := filepath.Join(schemaDir, name+".sql")
+	if err := writeDumpFile(config, schemaFile, []byte(querySchema(config, name, columns))); err != nil {
+		return err
+	}
+
+	whereClause := tableWhereClause(config, name, "")
+	totalRows, err := getTotalRowsWithRetry(ctx, config, name, whereClause, db)
+	if err != nil {
+		return err
+	}
+	output, err := createDataWriter(config, dataDir, name, false)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	if err := exportTableData(ctx, config, name, "*", whereClause, db, output, totalRows, TableCheckpoint{}, tableReport, nil); err != nil {
+		return err
+	}
+	log.Printf("Exported %d row(s) of query %s", tableReport.Rows, name)
+	return nil
+}
+
+// describeQuery returns the column definitions of the result of a query, as name and type
+func describeQuery(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "DESCRIBE TABLE ("+query+")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fields, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	for rows.Next() {
+		// The name and type come first, followed by the defaults, comment, codec and TTL
+		values := make([]string, len(fields))
+		targets := make([]any, len(fields))
+		for i := range values {
+			targets[i] = &values[i]
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		columns = append(columns, quoteIdentifier(values[0])+" "+values[1])
+	}
+	return columns, rows.Err()
+}
+
+// querySchema returns the CREATE TABLE statement of the table holding the result of a named query: a MergeTree table
+// with the columns of the result, sorted by nothing
+func querySchema(config Options, name string, columns []string) string {
+	return fmt.Sprintf("CREATE TABLE %s\n(\n    %s\n)\nENGINE = MergeTree\nORDER BY tuple()",
+		qualifiedName(config.DBName, name), strings.Join(columns, ",\n    "))
+}
+
+// addQueriesToManifest replaces the entries of the exported queries in the manifest of the dump, if it has one, so
+// that its validation covers their files
+func addQueriesToManifest(config Options, schemaDir, dataDir string, names []string) error {
+	if _, err := os.Stat(config.ManifestFile); os.IsNotExist(err) || len(names) == 0 {
+		return nil
+	}
+	manifest, err := loadManifest(config.ManifestFile)
+	if err != nil {
+		return err
+	}
+	manifest.Tables = slices.DeleteFunc(manifest.Tables, func(table ManifestTable) bool {
+		return slices.Contains(names, table.Name)
+	})
+	for _, name := range names {
+		manifestTable := ManifestTable{Name: name}
+		schemaFile, err := describeFile(filepath.Join(schemaDir, name+".sql"))
+		if err != nil {
+			return err
+		}
+		manifestTable.Files = append(manifestTable.Files, schemaFile)
+		files, err := dataFiles(config, dataDir, name)
+		if err != nil {
+			return err
+		}
+		if err := describeDataFiles(config, &manifestTable, files); err != nil {
+			return err
+		}
+		manifest.Tables = append(manifest.Tables, manifestTable)
+	}
+	return saveManifest(config, *manifest)
+}
@@ -0,0 +1,106 @@
+package chdump
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tolerant reports whether the import skips broken rows
+func tolerant(config Options) bool {
+	return config.AllowErrors > 0 || config.AllowErrorsRatio > 0
+}
+
+// rejectedFile returns the path of the file listing the rejected rows of a table, named after the table rather than
+// its staging table
+func rejectedFile(config Options, table string) string {
+	if config.AtomicRestore {
+		table = strings.TrimSuffix(table, stagingSuffix)
+	}
+	return filepath.Join(config.RejectedDir, table+".tsv")
+}
+
+// rejectedRowsArgs returns the clickhouse-client setting recording the broken rows skipped by the insert of a table
+// in a temporary file, removing the file of a previous attempt
+func rejectedRowsArgs(config Options, table string) ([]string, error) {
+	path, err := filepath.Abs(rejectedFile(config, table) + ".errors")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create rejected rows directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return []string{"--input_format_record_errors_file_path=" + path}, nil
+}
+
+// writeRejectedRows converts the broken rows recorded by ClickHouse for a table, a CSV file of the time, database,
+// table, row number, reason and raw data of every error, into the rejected rows file of the table, a TSV file with
+// the row number, the reason and the raw row, appending to it for the parts after the first data file of the table.
+// It returns the number of rejected rows.
+func writeRejectedRows(config Options, table string, appendRows bool) (int, error) {
+	path := rejectedFile(config, table)
+	errorsFile, err := os.Open(path + ".errors")
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path + ".errors")
+	defer errorsFile.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendRows {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	output, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create rejected rows file %s: %w", path, err)
+	}
+	defer output.Close()
+	if info, err := output.Stat(); err == nil && info.Size() == 0 {
+		if _, err := io.WriteString(output, "row\treason\traw_data\n"); err != nil {
+			return 0, err
+		}
+	}
+
+	reader := csv.NewReader(errorsFile)
+	reader.FieldsPerRecord = -1
+	rejected := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rejected, fmt.Errorf("failed to read the rejected rows of table %s: %w", table, err)
+		}
+		if len(record) < 6 || record[0] == "time" {
+			continue
+		}
+		line := strings.Join([]string{escapeTSV(record[3]), escapeTSV(record[4]), escapeTSV(record[5])}, "\t") + "\n"
+		if _, err := io.WriteString(output, line); err != nil {
+			return rejected, err
+		}
+		rejected++
+	}
+	if rejected > 0 {
+		log.Printf("Wrote %d rejected row(s) of table %s to %s", rejected, table, path)
+	}
+	return rejected, output.Close()
+}
+
+// tsvEscaper escapes the characters that TSV fields cannot hold
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// escapeTSV escapes a value for a TSV field
+func escapeTSV(value string) string {
+	return tsvEscaper.Replace(value)
+}
@@ -0,0 +1,85 @@
+package chdump
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy is how many timestamped dumps of a directory are kept after a successful run
+type RetentionPolicy struct {
+	KeepLast int // number of the latest successful dumps to keep, 0 for no limit
+	KeepDays int // number of days to keep the dumps, 0 for no limit
+}
+
+// Enabled reports whether the policy prunes any dump
+func (p RetentionPolicy) Enabled() bool {
+	return p.KeepLast > 0 || p.KeepDays > 0
+}
+
+// String describes the policy in the log
+func (p RetentionPolicy) String() string {
+	var limits []string
+	if p.KeepLast > 0 {
+		limits = append(limits, fmt.Sprintf("the last %d", p.KeepLast))
+	}
+	if p.KeepDays > 0 {
+		limits = append(limits, fmt.Sprintf("%d day(s)", p.KeepDays))
+	}
+	return strings.Join(limits, " and ")
+}
+
+// PruneDumps removes the timestamped dumps of the directory beyond the retention policy: the successful dumps that
+// are not among the last ones to keep or are older than the days to keep, and the failed dumps older than the oldest
+// successful dump that is kept. The latest successful dump is always kept, so that pruning never removes the only
+// good backup, whatever the policy. When the directory has a latest link, the dumps newer than the one it points to
+// are unfinished, and neither count as successful nor are removed.
+func PruneDumps(dumpDir string, policy RetentionPolicy) error {
+	entries, err := os.ReadDir(dumpDir)
+	if err != nil {
+		return err
+	}
+	latest, err := LatestDump(dumpDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var runs, succeeded []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), FailedSuffix)
+		if _, err := time.Parse(TimestampFormat, name); err != nil || !entry.IsDir() {
+			continue
+		}
+		runs = append(runs, entry.Name())
+		if name == entry.Name() && (latest == "" || name <= latest) {
+			succeeded = append(succeeded, name)
+		}
+	}
+	if len(succeeded) == 0 {
+		return nil
+	}
+	// The timestamps sort in chronological order
+	sort.Strings(succeeded)
+	cutoff := time.Now().UTC().AddDate(0, 0, -policy.KeepDays)
+	oldestKept := succeeded[len(succeeded)-1]
+	for i := len(succeeded) - 2; i >= 0; i-- {
+		started, _ := time.Parse(TimestampFormat, succeeded[i])
+		if policy.KeepLast > 0 && len(succeeded)-i > policy.KeepLast || policy.KeepDays > 0 && started.Before(cutoff) {
+			break
+		}
+		oldestKept = succeeded[i]
+	}
+
+	for _, run := range runs {
+		if strings.TrimSuffix(run, FailedSuffix) < oldestKept {
+			log.Printf("Removing dump %s of %s beyond the retention of %s", run, dumpDir, policy)
+			if err := os.RemoveAll(filepath.Join(dumpDir, run)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package chdump
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPruneDumps(t *testing.T) {
+	// run returns the name of the run started the given number of days ago
+	run := func(days int) string {
+		return time.Now().UTC().AddDate(0, 0, -days).Format(TimestampFormat)
+	}
+
+	tests := []struct {
+		name   string
+		runs   []string
+		latest string
+		policy RetentionPolicy
+		kept   []string
+	}{
+		{
+			name:   "keeps the last runs",
+			runs:   []string{run(4), run(3), run(2), run(1)},
+			policy: RetentionPolicy{KeepLast: 2},
+			kept:   []string{run(2), run(1)},
+		},
+		{
+			name:   "keeps the runs of the last days",
+			runs:   []string{run(10), run(5), run(1)},
+			policy: RetentionPolicy{KeepDays: 7},
+			kept:   []string{run(5), run(1)},
+		},
+		{
+			name:   "applies both limits",
+			runs:   []string{run(10), run(5), run(3), run(1)},
+			policy: RetentionPolicy{KeepLast: 3, KeepDays: 4},
+			kept:   []string{run(3), run(1)},
+		},
+		{
+			name:   "always keeps the latest successful run",
+			runs:   []string{run(30), run(20), run(10) + FailedSuffix},
+			policy: RetentionPolicy{KeepDays: 7},
+			kept:   []string{run(20), run(10) + FailedSuffix},
+		},
+		{
+			name:   "removes the failed runs older than the oldest kept",
+			runs:   []string{run(4) + FailedSuffix, run(3), run(2) + FailedSuffix, run(1)},
+			policy: RetentionPolicy{KeepLast: 1},
+			kept:   []string{run(1)},
+		},
+		{
+			name:   "keeps the failed runs newer than the oldest kept",
+			runs:   []string{run(4), run(3), run(2) + FailedSuffix, run(1)},
+			policy: RetentionPolicy{KeepLast: 2},
+			kept:   []string{run(3), run(2) + FailedSuffix, run(1)},
+		},
+		{
+			name:   "ignores the runs newer than the latest link",
+			runs:   []string{run(4), run(3), run(2), run(1)},
+			latest: run(3),
+			policy: RetentionPolicy{KeepLast: 1},
+			kept:   []string{run(3), run(2), run(1)},
+		},
+		{
+			name:   "ignores other entries",
+			runs:   []string{"scratch", run(2), run(1)},
+			policy: RetentionPolicy{KeepLast: 1},
+			kept:   []string{"scratch", run(1)},
+		},
+		{
+			name:   "keeps everything without successful runs",
+			runs:   []string{run(2) + FailedSuffix, run(1) + FailedSuffix},
+			policy: RetentionPolicy{KeepLast: 1},
+			kept:   []string{run(2) + FailedSuffix, run(1) + FailedSuffix},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range test.runs {
+				if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.latest != "" {
+				if err := os.Symlink(test.latest, filepath.Join(dir, LatestLink)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := PruneDumps(dir, test.policy); err != nil {
+				t.Fatalf("PruneDumps() error = %v", err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for _, entry := range entries {
+				if entry.Name() != LatestLink {
+					kept = append(kept, entry.Name())
+				}
+			}
+			want := slices.Clone(test.kept)
+			sort.Strings(want)
+			if !slices.Equal(kept, want) {
+				t.Errorf("PruneDumps() kept %v, want %v", kept, want)
+			}
+		})
+	}
+}
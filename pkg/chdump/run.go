@@ -0,0 +1,340 @@
+package chdump
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Manifest describes the contents of a dump so that it can be validated before import
+type Manifest struct {
+	ToolVersion   string          `json:"tool_version"`
+	ServerVersion string          `json:"server_version"`
+	DBName        string          `json:"dbname"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Tables        []ManifestTable `json:"tables"`
+	Dictionaries  []ManifestTable `json:"dictionaries,omitempty"`
+	Database      *ManifestFile   `json:"database,omitempty"` // the CREATE DATABASE statement, absent from older dumps
+}
+
+// ManifestTable describes the exported files of a single table
+type ManifestTable struct {
+	Name        string         `json:"name"`
+	Rows        int            `json:"rows"`
+	Checksum    string         `json:"checksum,omitempty"`
+	Incremental bool           `json:"incremental,omitempty"`
+	ExportedAt  time.Time      `json:"exported_at"`
+	Files       []ManifestFile `json:"files"`
+
+	// MaterializedView is "to" for a materialized view writing into an explicit TO table, whose data is exported
+	// with that table, or "inner" for one storing its data in an implicit .inner table, exported with the view
+	MaterializedView string `json:"materialized_view,omitempty"`
+	Target           string `json:"target,omitempty"`
+
+	// PartitionKey and SortingKey are the PARTITION BY and ORDER BY keys of a MergeTree table, and ShardingKey the
+	// sharding key of a Distributed table, or of the Distributed table reading a local table, so that an import into
+	// another topology can check and route the data
+	PartitionKey string `json:"partition_key,omitempty"`
+	SortingKey   string `json:"sorting_key,omitempty"`
+	ShardingKey  string `json:"sharding_key,omitempty"`
+}
+
+// ManifestFile describes a single file of the dump
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Report summarizes the outcome of a run for orchestration tooling
+type Report struct {
+	Operation  string         `json:"operation"`
+	DBName     string         `json:"dbname"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Tables     []*TableReport `json:"tables"`
+	// mu guards the tables of the report, which are processed in parallel
+	mu sync.Mutex
+}
+
+// TableReport describes the outcome of processing a single table
+type TableReport struct {
+	Table       string `json:"table"`
+	Status      string `json:"status"`
+	Rows        int    `json:"rows"`
+	Bytes       int64  `json:"bytes"`
+	SkippedRows int    `json:"skipped_rows,omitempty"`
+	// ExpectedRows and InsertedRows are the rows the row count verification of an import expected and counted
+	ExpectedRows    int     `json:"expected_rows,omitempty"`
+	InsertedRows    int     `json:"inserted_rows,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+	startedAt       time.Time
+}
+
+// Statuses of tables and runs in the report
+const (
+	statusSuccess = "success"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+)
+
+// RetryPolicy configures how transient errors are retried
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// State holds the checkpoint of an export or import run so that it can be resumed after a crash
+type State struct {
+	Operation        string                     `json:"operation"`
+	DBName           string                     `json:"dbname"`
+	CompletedSchemas []string                   `json:"completed_schemas,omitempty"`
+	CompletedTables  []string                   `json:"completed_tables"`
+	Checkpoints      map[string]TableCheckpoint `json:"checkpoints,omitempty"`
+	// mu guards the checkpoints of the tables processed in parallel
+	mu sync.Mutex
+}
+
+// update applies a change to the state and saves it, one table at a time
+func (s *State) update(path string, change func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change()
+	return saveState(path, s)
+}
+
+// checkpoint returns the position the export of a table has reached
+func (s *State) checkpoint(table string) TableCheckpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Checkpoints[table]
+}
+
+// TableCheckpoint is the position the paged export of a table has reached: the number of rows exported and the
+// tuple of the paging key of the last one, as text, with its type, from which the next batch starts
+type TableCheckpoint struct {
+	Rows int    `json:"rows"`
+	Key  string `json:"key"`
+	Type string `json:"type"`
+}
+
+// describeFile computes the size and SHA-256 checksum of the file
+func describeFile(path string) (ManifestFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	reader := &countingReader{reader: file}
+	if _, err := io.Copy(hash, reader); err != nil {
+		return ManifestFile{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return ManifestFile{Path: filepath.ToSlash(path), Size: reader.bytes, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// countingReader counts the bytes read through it, and the rows when it has the format of the data. The optional
+// onRead function is called after every read.
+type countingReader struct {
+	reader io.Reader
+	format Format
+	bytes  int64
+	rows   int
+	onRead func(r *countingReader)
+}
+
+// Read reads from the underlying reader and counts what was read
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bytes += int64(n)
+	if r.format != nil {
+		r.rows += r.format.CountRows(p[:n])
+	}
+	if r.onRead != nil {
+		r.onRead(r)
+	}
+	return n, err
+}
+
+// loadState loads the checkpoint state of the operation, export or import, when resuming, or starts a fresh one
+// otherwise
+func loadState(config Options, operation string) (*State, error) {
+	state := &State{Operation: operation, DBName: config.DBName, Checkpoints: make(map[string]TableCheckpoint)}
+	if !config.Resume {
+		return state, saveState(config.StateFile, state)
+	}
+
+	content, err := os.ReadFile(config.StateFile)
+	if os.IsNotExist(err) {
+		log.Printf("State file %s does not exist, starting from scratch", config.StateFile)
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved State
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", config.StateFile, err)
+	}
+	if saved.Operation != state.Operation || saved.DBName != state.DBName {
+		return nil, fmt.Errorf("state file %s belongs to %s of database %s", config.StateFile, saved.Operation, saved.DBName)
+	}
+	if saved.Checkpoints == nil {
+		saved.Checkpoints = make(map[string]TableCheckpoint)
+	}
+	log.Printf("Resuming %s: %d schema(s) and %d table(s) already completed", operation, len(saved.CompletedSchemas), len(saved.CompletedTables))
+	return &saved, nil
+}
+
+// saveState persists the checkpoint state to the state file
+func saveState(path string, state *State) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// startTableReport adds a table to the report and starts timing it
+func startTableReport(report *Report, table string) *TableReport {
+	tableReport := &TableReport{Table: table, startedAt: time.Now()}
+	report.mu.Lock()
+	report.Tables = append(report.Tables, tableReport)
+	report.mu.Unlock()
+	return tableReport
+}
+
+// skipTableReport records a table that is skipped because a previous run completed it
+func skipTableReport(config Options, report *Report, table string) {
+	report.mu.Lock()
+	report.Tables = append(report.Tables, &TableReport{Table: table, Status: statusSkipped})
+	report.mu.Unlock()
+	reportProgress(config, Progress{Operation: report.Operation, DBName: report.DBName, Table: table, Status: statusSkipped})
+}
+
+// finishTableReport records the duration and outcome of the table and reports it to the progress callback
+func finishTableReport(config Options, report *Report, tableReport *TableReport, err error) {
+	duration := time.Since(tableReport.startedAt)
+	tableReport.DurationSeconds = duration.Seconds()
+	if err != nil {
+		tableReport.Status = statusFailed
+		tableReport.Error = err.Error()
+	} else if tableReport.Status == "" {
+		tableReport.Status = statusSuccess
+	}
+	reportProgress(config, Progress{
+		Operation: report.Operation,
+		DBName:    report.DBName,
+		Table:     tableReport.Table,
+		Rows:      tableReport.Rows,
+		Bytes:     tableReport.Bytes,
+		Status:    tableReport.Status,
+		Duration:  duration,
+		Err:       err,
+	})
+}
+
+// writeReport completes the report with the outcome of the run, writes it to the report file, adds it to the report
+// of the migration the run is a step of and prints a summary
+func writeReport(config Options, report *Report, runErr error) error {
+	report.FinishedAt = time.Now()
+	report.Status = statusSuccess
+	if runErr != nil {
+		report.Status = statusFailed
+		report.Error = runErr.Error()
+	}
+	config.migration.addReport(report)
+
+	printReportSummary(report)
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(config.ReportFile, content, 0644)
+}
+
+// printReportSummary prints a human-readable summary of the report to stdout
+func printReportSummary(report *Report) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "TABLE\tSTATUS\tROWS\tBYTES\tDURATION\tERROR\n")
+	for _, tableReport := range report.Tables {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%.2fs\t%s\n", tableReport.Table, tableReport.Status,
+			tableReport.Rows, tableReport.Bytes, tableReport.DurationSeconds, tableReport.Error)
+	}
+	writer.Flush()
+	fmt.Printf("%s of database %s finished with status %s in %s\n", report.Operation, report.DBName, report.Status,
+		report.FinishedAt.Sub(report.StartedAt).Round(time.Millisecond))
+}
+
+// withRetry runs the operation, retrying it with exponential backoff while it fails with a transient error. It
+// stops retrying as soon as the context is done.
+func withRetry(ctx context.Context, policy RetryPolicy, operation string, fn func() error) error {
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || !isTransientError(err) || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("Transient error during %s (attempt %d/%d), retrying in %s: %v", operation, attempt, policy.MaxAttempts, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w while retrying after: %v", ctx.Err(), err)
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
+
+// transientErrorMarkers are fragments of error messages, including clickhouse-client output, that indicate a transient failure
+var transientErrorMarkers = []string{
+	"timeout",
+	"timed out",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+	"network_error",
+	"socket_timeout",
+}
+
+// isTransientError reports whether the error is caused by a timeout or a connection problem worth retrying
+func isTransientError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, marker := range transientErrorMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package chdump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLoadStateResumesCheckpoints(t *testing.T) {
+	config := Options{DBName: "sales", StateFile: filepath.Join(t.TempDir(), "state.json")}
+	state, err := loadState(config, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	position := TableCheckpoint{Rows: 20000, Key: "(42,'2024-05-01 10:00:00',123)", Type: "Tuple(UInt64, DateTime, UInt64)"}
+	err = state.update(config.StateFile, func() {
+		state.CompletedTables = append(state.CompletedTables, "customers")
+		state.Checkpoints["orders"] = position
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Resume = true
+	resumed, err := loadState(config, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resumed.checkpoint("orders"); got != position {
+		t.Errorf("checkpoint(orders) = %+v, want %+v", got, position)
+	}
+	if got := resumed.checkpoint("customers"); got != (TableCheckpoint{}) {
+		t.Errorf("checkpoint(customers) = %+v, want none", got)
+	}
+	if err := markTableCompleted(config.StateFile, resumed, "orders"); err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed.Checkpoints) != 0 {
+		t.Errorf("checkpoints = %v, want none once the table is completed", resumed.Checkpoints)
+	}
+
+	if _, err := loadState(config, "import"); err == nil {
+		t.Error("loadState() resumed the state of an export for an import")
+	}
+	config.Resume = false
+	fresh, err := loadState(config, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fresh.CompletedTables) != 0 || len(fresh.Checkpoints) != 0 {
+		t.Errorf("loadState() without resume = %+v, want a fresh state", fresh)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		wantErr  bool
+	}{
+		{name: "success", errs: []error{nil}, attempts: 1},
+		{name: "transient error then success", errs: []error{syscall.ECONNRESET, nil}, attempts: 2},
+		{name: "clickhouse-client timeout", errs: []error{errors.New("Code: 209. DB::NetException: Timeout exceeded while reading from socket"), nil}, attempts: 2},
+		{name: "permanent error", errs: []error{errors.New("Code: 60. DB::Exception: Table sales.orders does not exist")}, attempts: 1, wantErr: true},
+		{name: "attempts exhausted", errs: []error{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), syscall.ECONNREFUSED, syscall.ECONNREFUSED}, attempts: 3, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := withRetry(context.Background(), policy, "testing", func() error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+			if attempts != test.attempts {
+				t.Errorf("withRetry() made %d attempts, want %d", attempts, test.attempts)
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("withRetry() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	attempts := 0
+	err := withRetry(ctx, policy, "testing", func() error {
+		attempts++
+		cancel()
+		return syscall.ECONNRESET
+	})
+	if attempts != 1 || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("withRetry() = %v after %d attempts, want the first error", err, attempts)
+	}
+}
@@ -0,0 +1,105 @@
+package chdump
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// largestFirst orders the tables by decreasing size, so that the biggest tables start first and the smaller ones
+// fill the gaps at the end of the run. Tables of the same size keep their order.
+func largestFirst(tables []string, sizes map[string]int64) []string {
+	sorted := slices.Clone(tables)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		switch {
+		case sizes[a] > sizes[b]:
+			return -1
+		case sizes[a] < sizes[b]:
+			return 1
+		}
+		return 0
+	})
+	return sorted
+}
+
+// predictSchedule predicts the duration of processing the tables in order with the workers at the throughput in
+// MB/s per table, each table starting on the first worker to become free as the run does. It returns the predicted
+// duration and the critical path: the tables of the worker that finishes last.
+func predictSchedule(tables []string, sizes map[string]int64, workers int, throughput float64) (time.Duration, []string) {
+	workers = max(workers, 1)
+	loads := make([]time.Duration, workers)
+	paths := make([][]string, workers)
+	for _, table := range tables {
+		worker := 0
+		for i := range loads {
+			if loads[i] < loads[worker] {
+				worker = i
+			}
+		}
+		loads[worker] += time.Duration(float64(sizes[table]) / (throughput * 1024 * 1024) * float64(time.Second))
+		paths[worker] = append(paths[worker], table)
+	}
+	last := 0
+	for i := range loads {
+		if loads[i] > loads[last] {
+			last = i
+		}
+	}
+	return loads[last], paths[last]
+}
+
+// logSchedule logs the predicted duration and critical path of processing the tables in parallel
+func logSchedule(config Options, operation string, tables []string, sizes map[string]int64) {
+	duration, path := predictSchedule(tables, sizes, config.ParallelTables, config.EstimateThroughput)
+	log.Printf("Predicted %s duration with %d tables in parallel at %.0f MB/s: %s, critical path: %s", operation,
+		config.ParallelTables, config.EstimateThroughput, duration.Round(time.Second), formatPath(path, sizes))
+}
+
+// formatPath formats the tables of a critical path with their sizes
+func formatPath(path []string, sizes map[string]int64) string {
+	items := make([]string, len(path))
+	for i, table := range path {
+		items[i] = table + " (" + FormatBytes(sizes[table]) + ")"
+	}
+	return strings.Join(items, " -> ")
+}
+
+// runTables runs the function on the tables in order, on up to workers tables at a time. The first error returned
+// by the function stops starting new tables and is returned once the running ones finish.
+func runTables(tables []string, workers int, run func(table string) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		queue    = make(chan string)
+	)
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for table := range queue {
+				if err := run(table); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, table := range tables {
+		mu.Lock()
+		stopped := firstErr != nil
+		mu.Unlock()
+		if stopped {
+			break
+		}
+		queue <- table
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,70 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// checkSchemas compares the columns of the tables of the dump with those of their target tables before any data is
+// loaded, and returns the reason of every table whose columns do not match, which is not loaded unless the import
+// is forced. Staged tables, created from the dump, and tables inserted through a column map or by column name are
+// not checked.
+func checkSchemas(ctx context.Context, db *sql.DB, config Options, schemaFiles []SchemaFile, staged map[string]bool) (map[string]string, error) {
+	mismatched := make(map[string]string)
+	for _, file := range schemaFiles {
+		if staged[file.Table] || !createTablePattern.MatchString(file.Content) {
+			continue
+		}
+		table := targetTableName(config, file.Table)
+		if _, mapped := mappedInsert(config, table); mapped {
+			continue
+		}
+		columns := schemaColumns(file.Content)
+		if len(columns) == 0 {
+			continue
+		}
+		targetColumns, err := insertableColumns(ctx, db, config, table)
+		if err != nil {
+			return nil, err
+		}
+		differences := compareColumns(columns, targetColumns)
+		if len(differences) == 0 {
+			continue
+		}
+		reason := "schema mismatch: " + strings.Join(differences, "; ")
+		if config.Force {
+			log.Printf("Warning: loading table %s despite its %s", table, reason)
+			continue
+		}
+		log.Printf("Refusing to load table %s: %s", table, reason)
+		mismatched[file.Table] = reason
+	}
+	return mismatched, nil
+}
+
+// compareColumns returns the differences between the columns of a table in the dump and in the target
+func compareColumns(dumpColumns, targetColumns []Column) []string {
+	var differences []string
+	for _, column := range dumpColumns {
+		i := slices.IndexFunc(targetColumns, func(c Column) bool { return c.Name == column.Name })
+		switch {
+		case i < 0:
+			differences = append(differences, fmt.Sprintf("column %s is missing from the target", column.Name))
+		case targetColumns[i].Type != column.Type:
+			differences = append(differences, fmt.Sprintf("column %s is %s in the dump and %s in the target", column.Name, column.Type, targetColumns[i].Type))
+		}
+	}
+	for _, column := range targetColumns {
+		if !slices.ContainsFunc(dumpColumns, func(c Column) bool { return c.Name == column.Name }) {
+			differences = append(differences, fmt.Sprintf("column %s is missing from the dump", column.Name))
+		}
+	}
+	if len(differences) == 0 && !slices.Equal(dumpColumns, targetColumns) {
+		differences = append(differences, "the columns are in another order")
+	}
+	return differences
+}
@@ -0,0 +1,111 @@
+package chdump
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// runSchemaSync diffs the CREATE TABLE statements of the dump with the tables of the target database and prints the
+// statements bringing the target in line with the dump: the creation of the missing tables, and the ALTER TABLE
+// statements adding, modifying and dropping columns of the existing ones. With Apply, the statements are executed.
+func runSchemaSync(ctx context.Context, config Options, schemaDir string) error {
+	db, err := createDBConnection(ctx, config, "")
+	if err != nil {
+		return fmt.Errorf("initial database connection failed: %w", err)
+	}
+	defer db.Close()
+
+	var existingTables []string
+	err = withRetry(ctx, config.Retry, "fetching existing tables", func() (err error) {
+		existingTables, err = getExistingTables(ctx, db, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch existing tables: %w", err)
+	}
+	schemaFiles, err := listSchemaFiles(config, schemaDir)
+	if err != nil {
+		return err
+	}
+
+	var statements []string
+	if len(existingTables) == 0 {
+		createDatabase, err := createDatabaseQuery(config, schemaDir)
+		if err != nil {
+			return err
+		}
+		statements = append(statements, createDatabase)
+	}
+	for _, file := range schemaFiles {
+		if !createTablePattern.MatchString(file.Content) {
+			continue
+		}
+		table := targetTableName(config, file.Table)
+		if !slices.Contains(existingTables, table) {
+			statements = append(statements, rewriteSchema(config, file.Content))
+			continue
+		}
+		columns, err := tableColumns(ctx, db, config, table, "1")
+		if err != nil {
+			return err
+		}
+		statements = append(statements, alterColumns(config, table, columnDefinitions(file.Content), columns)...)
+	}
+
+	if len(statements) == 0 {
+		log.Printf("The schema of database %s matches the dump", config.DBName)
+		return nil
+	}
+	for _, statement := range statements {
+		fmt.Printf("%s;\n", strings.TrimSpace(statement))
+		if !config.Apply {
+			continue
+		}
+		if err := execWithRetry(ctx, db, config, statement); err != nil {
+			return fmt.Errorf("failed to sync the schema of database %s: %w", config.DBName, err)
+		}
+	}
+	if config.Apply {
+		log.Printf("Applied %d statement(s) to the schema of database %s", len(statements), config.DBName)
+	}
+	return nil
+}
+
+// alterTableQuery returns the beginning of an ALTER TABLE statement of a table of the database, on every host of the
+// cluster when one is given
+func alterTableQuery(config Options, table string) string {
+	alter := "ALTER TABLE " + qualifiedName(config.DBName, table)
+	if config.OnCluster != "" {
+		alter += " ON CLUSTER " + quoteIdentifier(config.OnCluster)
+	}
+	return alter
+}
+
+// alterColumns returns the ALTER TABLE statements turning the columns of a target table into those of the table in
+// the dump: the missing columns are added at their position, the columns of another type are modified, and the
+// columns missing from the dump are dropped, last
+func alterColumns(config Options, table string, dumpColumns []columnDefinition, targetColumns []Column) []string {
+	alter := alterTableQuery(config, table)
+
+	var statements []string
+	for i, column := range dumpColumns {
+		j := slices.IndexFunc(targetColumns, func(c Column) bool { return c.Name == column.Name })
+		switch {
+		case j < 0 && i == 0:
+			statements = append(statements, alter+" ADD COLUMN "+column.definition+" FIRST")
+		case j < 0:
+			statements = append(statements, alter+" ADD COLUMN "+column.definition+" AFTER "+quoteIdentifier(dumpColumns[i-1].Name))
+		case targetColumns[j].Type != column.Type:
+			statements = append(statements, alter+" MODIFY COLUMN "+column.definition)
+		}
+	}
+	for _, column := range targetColumns {
+		if !slices.ContainsFunc(dumpColumns, func(c columnDefinition) bool { return c.Name == column.Name }) {
+			statements = append(statements, alter+" DROP COLUMN "+quoteIdentifier(column.Name))
+		}
+	}
+	return statements
+}
@@ -0,0 +1,167 @@
+package chdump
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// shardingSuffix is appended to the name of a table to get the name of the Distributed table a shard-aware import
+// creates to insert its data through, when the target has none
+const shardingSuffix = "__sharding"
+
+// defaultShardingKey is the sharding key of the Distributed tables a shard-aware import creates for the tables without
+// a configured one, which spreads the rows evenly over the shards
+const defaultShardingKey = "rand()"
+
+// distributedInserts returns the Distributed tables a shard-aware import inserts the data of the tables with data
+// files through, so that the rows land on the shards of the cluster their sharding key selects: the Distributed table
+// of the target database reading the table, or else one created over the table with its configured sharding key or
+// the one recorded in the manifest, which the returned cleanup function drops
+func distributedInserts(ctx context.Context, db *sql.DB, config Options, schemaFiles []SchemaFile, dataDir string, manifestTables map[string]ManifestTable) (map[string]string, func(), error) {
+	inserts := make(map[string]string)
+	var created []string
+	cleanup := func() {
+		for _, table := range created {
+			if err := execWithRetry(context.WithoutCancel(ctx), db, config, "DROP TABLE IF EXISTS "+qualifiedName(config.DBName, table)); err != nil {
+				log.Printf("Warning: failed to drop Distributed table %s: %v", table, err)
+			}
+		}
+	}
+	if config.ShardCluster == "" {
+		return inserts, cleanup, nil
+	}
+
+	var metadata map[string]TableMetadata
+	err := withRetry(ctx, config.Retry, "fetching Distributed tables", func() (err error) {
+		metadata, err = getTableMetadata(ctx, db, config.DBName)
+		return err
+	})
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("failed to fetch Distributed tables: %w", err)
+	}
+	existing := distributedTablesByLocal(config.DBName, metadata)
+	for _, file := range schemaFiles {
+		if !createTablePattern.MatchString(file.Content) || !hasDataFiles(config, dataDir, file.Table) {
+			continue
+		}
+		// The data of a Distributed table of the dump is inserted through it already
+		if _, local := distributedLocalTable(file.Content); local != "" {
+			continue
+		}
+		table := targetTableName(config, file.Table)
+		recorded := manifestTables[file.Table].ShardingKey
+		if distributed, ok := existing[table]; ok {
+			if key := metadata[distributed].ShardingKey; recorded != "" && key != recorded {
+				log.Printf("Warning: Distributed table %s shards table %s by %s, while the source sharded it by %s", distributed, table, key, recorded)
+			}
+			log.Printf("Inserting the data of table %s through Distributed table %s", table, distributed)
+			inserts[table] = distributed
+			continue
+		}
+
+		key := cmp.Or(config.ShardingKeys[file.Table], recorded, defaultShardingKey)
+		distributed := table + shardingSuffix
+		statement := fmt.Sprintf("CREATE TABLE %s AS %s ENGINE = Distributed(%s, %s, %s, %s)", qualifiedName(config.DBName, distributed),
+			qualifiedName(config.DBName, table), quoteString(config.ShardCluster), quoteString(config.DBName), quoteString(table), key)
+		if err := execWithRetry(ctx, db, config, "DROP TABLE IF EXISTS "+qualifiedName(config.DBName, distributed)); err != nil {
+			return nil, cleanup, fmt.Errorf("failed to drop Distributed table %s: %w", distributed, err)
+		}
+		if err := execWithRetry(ctx, db, config, statement); err != nil {
+			return nil, cleanup, fmt.Errorf("failed to create Distributed table %s: %w", distributed, err)
+		}
+		created = append(created, distributed)
+		log.Printf("Inserting the data of table %s through Distributed table %s sharded by %s", table, distributed, key)
+		inserts[table] = distributed
+	}
+	return inserts, cleanup, nil
+}
+
+// distributedTablesByLocal returns the Distributed tables of the database by the table of the database they read,
+// the first one in name order for a table read by several. The Distributed tables of shard-aware imports are left
+// out.
+func distributedTablesByLocal(dbName string, metadata map[string]TableMetadata) map[string]string {
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tables := make(map[string]string)
+	for _, name := range names {
+		tableMetadata := metadata[name]
+		if tableMetadata.Engine != "Distributed" || tableMetadata.Local == "" || tableMetadata.LocalDB != dbName || strings.HasSuffix(name, shardingSuffix) {
+			continue
+		}
+		if _, ok := tables[tableMetadata.Local]; !ok {
+			tables[tableMetadata.Local] = name
+		}
+	}
+	return tables
+}
+
+// localShardingKeys returns the sharding keys of the tables of the database read by Distributed tables, that of the
+// first Distributed table in name order for a table read by several
+func localShardingKeys(dbName string, metadata map[string]TableMetadata) map[string]string {
+	keys := make(map[string]string)
+	for local, distributed := range distributedTablesByLocal(dbName, metadata) {
+		if key := metadata[distributed].ShardingKey; key != "" {
+			keys[local] = key
+		}
+	}
+	return keys
+}
+
+// manifestTables returns the tables recorded in the manifest of the dump by name, or none when the dump has no
+// manifest
+func manifestTables(config Options) map[string]ManifestTable {
+	tables := make(map[string]ManifestTable)
+	if _, err := os.Stat(config.ManifestFile); err != nil {
+		return tables
+	}
+	manifest, err := loadManifest(config.ManifestFile)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return tables
+	}
+	for _, table := range manifest.Tables {
+		tables[table.Name] = table
+	}
+	return tables
+}
+
+// checkTableKeys warns about the tables whose partition or sorting key in the target database differs from the one
+// recorded in the manifest, whose partitions and data layout differ from those of the source
+func checkTableKeys(ctx context.Context, db *sql.DB, config Options, schemaFiles []SchemaFile, manifestTables map[string]ManifestTable) error {
+	if len(manifestTables) == 0 {
+		return nil
+	}
+	var metadata map[string]TableMetadata
+	err := withRetry(ctx, config.Retry, "fetching table keys", func() (err error) {
+		metadata, err = getTableMetadata(ctx, db, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch table keys: %w", err)
+	}
+	for _, file := range schemaFiles {
+		recorded, ok := manifestTables[file.Table]
+		table := targetTableName(config, file.Table)
+		target, exists := metadata[table]
+		if !ok || !exists {
+			continue
+		}
+		if recorded.PartitionKey != "" && target.PartitionKey != recorded.PartitionKey {
+			log.Printf("Warning: table %s is partitioned by %s, while the source partitioned it by %s", table, target.PartitionKey, recorded.PartitionKey)
+		}
+		if recorded.SortingKey != "" && target.SortingKey != recorded.SortingKey {
+			log.Printf("Warning: table %s is sorted by %s, while the source sorted it by %s", table, target.SortingKey, recorded.SortingKey)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// snapshotSuffix is appended to the name of a table to get the name of the snapshot table a frozen export reads
+const snapshotSuffix = "__snapshot"
+
+// snapshotTable returns the name of the snapshot table of a table
+func snapshotTable(table string) string {
+	return table + snapshotSuffix
+}
+
+// sourceTable returns the table the data of a table is read from: its snapshot table when the export is frozen
+func sourceTable(config Options, table string) string {
+	if snapshot, ok := config.snapshots[table]; ok {
+		return snapshot
+	}
+	return table
+}
+
+// freezeTables freezes the MergeTree tables whose data is exported, so that tables written during the export are
+// exported as of the same moment. Every table is cloned into an empty snapshot table first, and then the parts of
+// all the tables are attached to their snapshot tables in one pass with ATTACH PARTITION FROM, which hard-links the
+// parts as FREEZE does, so that the tables are captured within a short window. It returns the snapshot tables of
+// the frozen tables; the others are exported live.
+func freezeTables(ctx context.Context, db *sql.DB, config Options, tables []string, metadata map[string]TableMetadata) (map[string]string, error) {
+	snapshots := make(map[string]string)
+	var frozen []string
+	for _, table := range tables {
+		tableMetadata := metadata[table]
+		if !hasData(config, tableMetadata) || tableMetadata.Target != "" {
+			continue
+		}
+		if !strings.HasSuffix(tableMetadata.Engine, "MergeTree") {
+			log.Printf("Table %s is exported live: %s tables cannot be frozen", table, tableMetadata.Engine)
+			continue
+		}
+		if err := createSnapshotTable(ctx, db, config, table); err != nil {
+			return snapshots, err
+		}
+		snapshots[table] = snapshotTable(table)
+		frozen = append(frozen, table)
+	}
+
+	partitions := make(map[string][]string)
+	for _, table := range frozen {
+		ids, err := activePartitions(ctx, db, config, table)
+		if err != nil {
+			return snapshots, err
+		}
+		partitions[table] = ids
+	}
+
+	started := time.Now()
+	for _, table := range frozen {
+		for _, id := range partitions[table] {
+			query := fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION ID %s FROM %s", qualifiedName(config.DBName, snapshotTable(table)),
+				quoteString(id), qualifiedName(config.DBName, table))
+			if err := execWithRetry(ctx, db, config, query); err != nil {
+				return snapshots, fmt.Errorf("failed to freeze partition %s of table %s: %w", id, table, err)
+			}
+		}
+	}
+	log.Printf("Froze %d table(s) in %s", len(frozen), time.Since(started).Round(time.Millisecond))
+	return snapshots, nil
+}
+
+// createSnapshotTable creates the empty snapshot table of a table, with the structure, keys and storage policy
+// ATTACH PARTITION FROM requires, dropping one left over by a previous run. Replicated engines are replaced with
+// their non-replicated counterparts, so that the snapshot table does not join the replicas of the table.
+func createSnapshotTable(ctx context.Context, db *sql.DB, config Options, table string) error {
+	snapshot := snapshotTable(table)
+	if err := execWithRetry(ctx, db, config, "DROP TABLE IF EXISTS "+qualifiedName(config.DBName, snapshot)); err != nil {
+		return fmt.Errorf("failed to drop snapshot table %s: %w", snapshot, err)
+	}
+	var statement string
+	err := withRetry(ctx, config.Retry, "fetching schema of "+table, func() error {
+		return db.QueryRowContext(ctx, "SHOW CREATE TABLE "+qualifiedName(config.DBName, table)).Scan(&statement)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch schema of table %s: %w", table, err)
+	}
+	statement = renameCreated(dereplicate(statement), qualifiedName(config.DBName, snapshot))
+	if err := execWithRetry(ctx, db, config, statement); err != nil {
+		return fmt.Errorf("failed to create snapshot table %s: %w", snapshot, err)
+	}
+	return nil
+}
+
+// activePartitions returns the IDs of the partitions of the active parts of a table
+func activePartitions(ctx context.Context, db *sql.DB, config Options, table string) ([]string, error) {
+	var ids []string
+	err := withRetry(ctx, config.Retry, "fetching partitions of "+table, func() error {
+		ids = nil
+		rows, err := db.QueryContext(ctx, "SELECT DISTINCT partition_id FROM system.parts WHERE database = ? AND table = ? AND active", config.DBName, table)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch partitions of table %s: %w", table, err)
+	}
+	return ids, nil
+}
+
+// dropSnapshots drops the snapshot tables of a frozen export, releasing their parts
+func dropSnapshots(ctx context.Context, db *sql.DB, config Options, snapshots map[string]string) {
+	for _, snapshot := range snapshots {
+		if err := execWithRetry(ctx, db, config, "DROP TABLE IF EXISTS "+qualifiedName(config.DBName, snapshot)); err != nil {
+			log.Printf("Failed to drop snapshot table %s: %v", snapshot, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package chdump
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// splitFiles reports whether the data of the tables is split into numbered parts
+func splitFiles(config Options) bool {
+	return config.MaxFileSize > 0 || config.MaxRowsPerFile > 0
+}
+
+// batchWriter writes the batches of the exported data of a table as ClickHouse outputs them
+type batchWriter interface {
+	writeBatch(data []byte) error
+	finishBatch(rows int) error
+}
+
+// dataWriter writes the exported batches of a table to its data file or, when the data files are split, to numbered
+// parts, starting a new part once the current one reaches the maximum size or would exceed the maximum number of
+// rows with the next batch
+type dataWriter struct {
+	config  Options
+	dataDir string
+	table   string
+	split   bool
+	file    *os.File
+	part    int   // number of the current part
+	rows    int   // rows of the current part
+	bytes   int64 // bytes of the current part
+	headed  bool  // whether the current file starts with the header of the format
+}
+
+// createDataWriter creates the data file of the table, or its first part. A resumed export appends to the data
+// file, or starts a part after the existing ones, while a new export removes the data files of a previous one.
+func createDataWriter(config Options, dataDir, table string, resume bool) (*dataWriter, error) {
+	files, err := dataFiles(config, dataDir, table)
+	if err != nil {
+		return nil, err
+	}
+	if !resume {
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				return nil, err
+			}
+		}
+		files = nil
+	}
+
+	w := &dataWriter{config: config, dataDir: dataDir, table: table, split: splitFiles(config)}
+	if w.split {
+		w.part = len(files)
+		return w, w.nextPart()
+	}
+	path := dataFilePath(config, dataDir, table)
+	if !resume {
+		w.file, err = os.Create(path)
+		return w, err
+	}
+	if w.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return w, err
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return w, err
+	}
+	w.headed = info.Size() > 0
+	return w, nil
+}
+
+// nextPart creates the next part of the data of the table
+func (w *dataWriter) nextPart() error {
+	w.part++
+	w.rows, w.bytes, w.headed = 0, 0, false
+	path := partFilePath(w.config, w.dataDir, w.table, w.part)
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create data file %s: %w", path, err)
+	}
+	w.file = file
+	if w.part > 1 {
+		log.Printf("Writing part %d of table %s to %s", w.part, w.table, path)
+	}
+	return nil
+}
+
+// Write writes to the current data file, creating the next part if the previous one is full
+func (w *dataWriter) Write(p []byte) (int, error) {
+	if w.file == nil {
+		if err := w.nextPart(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// writeBatch writes a batch of data as ClickHouse outputs it, keeping its header only at the start of the file
+func (w *dataWriter) writeBatch(data []byte) error {
+	if w.file == nil {
+		if err := w.nextPart(); err != nil {
+			return err
+		}
+	}
+	if _, rows := splitHeader(w.config.Format, data); w.headed {
+		data = rows
+	}
+	w.headed = true
+	return writeBatch(w.config.Format, w, data)
+}
+
+// finishBatch records the rows of a written batch and closes the current part when it is full
+func (w *dataWriter) finishBatch(rows int) error {
+	w.rows += rows
+	if !w.split || w.file == nil {
+		return nil
+	}
+	full := w.config.MaxFileSize > 0 && w.bytes >= w.config.MaxFileSize ||
+		w.config.MaxRowsPerFile > 0 && w.rows+w.config.ChunkSize > w.config.MaxRowsPerFile
+	if !full {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Close closes the current data file
+func (w *dataWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
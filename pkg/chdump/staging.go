@@ -0,0 +1,157 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// stagingSuffix is appended to the name of a table to get the name of the staging table an atomic restore loads
+const stagingSuffix = "__restore"
+
+// stagingTable returns the name of the staging table of a table
+func stagingTable(table string) string {
+	return table + stagingSuffix
+}
+
+// createTablePattern matches a CREATE TABLE statement
+var createTablePattern = regexp.MustCompile(`(?is)^\s*CREATE\s+(?:OR\s+REPLACE\s+)?TABLE\b`)
+
+// createdNamePattern matches the name of the created object at the end of the beginning of a CREATE statement
+var createdNamePattern = regexp.MustCompile("(?:(?:`[^`]+`|\\w+)\\.)?(?:`[^`]+`|\\w+)$")
+
+// stagedTables returns the tables of the dump an atomic restore loads into staging tables: the tables with a data
+// file of their own. Views, dictionaries and Distributed tables, whose inserts reach their local tables directly,
+// are not staged.
+func stagedTables(config Options, schemaFiles []SchemaFile, dataDir string) map[string]bool {
+	staged := make(map[string]bool)
+	if !config.AtomicRestore {
+		return staged
+	}
+	for _, file := range schemaFiles {
+		if !createTablePattern.MatchString(file.Content) {
+			continue
+		}
+		if _, local := distributedLocalTable(file.Content); local != "" {
+			continue
+		}
+		if hasDataFiles(config, dataDir, file.Table) {
+			staged[file.Table] = true
+		}
+	}
+	return staged
+}
+
+// stageSchema renames the table created by a rewritten CREATE statement to its staging table
+func stageSchema(config Options, statement, table string) string {
+	return renameCreated(statement, qualifiedName(config.DBName, stagingTable(table)))
+}
+
+// renameCreated replaces the name of the object created by a CREATE statement with the qualified name
+func renameCreated(statement, name string) string {
+	location := createObjectPattern.FindStringIndex(statement)
+	if location == nil {
+		return statement
+	}
+	head := createdNamePattern.ReplaceAllLiteralString(statement[:location[1]], name)
+	return head + statement[location[1]:]
+}
+
+// atomicSchema returns the statement an atomic restore executes for a schema file: the creation of the staging
+// table of a staged table, after dropping one left over by a previous run, or nothing for an object that already
+// exists, which is kept as it is
+func atomicSchema(ctx context.Context, db *sql.DB, config Options, file SchemaFile, staged map[string]bool) (string, error) {
+	table := targetTableName(config, file.Table)
+	statement := rewriteSchema(config, file.Content)
+	if staged[file.Table] {
+		if err := execWithRetry(ctx, db, config, dropTableQuery(config, stagingTable(table))); err != nil {
+			return "", fmt.Errorf("failed to drop staging table %s: %w", stagingTable(table), err)
+		}
+		return stageSchema(config, statement, table), nil
+	}
+	exists, err := tableExists(ctx, db, config, table)
+	if err != nil || exists {
+		return "", err
+	}
+	return statement, nil
+}
+
+// restoreAtomically loads the data of a table into its staging table, verifies its row count, and then swaps the
+// staging table with the table, so that readers see either the previous data or all of the restored data
+func restoreAtomically(ctx context.Context, config Options, table string, dataFiles []string, recorded *int, db *sql.DB, tableReport *TableReport) error {
+	staging := stagingTable(table)
+	// The staging table may hold the rows of an interrupted run
+	if err := execWithRetry(ctx, db, config, addClusterClause(config, "TRUNCATE TABLE "+qualifiedName(config.DBName, staging))); err != nil {
+		return fmt.Errorf("failed to truncate staging table %s: %w", staging, err)
+	}
+	stagingConfig := config
+	stagingConfig.VerifyRowCounts = true
+	if err := importTableData(ctx, stagingConfig, staging, dataFiles, recorded, db, tableReport); err != nil {
+		return err
+	}
+	return swapStagingTable(ctx, db, config, table)
+}
+
+// swapStagingTable replaces a table with its staging table: the tables are exchanged atomically and the previous
+// data dropped, or the staging table is renamed when the table does not exist yet
+func swapStagingTable(ctx context.Context, db *sql.DB, config Options, table string) error {
+	staging := stagingTable(table)
+	exists, err := tableExists(ctx, db, config, table)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		query := fmt.Sprintf("RENAME TABLE %s TO %s", qualifiedName(config.DBName, staging), qualifiedName(config.DBName, table))
+		if err := execWithRetry(ctx, db, config, addClusterClause(config, query)); err != nil {
+			return fmt.Errorf("failed to rename staging table %s to %s: %w", staging, table, err)
+		}
+		log.Printf("Staging table %s renamed to %s", staging, table)
+		return nil
+	}
+
+	query := fmt.Sprintf("EXCHANGE TABLES %s AND %s", qualifiedName(config.DBName, staging), qualifiedName(config.DBName, table))
+	if err := execWithRetry(ctx, db, config, addClusterClause(config, query)); err != nil {
+		return fmt.Errorf("failed to exchange staging table %s with %s: %w", staging, table, err)
+	}
+	log.Printf("Staging table %s exchanged with %s", staging, table)
+	if err := execWithRetry(ctx, db, config, dropTableQuery(config, staging)); err != nil {
+		return fmt.Errorf("failed to drop the previous data of %s in %s: %w", table, staging, err)
+	}
+	return nil
+}
+
+// dropTableQuery returns the statement dropping a table of the database if it exists
+func dropTableQuery(config Options, table string) string {
+	return addClusterClause(config, "DROP TABLE IF EXISTS "+qualifiedName(config.DBName, table))
+}
+
+// addClusterClause appends an ON CLUSTER clause to a statement when a cluster is configured
+func addClusterClause(config Options, statement string) string {
+	if config.OnCluster == "" {
+		return statement
+	}
+	return statement + " ON CLUSTER " + quoteIdentifier(config.OnCluster)
+}
+
+// execWithRetry executes a statement, retrying transient errors according to the retry policy
+func execWithRetry(ctx context.Context, db *sql.DB, config Options, statement string) error {
+	return withRetry(ctx, config.Retry, "executing "+strings.Fields(statement)[0], func() error {
+		_, err := db.ExecContext(ctx, statement)
+		return err
+	})
+}
+
+// tableExists checks if the database holds a table, view or dictionary of the name
+func tableExists(ctx context.Context, db *sql.DB, config Options, table string) (bool, error) {
+	var count int
+	err := withRetry(ctx, config.Retry, "checking if table "+table+" exists", func() error {
+		return db.QueryRowContext(ctx, "SELECT count() FROM system.tables WHERE database = ? AND name = ?", config.DBName, table).Scan(&count)
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check if table %s exists: %w", table, err)
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,74 @@
+package chdump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStagedTables(t *testing.T) {
+	dataDir := t.TempDir()
+	for _, file := range []string{"orders.tsv", "events.0001.tsv", "events.0002.tsv", "orders_all.tsv"} {
+		if err := os.WriteFile(filepath.Join(dataDir, file), []byte("1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	schemaFiles := []SchemaFile{
+		{Table: "orders", Content: "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Table: "events", Content: "CREATE TABLE sales.events (id UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Table: "customers", Content: "CREATE TABLE sales.customers (id UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Table: "orders_all", Content: "CREATE TABLE sales.orders_all (id UInt64) ENGINE = Distributed(main, sales, orders, rand())"},
+		{Table: "totals", Content: "CREATE VIEW sales.totals AS SELECT count() FROM sales.orders"},
+	}
+
+	config := Options{Format: TSV, AtomicRestore: true}
+	staged := stagedTables(config, schemaFiles, dataDir)
+	want := map[string]bool{"orders": true, "events": true}
+	if len(staged) != len(want) || !staged["orders"] || !staged["events"] {
+		t.Errorf("stagedTables() = %v, want %v", staged, want)
+	}
+
+	config.AtomicRestore = false
+	if staged := stagedTables(config, schemaFiles, dataDir); len(staged) != 0 {
+		t.Errorf("stagedTables() without -atomicRestore = %v, want none", staged)
+	}
+}
+
+func TestStageSchema(t *testing.T) {
+	tests := []struct {
+		name      string
+		table     string
+		statement string
+		want      string
+	}{
+		{
+			name:      "qualified name",
+			table:     "orders",
+			statement: "CREATE TABLE sales.orders (id UInt64) ENGINE = MergeTree ORDER BY id",
+			want:      "CREATE TABLE `sales`.`orders__restore` (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+		{
+			name:      "backquoted name",
+			table:     "order items",
+			statement: "CREATE TABLE IF NOT EXISTS `sales`.`order items` (id UInt64) ENGINE = MergeTree ORDER BY id",
+			want:      "CREATE TABLE IF NOT EXISTS `sales`.`order items__restore` (id UInt64) ENGINE = MergeTree ORDER BY id",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := stageSchema(Options{DBName: "sales"}, test.statement, test.table); got != test.want {
+				t.Errorf("stageSchema() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDropTableQuery(t *testing.T) {
+	if got, want := dropTableQuery(Options{DBName: "sales"}, "orders__restore"), "DROP TABLE IF EXISTS `sales`.`orders__restore`"; got != want {
+		t.Errorf("dropTableQuery() = %q, want %q", got, want)
+	}
+	config := Options{DBName: "sales", OnCluster: "main"}
+	if got, want := dropTableQuery(config, "orders__restore"), "DROP TABLE IF EXISTS `sales`.`orders__restore` ON CLUSTER `main`"; got != want {
+		t.Errorf("dropTableQuery() ON CLUSTER = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+)
+
+// setStatementPattern matches a SET statement, which changes the settings of the session for the statements after it
+var setStatementPattern = regexp.MustCompile(`(?is)^\s*SET\s`)
+
+// splitStatements splits the content of a schema file into its statements at the semicolons outside of string
+// literals, quoted identifiers and comments. The comments before a statement and the statements holding nothing but
+// comments are dropped.
+func splitStatements(content string) []string {
+	var statements []string
+	start, empty := 0, true
+	begin := func(i int) {
+		if empty {
+			start, empty = i, false
+		}
+	}
+	flush := func(end int) {
+		if !empty {
+			statements = append(statements, strings.TrimSpace(content[start:end]))
+		}
+		empty = true
+	}
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			begin(i)
+			// A quote doubled inside the literal closes and reopens it, which splits the same way
+			for i++; i < len(content) && content[i] != c; i++ {
+				if content[i] == '\\' {
+					i++
+				}
+			}
+		case c == '-' && strings.HasPrefix(content[i:], "--"):
+			if end := strings.IndexByte(content[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(content)
+			}
+		case c == '/' && strings.HasPrefix(content[i:], "/*"):
+			if end := strings.Index(content[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(content)
+			}
+		case c == ';':
+			flush(i)
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			begin(i)
+		}
+	}
+	flush(len(content))
+	return statements
+}
+
+// primaryStatement returns the statement of a schema file creating its object: the first CREATE statement, or the
+// first statement of a file without one
+func primaryStatement(statements []string) string {
+	for _, statement := range statements {
+		if createObjectPattern.MatchString(statement) {
+			return statement
+		}
+	}
+	if len(statements) > 0 {
+		return statements[0]
+	}
+	return ""
+}
+
+// schemaStatements returns the rewritten statements of a schema file in order, with the CREATE statement of its
+// object replaced by the given statement
+func schemaStatements(config Options, file SchemaFile, primary string) []string {
+	statements := make([]string, len(file.Statements))
+	for i, statement := range file.Statements {
+		if statement == file.Content {
+			statements[i] = primary
+		} else {
+			statements[i] = rewriteSchema(config, statement)
+		}
+	}
+	return statements
+}
+
+// execSchemaStatements executes the statements of a schema file in order on one connection, so that its SET
+// statements apply to the statements after them. A retry resumes at the failed statement on a new connection, after
+// replaying the SET statements before it.
+func execSchemaStatements(ctx context.Context, db *sql.DB, config Options, file SchemaFile, statements []string) error {
+	done := 0
+	return withRetry(ctx, config.Retry, "executing schema file "+file.Name, func() error {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		for i, statement := range statements {
+			if i < done && !setStatementPattern.MatchString(statement) {
+				continue
+			}
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+			done = max(done, i+1)
+		}
+		return nil
+	})
+}
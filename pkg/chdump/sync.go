@@ -0,0 +1,215 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// syncServer keeps the databases of the target server in sync with those of the source server: every pass compares
+// the tables of both per partition and copies only the partitions that diverge. With a sync interval, the passes are
+// repeated after the interval until the context is canceled, a failed pass being retried with the next one.
+func syncServer(ctx context.Context, config Options) error {
+	for pass := 1; ; pass++ {
+		log.Printf("Sync pass %d from %s to %s started", pass, config.SourceHost, config.Host)
+		err := syncDatabases(ctx, config)
+		if config.SyncInterval <= 0 {
+			return err
+		}
+		if ctx.Err() != nil {
+			log.Printf("Sync from %s to %s stopped", config.SourceHost, config.Host)
+			return nil
+		}
+		if err != nil {
+			log.Printf("Sync pass %d failed: %v", pass, err)
+		}
+
+		log.Printf("Next sync pass in %s", config.SyncInterval)
+		timer := time.NewTimer(config.SyncInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Printf("Sync from %s to %s stopped", config.SourceHost, config.Host)
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// syncDatabases runs a sync pass over the databases of the source server, the data of their divergent partitions
+// being exported into the per-database layout of the dump directory on the way
+func syncDatabases(ctx context.Context, config Options) error {
+	source := sourceConfig(config)
+	sourceDB, err := createDBConnection(ctx, source, source.DBName)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	defer sourceDB.Close()
+
+	targetDB, err := createDBConnection(ctx, config, "")
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	defer targetDB.Close()
+
+	databases, err := serverDatabases(ctx, sourceDB, source)
+	if err != nil {
+		return fmt.Errorf("failed to resolve databases: %w", err)
+	}
+	var failedDatabases []string
+	for _, dbName := range databases {
+		dbConfig, _, dataDir := databaseConfig(config, dbName, filepath.Join(config.DumpDir, dbName))
+		dbSource := sourceConfig(dbConfig)
+		dbSource.DBName = dbName
+		if err := syncDatabase(ctx, sourceDB, targetDB, dbSource, dbConfig, dataDir); err != nil {
+			log.Printf("Error syncing database %s: %v", dbName, err)
+			if config.FailFast || ctx.Err() != nil {
+				return err
+			}
+			failedDatabases = append(failedDatabases, dbName)
+		}
+	}
+	if len(failedDatabases) > 0 {
+		return fmt.Errorf("failed for %d database(s): %s", len(failedDatabases), strings.Join(failedDatabases, ", "))
+	}
+	return nil
+}
+
+// syncDatabase syncs the selected MergeTree tables of a database that exist in the target. The tables of other
+// engines, which have no partitions to compare, and the tables missing in the target are left out.
+func syncDatabase(ctx context.Context, sourceDB, targetDB *sql.DB, source, config Options, dataDir string) (err error) {
+	report := &Report{Operation: "sync", DBName: config.DBName, StartedAt: time.Now()}
+	defer func() {
+		if reportErr := writeReport(config, report, err); reportErr != nil {
+			log.Printf("Failed to write report: %v", reportErr)
+		}
+	}()
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	var metadata map[string]TableMetadata
+	var targetTables []string
+	err = withRetry(ctx, config.Retry, "fetching tables", func() (err error) {
+		if metadata, err = getTableMetadata(ctx, sourceDB, source.DBName); err != nil {
+			return err
+		}
+		targetTables, err = getTables(ctx, targetDB, config.DBName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch tables: %w", err)
+	}
+
+	tables := make([]string, 0, len(metadata))
+	for table, tableMetadata := range metadata {
+		if isTableSelected(config, table) && strings.HasSuffix(tableMetadata.Engine, "MergeTree") {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+
+	var failedTables []string
+	for _, table := range tables {
+		target := targetTableName(config, table)
+		if !slices.Contains(targetTables, target) {
+			log.Printf("Warning: table %s is missing in the target database %s, restore it to sync it", target, config.DBName)
+			continue
+		}
+		tableReport := startTableReport(report, target)
+		err := syncTable(ctx, sourceDB, targetDB, source, config, table, dataDir, tableReport)
+		finishTableReport(config, report, tableReport, err)
+		if err != nil {
+			log.Printf("Error syncing table %s: %v", table, err)
+			if config.FailFast || ctx.Err() != nil {
+				return fmt.Errorf("failed to sync table %s: %w", table, err)
+			}
+			failedTables = append(failedTables, table)
+		}
+	}
+	if len(failedTables) > 0 {
+		return fmt.Errorf("%d of %d table(s) failed: %s", len(failedTables), len(tables), strings.Join(failedTables, ", "))
+	}
+	return nil
+}
+
+// syncTable compares a table of the source and the target by the row count and checksum of every partition, drops
+// the partitions of the target missing in the source and replaces the partitions that differ or are missing in the
+// target with those of the source, whose data is exported into the data directory and removed once imported
+func syncTable(ctx context.Context, sourceDB, targetDB *sql.DB, source, config Options, table, dataDir string, tableReport *TableReport) error {
+	target := targetTableName(config, table)
+	var sourcePartitions, targetPartitions map[string]PartitionChecksum
+	err := withRetry(ctx, config.Retry, "computing checksums of "+table, func() (err error) {
+		if sourcePartitions, err = getPartitionChecksums(ctx, sourceDB, source.DBName, table); err != nil {
+			return err
+		}
+		targetPartitions, err = getPartitionChecksums(ctx, targetDB, config.DBName, target)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to compute checksums: %w", err)
+	}
+
+	copied, dropped := divergentPartitions(sourcePartitions, targetPartitions)
+	if len(copied) == 0 && len(dropped) == 0 {
+		log.Printf("Table %s is in sync", target)
+		tableReport.Status = statusSkipped
+		return nil
+	}
+	if err := dropPartitions(ctx, targetDB, config, target, dropped); err != nil {
+		return err
+	}
+	if len(copied) == 0 {
+		return nil
+	}
+
+	// The rows of the export are counted apart from those of the import, which verifies its row count with them
+	if err := dumpPartitionData(ctx, source, table, copied, dataDir, sourceDB, &TableReport{Table: table}); err != nil {
+		return err
+	}
+	files, err := dataFiles(source, dataDir, table)
+	defer func() {
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				log.Printf("Warning: failed to remove data file %s: %v", file, err)
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if err := dropPartitions(ctx, targetDB, config, target, copied); err != nil {
+		return err
+	}
+	if err := importTableData(ctx, config, target, files, nil, targetDB, tableReport); err != nil {
+		return err
+	}
+	log.Printf("Synced %d partition(s) of table %s, dropped %d", len(copied), target, len(dropped))
+	return nil
+}
+
+// divergentPartitions returns the partitions of a table to copy from the source, whose row count or checksum
+// differs or which are missing in the target, and those to drop from the target, which are missing in the source
+func divergentPartitions(source, target map[string]PartitionChecksum) ([]string, []string) {
+	var copied, dropped []string
+	for partition, checksum := range source {
+		if targetChecksum, ok := target[partition]; !ok || targetChecksum != checksum {
+			copied = append(copied, partition)
+		}
+	}
+	for partition := range target {
+		if _, ok := source[partition]; !ok {
+			dropped = append(dropped, partition)
+		}
+	}
+	sort.Strings(copied)
+	sort.Strings(dropped)
+	return copied, dropped
+}
@@ -0,0 +1,168 @@
+package chdump
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// tenantsDir is the directory of a dump, next to its schema and data directories, holding the dumps of the tenants
+// of the tables split by tenant
+const tenantsDir = "tenants"
+
+// dumpTenantData dumps the data of a table split by tenant: every batch selects the tenant column before the columns
+// of the table, and its rows are written to the data file of the table in the dump of their tenant, without the
+// tenant column, so that the data of all the tenants is exported in a single pass over the table
+func dumpTenantData(ctx context.Context, config Options, table, column, schemaDir, dataDir string, db *sql.DB, tableReport *TableReport) error {
+	whereClause := tableWhereClause(config, table, "")
+	totalRows, err := getTotalRowsWithRetry(ctx, config, table, whereClause, db)
+	if err != nil {
+		return err
+	}
+	columns, err := selectColumns(ctx, db, config, table)
+	if err != nil {
+		return err
+	}
+
+	output := &tenantWriter{
+		config:     config,
+		dir:        filepath.Join(filepath.Dir(dataDir), tenantsDir),
+		table:      table,
+		schemaFile: filepath.Join(schemaDir, table+".sql"),
+		writers:    make(map[string]*dataWriter),
+		rows:       make(map[string]int),
+	}
+	defer output.Close()
+	if err := exportTableData(ctx, config, table, quoteIdentifier(column)+", "+columns, whereClause, db, output, totalRows, TableCheckpoint{}, tableReport, nil); err != nil {
+		return err
+	}
+	log.Printf("Exported the data of table %s into the dumps of %d tenant(s) in %s", table, len(output.writers), output.dir)
+	return nil
+}
+
+// tenantWriter writes the batches of a table whose rows start with their tenant to the data files of the table in
+// the dumps of the tenants. The dump of a tenant is a directory with the schema and data directories of a dump,
+// created with the first row of the tenant, into which the schema file of the table is copied.
+type tenantWriter struct {
+	config     Options
+	dir        string
+	table      string
+	schemaFile string
+	writers    map[string]*dataWriter // data writers of the table per tenant
+	rows       map[string]int         // rows of the current batch per tenant
+}
+
+// writeBatch splits a batch into the rows of each tenant and writes them to the data files of the tenants, with the
+// header of the batch
+func (w *tenantWriter) writeBatch(data []byte) error {
+	header, rows := splitHeader(w.config.Format, data)
+	var tenantHeader []byte
+	for _, line := range splitLines(header) {
+		_, fields, _ := bytes.Cut(line, []byte("\t"))
+		tenantHeader = append(tenantHeader, fields...)
+	}
+
+	clear(w.rows)
+	batches := make(map[string][]byte)
+	for _, line := range splitLines(rows) {
+		tenant, row, ok := bytes.Cut(line, []byte("\t"))
+		if !ok {
+			return fmt.Errorf("row of table %s without a tenant", w.table)
+		}
+		batch, ok := batches[string(tenant)]
+		if !ok {
+			batch = slices.Clone(tenantHeader)
+		}
+		batches[string(tenant)] = append(batch, row...)
+		w.rows[string(tenant)]++
+	}
+	for tenant, batch := range batches {
+		writer, err := w.writer(tenant)
+		if err != nil {
+			return err
+		}
+		if err := writer.writeBatch(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishBatch records the rows of the written batch in the data files of the tenants
+func (w *tenantWriter) finishBatch(int) error {
+	for tenant, rows := range w.rows {
+		if err := w.writers[tenant].finishBatch(rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writer returns the data writer of the table in the dump of a tenant, creating the dump and copying the schema file
+// of the table into it for the first rows of the tenant
+func (w *tenantWriter) writer(tenant string) (*dataWriter, error) {
+	if writer, ok := w.writers[tenant]; ok {
+		return writer, nil
+	}
+	dir := filepath.Join(w.dir, tenantDirName(tenant))
+	schemaDir, dataDir := filepath.Join(dir, "schema"), filepath.Join(dir, "data")
+	if err := createDirectories(schemaDir, dataDir); err != nil {
+		return nil, err
+	}
+	// The schema file is copied as it is, encrypted or not
+	schema, err := os.ReadFile(w.schemaFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(schemaDir, filepath.Base(w.schemaFile)), schema, 0644); err != nil {
+		return nil, err
+	}
+	writer, err := createDataWriter(w.config, dataDir, w.table, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data file of tenant %s: %w", tenant, err)
+	}
+	w.writers[tenant] = writer
+	return writer, nil
+}
+
+// Close closes the data files of the tenants
+func (w *tenantWriter) Close() error {
+	var firstErr error
+	for _, writer := range w.writers {
+		if err := writer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// splitLines splits data into its lines, each with its newline
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		lines = append(lines, data[:end])
+		data = data[end:]
+	}
+	return lines
+}
+
+// tenantDirName returns the name of the directory of the dump of a tenant: its value as ClickHouse outputs it in
+// the data, escaped to be a single path element
+func tenantDirName(tenant string) string {
+	name := url.PathEscape(tenant)
+	// An escaped value never holds a bare percent sign
+	if name == "" || name == "." || name == ".." {
+		name = "%" + name
+	}
+	return name
+}
@@ -0,0 +1,102 @@
+package chdump
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimit bounds the rate of the data exported or imported by a run, so that a restore does not starve the
+// production traffic of a shared cluster. The limits are shared by the tables processed in parallel.
+type RateLimit struct {
+	// MaxBytesPerSec is the maximum number of bytes of data per second, unlimited when 0
+	MaxBytesPerSec int64
+	// MaxRowsPerSec is the maximum number of rows per second, unlimited when 0
+	MaxRowsPerSec int
+	// limiter is set up by prepare and shared by the copies of the options
+	limiter *rateLimiter
+}
+
+// Enabled reports whether a limit is set
+func (l RateLimit) Enabled() bool {
+	return l.MaxBytesPerSec > 0 || l.MaxRowsPerSec > 0
+}
+
+// rateLimiter delays the data so that its rate stays within the limits. Every chunk of data pushes back the time
+// the next one may pass by the time it takes at the limited rate, so that idle periods do not allow bursts.
+type rateLimiter struct {
+	limit RateLimit
+	mu    sync.Mutex
+	next  time.Time
+}
+
+// newRateLimiter returns the rate limiter of the limits
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit}
+}
+
+// wait waits until a chunk of the bytes and rows may pass. A nil limiter never waits.
+func (l *rateLimiter) wait(ctx context.Context, bytes, rows int) error {
+	if l == nil {
+		return nil
+	}
+	var cost time.Duration
+	if l.limit.MaxBytesPerSec > 0 {
+		cost = time.Duration(float64(bytes) / float64(l.limit.MaxBytesPerSec) * float64(time.Second))
+	}
+	if l.limit.MaxRowsPerSec > 0 {
+		cost = max(cost, time.Duration(float64(rows)/float64(l.limit.MaxRowsPerSec)*float64(time.Second)))
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(cost)
+	delay := l.next.Sub(now) - cost
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader reads from the underlying reader within the rate limits, counting the rows read only when they
+// are limited
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	format  Format
+	limiter *rateLimiter
+}
+
+// Read reads from the underlying reader and waits until what was read may pass
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	rows := 0
+	if r.limiter.limit.MaxRowsPerSec > 0 {
+		rows = r.format.CountRows(p[:n])
+	}
+	if waitErr := r.limiter.wait(r.ctx, n, rows); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// throttle wraps a reader of data files of the format in the rate limits of the options, if any
+func throttle(ctx context.Context, config Options, reader io.Reader) io.Reader {
+	if config.RateLimit.limiter == nil {
+		return reader
+	}
+	return &throttledReader{ctx: ctx, reader: reader, format: config.Format, limiter: config.RateLimit.limiter}
+}
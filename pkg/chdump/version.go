@@ -0,0 +1,118 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// versionedFeature is a feature of the tool that needs a minimum version of the server
+type versionedFeature struct {
+	// name describes the feature and the server feature it relies on
+	name string
+	// minimum is the first major.minor version of ClickHouse supporting the feature
+	minimum string
+	// enabled reports whether the options use the feature
+	enabled func(config Options) bool
+}
+
+// exportFeatures are the features of the export that need a minimum version of the source server
+var exportFeatures = []versionedFeature{
+	{"frozen exports (ATTACH PARTITION FROM)", "19.1", func(config Options) bool { return config.Freeze }},
+}
+
+// importFeatures are the features of the import that need a minimum version of the target server
+var importFeatures = []versionedFeature{
+	{"atomic restores (EXCHANGE TABLES)", "20.5", func(config Options) bool { return config.AtomicRestore }},
+	{"column maps (input table function)", "19.15", func(config Options) bool { return len(config.ColumnMaps) > 0 }},
+	{"schema drift (input table function)", "19.15", func(config Options) bool { return config.AllowSchemaDrift }},
+	{"skipping broken rows (input_format_record_errors_file_path)", "22.5", tolerant},
+}
+
+// explainASTVersion is the first version of ClickHouse supporting EXPLAIN AST, which the schema validation uses
+const explainASTVersion = "20.6"
+
+// serverVersion fetches the version of the server
+func serverVersion(ctx context.Context, db *sql.DB, config Options) (string, error) {
+	var version string
+	err := withRetry(ctx, config.Retry, "fetching server version", func() error {
+		return db.QueryRowContext(ctx, "SELECT version()").Scan(&version)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch server version: %w", err)
+	}
+	return version, nil
+}
+
+// checkServerVersion fetches the version of the server and fails when the options use features it does not support
+func checkServerVersion(ctx context.Context, db *sql.DB, config Options, features []versionedFeature) (string, error) {
+	version, err := serverVersion(ctx, db, config)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Connected to ClickHouse %s on %s", version, config.Host)
+	var unsupported []string
+	for _, feature := range features {
+		if feature.enabled(config) && !versionAtLeast(version, feature.minimum) {
+			unsupported = append(unsupported, fmt.Sprintf("%s needs %s or later", feature.name, feature.minimum))
+		}
+	}
+	if len(unsupported) > 0 {
+		return "", fmt.Errorf("ClickHouse %s does not support the requested features: %s", version, strings.Join(unsupported, ", "))
+	}
+	return version, nil
+}
+
+// warnNewerDump warns when the dump was exported from a newer version of ClickHouse than the target, whose schema
+// may use syntax, types or settings the target does not support
+func warnNewerDump(config Options, version string) {
+	if _, err := os.Stat(config.ManifestFile); err != nil || version == "" {
+		return
+	}
+	manifest, err := loadManifest(config.ManifestFile)
+	if err != nil || manifest.ServerVersion == "" {
+		return
+	}
+	if compareVersions(majorMinor(manifest.ServerVersion), majorMinor(version)) > 0 {
+		log.Printf("Warning: the dump was exported from ClickHouse %s, newer than the target ClickHouse %s, and may not restore cleanly",
+			manifest.ServerVersion, version)
+	}
+}
+
+// versionAtLeast reports whether a version such as 23.8.2.7 is at least the minimum version. An unknown version is
+// assumed to support everything.
+func versionAtLeast(version, minimum string) bool {
+	return version == "" || compareVersions(version, minimum) >= 0
+}
+
+// majorMinor returns the major and minor components of a version
+func majorMinor(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	return strings.Join(parts[:min(len(parts), 2)], ".")
+}
+
+// compareVersions compares two dotted versions component by component, the missing components counting as 0, and
+// returns -1, 0 or 1
+func compareVersions(a, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(aParts), len(bParts)); i++ {
+		var x, y int
+		if i < len(aParts) {
+			x, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			y, _ = strconv.Atoi(bParts[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
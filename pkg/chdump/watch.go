@@ -0,0 +1,129 @@
+package chdump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// watchState holds what the cycles of a watched export carry over from one cycle to the next: the signatures of the
+// active parts of the partitions of the MergeTree tables as of their last export
+type watchState struct {
+	mu sync.Mutex
+	// signatures maps the host, database and table to the signatures of its exported partitions
+	signatures map[string]map[string]string
+}
+
+// watchExport runs the export on every cycle of the watch mode until the context is canceled, pausing for the watch
+// interval between cycles. The incremental tables append the rows newer than their watermark to their delta files,
+// the other MergeTree tables export only the partitions that changed since the previous cycle, and every cycle
+// rewrites the manifest. A failed cycle is retried with the next one.
+func watchExport(ctx context.Context, config Options, export func(context.Context, Options) error) error {
+	config.watch = &watchState{signatures: make(map[string]map[string]string)}
+	for cycle := 1; ; cycle++ {
+		log.Printf("Watch cycle %d started", cycle)
+		startedAt := time.Now()
+		err := export(ctx, config)
+		if ctx.Err() != nil {
+			log.Printf("Watch mode stopped")
+			return nil
+		}
+		if err != nil {
+			log.Printf("Watch cycle %d failed: %v", cycle, err)
+		} else {
+			log.Printf("Watch cycle %d finished in %s", cycle, time.Since(startedAt).Round(time.Millisecond))
+		}
+		// Only the first cycle resumes an interrupted run
+		config.Resume = false
+
+		log.Printf("Next watch cycle in %s", config.WatchInterval)
+		timer := time.NewTimer(config.WatchInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Printf("Watch mode stopped")
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// dumpChangedPartitions dumps the data of a MergeTree table of a watched export partition by partition, like an
+// export of selected partitions, but only the partitions whose active parts changed since the previous cycle or that
+// have no data file yet. The data files of the partitions that no longer exist, and of a previous export of the whole
+// table, are removed.
+func dumpChangedPartitions(ctx context.Context, config Options, table, dataDir string, db *sql.DB, tableReport *TableReport) error {
+	var signatures map[string]string
+	err := withRetry(ctx, config.Retry, "fetching partitions of "+table, func() (err error) {
+		signatures, err = partitionSignatures(ctx, db, config.DBName, table)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch partitions: %w", err)
+	}
+
+	files, err := dataFiles(config, dataDir, table)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, ok := signatures[dataFilePartition(config, file)]; ok {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	key := config.Host + "/" + qualifiedName(config.DBName, table)
+	config.watch.mu.Lock()
+	previous := config.watch.signatures[key]
+	config.watch.mu.Unlock()
+	var changed []string
+	for partition, signature := range signatures {
+		if previous[partition] != signature || !hasDataFiles(config, dataDir, partitionFileTable(table, partition)) {
+			changed = append(changed, partition)
+		}
+	}
+	sort.Strings(changed)
+	if len(changed) == 0 {
+		log.Printf("No partition of table %s changed since the previous cycle", table)
+		tableReport.Status = statusSkipped
+		return nil
+	}
+
+	if err := dumpPartitions(ctx, config, table, changed, dataDir, db, tableReport); err != nil {
+		return err
+	}
+	config.watch.mu.Lock()
+	config.watch.signatures[key] = signatures
+	config.watch.mu.Unlock()
+	log.Printf("Exported %d changed partition(s) of %d of table %s", len(changed), len(signatures), table)
+	return nil
+}
+
+// partitionSignatures returns the signatures of the active parts of the partitions of a table: their row count,
+// highest block number and highest data version, which new inserts and mutations raise
+func partitionSignatures(ctx context.Context, db *sql.DB, dbName, table string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT partition_id, concat(toString(sum(rows)), ':', toString(max(max_block_number)), ':', toString(max(data_version)))
+		FROM system.parts WHERE active AND database = ? AND table = ? GROUP BY partition_id`, dbName, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	signatures := make(map[string]string)
+	for rows.Next() {
+		var partition, signature string
+		if err := rows.Scan(&partition, &signature); err != nil {
+			return nil, err
+		}
+		signatures[partition] = signature
+	}
+	return signatures, rows.Err()
+}
@@ -0,0 +1,126 @@
+package chdump
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// pendingSuffix is appended to the watermark file to name the file recording the delta appends in progress
+const pendingSuffix = ".pending"
+
+// pendingDelta records a delta append in progress: the high-water mark it exports up to and the size of the delta
+// file before the append, so that a run interrupted between the append and the watermark save can be rolled back
+type pendingDelta struct {
+	Watermark string `json:"watermark"`
+	File      string `json:"file"`
+	Size      int64  `json:"size"`
+}
+
+// watermarkStore keeps the high-water marks of the incremental tables, and the delta appends in progress, in sync
+// with the watermark file while tables are exported in parallel
+type watermarkStore struct {
+	path      string
+	mu        sync.Mutex
+	committed map[string]string
+	pending   map[string]pendingDelta
+}
+
+// loadWatermarkStore reads the stored high-water marks and the delta appends in progress
+func loadWatermarkStore(path string) (*watermarkStore, error) {
+	committed, err := loadWatermarks(path)
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]pendingDelta)
+	if err := readJSONFile(path+pendingSuffix, &pending); err != nil {
+		return nil, err
+	}
+	return &watermarkStore{path: path, committed: committed, pending: pending}, nil
+}
+
+// begin rolls back the delta append of the table left over by an interrupted run, and returns the high-water mark
+// the next delta starts from
+func (s *watermarkStore) begin(table string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.committed[table]
+	pending, interrupted := s.pending[table]
+	if !interrupted {
+		return previous, ok, nil
+	}
+
+	if pending.Watermark != previous {
+		log.Printf("Rolling back the interrupted delta of table %s in %s", table, pending.File)
+		if err := os.Truncate(pending.File, pending.Size); err != nil && !os.IsNotExist(err) {
+			return "", false, fmt.Errorf("failed to roll back delta file %s: %w", pending.File, err)
+		}
+	}
+	delete(s.pending, table)
+	return previous, ok, writeJSONFile(s.path+pendingSuffix, s.pending)
+}
+
+// prepare records the delta append of the table before it starts
+func (s *watermarkStore) prepare(table string, delta pendingDelta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[table] = delta
+	return writeJSONFile(s.path+pendingSuffix, s.pending)
+}
+
+// commit saves the new high-water mark of the table once its delta has been appended completely
+func (s *watermarkStore) commit(table, watermark string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed[table] = watermark
+	if err := saveWatermarks(s.path, s.committed); err != nil {
+		return err
+	}
+	delete(s.pending, table)
+	return writeJSONFile(s.path+pendingSuffix, s.pending)
+}
+
+// loadWatermarks reads the stored high-water marks, returning an empty set if the file does not exist
+func loadWatermarks(path string) (map[string]string, error) {
+	watermarks := make(map[string]string)
+	if err := readJSONFile(path, &watermarks); err != nil {
+		return nil, err
+	}
+	return watermarks, nil
+}
+
+// saveWatermarks persists the high-water marks to the watermark file
+func saveWatermarks(path string, watermarks map[string]string) error {
+	return writeJSONFile(path, watermarks)
+}
+
+// readJSONFile parses the JSON file into value, leaving it untouched if the file does not exist
+func readJSONFile(path string, value any) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, value); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile replaces the JSON file atomically, so that a crash never leaves it half written
+func writeJSONFile(path string, value any) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
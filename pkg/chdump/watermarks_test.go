@@ -0,0 +1,99 @@
+package chdump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatermarkStoreRollsBackInterruptedDelta(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "watermarks.json")
+	deltaFile := filepath.Join(dir, "events.tsv")
+	if err := os.WriteFile(deltaFile, []byte("1\n2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := loadWatermarkStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.commit("events", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.prepare("events", pendingDelta{Watermark: "4", File: deltaFile, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// The run crashes after appending part of the delta and before saving the watermark
+	if err := os.WriteFile(deltaFile, []byte("1\n2\n3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = loadWatermarkStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, ok, err := store.begin("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || previous != "2" {
+		t.Errorf("begin() = %q, %v, want the committed watermark 2", previous, ok)
+	}
+	content, err := os.ReadFile(deltaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "1\n2\n" {
+		t.Errorf("delta file = %q, want the partial append rolled back", content)
+	}
+	if len(store.pending) != 0 {
+		t.Errorf("pending = %v, want none", store.pending)
+	}
+}
+
+func TestWatermarkStoreKeepsCommittedDelta(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "watermarks.json")
+	deltaFile := filepath.Join(dir, "events.tsv")
+	if err := os.WriteFile(deltaFile, []byte("1\n2\n3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The run crashes after saving the watermark and before clearing the pending delta
+	if err := saveWatermarks(path, map[string]string{"events": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONFile(path+pendingSuffix, map[string]pendingDelta{"events": {Watermark: "3", File: deltaFile, Size: 4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := loadWatermarkStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, ok, err := store.begin("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || previous != "3" {
+		t.Errorf("begin() = %q, %v, want the committed watermark 3", previous, ok)
+	}
+	content, err := os.ReadFile(deltaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "1\n2\n3\n" {
+		t.Errorf("delta file = %q, want the committed append kept", content)
+	}
+}
+
+func TestWatermarkStoreWithoutFiles(t *testing.T) {
+	store, err := loadWatermarkStore(filepath.Join(t.TempDir(), "watermarks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous, ok, err := store.begin("events"); err != nil || ok || previous != "" {
+		t.Errorf("begin() = %q, %v, %v, want no watermark", previous, ok, err)
+	}
+}
@@ -0,0 +1,4 @@
+// Package chdumppb holds the gRPC API of the chdump daemon, generated from chdump.proto.
+package chdumppb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chdump.proto